@@ -0,0 +1,61 @@
+package certificate
+
+import (
+	"context"
+	"reflect"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// AdmissionCheck checks that admission requests succeed
+type AdmissionCheck func(ctx context.Context) error
+
+// NewDryRunAdmissionCheck returns an AdmissionCheck that sends object as a
+// dry run create request through the API server so that it is admitted by
+// the webhooks it matches, without being persisted.
+func NewDryRunAdmissionCheck(cli client.Client, object client.Object) AdmissionCheck {
+	return func(ctx context.Context) error {
+		return cli.Create(ctx, object.DeepCopyObject().(client.Object), client.DryRunAll)
+	}
+}
+
+// caBundles returns a copy of all the CA bundles of a certificate chain
+func caBundles(certificateChain *chain.CertificateChainData) map[string][]byte {
+	bundles := map[string][]byte{}
+	for name, certificateIssued := range certificateChain.CertificatesIssued {
+		for caName, caBundle := range certificateIssued.CACertPEM {
+			bundles[name+"/"+caName] = append([]byte{}, caBundle...)
+		}
+	}
+	return bundles
+}
+
+// admissionCheckPending returns whether the configured admission check, if
+// any, has to run since the CA bundles of a certificate chain changed
+func (m *Manager) admissionCheckPending(previousCABundles map[string][]byte, certificateChain *chain.CertificateChainData) bool {
+	return m.admissionCheck != nil && !reflect.DeepEqual(previousCABundles, caBundles(certificateChain))
+}
+
+// checkAdmission runs the configured admission check and records its result
+// on the manager status. It is run once the reconcile is done, without
+// holding it, so a slow check does not hold back other reconciles.
+func (m *Manager) checkAdmission(ctx context.Context) {
+	logger := m.log.WithName("checkAdmission")
+	logger.Info("Checking admission after CA bundle injection")
+	ctx, cancel := context.WithTimeout(ctx, m.admissionCheckTimeout)
+	defer cancel()
+	err := m.admissionCheck(ctx)
+	if err != nil {
+		logger.Error(err, "Admission check failed")
+	} else {
+		logger.Info("Admission check succeeded")
+	}
+
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.status.AdmissionCheckTime = triple.Now().UTC()
+	m.status.AdmissionCheckError = err
+}
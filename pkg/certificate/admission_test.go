@@ -0,0 +1,159 @@
+package certificate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Admission check", func() {
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	type admissionCheckCase struct {
+		check         AdmissionCheck
+		expectedError string
+	}
+	DescribeTable("after CA bundle injection",
+		func(c admissionCheckCase) {
+			checks := 0
+			mgr, err := NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithAdmissionCheck(func(ctx context.Context) error {
+					checks++
+					return c.check(ctx)
+				}, 100*time.Millisecond),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+			for i := 0; i < 2; i++ {
+				err = mgr.Apply(context.TODO())
+				Expect(err).To(Succeed(), "should succeed applying certificates")
+			}
+
+			Expect(checks).To(Equal(1), "should run the admission check only when CA bundle is injected")
+			status := mgr.Status()
+			Expect(status.AdmissionCheckTime).ToNot(BeZero(), "should report admission check time")
+			if c.expectedError == "" {
+				Expect(status.AdmissionCheckError).To(Succeed(), "should report admission check success")
+			} else {
+				Expect(status.AdmissionCheckError).To(MatchError(ContainSubstring(c.expectedError)), "should report admission check failure")
+			}
+		},
+		Entry("when the webhook admits the request, should report success", admissionCheckCase{
+			check: func(ctx context.Context) error {
+				return nil
+			},
+		}),
+		Entry("when the webhook rejects the request, should report failure", admissionCheckCase{
+			check: func(ctx context.Context) error {
+				return errors.New("x509: certificate signed by unknown authority")
+			},
+			expectedError: "unknown authority",
+		}),
+		Entry("when the webhook does not answer in time, should report failure", admissionCheckCase{
+			check: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			expectedError: context.DeadlineExceeded.Error(),
+		}),
+	)
+})
+
+var _ = Describe("Dry run admission check", func() {
+	var (
+		server    *httptest.Server
+		requests  []*http.Request
+		rejection string
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "admission-check"},
+		}
+	)
+
+	BeforeEach(func() {
+		requests = nil
+		rejection = ""
+		// server fakes the API server, admitting or rejecting the requests
+		// as the webhooks would
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			w.Header().Set("Content-Type", "application/json")
+			if rejection != "" {
+				w.WriteHeader(http.StatusInternalServerError)
+				_ = json.NewEncoder(w).Encode(metav1.Status{
+					TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+					Status:   metav1.StatusFailure,
+					Code:     http.StatusInternalServerError,
+					Reason:   metav1.StatusReasonInternalError,
+					Message:  rejection,
+				})
+				return
+			}
+			created := configMap.DeepCopy()
+			created.TypeMeta = metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"}
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(created)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	check := func() error {
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), meta.RESTScopeNamespace)
+		serverClient, err := client.New(&rest.Config{Host: server.URL}, client.Options{Scheme: scheme.Scheme, Mapper: mapper})
+		Expect(err).To(Succeed(), "should succeed creating the client of the fake API server")
+		return NewDryRunAdmissionCheck(serverClient, configMap)(context.TODO())
+	}
+
+	It("should send the object as a dry run create request", func() {
+		Expect(check()).To(Succeed(), "should succeed when the request is admitted")
+		Expect(requests).To(HaveLen(1), "should send a single request")
+		Expect(requests[0].Method).To(Equal(http.MethodPost), "should send a create request")
+		Expect(requests[0].URL.Path).To(Equal("/api/v1/namespaces/foo/configmaps"), "should create the object")
+		Expect(requests[0].URL.Query()["dryRun"]).To(ConsistOf(metav1.DryRunAll), "should not persist the object")
+	})
+
+	It("should fail when the request is rejected", func() {
+		rejection = "Internal error occurred: failed calling webhook: x509: certificate signed by unknown authority"
+		Expect(check()).To(MatchError(ContainSubstring("unknown authority")), "should fail with the rejection")
+		Expect(requests).To(HaveLen(1), "should send a single request")
+		Expect(requests[0].URL.Query()["dryRun"]).To(ConsistOf(metav1.DryRunAll), "should not persist the object")
+	})
+})
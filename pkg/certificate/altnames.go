@@ -0,0 +1,67 @@
+package certificate
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// altnames.go issues the service certificates with extra SANs along the ones
+// derived from the services, for webhooks also reachable from outside the
+// cluster, for instance at an external DNS name through an ingress or at a
+// LoadBalancer IP.
+
+// validateExtraAltNames checks that the extra DNS names are DNS subdomains,
+// wildcards allowed, and that the extra IPs are set
+func validateExtraAltNames(altNames *triple.AltNames) error {
+	if altNames == nil {
+		return nil
+	}
+	for _, dnsName := range altNames.DNSNames {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(dnsName, "*.")); len(errs) > 0 {
+			return errors.Errorf("extra DNS name %q is invalid: %s", dnsName, strings.Join(errs, ", "))
+		}
+	}
+	for _, ip := range altNames.IPs {
+		if ip == nil {
+			return errors.New("extra IPs cannot be nil")
+		}
+	}
+	return nil
+}
+
+// applyExtraAltNames adds the extra SANs, if any, to the certificate issues
+// of the services backing the webhooks of the object map, skipping the ones
+// they already have.
+func (m *Manager) applyExtraAltNames(objects objectMap, certificateChain *chain.CertificateChainData) {
+	if m.extraAltNames == nil {
+		return
+	}
+	for name := range serviceCertificateIssueNames(objects) {
+		certificateIssue := certificateChain.CertificatesIssued[name]
+		if certificateIssue == nil {
+			continue
+		}
+		for _, dnsName := range m.extraAltNames.DNSNames {
+			certificateIssue.Hostnames = appendIfMissing(certificateIssue.Hostnames, dnsName)
+		}
+		for _, ip := range m.extraAltNames.IPs {
+			certificateIssue.IPs = appendIfMissing(certificateIssue.IPs, ip.String())
+		}
+	}
+}
+
+// appendIfMissing appends value to values unless already there
+func appendIfMissing(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
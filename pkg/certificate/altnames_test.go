@@ -0,0 +1,72 @@
+package certificate
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Extra alt names", func() {
+	webhooks := []WebhookReference{{Type: MutatingWebhook, Name: "foo"}}
+
+	DescribeTable("when validating the extra alt names",
+		func(altNames triple.AltNames, expectedErr string) {
+			_, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithExtraAltNames(altNames))
+			if expectedErr == "" {
+				Expect(err).To(Succeed(), "should succeed validating the extra alt names")
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)), "should fail validating the extra alt names")
+			}
+		},
+		Entry("with a DNS name and an IP should succeed",
+			triple.AltNames{DNSNames: []string{"webhook.example.com"}, IPs: []net.IP{net.ParseIP("192.0.2.10")}}, ""),
+		Entry("with a wildcard DNS name should succeed",
+			triple.AltNames{DNSNames: []string{"*.example.com"}}, ""),
+		Entry("with an invalid DNS name should fail",
+			triple.AltNames{DNSNames: []string{"webhook_example.com"}}, `extra DNS name "webhook_example.com" is invalid`),
+		Entry("with a nil IP should fail",
+			triple.AltNames{IPs: []net.IP{net.ParseIP("foo")}}, "extra IPs cannot be nil"),
+	)
+
+	It("should issue the service certificate with the extra alt names merged with the service ones", func() {
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		object := &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		objects := objectMap{object.key: object}
+		certificateChain := chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objects, &certificateChain)
+
+		hostname := serviceHostname(expectedService.Name, expectedService.Namespace)
+		mgr, err := NewManager(webhook.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithExtraAltNames(triple.AltNames{
+			DNSNames: []string{"webhook.example.com", hostname},
+			IPs:      []net.IP{net.ParseIP("192.0.2.10")},
+		}))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		mgr.applyExtraAltNames(objects, &certificateChain)
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+
+		certs, err := triple.ParseCertsPEM(certificateChain.CertificatesIssued[hostname].CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the service certificate")
+		Expect(certs[0].DNSNames).To(ConsistOf(
+			expectedService.Name,
+			namespacedHostname(expectedService.Name, expectedService.Namespace),
+			hostname,
+			serviceFqdn(expectedService.Name, expectedService.Namespace),
+			"webhook.example.com",
+		), "should issue the certificate with the extra DNS names, without duplicates")
+		Expect(certs[0].IPAddresses).To(HaveLen(1), "should issue the certificate with the extra IP")
+		Expect(certs[0].IPAddresses[0].Equal(net.ParseIP("192.0.2.10"))).To(BeTrue(), "should issue the certificate with the extra IP")
+	})
+})
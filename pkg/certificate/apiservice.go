@@ -0,0 +1,85 @@
+package certificate
+
+import (
+	"encoding/base64"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// apiservice.go handles the APIServices registering aggregated API servers.
+// They are mapped to and from certificate chain data as admission webhooks
+// are, through a client config built from their backing service and CA
+// bundle. They are handled as unstructured objects so that the
+// apiregistration API types are not needed, the client config not sharing
+// memory with them: CA bundles set on it are stored back with
+// storeClientConfigs.
+
+// apiServiceName is the name the APIService is tracked with, as if it was one
+// of the webhooks of a webhook configuration.
+const apiServiceName = "apiservice"
+
+var apiServiceGVK = schema.GroupVersionKind{
+	Group:   "apiregistration.k8s.io",
+	Version: "v1",
+	Kind:    "APIService",
+}
+
+func initAPIService(name, namespace string) client.Object {
+	apiService := &unstructured.Unstructured{}
+	apiService.SetGroupVersionKind(apiServiceGVK)
+	apiService.SetName(name)
+	apiService.SetNamespace(namespace)
+	return apiService
+}
+
+// isAPIService returns whether an object is an unstructured APIService
+func isAPIService(object client.Object) (*unstructured.Unstructured, bool) {
+	apiService, ok := object.(*unstructured.Unstructured)
+	if !ok || apiService.GroupVersionKind() != apiServiceGVK {
+		return nil, false
+	}
+	return apiService, true
+}
+
+// apiServiceClientConfig returns the client config of an APIService, nil if
+// it is not backed by a service, being served by the API server itself.
+func apiServiceClientConfig(apiService *unstructured.Unstructured) *admissionregistrationv1.WebhookClientConfig {
+	name, _, _ := unstructured.NestedString(apiService.Object, "spec", "service", "name")
+	namespace, _, _ := unstructured.NestedString(apiService.Object, "spec", "service", "namespace")
+	if name == "" {
+		return nil
+	}
+	clientConfig := &admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+	port, found, _ := unstructured.NestedInt64(apiService.Object, "spec", "service", "port")
+	if found {
+		port32 := int32(port)
+		clientConfig.Service.Port = &port32
+	}
+	caBundle, _, _ := unstructured.NestedString(apiService.Object, "spec", "caBundle")
+	if caBundle != "" {
+		clientConfig.CABundle, _ = base64.StdEncoding.DecodeString(caBundle)
+	}
+	return clientConfig
+}
+
+// storeAPIServiceClientConfig stores back at an APIService the CA bundle of
+// its client config, if any.
+func storeAPIServiceClientConfig(apiService *unstructured.Unstructured, clientConfigs map[string]*admissionregistrationv1.WebhookClientConfig) {
+	clientConfig, found := clientConfigs[apiServiceName]
+	if !found {
+		return
+	}
+	if clientConfig.CABundle == nil {
+		unstructured.RemoveNestedField(apiService.Object, "spec", "caBundle")
+		return
+	}
+	_ = unstructured.SetNestedField(apiService.Object, base64.StdEncoding.EncodeToString(clientConfig.CABundle), "spec", "caBundle")
+}
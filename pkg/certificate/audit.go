@@ -0,0 +1,127 @@
+package certificate
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// audit.go writes a JSON line for every rotated certificate to an audit log,
+// with a schema stable across releases so it can be ingested by audit
+// pipelines, separately from the operational logs.
+
+// AuditRecord is the audit log line of a rotated certificate, either the CA
+// or the certificate of a certificate issue
+type AuditRecord struct {
+	// Timestamp is the time the rotated certificate was written at
+	Timestamp time.Time `json:"timestamp"`
+
+	// Reason is the trigger of the rotation
+	Reason chain.RotationReason `json:"reason"`
+
+	// Target is the name of the CA or of the certificate issue
+	Target string `json:"target"`
+
+	// OldSerial and OldNotAfter are the hex encoded serial number and the
+	// expiration of the certificate replaced, empty and null if there was
+	// none
+	OldSerial   string     `json:"oldSerial"`
+	OldNotAfter *time.Time `json:"oldNotAfter"`
+
+	// NewSerial and NewNotAfter are the hex encoded serial number and the
+	// expiration of the certificate issued
+	NewSerial   string    `json:"newSerial"`
+	NewNotAfter time.Time `json:"newNotAfter"`
+
+	// CAFingerprint is the hex encoded SHA-256 fingerprint of the CA
+	// certificate signing the certificates issued
+	CAFingerprint string `json:"caFingerprint"`
+}
+
+// auditRotation writes an audit record for the CA and for every certificate
+// issue whose certificate was rotated, the CA first and then the certificate
+// issues by name. Audit log failures are not fatal.
+func (m *Manager) auditRotation(previousCA []byte, previousCerts map[string][]byte, certificateChain *chain.CertificateChainData) {
+	if m.auditLog == nil || certificateChain.RotationReason == "" {
+		return
+	}
+	caCert := lastCertificate(certificateChain.CA.CertPEM)
+	if caCert == nil {
+		return
+	}
+	caFingerprint := sha256.Sum256(caCert.Raw)
+	newRecord := func(target string, oldCert, newCert *x509.Certificate) AuditRecord {
+		record := AuditRecord{
+			Timestamp:     triple.Now().UTC(),
+			Reason:        certificateChain.RotationReason,
+			Target:        target,
+			NewSerial:     newCert.SerialNumber.Text(16),
+			NewNotAfter:   newCert.NotAfter.UTC(),
+			CAFingerprint: hex.EncodeToString(caFingerprint[:]),
+		}
+		if oldCert != nil {
+			oldNotAfter := oldCert.NotAfter.UTC()
+			record.OldSerial = oldCert.SerialNumber.Text(16)
+			record.OldNotAfter = &oldNotAfter
+		}
+		return record
+	}
+
+	records := []AuditRecord{}
+	oldCA := lastCertificate(previousCA)
+	if oldCA == nil || !oldCA.Equal(caCert) {
+		records = append(records, newRecord(certificateChain.CA.Name, oldCA, caCert))
+	}
+	names := make([]string, 0, len(certificateChain.CertificatesIssued))
+	for name := range certificateChain.CertificatesIssued {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		newCert := lastCertificate(certificateChain.CertificatesIssued[name].CertPEM)
+		if newCert == nil {
+			continue
+		}
+		oldCert := lastCertificate(previousCerts[name])
+		if oldCert != nil && oldCert.Equal(newCert) {
+			continue
+		}
+		records = append(records, newRecord(name, oldCert, newCert))
+	}
+
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			m.log.WithName("auditRotation").Error(err, "Failed encoding audit record", "target", record.Target)
+			continue
+		}
+		// a single write per line so lines are not interleaved with the
+		// ones of other writers
+		_, err = m.auditLog.Write(append(line, '\n'))
+		if err != nil {
+			m.log.WithName("auditRotation").Error(err, "Failed writing audit record", "target", record.Target)
+			m.handleError(errors.Wrapf(err, "Failed writing audit record for %s", record.Target))
+		}
+	}
+}
+
+// lastCertificate returns the last certificate of PEM encoded certificates,
+// the current one, nil if there is none
+func lastCertificate(certPEM []byte) *x509.Certificate {
+	if len(certPEM) == 0 {
+		return nil
+	}
+	certs, err := triple.ParseCertsPEM(certPEM)
+	if err != nil || len(certs) == 0 {
+		return nil
+	}
+	return certs[len(certs)-1]
+}
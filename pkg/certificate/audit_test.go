@@ -0,0 +1,109 @@
+package certificate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+var _ = Describe("Audit log", func() {
+	var (
+		auditLog         *bytes.Buffer
+		mgr              *Manager
+		certificateChain chain.CertificateChainData
+		hostname         = serviceHostname(expectedService.Name, expectedService.Namespace)
+	)
+
+	BeforeEach(func() {
+		auditLog = &bytes.Buffer{}
+		var err error
+		mgr, err = NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithAuditLog(auditLog))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+		certificateChain = chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				hostname: newCertificateIssue(expectedService.Name, expectedService.Namespace),
+			},
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+	})
+
+	auditRecords := func() []map[string]interface{} {
+		records := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSuffix(auditLog.String(), "\n"), "\n") {
+			record := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(line), &record)).To(Succeed(), "should write an audit record per line")
+			records = append(records, record)
+		}
+		return records
+	}
+
+	It("should write an audit record for the CA and the service certificate rotated", func() {
+		previousCA := certificateChain.CA.CertPEM
+		previousCerts := issuedCertPEMs(&certificateChain)
+		oldCA := lastCertificate(previousCA)
+		oldCert := lastCertificate(previousCerts[hostname])
+
+		_, err := chain.Rotate(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed rotating certificates")
+		mgr.auditRotation(previousCA, previousCerts, &certificateChain)
+
+		newCA := lastCertificate(certificateChain.CA.CertPEM)
+		newCert := lastCertificate(certificateChain.CertificatesIssued[hostname].CertPEM)
+		fingerprint := sha256.Sum256(newCA.Raw)
+		records := auditRecords()
+		Expect(records).To(HaveLen(2), "should write a record for the CA and one for the service certificate")
+		for _, record := range records {
+			Expect(record).To(HaveLen(8), "should write the schema fields only")
+			Expect(record).To(HaveKeyWithValue("reason", string(chain.RotationReasonForced)), "should record the rotation reason")
+			Expect(record).To(HaveKeyWithValue("caFingerprint", hex.EncodeToString(fingerprint[:])), "should record the new CA fingerprint")
+			timestamp, err := time.Parse(time.RFC3339Nano, record["timestamp"].(string))
+			Expect(err).To(Succeed(), "should record an RFC 3339 timestamp")
+			Expect(timestamp).To(BeTemporally("~", time.Now(), time.Minute), "should record the rotation time")
+		}
+		Expect(records[0]).To(HaveKeyWithValue("target", certificateChain.CA.Name), "should record the CA first")
+		Expect(records[0]).To(HaveKeyWithValue("oldSerial", oldCA.SerialNumber.Text(16)), "should record the old CA serial")
+		Expect(records[0]).To(HaveKeyWithValue("newSerial", newCA.SerialNumber.Text(16)), "should record the new CA serial")
+		Expect(records[0]).To(HaveKeyWithValue("oldNotAfter", oldCA.NotAfter.UTC().Format(time.RFC3339)), "should record the old CA expiration")
+		Expect(records[0]).To(HaveKeyWithValue("newNotAfter", newCA.NotAfter.UTC().Format(time.RFC3339)), "should record the new CA expiration")
+		Expect(records[1]).To(HaveKeyWithValue("target", hostname), "should record the service certificate")
+		Expect(records[1]).To(HaveKeyWithValue("oldSerial", oldCert.SerialNumber.Text(16)), "should record the old certificate serial")
+		Expect(records[1]).To(HaveKeyWithValue("newSerial", newCert.SerialNumber.Text(16)), "should record the new certificate serial")
+		Expect(records[1]).To(HaveKeyWithValue("oldNotAfter", oldCert.NotAfter.UTC().Format(time.RFC3339)), "should record the old certificate expiration")
+		Expect(records[1]).To(HaveKeyWithValue("newNotAfter", newCert.NotAfter.UTC().Format(time.RFC3339)), "should record the new certificate expiration")
+	})
+
+	It("should write an audit record with no old certificate for the certificates first issued", func() {
+		mgr.auditRotation(nil, map[string][]byte{}, &certificateChain)
+
+		records := auditRecords()
+		Expect(records).To(HaveLen(2), "should write a record for the CA and one for the service certificate")
+		for _, record := range records {
+			Expect(record).To(HaveKeyWithValue("reason", string(chain.RotationReasonMissing)), "should record the rotation reason")
+			Expect(record).To(HaveKeyWithValue("oldSerial", ""), "should record no old serial")
+			Expect(record).To(HaveKeyWithValue("oldNotAfter", BeNil()), "should record no old expiration")
+		}
+	})
+
+	It("should not write audit records without a rotation", func() {
+		previousCA := certificateChain.CA.CertPEM
+		previousCerts := issuedCertPEMs(&certificateChain)
+		certificateChain.RotationReason = ""
+		_, err := chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed updating certificates")
+		mgr.auditRotation(previousCA, previousCerts, &certificateChain)
+		Expect(auditLog.Len()).To(BeZero(), "should not write audit records")
+	})
+})
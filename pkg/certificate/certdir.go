@@ -0,0 +1,171 @@
+package certificate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// certdir.go writes the service certificate and key to a local directory, as
+// tls.crt and tls.key, for webhook servers that load and watch them from
+// disk. The Secret stays the store the certificates are read back from. As
+// the kubelet does with projected volumes, both files are written to a new
+// data directory and swapped in at once by replacing the ..data symlink they
+// point through, so the certificate and key read are always a pair.
+
+const (
+	// certDirDataLink is the symlink to the current data directory
+	certDirDataLink = "..data"
+
+	// certDirDataPrefix prefixes the data directories
+	certDirDataPrefix = "..data-"
+)
+
+// firstCertificateIssue returns the certificate issue of the first service by
+// name, nil if there is none.
+func firstCertificateIssue(certificateChain *chain.CertificateChainData) *chain.CertificateIssue {
+	names := make([]string, 0, len(certificateChain.CertificatesIssued))
+	for name := range certificateChain.CertificatesIssued {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return certificateChain.CertificatesIssued[names[0]]
+}
+
+// writeCertDir writes the current service certificate and key of the first
+// service by name to the certificates directory, the certificates of the
+// other services are not written. The previous certificate kept during a
+// rotation overlap is left out so the certificate file matches the key.
+// Nothing is written if the files are unchanged or if there is no
+// certificates directory configured.
+func (m *Manager) writeCertDir(certificateChain *chain.CertificateChainData) error {
+	if m.certDir == "" {
+		return nil
+	}
+	certificateIssue := firstCertificateIssue(certificateChain)
+	if certificateIssue == nil || certificateIssue.KeyPEM == nil {
+		return nil
+	}
+	cert := lastCertificate(certificateIssue.CertPEM)
+	if cert == nil {
+		return nil
+	}
+	files := map[string][]byte{
+		corev1.TLSCertKey:       triple.EncodeCertPEM(cert),
+		corev1.TLSPrivateKeyKey: certificateIssue.KeyPEM,
+	}
+
+	err := os.MkdirAll(m.certDir, 0700)
+	if err != nil {
+		return errors.Wrapf(err, "failed creating certificates directory %s", m.certDir)
+	}
+	if certDirHolds(m.certDir, files) {
+		return nil
+	}
+	return swapCertDirData(m.certDir, files)
+}
+
+// certDirHolds returns whether the files at the certificates directory already
+// hold data, read through their symlinks
+func certDirHolds(dir string, files map[string][]byte) bool {
+	for name, data := range files {
+		current, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(current, data) {
+			return false
+		}
+	}
+	return true
+}
+
+// swapCertDirData writes files to a new data directory, points the data
+// symlink to it and the files to the data symlink, replacing any symlink or
+// regular file there, and removes the previous data directory. Every
+// replacement is a rename so readers never see a partially written file, and
+// the data symlink replacement swaps all the files at once.
+func swapCertDirData(dir string, files map[string][]byte) error {
+	dataDir, err := ioutil.TempDir(dir, certDirDataPrefix)
+	if err != nil {
+		return errors.Wrapf(err, "failed creating data directory at %s", dir)
+	}
+	for name, data := range files {
+		err = writeSyncedFile(filepath.Join(dataDir, name), data)
+		if err != nil {
+			_ = os.RemoveAll(dataDir)
+			return err
+		}
+	}
+
+	dataLink := filepath.Join(dir, certDirDataLink)
+	previousDataDir, _ := os.Readlink(dataLink)
+	err = replaceSymlink(filepath.Base(dataDir), dataLink)
+	if err != nil {
+		_ = os.RemoveAll(dataDir)
+		return err
+	}
+
+	for name := range files {
+		target := filepath.Join(certDirDataLink, name)
+		path := filepath.Join(dir, name)
+		if current, err := os.Readlink(path); err == nil && current == target {
+			continue
+		}
+		err = replaceSymlink(target, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if previousDataDir != "" && previousDataDir != filepath.Base(dataDir) && strings.HasPrefix(previousDataDir, certDirDataPrefix) {
+		_ = os.RemoveAll(filepath.Join(dir, previousDataDir))
+	}
+	return nil
+}
+
+// replaceSymlink creates a symlink to target at a temporary path and renames
+// it to path
+func replaceSymlink(target, path string) error {
+	tmpPath := path + ".tmp"
+	_ = os.Remove(tmpPath)
+	err := os.Symlink(target, tmpPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed creating temporary symlink for %s", path)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return errors.Wrapf(err, "failed renaming temporary symlink to %s", path)
+	}
+	return nil
+}
+
+// writeSyncedFile writes data to a new file at path, only readable by the
+// owner, and syncs it to disk
+func writeSyncedFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed creating %s", path)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed writing %s", path)
+	}
+	return nil
+}
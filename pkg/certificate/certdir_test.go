@@ -0,0 +1,172 @@
+package certificate
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Certificates directory", func() {
+	var (
+		mgr     *Manager
+		tempDir string
+		certDir string
+	)
+
+	// readCertDir returns the certificate and key written to the
+	// certificates directory
+	readCertDir := func() ([]byte, []byte) {
+		certPEM, err := ioutil.ReadFile(filepath.Join(certDir, corev1.TLSCertKey))
+		Expect(err).To(Succeed(), "should succeed reading the certificate file")
+		keyPEM, err := ioutil.ReadFile(filepath.Join(certDir, corev1.TLSPrivateKeyKey))
+		Expect(err).To(Succeed(), "should succeed reading the key file")
+		return certPEM, keyPEM
+	}
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "certdir")
+		Expect(err).To(Succeed(), "should succeed creating a temporary directory")
+		certDir = filepath.Join(tempDir, "tls")
+
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithCertDir(certDir),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+		_ = os.RemoveAll(tempDir)
+	})
+
+	It("should write the certificate and key of the Secret after every rotation", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		certPEM, keyPEM := readCertDir()
+		Expect(certPEM).To(Equal(secret.Data[corev1.TLSCertKey]), "should write the certificate of the Secret")
+		Expect(keyPEM).To(Equal(secret.Data[corev1.TLSPrivateKeyKey]), "should write the key of the Secret")
+		_, err = tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).To(Succeed(), "should write a parseable certificate and key pair")
+
+		By("Forcing a rotation")
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+
+		rotatedSecret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		rotatedCertPEM, rotatedKeyPEM := readCertDir()
+		Expect(rotatedCertPEM).ToNot(Equal(certPEM), "should write the rotated certificate")
+		Expect(rotatedCertPEM).To(Equal(rotatedSecret.Data[corev1.TLSCertKey]), "should write the rotated certificate of the Secret")
+		Expect(rotatedKeyPEM).To(Equal(rotatedSecret.Data[corev1.TLSPrivateKeyKey]), "should write the rotated key of the Secret")
+		_, err = tls.X509KeyPair(rotatedCertPEM, rotatedKeyPEM)
+		Expect(err).To(Succeed(), "should write a parseable rotated certificate and key pair")
+
+		files, err := ioutil.ReadDir(certDir)
+		Expect(err).To(Succeed(), "should succeed listing the certificates directory")
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		Expect(names).To(ConsistOf(corev1.TLSCertKey, corev1.TLSPrivateKeyKey, certDirDataLink, HavePrefix(certDirDataPrefix)),
+			"should not leave temporary files nor previous data behind")
+	})
+})
+
+var _ = Describe("Certificates directory during the rotation overlap", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "certdir")
+		Expect(err).To(Succeed(), "should succeed creating a temporary directory")
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+		_ = os.RemoveAll(tempDir)
+	})
+
+	It("should swap the current certificate and key through the data symlink", func() {
+		now := time.Now()
+		triple.Now = func() time.Time { return now }
+		mgr, err := NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil,
+			chain.Options{CARotateInterval: time.Hour, CertRotateInterval: 30 * time.Minute}, nil, WithCertDir(tempDir))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+		certificateChain := chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				certificateIssue.Name: certificateIssue,
+			},
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		Expect(mgr.writeCertDir(&certificateChain)).To(Succeed(), "should succeed writing the certificates directory")
+		dataDir, err := os.Readlink(filepath.Join(tempDir, certDirDataLink))
+		Expect(err).To(Succeed(), "should point the data symlink to the data directory")
+
+		By("Rotating the service certificate with overlap")
+		_, certsDeadline, err := chain.RotationDeadlines(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed computing the rotation deadlines")
+		now = certsDeadline.Add(time.Second)
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed rotating certificates")
+		certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the service certificates")
+		Expect(certs).To(HaveLen(2), "should keep the previous certificate during the overlap")
+		Expect(mgr.writeCertDir(&certificateChain)).To(Succeed(), "should succeed writing the certificates directory")
+
+		certPEM, err := ioutil.ReadFile(filepath.Join(tempDir, corev1.TLSCertKey))
+		Expect(err).To(Succeed(), "should succeed reading the certificate file")
+		keyPEM, err := ioutil.ReadFile(filepath.Join(tempDir, corev1.TLSPrivateKeyKey))
+		Expect(err).To(Succeed(), "should succeed reading the key file")
+		Expect(certPEM).To(Equal(triple.EncodeCertPEM(certs[1])), "should write the current certificate only")
+		_, err = tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).To(Succeed(), "should write a matching certificate and key pair")
+
+		for _, name := range []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey} {
+			target, err := os.Readlink(filepath.Join(tempDir, name))
+			Expect(err).To(Succeed(), "should write %s as a symlink", name)
+			Expect(target).To(Equal(filepath.Join(certDirDataLink, name)), "should point %s through the data symlink", name)
+		}
+		rotatedDataDir, err := os.Readlink(filepath.Join(tempDir, certDirDataLink))
+		Expect(err).To(Succeed(), "should point the data symlink to the data directory")
+		Expect(rotatedDataDir).ToNot(Equal(dataDir), "should swap the data directory")
+		_, err = os.Stat(filepath.Join(tempDir, dataDir))
+		Expect(os.IsNotExist(err)).To(BeTrue(), "should remove the previous data directory")
+	})
+})
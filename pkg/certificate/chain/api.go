@@ -1,8 +1,9 @@
 package chain
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
+	"fmt"
 	"time"
 
 	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
@@ -11,6 +12,8 @@ import (
 // CertificateIssue contains details about an issued certificate, including the
 // private key and named CA certificates known to verify the issued certificate.
 type CertificateIssue struct {
+	// Name identifies the certificate issue and is the CommonName of the
+	// certificates issued for it
 	Name      string
 	IPs       []string
 	Hostnames []string
@@ -19,7 +22,7 @@ type CertificateIssue struct {
 	CACertPEM map[string][]byte
 
 	// decoded data
-	key     *rsa.PrivateKey
+	key     crypto.Signer
 	certs   []*x509.Certificate
 	caCerts map[string][]*x509.Certificate
 }
@@ -34,16 +37,99 @@ type CA struct {
 	keyPair *triple.KeyPair
 }
 
+// RotationReason is the trigger of a certificate chain rotation
+type RotationReason string
+
+const (
+	// RotationReasonScheduled rotation deadline was reached
+	RotationReasonScheduled RotationReason = "Scheduled"
+
+	// RotationReasonForced rotation was requested on demand
+	RotationReasonForced RotationReason = "Forced"
+
+	// RotationReasonMissing CA or issued certificates were missing
+	RotationReasonMissing RotationReason = "Missing"
+
+	// RotationReasonInvalid certificate chain failed verification
+	RotationReasonInvalid RotationReason = "Invalid"
+
+	// RotationReasonCAChanged issued certificates were not signed by the
+	// current CA
+	RotationReasonCAChanged RotationReason = "CAChanged"
+
+	// RotationReasonSANsChanged issued certificates did not carry the IPs and
+	// hostnames of their certificate issue
+	RotationReasonSANsChanged RotationReason = "SANsChanged"
+)
+
 // CertificateChainData represents details about a certification authority and
 // named certificates issued by that authority.
 type CertificateChainData struct {
 	CertificatesIssued map[string]*CertificateIssue
 	CA                 CA
+
+	// RotationReason is set to the reason of the rotation done by Update or
+	// Rotate, if any
+	RotationReason RotationReason
 }
 
+// CABundleOrder is the order of the CA certificates at a CA bundle
+type CABundleOrder string
+
+const (
+	// CABundleOldestFirst places the newest CA certificate last
+	CABundleOldestFirst CABundleOrder = "OldestFirst"
+
+	// CABundleNewestFirst places the newest CA certificate first
+	CABundleNewestFirst CABundleOrder = "NewestFirst"
+)
+
+// NotYetValidPolicy is the way a certificate chain not valid yet is handled,
+// one with certificates whose NotBefore is in the future because they were
+// issued with a clock ahead of the current one
+type NotYetValidPolicy string
+
+const (
+	// NotYetValidRegenerate rotates the certificate chain as invalid, issuing
+	// certificates valid as of the current time
+	NotYetValidRegenerate NotYetValidPolicy = "Regenerate"
+
+	// NotYetValidWait keeps the certificate chain, Update returning the time
+	// it becomes valid at and Verify failing with a NotYetValidError until
+	// then
+	NotYetValidWait NotYetValidPolicy = "Wait"
+)
+
+// NotYetValidError is the error Verify fails with for a certificate chain
+// that verifies but for its certificates not being valid yet
+type NotYetValidError struct {
+	// ValidAt is the time the certificate chain becomes valid at
+	ValidAt time.Time
+}
+
+func (e *NotYetValidError) Error() string {
+	return fmt.Sprintf("Certificate chain not valid until %s", e.ValidAt.UTC().Format(time.RFC3339))
+}
+
+// ReducedValidityPolicy is the way a service certificate rotation issuing a
+// certificate that expires before the one currently served is handled, as
+// shortening CertRotateInterval would do
+type ReducedValidityPolicy string
+
+const (
+	// ReducedValidityWarn issues the certificate with a warning
+	ReducedValidityWarn ReducedValidityPolicy = "Warn"
+
+	// ReducedValidityRefuse fails the rotation, keeping the certificate
+	// currently served until it is rotated with its CA
+	ReducedValidityRefuse ReducedValidityPolicy = "Refuse"
+)
+
 // Options that allow to customize certificate rotation.
 type Options struct {
-	// CARotateInterval configurated duration for CA and certificate
+	// CARotateInterval configurated duration for CA certificates, the CA
+	// is only regenerated at its own rotation deadline and keeps signing
+	// the service certificates rotated before it
 	CARotateInterval time.Duration
 
 	// CAOverlapInterval the duration of CA Certificates at CABundle if
@@ -52,12 +138,102 @@ type Options struct {
 
 	// CertRotateInterval configurated duration for of service certificate
 	// the the webhook configuration is referencing different services all
-	// of them will share the same duration
+	// of them will share the same duration. It can be shorter than
+	// CARotateInterval, for short-lived service certificates issued by a
+	// long-lived CA. If not set it will default to CARotateInterval
 	CertRotateInterval time.Duration
 
 	// CertOverlapInterval the duration of service certificates at bundle if
 	// not set it will default to CertRotateInterval
 	CertOverlapInterval time.Duration
+
+	// CARenewBeforeFraction sets CAOverlapInterval as a fraction of
+	// CARotateInterval, so the CA is renewed that fraction of its life
+	// before expiring. It cannot be set together with CAOverlapInterval,
+	// SetDefaultsAndValidate folds it into CAOverlapInterval.
+	CARenewBeforeFraction float64
+
+	// CertRenewBeforeFraction sets CertOverlapInterval as a fraction of
+	// CertRotateInterval, independently of the CA one. It cannot be set
+	// together with CertOverlapInterval, SetDefaultsAndValidate folds it
+	// into CertOverlapInterval.
+	CertRenewBeforeFraction float64
+
+	// CertUsages the extended key usages of service certificates, if not
+	// set they are issued for x509.ExtKeyUsageServerAuth. Webhooks are
+	// served over TLS so it has to include x509.ExtKeyUsageServerAuth.
+	CertUsages []x509.ExtKeyUsage
+
+	// MaxSANs limits the number of DNS names and IP addresses of a service
+	// certificate, exceeding it fails the certificate issuance unless
+	// TruncateSANs is set. If not set, there is no limit.
+	MaxSANs int
+
+	// TruncateSANs issues service certificates exceeding MaxSANs with the
+	// first MaxSANs SANs only, DNS names first, with a warning.
+	TruncateSANs bool
+
+	// CAMaxRotateInterval caps CARotateInterval, longer durations are
+	// clamped to it with a warning since some clients reject CA certificates
+	// expiring too far in the future. If not set, it defaults to
+	// DefaultCAMaxRotateInterval, there is no way to disable the cap.
+	CAMaxRotateInterval time.Duration
+
+	// CABundleOrder the order of CA certificates at CA bundles during
+	// overlap, if not set they are placed as CABundleOldestFirst
+	CABundleOrder CABundleOrder
+
+	// CAKeySize and CertKeySize the size in bits of the RSA keys of the CA
+	// and service certificates, at least triple.DefaultRSAKeySize which is
+	// also the default if not set.
+	CAKeySize   int
+	CertKeySize int
+
+	// KeyAlgorithm the algorithm of the keys of the CA and service
+	// certificates, if not set they are triple.KeyAlgorithmRSA keys. The
+	// key sizes only apply to RSA keys.
+	KeyAlgorithm triple.KeyAlgorithm
+
+	// SerialNumberBits the maximum bit length of the serial numbers of the
+	// CA and service certificates, from triple.LegacySerialNumberBits (63) to
+	// triple.DefaultSerialNumberBits (159) which is also the default if not
+	// set.
+	SerialNumberBits int
+
+	// ReuseCAKey rotates the CA re-signing a new CA certificate with the
+	// current CA key instead of generating a new one, so the CA keeps the
+	// same public key with an extended validity. The CA key is only
+	// generated if there is none, Rotate reuses it too.
+	ReuseCAKey bool
+
+	// NotYetValidPolicy the way a certificate chain not valid yet is
+	// handled, if not set it is regenerated as NotYetValidRegenerate does
+	NotYetValidPolicy NotYetValidPolicy
+
+	// ReducedValidityPolicy the way a service certificate rotation reducing
+	// the remaining validity is handled, if not set it is done with a
+	// warning as ReducedValidityWarn does. Certificates expiring with their
+	// CA are compared by the CA expiration and rotations with a new CA are
+	// not checked.
+	ReducedValidityPolicy ReducedValidityPolicy
+
+	// ReconcileInterval the longest interval between two Update calls, for
+	// callers not calling Update at the returned time. Certificates expiring
+	// before the next Update would be called are rotated right away,
+	// regardless of their rotation deadline. It has to be shorter than
+	// CertRotateInterval. If not set, Update is expected at the returned time.
+	// The certificate Manager caps its requeue interval to it.
+	ReconcileInterval time.Duration
+
+	// RotationJitter brings forward each rotation deadline by up to this
+	// fraction of the certificate life before it, so that the certificates
+	// of chains issued together are not rotated together. The fraction of
+	// it a deadline is brought forward by is drawn from the certificate
+	// serial number, so the deadline does not change between Update calls.
+	// Valid values are in the [0, MaxRotationJitter] range, values out of it
+	// are clamped to it with a warning. If not set, certificates are rotated
+	// at their rotation deadline.
+	RotationJitter float64
 }
 
 // Update keeps the certificate chain data currrent by:
@@ -79,7 +255,38 @@ func Update(options *Options, data *CertificateChainData) (time.Time, error) {
 	return chain.update()
 }
 
-// Verify the certificate chain. An error is returned if it does not.
+// UpdateCerts does as Update keeping the CA as is, even if it is due for
+// rotation, so that the issued certificates are kept current while the CA
+// rotation is deferred. It fails if there is no CA to issue them with.
+// Returns a Time prediction when UpdateCerts should be called again.
+func UpdateCerts(options *Options, data *CertificateChainData) (time.Time, error) {
+	chain, err := newChain(options, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return chain.updateCerts()
+}
+
+// Rotate rotates the CA and all issued certificates regardless of their
+// deadlines and then updates the certificate chain data as Update does.
+// Returns a Time prediction when Update should be called again.
+func Rotate(options *Options, data *CertificateChainData) (time.Time, error) {
+	chain, err := newChain(options, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	err = chain.rotateAll()
+	if err != nil {
+		return time.Time{}, err
+	}
+	data.RotationReason = RotationReasonForced
+	return chain.update()
+}
+
+// Verify the certificate chain. An error is returned if it does not, a
+// NotYetValidError if it only fails for its certificates not being valid yet.
 func Verify(options *Options, data *CertificateChainData) error {
 	chain, err := newChain(options, data)
 	if err != nil {
@@ -88,3 +295,27 @@ func Verify(options *Options, data *CertificateChainData) error {
 
 	return chain.verifyTLS()
 }
+
+// PendingRotation returns the reason Update would rotate the certificate
+// chain data for, empty if it would not, and whether it would rotate the CA
+// too. Nothing is rotated, so it can be used to plan a rotation.
+func PendingRotation(options *Options, data *CertificateChainData) (reason RotationReason, rotateCA bool, err error) {
+	chain, err := newChain(options, data)
+	if err != nil {
+		return "", false, err
+	}
+
+	reason, rotateCA = chain.pendingRotation()
+	return reason, rotateCA, nil
+}
+
+// RotationDeadlines returns the times the CA and the issued certificates of
+// the certificate chain are due for rotation at.
+func RotationDeadlines(options *Options, data *CertificateChainData) (caDeadline time.Time, certsDeadline time.Time, err error) {
+	chain, err := newChain(options, data)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return chain.findRotationDeadlineForCA(), chain.findRotationDeadlineForCerts(), nil
+}
@@ -1,9 +1,10 @@
 package chain
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -64,6 +65,10 @@ func newChain(options *Options, data *CertificateChainData) (*certificateChain,
 		certificateIssue.caCerts = map[string][]*x509.Certificate{}
 		for k, v := range certificateIssue.CACertPEM {
 			certs, err := triple.ParseCertsPEM(v)
+			// CA bundles may be stored in any order, keep them oldest first
+			sort.SliceStable(certs, func(i, j int) bool {
+				return certs[i].NotBefore.Before(certs[j].NotBefore)
+			})
 			certificateIssue.caCerts[k] = certs
 			if err != nil {
 				// If any CABundle is wrong or empty, rotate CA
@@ -96,15 +101,39 @@ func (c *certificateChain) getCertOverlapInterval() time.Duration {
 	return c.CertOverlapInterval
 }
 
+func (c *certificateChain) getCAKeySize() int {
+	return c.CAKeySize
+}
+
+func (c *certificateChain) getCertKeySize() int {
+	return c.CertKeySize
+}
+
+// newKey generates a key of the configured algorithm, of bits size if it is
+// an RSA key
+func (c *certificateChain) newKey(bits int) (crypto.Signer, error) {
+	if c.KeyAlgorithm == triple.KeyAlgorithmRSA {
+		return triple.NewPrivateKeyWithSize(bits)
+	}
+	return triple.NewPrivateKeyWithConfig(triple.KeyConfig{Algorithm: c.KeyAlgorithm})
+}
+
+func (c *certificateChain) getCertUsages() []x509.ExtKeyUsage {
+	return c.CertUsages
+}
+
 // setCaKeypair sets a new CA KeyPair in all formats and adds it to all CA bundles
 func (c *certificateChain) setCaKeyPair(keyPair *triple.KeyPair) error {
+	keyPEM, certPEM, err := keyPairToKeyPairPem(keyPair)
+	if err != nil {
+		return err
+	}
 	c.data.CA.keyPair = keyPair
-	c.data.CA.KeyPEM, c.data.CA.CertPEM = keyPairToKeyPairPem(keyPair)
+	c.data.CA.KeyPEM, c.data.CA.CertPEM = keyPEM, certPEM
 	for _, certificateIssued := range c.data.CertificatesIssued {
 		for k, caCerts := range certificateIssued.caCerts {
 			caCerts = append(caCerts, keyPair.Cert)
-			certificateIssued.caCerts[k] = caCerts
-			certificateIssued.CACertPEM[k] = triple.EncodeCertsPEM(caCerts)
+			c.setCaCerts(certificateIssued, k, caCerts)
 		}
 	}
 	return nil
@@ -113,22 +142,45 @@ func (c *certificateChain) setCaKeyPair(keyPair *triple.KeyPair) error {
 // setCaCerts sets a CA certificate for a certificate issue in all formats
 func (c *certificateChain) setCaCerts(certificateIssued *CertificateIssue, name string, caCerts []*x509.Certificate) {
 	certificateIssued.caCerts[name] = caCerts
-	certificateIssued.CACertPEM[name] = triple.EncodeCertsPEM(caCerts)
+	certificateIssued.CACertPEM[name] = c.encodeCABundle(caCerts)
+}
+
+// encodeCABundle encodes oldest first CA certificates with the configured
+// CA bundle order
+func (c *certificateChain) encodeCABundle(caCerts []*x509.Certificate) []byte {
+	if c.CABundleOrder != CABundleNewestFirst {
+		return triple.EncodeCertsPEM(caCerts)
+	}
+	reversed := make([]*x509.Certificate, len(caCerts))
+	for i, caCert := range caCerts {
+		reversed[len(caCerts)-1-i] = caCert
+	}
+	return triple.EncodeCertsPEM(reversed)
 }
 
 // setKeyResetCert sets a key pair for a certificate issue in all formats, existing certificates are removed
-func (c *certificateChain) setKeyResetCert(certificateIssued *CertificateIssue, keyPair *triple.KeyPair) {
+func (c *certificateChain) setKeyResetCert(certificateIssued *CertificateIssue, keyPair *triple.KeyPair) error {
+	keyPEM, certPEM, err := keyPairToKeyPairPem(keyPair)
+	if err != nil {
+		return err
+	}
 	certificateIssued.key = keyPair.Key
 	certificateIssued.certs = []*x509.Certificate{keyPair.Cert}
-	certificateIssued.KeyPEM, certificateIssued.CertPEM = keyPairToKeyPairPem(keyPair)
+	certificateIssued.KeyPEM, certificateIssued.CertPEM = keyPEM, certPEM
+	return nil
 }
 
 // setKeyAppendCert sets a key pair for a certificate issue in all formats, appended to previous certificates
-func (c *certificateChain) setKeyAppendCert(certificateIssued *CertificateIssue, keyPair *triple.KeyPair) {
+func (c *certificateChain) setKeyAppendCert(certificateIssued *CertificateIssue, keyPair *triple.KeyPair) error {
+	keyPEM, err := triple.EncodeSignerPEM(keyPair.Key)
+	if err != nil {
+		return err
+	}
 	certificateIssued.key = keyPair.Key
 	certificateIssued.certs = append(certificateIssued.certs, keyPair.Cert)
-	certificateIssued.KeyPEM = triple.EncodePrivateKeyPEM(keyPair.Key)
+	certificateIssued.KeyPEM = keyPEM
 	certificateIssued.CertPEM = triple.EncodeCertsPEM(certificateIssued.certs)
+	return nil
 }
 
 // setCerts sets certificates for a certificate issue in all formats, preserving the previous key
@@ -138,29 +190,28 @@ func (c *certificateChain) setCerts(certificateIssued *CertificateIssue, certs [
 }
 
 // keyPairPemToKeypair converts KeyPair from PEM format
-func keyPairPemToKeypair(keypem []byte, certpem []byte) (*rsa.PrivateKey, []*x509.Certificate, error) {
-	key, err := triple.ParsePrivateKeyPEM(keypem)
+func keyPairPemToKeypair(keypem []byte, certpem []byte) (crypto.Signer, []*x509.Certificate, error) {
+	key, err := triple.ParseSignerPEM(keypem)
 	if err != nil {
 		return nil, nil, err
 	}
-	rsakey, ok := key.(*rsa.PrivateKey)
-	if !ok {
-		return nil, nil, errors.New("Expected RSA key but found different type")
-	}
 
 	certs, err := triple.ParseCertsPEM(certpem)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return rsakey, certs, nil
+	return key, certs, nil
 }
 
 // keyPairToKeyPairPem converts KeyPair to PEM format
-func keyPairToKeyPairPem(keyPair *triple.KeyPair) (key []byte, cert []byte) {
-	key = triple.EncodePrivateKeyPEM(keyPair.Key)
+func keyPairToKeyPairPem(keyPair *triple.KeyPair) (key []byte, cert []byte, err error) {
+	key, err = triple.EncodeSignerPEM(keyPair.Key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed encoding key")
+	}
 	cert = triple.EncodeCertPEM(keyPair.Cert)
-	return
+	return key, cert, nil
 }
 
 func (r *certificateChain) update() (time.Time, error) {
@@ -171,6 +222,19 @@ func (r *certificateChain) update() (time.Time, error) {
 	deadlineToRotateCerts := r.findRotationDeadlineForCerts()
 	rotateCA := !r.now().Before(deadlineToRotateCA)
 	rotateCerts := !r.now().Before(deadlineToRotateCerts)
+	reason := RotationReasonScheduled
+	if r.missingCertificates() {
+		reason = RotationReasonMissing
+	}
+
+	// Wait for a certificate chain issued with a clock ahead of ours to
+	// become valid instead of regenerating it
+	if r.NotYetValidPolicy == NotYetValidWait && !rotateCA && !r.missingCertificates() {
+		if validAt, notYetValid := r.notYetValidUntil(); notYetValid {
+			logger.Info("Certificate chain not valid yet, waiting for it", "validAt", validAt)
+			return validAt, nil
+		}
+	}
 
 	// Ensure certificate chain
 	if !rotateCA {
@@ -179,6 +243,32 @@ func (r *certificateChain) update() (time.Time, error) {
 			logger.Info("Certificate chain failed verification, will force full chain rotation", "err", err)
 			// Force rotation
 			rotateCA = true
+			if reason != RotationReasonMissing {
+				reason = RotationReasonInvalid
+			}
+		}
+	}
+
+	// Ensure issued certificates are signed by the current CA
+	if !rotateCA && !rotateCerts {
+		err := r.verifyCertsSigner()
+		if err != nil {
+			logger.Info("Certificates not signed by current CA, will force issued certificates rotation", "err", err)
+			err = r.rotateCertsWithoutOverlap()
+			if err != nil {
+				return time.Time{}, errors.Wrap(err, "Failed re-signing certificates")
+			}
+			r.data.RotationReason = RotationReasonCAChanged
+		}
+	}
+
+	// Ensure issued certificates are valid for the current SANs, which may
+	// have changed before their rotation deadline
+	if !rotateCA && !rotateCerts {
+		if name, changed := r.sansChanged(); changed {
+			logger.Info("Certificate SANs changed, will force issued certificates rotation", "name", name)
+			rotateCerts = true
+			reason = RotationReasonSANsChanged
 		}
 	}
 
@@ -186,20 +276,27 @@ func (r *certificateChain) update() (time.Time, error) {
 	if rotateCA {
 		// If rotate fails runtime-controller manager will re-enqueue it, so
 		// it will be retried
+		logger.Info("Rotating certificate chain", "reason", reason)
+		if _, notYetValid := r.notYetValidUntil(); notYetValid {
+			r.cleanUpNotYetValidCACerts()
+		}
 		err := r.rotateAll()
 		if err != nil {
 			return time.Time{}, errors.Wrap(err, "Failed rotating certificate chain")
 		}
+		r.data.RotationReason = reason
 
 		// Re-calculate deadlines
 		deadlineToRotateCA = r.findRotationDeadlineForCA()
 		deadlineToRotateCerts = r.findRotationDeadlineForCerts()
 	} else if rotateCerts {
 		// CA is ok but expiration but we have passed expiration time for chain certificates
+		logger.Info("Rotating certificates", "reason", reason)
 		err := r.rotateCertsWithOverlap()
 		if err != nil {
 			return time.Time{}, errors.Wrap(err, "Failed rotating bundles")
 		}
+		r.data.RotationReason = reason
 
 		// Re-calculate deadline
 		deadlineToRotateCerts = r.findRotationDeadlineForCerts()
@@ -240,21 +337,196 @@ func (r *certificateChain) update() (time.Time, error) {
 	return updateAt, nil
 }
 
+// updateCerts does update keeping the CA as is, rotating the issued
+// certificates only. It fails if there is no CA to issue them with.
+func (r *certificateChain) updateCerts() (time.Time, error) {
+	logger := r.log.WithName("updateCerts")
+	logger.Info("Checking issued certificates for rotation or cleanup")
+
+	if r.data.CA.keyPair.Key == nil || r.data.CA.keyPair.Cert == nil {
+		return time.Time{}, errors.New("There is no CA to issue certificates with")
+	}
+
+	rotate := r.rotateCertsWithOverlap
+	reason := RotationReasonScheduled
+	rotateCerts := !r.now().Before(r.findRotationDeadlineForCerts())
+	if err := r.verifyCertsSigner(); err != nil {
+		logger.Info("Certificates missing or not signed by current CA, will rotate them without overlap", "err", err)
+		rotate = r.rotateCertsWithoutOverlap
+		rotateCerts = true
+		reason = RotationReasonCAChanged
+		if r.missingCertificates() {
+			reason = RotationReasonMissing
+		}
+	} else if name, changed := r.sansChanged(); changed && !rotateCerts {
+		logger.Info("Certificate SANs changed, will force issued certificates rotation", "name", name)
+		rotateCerts = true
+		reason = RotationReasonSANsChanged
+	}
+
+	if rotateCerts {
+		logger.Info("Rotating certificates", "reason", reason)
+		err := rotate()
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "Failed rotating certificates")
+		}
+		r.data.RotationReason = reason
+	}
+
+	if !r.now().Before(r.findCleanUpDeadlineForCerts()) {
+		r.cleanUpCerts()
+	}
+
+	updateAt := minTime(r.findRotationDeadlineForCerts(), r.findCleanUpDeadlineForCerts())
+	logger.Info("Issued certificates updated & current until next update", "updateAt", updateAt)
+	return updateAt, nil
+}
+
+// pendingRotation returns the reason update would rotate the certificate
+// chain for, empty if it would not, and whether it would rotate the CA too,
+// without rotating anything.
+func (r *certificateChain) pendingRotation() (RotationReason, bool) {
+	rotateCA := !r.now().Before(r.findRotationDeadlineForCA())
+	rotateCerts := !r.now().Before(r.findRotationDeadlineForCerts())
+	reason := RotationReasonScheduled
+	if r.missingCertificates() {
+		reason = RotationReasonMissing
+	}
+
+	if r.NotYetValidPolicy == NotYetValidWait && !rotateCA && !r.missingCertificates() {
+		if _, notYetValid := r.notYetValidUntil(); notYetValid {
+			return "", false
+		}
+	}
+
+	if !rotateCA && r.verifyTLS() != nil {
+		rotateCA = true
+		if reason != RotationReasonMissing {
+			reason = RotationReasonInvalid
+		}
+	}
+
+	if !rotateCA && !rotateCerts {
+		if r.verifyCertsSigner() != nil {
+			return RotationReasonCAChanged, false
+		}
+		if _, changed := r.sansChanged(); changed {
+			return RotationReasonSANsChanged, false
+		}
+		return "", false
+	}
+	return reason, rotateCA
+}
+
 func (c *certificateChain) verifyTLS() error {
+	// The stored CA certificate has to be the one of the CA key signing the
+	// issued certificates
+	if c.data.CA.keyPair.Cert == nil || c.data.CA.keyPair.Key == nil {
+		return errors.New("Missing CA key pair")
+	}
+	err := triple.VerifyKeyPair(c.data.CA.keyPair.Cert, c.data.CA.keyPair.Key)
+	if err != nil {
+		return errors.Wrap(err, "Failed to verify CA key pair")
+	}
+
+	// A certificate chain not valid yet is verified as of the time it is
+	// valid at, so that it is only reported as not valid yet if that is
+	// all there is to it
+	validAt, notYetValid := c.notYetValidUntil()
+
 	for _, certificateIssued := range c.data.CertificatesIssued {
+		cert := getLastCert(certificateIssued.certs)
+		if cert == nil || certificateIssued.key == nil {
+			return errors.Errorf("Missing key pair for certificate %s", certificateIssued.Name)
+		}
+		err := triple.VerifyKeyPair(cert, certificateIssued.key)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to verify key pair for certificate %s", certificateIssued.Name)
+		}
+		if cert.IsCA {
+			return errors.Errorf("Certificate %s is a CA certificate", certificateIssued.Name)
+		}
+
 		for name, caCertPEM := range certificateIssued.CACertPEM {
 			caCert := getLastCert(certificateIssued.caCerts[name])
 			if !reflect.DeepEqual(caCert, c.data.CA.keyPair.Cert) {
 				return errors.New("CA last certificate for verification and CA certificate are different")
 			}
 
-			err := triple.VerifyTLS(certificateIssued.CertPEM, certificateIssued.KeyPEM, caCertPEM)
+			result := triple.VerifyTLSDetailed(certificateIssued.CertPEM, certificateIssued.KeyPEM, caCertPEM, triple.VerifyOptions{})
+			if notYetValid && c.now().Before(certificateIssued.certs[0].NotBefore) {
+				result.ValidityWindow = triple.VerifyCheck{}
+			}
+			err := result.Err()
 			if err != nil {
 				return errors.Wrapf(err, "Failed to verify certificate %s with named CA %s", certificateIssued.Name, name)
 			}
 		}
 	}
 
+	if notYetValid {
+		return &NotYetValidError{ValidAt: validAt}
+	}
+	return nil
+}
+
+// notYetValidUntil returns the latest NotBefore of the CA certificate and the
+// last issued certificates and whether it is in the future.
+func (c *certificateChain) notYetValidUntil() (time.Time, bool) {
+	certs := []*x509.Certificate{}
+	if c.data.CA.keyPair != nil && c.data.CA.keyPair.Cert != nil {
+		certs = append(certs, c.data.CA.keyPair.Cert)
+	}
+	for _, certificateIssued := range c.data.CertificatesIssued {
+		if cert := getLastCert(certificateIssued.certs); cert != nil {
+			certs = append(certs, cert)
+		}
+	}
+	validAt := time.Time{}
+	for _, cert := range certs {
+		if cert.NotBefore.After(validAt) {
+			validAt = cert.NotBefore
+		}
+	}
+	return validAt, c.now().Before(validAt)
+}
+
+// missingCertificates returns true if the CA, any issued certificate or any
+// CA bundle is missing.
+func (c *certificateChain) missingCertificates() bool {
+	if c.data.CA.keyPair == nil || c.data.CA.keyPair.Cert == nil {
+		return true
+	}
+	for _, certificateIssued := range c.data.CertificatesIssued {
+		if getLastCert(certificateIssued.certs) == nil {
+			return true
+		}
+		for _, caCerts := range certificateIssued.caCerts {
+			if getLastCert(caCerts) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyCertsSigner checks that the last certificate of every certificate
+// issue is signed by the current CA.
+func (c *certificateChain) verifyCertsSigner() error {
+	caCert := c.data.CA.keyPair.Cert
+	if caCert == nil {
+		return errors.New("CA certificate is missing")
+	}
+	for _, certificateIssued := range c.data.CertificatesIssued {
+		cert := getLastCert(certificateIssued.certs)
+		if cert == nil {
+			return errors.Errorf("Certificate %s is missing", certificateIssued.Name)
+		}
+		err := cert.CheckSignatureFrom(caCert)
+		if err != nil {
+			return errors.Wrapf(err, "Certificate %s is not signed by current CA", certificateIssued.Name)
+		}
+	}
 	return nil
 }
 
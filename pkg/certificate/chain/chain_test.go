@@ -1,6 +1,10 @@
 package chain
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -69,6 +73,14 @@ var _ = Describe("chain", func() {
 			},
 			shouldFail: true,
 		}),
+		Entry("when private key does not match the certificate, should fail", verifyTLSTestCase{
+			certificateChainMod: func(chain *CertificateChainData) {
+				key, err := triple.NewPrivateKey()
+				Expect(err).To(Succeed(), "should succeed creating new private key")
+				chain.CertificatesIssued[certIssueName].KeyPEM = triple.EncodePrivateKeyPEM(key)
+			},
+			shouldFail: true,
+		}),
 		Entry("missing CA key, should fail", verifyTLSTestCase{
 			certificateChainMod: func(chain *CertificateChainData) {
 				chain.CA.KeyPEM = nil
@@ -105,6 +117,13 @@ var _ = Describe("chain", func() {
 			},
 			shouldFail: true,
 		}),
+		Entry("when certificate is a CA certificate, should fail", verifyTLSTestCase{
+			certificateChainMod: func(chain *CertificateChainData) {
+				chain.CertificatesIssued[certIssueName].KeyPEM = chain.CA.KeyPEM
+				chain.CertificatesIssued[certIssueName].CertPEM = chain.CA.CertPEM
+			},
+			shouldFail: true,
+		}),
 		Entry("missing CA cert for verification, should fail", verifyTLSTestCase{
 			certificateChainMod: func(chain *CertificateChainData) {
 				chain.CertificatesIssued[certIssueName].CACertPEM[caCertName] = nil
@@ -128,4 +147,779 @@ var _ = Describe("chain", func() {
 			shouldFail: true,
 		}),
 	)
+
+	Context("when the CA is swapped without re-signing the certificates", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+			newCA   *triple.KeyPair
+		)
+		BeforeEach(func() {
+			options = Options{}
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+
+			newCA, err = triple.NewCA(caName, OneYearDuration)
+			Expect(err).To(Succeed(), "should succeed creating new CA")
+			chain.CA.KeyPEM, chain.CA.CertPEM, err = keyPairToKeyPairPem(newCA)
+			Expect(err).To(Succeed(), "should succeed encoding new CA")
+			caBundle := chain.CertificatesIssued[certIssueName].CACertPEM[caCertName]
+			chain.CertificatesIssued[certIssueName].CACertPEM[caCertName] = append(caBundle, triple.EncodeCertPEM(newCA.Cert)...)
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify against the union CA bundle")
+		})
+		It("should detect the mismatch on update and re-sign the certificates with the current CA", func() {
+			reason, rotateCA, err := PendingRotation(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed planning the rotation")
+			Expect(reason).To(Equal(RotationReasonCAChanged), "should plan to re-sign the certificates")
+			Expect(rotateCA).To(BeFalse(), "should plan to keep the CA")
+
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.CA.CertPEM).To(Equal(triple.EncodeCertPEM(newCA.Cert)), "should keep the current CA")
+			certs, err := triple.ParseCertsPEM(chain.CertificatesIssued[certIssueName].CertPEM)
+			Expect(err).To(Succeed(), "should succeed parsing certificates")
+			Expect(certs).To(HaveLen(1), "should reset the certificates")
+			Expect(certs[0].CheckSignatureFrom(newCA.Cert)).To(Succeed(), "should be signed by current CA")
+			Expect(chain.RotationReason).To(Equal(RotationReasonCAChanged), "should record the CA change as rotation reason")
+		})
+	})
+
+	Context("when the SANs of a certificate issue change before its rotation deadline", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+			ca      []byte
+			cert    []byte
+		)
+		BeforeEach(func() {
+			options = Options{}
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						IPs:       []string{"10.0.0.1"},
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+			ca = chain.CA.CertPEM
+			cert = chain.CertificatesIssued[certIssueName].CertPEM
+
+			By("Reconciling without changes")
+			chain.RotationReason = ""
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(BeEmpty(), "should not rotate the certificates")
+			reason, _, err := PendingRotation(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed planning the rotation")
+			Expect(reason).To(BeEmpty(), "should not plan to rotate the certificates")
+		})
+		DescribeTable("should rotate the certificates with the current SANs, keeping the CA",
+			func(ips, hostnames []string) {
+				chain.CertificatesIssued[certIssueName].IPs = ips
+				chain.CertificatesIssued[certIssueName].Hostnames = hostnames
+				reason, rotateCA, err := PendingRotation(&options, &chain)
+				Expect(err).To(Succeed(), "should succeed planning the rotation")
+				Expect(reason).To(Equal(RotationReasonSANsChanged), "should plan to rotate the certificates")
+				Expect(rotateCA).To(BeFalse(), "should plan to keep the CA")
+				Expect(chain.CertificatesIssued[certIssueName].CertPEM).To(Equal(cert), "should not rotate the certificate planning it")
+
+				_, err = Update(&options, &chain)
+				Expect(err).To(Succeed(), "should succeed updating")
+				Expect(chain.RotationReason).To(Equal(RotationReasonSANsChanged), "should record the SANs change as rotation reason")
+				Expect(chain.CA.CertPEM).To(Equal(ca), "should keep the CA")
+				certs, err := triple.ParseCertsPEM(chain.CertificatesIssued[certIssueName].CertPEM)
+				Expect(err).To(Succeed(), "should succeed parsing certificates")
+				Expect(certs[len(certs)-1].DNSNames).To(ConsistOf(hostnames), "should issue the certificate with the current hostnames")
+				Expect(certs[len(certs)-1].IPAddresses).To(HaveLen(len(ips)), "should issue the certificate with the current IPs")
+				Expect(chain.CertificatesIssued[certIssueName].CertPEM).ToNot(Equal(cert), "should rotate the certificate while still valid")
+				Expect(Verify(&options, &chain)).To(Succeed(), "should verify the rotated certificates")
+			},
+			Entry("with a renamed service", []string{"10.0.0.1"}, []string{"bar-service"}),
+			Entry("with an added DNS alias", []string{"10.0.0.1"}, []string{certIssueName, "foo-alias"}),
+			Entry("with a changed IP", []string{"10.0.0.2"}, []string{certIssueName}),
+		)
+	})
+
+	DescribeTable("CA bundle order during CA overlap",
+		func(order CABundleOrder, expectNewestFirst bool) {
+			defer func() { triple.Now = time.Now }()
+			now := time.Now()
+			triple.Now = func() time.Time { return now }
+
+			options := Options{CABundleOrder: order}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			chain := CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+
+			now = now.Add(options.CARotateInterval - options.CAOverlapInterval + time.Minute)
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should rotate the CA")
+
+			caCerts, err := triple.ParseCertsPEM(chain.CertificatesIssued[certIssueName].CACertPEM[caCertName])
+			Expect(err).To(Succeed(), "should succeed parsing CA bundle")
+			Expect(caCerts).To(HaveLen(2), "should contain old and new CA")
+
+			newest, oldest := caCerts[1], caCerts[0]
+			if expectNewestFirst {
+				newest, oldest = caCerts[0], caCerts[1]
+			}
+			Expect(newest.NotBefore.After(oldest.NotBefore)).To(BeTrue(), "should place CAs in the configured order")
+			Expect(triple.EncodeCertPEM(newest)).To(Equal(chain.CA.CertPEM), "should include current CA")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should reconcile again")
+			reordered, err := triple.ParseCertsPEM(chain.CertificatesIssued[certIssueName].CACertPEM[caCertName])
+			Expect(err).To(Succeed(), "should succeed parsing CA bundle")
+			Expect(reordered).To(Equal(caCerts), "should keep the order on following reconciles")
+		},
+		Entry("not set should place oldest first", CABundleOrder(""), false),
+		Entry("oldest first", CABundleOldestFirst, false),
+		Entry("newest first", CABundleNewestFirst, true),
+	)
+
+	Context("when rotating", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+			now     time.Time
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			triple.Now = func() time.Time { return now }
+			options = Options{}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+			Expect(chain.RotationReason).To(Equal(RotationReasonMissing), "should record missing certificates as rotation reason")
+			chain.RotationReason = ""
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should not record a reason when nothing is rotated", func() {
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(BeEmpty(), "should not record a rotation reason")
+		})
+		It("should record a scheduled rotation at the deadline", func() {
+			now = now.Add(options.CertRotateInterval - options.CertOverlapInterval + time.Minute)
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonScheduled), "should record a scheduled rotation")
+		})
+		It("should record a forced rotation", func() {
+			previousCA := chain.CA.CertPEM
+			_, err := Rotate(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed rotating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonForced), "should record a forced rotation")
+			Expect(chain.CA.CertPEM).ToNot(Equal(previousCA), "should rotate the CA")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+		})
+		It("should record a missing CA bundle rotation", func() {
+			chain.CertificatesIssued[certIssueName].CACertPEM[caCertName] = []byte("This is not a CABundle PEM")
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonMissing), "should record a missing CA bundle rotation")
+		})
+		It("should record an invalid chain rotation", func() {
+			hackedCA, err := triple.NewCA("hacked-ca", OneYearDuration)
+			Expect(err).To(Succeed(), "should succeed creating new hacked CA")
+			caBundle := chain.CertificatesIssued[certIssueName].CACertPEM[caCertName]
+			chain.CertificatesIssued[certIssueName].CACertPEM[caCertName] = append(caBundle, triple.EncodeCertPEM(hackedCA.Cert)...)
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonInvalid), "should record an invalid chain rotation")
+		})
+		It("should rotate a CA certificate not matching the stored CA key", func() {
+			hackedCA, err := triple.NewCA("hacked-ca", OneYearDuration)
+			Expect(err).To(Succeed(), "should succeed creating new hacked CA")
+			chain.CA.KeyPEM = triple.EncodePrivateKeyPEM(hackedCA.Key.(*rsa.PrivateKey))
+			previousCA := chain.CA.CertPEM
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonInvalid), "should record an invalid chain rotation")
+			Expect(chain.CA.CertPEM).ToNot(Equal(previousCA), "should rotate the CA")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when the certificate chain is not valid yet", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+			now     time.Time
+			issued  time.Time
+		)
+		BeforeEach(func() {
+			issued = time.Now().Truncate(time.Second)
+			now = issued
+			triple.Now = func() time.Time { return now }
+			options = Options{}
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+			chain.RotationReason = ""
+
+			By("Going back in time as if issued with a clock ahead")
+			now = issued.Add(-10 * time.Minute)
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should fail verification as not valid yet", func() {
+			err := Verify(&options, &chain)
+			Expect(err).To(MatchError(ContainSubstring("Certificate chain not valid until")), "should fail verifying the certificate chain")
+			notYetValid := &NotYetValidError{}
+			Expect(errors.As(err, &notYetValid)).To(BeTrue(), "should fail as not valid yet")
+			Expect(notYetValid.ValidAt).To(BeTemporally("==", issued), "should be valid once issued")
+		})
+		It("should fail verification as invalid if it does not verify otherwise", func() {
+			otherCA, err := triple.NewCA("other-ca", time.Hour)
+			Expect(err).To(Succeed(), "should succeed generating another CA")
+			chain.CertificatesIssued[certIssueName].CACertPEM[caCertName] = triple.EncodeCertPEM(otherCA.Cert)
+			err = Verify(&options, &chain)
+			Expect(err).To(HaveOccurred(), "should fail verifying the certificate chain")
+			notYetValid := &NotYetValidError{}
+			Expect(errors.As(err, &notYetValid)).To(BeFalse(), "should not fail as not valid yet")
+		})
+		It("should regenerate it by default", func() {
+			previousCA := chain.CA.CertPEM
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonInvalid), "should record an invalid chain rotation")
+			Expect(chain.CA.CertPEM).ToNot(Equal(previousCA), "should rotate the CA")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the regenerated certificate chain")
+		})
+		It("should wait for it with NotYetValidWait", func() {
+			options.NotYetValidPolicy = NotYetValidWait
+			previousCA := chain.CA.CertPEM
+			previousCert := chain.CertificatesIssued[certIssueName].CertPEM
+			updateAt, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(updateAt).To(Equal(issued.UTC()), "should update again once valid")
+			Expect(chain.RotationReason).To(BeEmpty(), "should not rotate")
+			Expect(chain.CA.CertPEM).To(Equal(previousCA), "should keep the CA")
+			Expect(chain.CertificatesIssued[certIssueName].CertPEM).To(Equal(previousCert), "should keep the certificate")
+			Expect(Verify(&options, &chain)).To(Equal(&NotYetValidError{ValidAt: updateAt}), "should fail verifying as not valid yet until valid")
+
+			now = updateAt
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(BeEmpty(), "should not rotate once valid")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify once valid")
+		})
+	})
+
+	Context("when the service certificates are shorter lived than the CA", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+			now     time.Time
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			triple.Now = func() time.Time { return now }
+			options = Options{
+				CARotateInterval:   OneYearDuration,
+				CertRotateInterval: 90 * 24 * time.Hour,
+			}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should rotate the service certificates with the same CA until the CA deadline", func() {
+			updateAt, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+			caKey, caCert := chain.CA.KeyPEM, chain.CA.CertPEM
+			caDeadline, certsDeadline, err := RotationDeadlines(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed computing the rotation deadlines")
+			Expect(updateAt).To(Equal(certsDeadline), "should update next at the service certificates deadline")
+			Expect(certsDeadline).To(BeTemporally("<", caDeadline), "should rotate the service certificates before the CA")
+
+			rotations := 0
+			for {
+				now = updateAt
+				if !now.Before(caDeadline) {
+					break
+				}
+				chain.RotationReason = ""
+				previousCert := chain.CertificatesIssued[certIssueName].CertPEM
+				updateAt, err = Update(&options, &chain)
+				Expect(err).To(Succeed(), "should succeed updating")
+				if chain.RotationReason == "" {
+					continue
+				}
+				rotations++
+				Expect(chain.RotationReason).To(Equal(RotationReasonScheduled), "should record a scheduled rotation")
+				Expect(chain.CertificatesIssued[certIssueName].CertPEM).ToNot(Equal(previousCert), "should rotate the service certificate")
+				Expect(chain.CA.KeyPEM).To(Equal(caKey), "should keep the CA key")
+				Expect(chain.CA.CertPEM).To(Equal(caCert), "should keep the CA certificate")
+				Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+			}
+			Expect(rotations).To(BeNumerically(">=", 2), "should rotate the service certificates more than once")
+
+			By("Reaching the CA deadline")
+			chain.RotationReason = ""
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonScheduled), "should record a scheduled rotation")
+			Expect(chain.CA.KeyPEM).ToNot(Equal(caKey), "should rotate the CA key")
+			Expect(chain.CA.CertPEM).ToNot(Equal(caCert), "should rotate the CA certificate")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when a rotation reduces the remaining validity of the service certificate", func() {
+		var (
+			chain CertificateChainData
+			cert  []byte
+		)
+		BeforeEach(func() {
+			options := Options{
+				CARotateInterval:   OneYearDuration,
+				CertRotateInterval: 90 * 24 * time.Hour,
+			}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+			cert = chain.CertificatesIssued[certIssueName].CertPEM
+
+			By("Changing the SANs to rotate the certificate before its deadline")
+			chain.RotationReason = ""
+			chain.CertificatesIssued[certIssueName].Hostnames = []string{certIssueName, "foo-alias"}
+		})
+		DescribeTable("should guard the rotation with a shortened certificate duration",
+			func(policy ReducedValidityPolicy, expectRefused bool) {
+				options := Options{
+					CARotateInterval:      OneYearDuration,
+					CertRotateInterval:    7 * 24 * time.Hour,
+					ReducedValidityPolicy: policy,
+				}
+				Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+				_, err := Update(&options, &chain)
+				if expectRefused {
+					Expect(err).To(MatchError(ContainSubstring("before the one currently served")), "should refuse the rotation")
+					return
+				}
+				Expect(err).To(Succeed(), "should succeed updating")
+				Expect(chain.RotationReason).To(Equal(RotationReasonSANsChanged), "should rotate the certificate")
+				Expect(chain.CertificatesIssued[certIssueName].CertPEM).ToNot(Equal(cert), "should issue the shorter lived certificate")
+			},
+			Entry("by warning when not set", ReducedValidityPolicy(""), false),
+			Entry("by warning with ReducedValidityWarn", ReducedValidityWarn, false),
+			Entry("by refusing with ReducedValidityRefuse", ReducedValidityRefuse, true),
+		)
+	})
+
+	Context("when the certificates expire before the next reconcile", func() {
+		var (
+			chain CertificateChainData
+			now   time.Time
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			triple.Now = func() time.Time { return now }
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		DescribeTable("should rotate them",
+			func(reconcileInterval time.Duration, shouldRotate bool) {
+				options := Options{
+					CertRotateInterval:  2 * time.Hour,
+					CertOverlapInterval: 10 * time.Minute,
+					ReconcileInterval:   reconcileInterval,
+				}
+				_, err := Update(&options, &chain)
+				Expect(err).To(Succeed(), "should initially reconcile")
+				chain.RotationReason = ""
+				previousCert := chain.CertificatesIssued[certIssueName].CertPEM
+
+				By("Updating before the rotation deadline but within a reconcile interval of the expiration")
+				now = now.Add(90 * time.Minute)
+				_, err = Update(&options, &chain)
+				Expect(err).To(Succeed(), "should succeed updating")
+				if shouldRotate {
+					Expect(chain.RotationReason).To(Equal(RotationReasonScheduled), "should record a scheduled rotation")
+					Expect(chain.CertificatesIssued[certIssueName].CertPEM).ToNot(Equal(previousCert), "should rotate the certificate")
+				} else {
+					Expect(chain.RotationReason).To(BeEmpty(), "should not record a rotation reason")
+					Expect(chain.CertificatesIssued[certIssueName].CertPEM).To(Equal(previousCert), "should not rotate the certificate")
+				}
+			},
+			Entry("not when the reconcile interval is not set", time.Duration(0), false),
+			Entry("not when the next reconcile is before the expiration", 20*time.Minute, false),
+			Entry("immediately when the next reconcile is after the expiration", time.Hour, true),
+		)
+	})
+
+	Context("when rotating the CA reusing its key", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+			now     time.Time
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			triple.Now = func() time.Time { return now }
+			options = Options{
+				CARotateInterval: 2 * time.Hour,
+				ReuseCAKey:       true,
+			}
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should initially reconcile")
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should issue a CA certificate with the same public key and a later expiration", func() {
+			previousCAs, err := triple.ParseCertsPEM(chain.CA.CertPEM)
+			Expect(err).ToNot(HaveOccurred(), "should parse the previous CA certificate")
+			previousCAKey := chain.CA.KeyPEM
+
+			now = now.Add(options.CARotateInterval - options.CAOverlapInterval + time.Minute)
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+			Expect(chain.RotationReason).To(Equal(RotationReasonScheduled), "should record a scheduled rotation")
+
+			rotatedCAs, err := triple.ParseCertsPEM(chain.CA.CertPEM)
+			Expect(err).ToNot(HaveOccurred(), "should parse the rotated CA certificate")
+			Expect(chain.CA.KeyPEM).To(Equal(previousCAKey), "should keep the CA key")
+			Expect(rotatedCAs[0].RawSubjectPublicKeyInfo).To(Equal(previousCAs[0].RawSubjectPublicKeyInfo), "should keep the CA public key")
+			Expect(rotatedCAs[0].NotAfter).To(BeTemporally(">", previousCAs[0].NotAfter), "should extend the CA expiration")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when updating the issued certificates only", func() {
+		It("should rotate them with the current CA even if it is due for rotation", func() {
+			defer func() { triple.Now = time.Now }()
+			now := time.Now()
+			triple.Now = func() time.Time { return now }
+
+			options := Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			chain := CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := UpdateCerts(&options, &chain)
+			Expect(err).To(HaveOccurred(), "should fail without a CA")
+
+			_, err = Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed issuing certificates")
+			ca := chain.CA.CertPEM
+			cert := chain.CertificatesIssued[certIssueName].CertPEM
+
+			now = now.Add(options.CARotateInterval - options.CAOverlapInterval + time.Minute)
+			chain.RotationReason = ""
+			updateAt, err := UpdateCerts(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating the issued certificates")
+			Expect(chain.CA.CertPEM).To(Equal(ca), "should keep the CA")
+			Expect(chain.RotationReason).To(Equal(RotationReasonScheduled), "should record the scheduled rotation")
+			Expect(chain.CertificatesIssued[certIssueName].CertPEM).ToNot(Equal(cert), "should rotate the certificate")
+			Expect(updateAt).To(BeTemporally(">", now), "should be current until a later update")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the rotated certificates with the current CA")
+		})
+	})
+
+	Context("when planning the rotation of missing certificates", func() {
+		It("should plan to rotate the CA without issuing anything", func() {
+			options := Options{}
+			chain := CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			reason, rotateCA, err := PendingRotation(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed planning the rotation")
+			Expect(reason).To(Equal(RotationReasonMissing), "should plan to issue the missing certificates")
+			Expect(rotateCA).To(BeTrue(), "should plan to issue the CA")
+			Expect(chain.CA.CertPEM).To(BeEmpty(), "should not issue the CA")
+			Expect(chain.CertificatesIssued[certIssueName].CertPEM).To(BeEmpty(), "should not issue the service certificate")
+			Expect(chain.RotationReason).To(BeEmpty(), "should not record a rotation")
+		})
+	})
+
+	Context("when configured with key sizes", func() {
+		It("should generate the CA and service keys with them", func() {
+			options := Options{
+				CAKeySize: 3072,
+			}
+			chain := CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+
+			caKey, err := triple.ParsePrivateKeyPEM(chain.CA.KeyPEM)
+			Expect(err).To(Succeed(), "should parse the CA key")
+			Expect(caKey.(*rsa.PrivateKey).N.BitLen()).To(Equal(3072), "should generate the CA key with the CA key size")
+			key, err := triple.ParsePrivateKeyPEM(chain.CertificatesIssued[certIssueName].KeyPEM)
+			Expect(err).To(Succeed(), "should parse the service key")
+			Expect(key.(*rsa.PrivateKey).N.BitLen()).To(Equal(triple.DefaultRSAKeySize), "should generate the service key with the default size")
+		})
+	})
+
+	Context("when configured with a key algorithm", func() {
+		It("should generate the CA and service keys with it", func() {
+			options := Options{
+				KeyAlgorithm: triple.KeyAlgorithmECDSAP256,
+			}
+			chain := CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+
+			caKey, err := triple.ParsePrivateKeyPEM(chain.CA.KeyPEM)
+			Expect(err).To(Succeed(), "should parse the CA key")
+			Expect(caKey).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}), "should generate an ECDSA CA key")
+			key, err := triple.ParsePrivateKeyPEM(chain.CertificatesIssued[certIssueName].KeyPEM)
+			Expect(err).To(Succeed(), "should parse the service key")
+			Expect(key).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}), "should generate an ECDSA service key")
+			Expect(Verify(&options, &chain)).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when configured with a serial number size", func() {
+		It("should issue the CA and service certificates with serial numbers of that size", func() {
+			options := Options{
+				SerialNumberBits: triple.LegacySerialNumberBits,
+			}
+			chain := CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: []string{certIssueName},
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed updating")
+
+			caCerts, err := triple.ParseCertsPEM(chain.CA.CertPEM)
+			Expect(err).To(Succeed(), "should parse the CA certificate")
+			certs, err := triple.ParseCertsPEM(chain.CertificatesIssued[certIssueName].CertPEM)
+			Expect(err).To(Succeed(), "should parse the service certificate")
+			for _, cert := range append(caCerts, certs...) {
+				Expect(cert.SerialNumber.Sign()).To(Equal(1), "should have a positive serial number")
+				Expect(cert.SerialNumber.BitLen()).To(BeNumerically("<=", triple.LegacySerialNumberBits), "should fit a signed 64-bit integer")
+			}
+		})
+	})
+
+	Context("when issuing a certificate with more SANs than allowed", func() {
+		var (
+			options Options
+			chain   CertificateChainData
+		)
+		BeforeEach(func() {
+			hostnames := []string{}
+			for i := 0; i < 200; i++ {
+				hostnames = append(hostnames, fmt.Sprintf("alias-%d.%s", i, certIssueName))
+			}
+			options = Options{
+				MaxSANs: 100,
+			}
+			chain = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					certIssueName: {
+						Name:      certIssueName,
+						Hostnames: hostnames,
+						CACertPEM: map[string][]byte{
+							caCertName: {},
+						},
+					},
+				},
+				CA: CA{
+					Name: caName,
+				},
+			}
+		})
+		It("should fail issuing it", func() {
+			_, err := Update(&options, &chain)
+			Expect(err).To(MatchError(ContainSubstring("has 200 SANs, exceeding the maximum of 100")), "should refuse issuing the certificate")
+		})
+		It("should issue it with truncated SANs if configured to", func() {
+			options.TruncateSANs = true
+			_, err := Update(&options, &chain)
+			Expect(err).To(Succeed(), "should succeed issuing the certificate")
+			certs, err := triple.ParseCertsPEM(chain.CertificatesIssued[certIssueName].CertPEM)
+			Expect(err).To(Succeed(), "should succeed parsing the certificate")
+			Expect(certs[len(certs)-1].DNSNames).To(Equal(chain.CertificatesIssued[certIssueName].Hostnames[:100]), "should keep the first SANs")
+		})
+	})
 })
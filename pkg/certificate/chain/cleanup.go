@@ -48,3 +48,23 @@ func (c *certificateChain) cleanUpCerts() {
 		c.setCerts(certificateIssued, certs)
 	}
 }
+
+// cleanUpNotYetValidCACerts drops the CA certificates not valid yet from the CA
+// bundles, as they would stay the newest ones there after regenerating the CA.
+func (c *certificateChain) cleanUpNotYetValidCACerts() {
+	logger := c.log.WithName("cleanUpNotYetValidCACerts")
+	now := c.now()
+	for _, certificateIssued := range c.data.CertificatesIssued {
+		for k, caCerts := range certificateIssued.caCerts {
+			validCACerts := []*x509.Certificate{}
+			for _, caCert := range caCerts {
+				if now.Before(caCert.NotBefore) {
+					logger.Info("Cleaning up CA certificate not valid yet", "NotBefore", caCert.NotBefore)
+					continue
+				}
+				validCACerts = append(validCACerts, caCert)
+			}
+			c.setCaCerts(certificateIssued, k, validCACerts)
+		}
+	}
+}
@@ -2,14 +2,29 @@ package chain
 
 import (
 	"crypto/x509"
+	"math/big"
 	"time"
 )
 
-// nextRotationDeadlineForCA finds the earliest time a CA certificate needs to
-// be rotated.
+// rotationJitterDraws is the number of distinct fractions of the rotation
+// jitter a deadline can be brought forward by
+const rotationJitterDraws = 1 << 16
+
+// findRotationDeadlineForCA finds the earliest time a CA certificate, either
+// the stored one or the ones at CA bundles, needs to be rotated.
 func (c *certificateChain) findRotationDeadlineForCA() time.Time {
 	logger := c.log.WithName("findRotationDeadlineForCA")
 	deadlines := make([]time.Time, 0)
+
+	// The stored CA may have been issued long ago or externally, its
+	// remaining validity is what counts
+	if c.data.CA.keyPair != nil && c.data.CA.keyPair.Cert != nil {
+		cert := c.data.CA.keyPair.Cert
+		overlap := c.getCAOverlapInterval()
+		deadline := c.nextRotationDeadlineForCert(cert, overlap)
+		logger.Info("Considering stored CA certificate deadline", "notBefore", cert.NotBefore, "notAfter", cert.NotAfter, "overlap", overlap, "deadline", deadline)
+		deadlines = append(deadlines, deadline)
+	}
 	for _, certificateIssued := range c.data.CertificatesIssued {
 		for _, certs := range certificateIssued.caCerts {
 			cert := getLastCert(certs)
@@ -18,7 +33,7 @@ func (c *certificateChain) findRotationDeadlineForCA() time.Time {
 				return time.Time{}
 			}
 			overlap := c.getCAOverlapInterval()
-			deadline := nextRotationDeadlineForCert(cert, overlap)
+			deadline := c.nextRotationDeadlineForCert(cert, overlap)
 			logger.Info("Considering CA certificate deadline", "notBefore", cert.NotBefore, "notAfter", cert.NotAfter, "overlap", overlap, "deadline", deadline)
 			deadlines = append(deadlines, deadline)
 		}
@@ -40,7 +55,7 @@ func (c *certificateChain) findRotationDeadlineForCerts() time.Time {
 			return time.Time{}
 		}
 		overlap := c.getCertOverlapInterval()
-		deadline := nextRotationDeadlineForCert(cert, overlap)
+		deadline := c.nextRotationDeadlineForCert(cert, overlap)
 		logger.Info("Considering certificate deadline", "notBefore", cert.NotBefore, "notAfter", cert.NotAfter, "overlap", overlap, "deadline", deadline)
 		deadlines = append(deadlines, deadline)
 	}
@@ -61,6 +76,44 @@ func nextRotationDeadlineForCert(certificate *x509.Certificate, overlap time.Dur
 	return deadline
 }
 
+// rotationJitterDraw returns the fraction of the rotation jitter the
+// certificate rotation deadline is brought forward by, in the [0, 1) range.
+// It is drawn from the certificate serial number so that it is random across
+// certificates but the same for a certificate every time.
+func rotationJitterDraw(certificate *x509.Certificate) float64 {
+	if certificate.SerialNumber == nil {
+		return 0
+	}
+	draw := new(big.Int).Mod(certificate.SerialNumber, big.NewInt(rotationJitterDraws))
+	return float64(draw.Int64()) / rotationJitterDraws
+}
+
+// jitterRotationDeadline brings forward the rotation deadline by the drawn
+// fraction of RotationJitter of the certificate life before it
+func (c *certificateChain) jitterRotationDeadline(certificate *x509.Certificate, deadline time.Time) time.Time {
+	life := deadline.Sub(certificate.NotBefore)
+	if c.RotationJitter <= 0 || life <= 0 {
+		return deadline
+	}
+	return deadline.Add(-time.Duration(c.RotationJitter * rotationJitterDraw(certificate) * float64(life)))
+}
+
+// nextRotationDeadlineForCert returns nextRotationDeadlineForCert, jittered,
+// unless the certificate expires before the next reconcile, in which case it
+// has to be rotated now.
+func (c *certificateChain) nextRotationDeadlineForCert(certificate *x509.Certificate, overlap time.Duration) time.Time {
+	deadline := c.jitterRotationDeadline(certificate, nextRotationDeadlineForCert(certificate, overlap))
+	if c.ReconcileInterval <= 0 {
+		return deadline
+	}
+	nextReconcile := c.now().Add(c.ReconcileInterval)
+	if deadline.After(c.now()) && !nextReconcile.Before(certificate.NotAfter) {
+		c.log.WithName("nextRotationDeadlineForCert").Info("Certificate expires before next reconcile, using an inmediate deadline", "notAfter", certificate.NotAfter, "nextReconcile", nextReconcile)
+		return c.now()
+	}
+	return deadline
+}
+
 // findCleanUpDeadlineForCACerts finds the earliest time a CA certificate will
 // expire and thus needs to be cleaned up.
 func (c *certificateChain) findCleanUpDeadlineForCACerts() time.Time {
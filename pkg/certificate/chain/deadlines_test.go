@@ -3,11 +3,14 @@ package chain
 import (
 	"crypto/x509"
 	"fmt"
+	"math/big"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
 )
 
 const maxNegativeDuration time.Duration = -1 << 63
@@ -186,4 +189,155 @@ var _ = Describe("Deadlines", func() {
 			shouldRotate: true,
 		}),
 	)
+
+	Context("when loading a half-expired stored CA", func() {
+		var (
+			options Options
+			ca      *triple.KeyPair
+			data    CertificateChainData
+		)
+		BeforeEach(func() {
+			options = Options{}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+
+			By("Issuing the CA and certificate half a CA life ago")
+			triple.Now = func() time.Time { return now.Add(-options.CARotateInterval / 2) }
+			defer func() { triple.Now = time.Now }()
+			var err error
+			ca, err = triple.NewCA("foo-ca", options.CARotateInterval)
+			Expect(err).To(Succeed(), "should succeed creating CA")
+			keyPair, err := triple.NewServerKeyPair(ca, "foo-service", nil, []string{"foo-service"}, options.CertRotateInterval)
+			Expect(err).To(Succeed(), "should succeed issuing certificate")
+
+			caKeyPEM, caCertPEM, err := keyPairToKeyPairPem(ca)
+			Expect(err).To(Succeed(), "should succeed encoding CA")
+			keyPEM, certPEM, err := keyPairToKeyPairPem(keyPair)
+			Expect(err).To(Succeed(), "should succeed encoding certificate")
+			data = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					"foo-service": {
+						Name:      "foo-service",
+						Hostnames: []string{"foo-service"},
+						KeyPEM:    keyPEM,
+						CertPEM:   certPEM,
+						CACertPEM: map[string][]byte{},
+					},
+				},
+				CA: CA{
+					Name:    "foo-ca",
+					KeyPEM:  caKeyPEM,
+					CertPEM: caCertPEM,
+				},
+			}
+		})
+		It("should compute the CA rotation deadline from its real remaining life", func() {
+			caDeadline, _, err := RotationDeadlines(&options, &data)
+			Expect(err).To(Succeed(), "should succeed finding deadlines")
+			Expect(caDeadline).To(Equal(ca.Cert.NotAfter.Add(-options.CAOverlapInterval)), "should use the stored CA expiration")
+			Expect(caDeadline.Sub(now)).To(BeNumerically("<", options.CARotateInterval-options.CAOverlapInterval), "should not assume the CA was just issued")
+		})
+	})
+
+	Context("when renewing CA and certificates with different fractions", func() {
+		var (
+			options Options
+			data    CertificateChainData
+		)
+		BeforeEach(func() {
+			options = Options{
+				CARotateInterval:        time.Hour,
+				CARenewBeforeFraction:   0.5,
+				CertRenewBeforeFraction: 0.1,
+			}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			data = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					"foo-service": {
+						Name:      "foo-service",
+						Hostnames: []string{"foo-service"},
+						CACertPEM: map[string][]byte{},
+					},
+				},
+			}
+			_, err := Update(&options, &data)
+			Expect(err).To(Succeed(), "should succeed issuing certificates")
+		})
+		It("should compute each deadline with its own renew before fraction", func() {
+			caDeadline, certsDeadline, err := RotationDeadlines(&options, &data)
+			Expect(err).To(Succeed(), "should succeed finding deadlines")
+
+			caCerts, err := triple.ParseCertsPEM(data.CA.CertPEM)
+			Expect(err).To(Succeed(), "should succeed parsing CA certificate")
+			ca := caCerts[0]
+			certs, err := triple.ParseCertsPEM(data.CertificatesIssued["foo-service"].CertPEM)
+			Expect(err).To(Succeed(), "should succeed parsing certificate")
+			cert := certs[len(certs)-1]
+
+			relativeDeadline := func(deadline time.Time, cert *x509.Certificate) float64 {
+				return float64(deadline.Sub(cert.NotBefore)) / float64(cert.NotAfter.Sub(cert.NotBefore))
+			}
+			Expect(relativeDeadline(caDeadline, ca)).To(BeNumerically("~", 0.5, 0.01), "should renew the CA at half of its life")
+			Expect(relativeDeadline(certsDeadline, cert)).To(BeNumerically("~", 0.9, 0.01), "should renew the certificate at 90% of its life")
+		})
+	})
+
+	Context("when jittering the rotation deadlines", func() {
+		var (
+			options Options
+			data    CertificateChainData
+		)
+		BeforeEach(func() {
+			options = Options{CARotateInterval: time.Hour}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			data = CertificateChainData{
+				CertificatesIssued: map[string]*CertificateIssue{
+					"foo-service": {
+						Name:      "foo-service",
+						Hostnames: []string{"foo-service"},
+						CACertPEM: map[string][]byte{},
+					},
+				},
+			}
+			_, err := Update(&options, &data)
+			Expect(err).To(Succeed(), "should succeed issuing certificates")
+		})
+		DescribeTable("should bring forward the deadlines by the drawn fraction of the jitter factor",
+			func(jitter, expectedJitter float64) {
+				jitteredOptions := options
+				jitteredOptions.RotationJitter = jitter
+				Expect(jitteredOptions.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+				caDeadline, certsDeadline, err := RotationDeadlines(&jitteredOptions, &data)
+				Expect(err).To(Succeed(), "should succeed finding deadlines")
+
+				caCerts, err := triple.ParseCertsPEM(data.CA.CertPEM)
+				Expect(err).To(Succeed(), "should succeed parsing CA certificate")
+				ca := caCerts[0]
+				certs, err := triple.ParseCertsPEM(data.CertificatesIssued["foo-service"].CertPEM)
+				Expect(err).To(Succeed(), "should succeed parsing certificate")
+				cert := certs[len(certs)-1]
+
+				jitteredDeadline := func(cert *x509.Certificate, overlap time.Duration) time.Time {
+					deadline := nextRotationDeadlineForCert(cert, overlap)
+					return deadline.Add(-time.Duration(expectedJitter * rotationJitterDraw(cert) * float64(deadline.Sub(cert.NotBefore))))
+				}
+				Expect(caDeadline).To(Equal(jitteredDeadline(ca, options.CAOverlapInterval)), "should bring forward the CA deadline")
+				Expect(certsDeadline).To(Equal(jitteredDeadline(cert, options.CertOverlapInterval)), "should bring forward the certificates deadline")
+			},
+			Entry("without jitter", 0.0, 0.0),
+			Entry("with a small jitter", 0.1, 0.1),
+			Entry("with a large jitter", 0.5, 0.5),
+			Entry("with the largest jitter", MaxRotationJitter, MaxRotationJitter),
+			Entry("with a jitter above the largest", 1.5, MaxRotationJitter),
+			Entry("with a negative jitter", -0.5, 0.0),
+		)
+		It("should draw the fraction of the jitter factor from the certificate serial number", func() {
+			serial := func(n int64) *x509.Certificate {
+				return &x509.Certificate{SerialNumber: big.NewInt(n)}
+			}
+			Expect(rotationJitterDraw(serial(0))).To(Equal(0.0), "should not bring forward the deadline of a zero draw")
+			Expect(rotationJitterDraw(serial(rotationJitterDraws/2))).To(Equal(0.5), "should draw half of the jitter")
+			Expect(rotationJitterDraw(serial(3*rotationJitterDraws+rotationJitterDraws/4))).To(Equal(0.25), "should draw from the low bits of the serial number")
+			Expect(rotationJitterDraw(&x509.Certificate{})).To(Equal(0.0), "should not bring forward the deadline without serial number")
+		})
+	})
 })
@@ -1,15 +1,57 @@
 package chain
 
 import (
+	"crypto/x509"
 	"fmt"
+	"math"
 	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
 )
 
 const (
 	OneYearDuration = 365 * 24 * time.Hour
+
+	// DefaultCAMaxRotateInterval is the recommended cap for CARotateInterval
+	DefaultCAMaxRotateInterval = 20 * OneYearDuration
+
+	// MaxRotationJitter is the largest RotationJitter, so that certificates
+	// are never rotated right after being issued
+	MaxRotationJitter = 0.9
+)
+
+var (
+	// optionsLog logs the warnings about the options defaulted
+	optionsLog = logf.Log.WithName("certificate/chain")
 )
 
 func (o *Options) validate() error {
+	if o.CARotateInterval <= 0 {
+		return fmt.Errorf("failed validating certificate options, 'CARotateInterval' has to be > 0")
+	}
+
+	if o.CAOverlapInterval <= 0 {
+		return fmt.Errorf("failed validating certificate options, 'CAOverlapInterval' has to be > 0")
+	}
+
+	if o.CertRotateInterval <= 0 {
+		return fmt.Errorf("failed validating certificate options, 'CertRotateInterval' has to be > 0")
+	}
+
+	if o.CertOverlapInterval <= 0 {
+		return fmt.Errorf("failed validating certificate options, 'CertOverlapInterval' has to be > 0")
+	}
+
+	if o.MaxSANs < 0 {
+		return fmt.Errorf("failed validating certificate options, 'MaxSANs' has to be >= 0")
+	}
+
+	if o.CAMaxRotateInterval <= 0 {
+		return fmt.Errorf("failed validating certificate options, 'CAMaxRotateInterval' has to be > 0")
+	}
+
 	if o.CAOverlapInterval >= o.CARotateInterval {
 		return fmt.Errorf("failed validating certificate options, 'CAOverlapInterval' has to be < 'CARotateInterval'")
 	}
@@ -22,10 +64,94 @@ func (o *Options) validate() error {
 		return fmt.Errorf("failed validating certificate options, 'CertOverlapInterval' has to be < 'CertRotateInterval'")
 	}
 
+	if o.ReconcileInterval < 0 {
+		return fmt.Errorf("failed validating certificate options, 'ReconcileInterval' has to be >= 0")
+	}
+
+	if o.ReconcileInterval >= o.CertRotateInterval {
+		return fmt.Errorf("failed validating certificate options, 'ReconcileInterval' has to be < 'CertRotateInterval'")
+	}
+
+	if o.CAKeySize != 0 {
+		err := triple.ValidateRSAKeySize(o.CAKeySize)
+		if err != nil {
+			return fmt.Errorf("failed validating certificate options, 'CAKeySize' is invalid: %v", err)
+		}
+	}
+
+	if o.CertKeySize != 0 {
+		err := triple.ValidateRSAKeySize(o.CertKeySize)
+		if err != nil {
+			return fmt.Errorf("failed validating certificate options, 'CertKeySize' is invalid: %v", err)
+		}
+	}
+
+	switch o.KeyAlgorithm {
+	case triple.KeyAlgorithmRSA, triple.KeyAlgorithmECDSAP256, triple.KeyAlgorithmECDSAP384, triple.KeyAlgorithmEd25519:
+	default:
+		return fmt.Errorf("failed validating certificate options, 'KeyAlgorithm' has to be '%s', '%s', '%s' or '%s'",
+			triple.KeyAlgorithmRSA, triple.KeyAlgorithmECDSAP256, triple.KeyAlgorithmECDSAP384, triple.KeyAlgorithmEd25519)
+	}
+
+	if (o.CAKeySize != 0 || o.CertKeySize != 0) && o.KeyAlgorithm != triple.KeyAlgorithmRSA {
+		return fmt.Errorf("failed validating certificate options, 'CAKeySize' and 'CertKeySize' only apply to '%s' keys", triple.KeyAlgorithmRSA)
+	}
+
+	err := triple.ValidateSerialNumberBits(o.SerialNumberBits)
+	if err != nil {
+		return fmt.Errorf("failed validating certificate options, 'SerialNumberBits' is invalid: %v", err)
+	}
+
+	if !hasServerAuthUsage(o.CertUsages) {
+		return fmt.Errorf("failed validating certificate options, 'CertUsages' has to include ServerAuth to serve webhooks")
+	}
+
+	if o.NotYetValidPolicy != NotYetValidRegenerate && o.NotYetValidPolicy != NotYetValidWait {
+		return fmt.Errorf("failed validating certificate options, 'NotYetValidPolicy' has to be '%s' or '%s'", NotYetValidRegenerate, NotYetValidWait)
+	}
+
+	if o.ReducedValidityPolicy != ReducedValidityWarn && o.ReducedValidityPolicy != ReducedValidityRefuse {
+		return fmt.Errorf("failed validating certificate options, 'ReducedValidityPolicy' has to be '%s' or '%s'", ReducedValidityWarn, ReducedValidityRefuse)
+	}
+
+	if o.CABundleOrder != CABundleOldestFirst && o.CABundleOrder != CABundleNewestFirst {
+		return fmt.Errorf("failed validating certificate options, 'CABundleOrder' has to be '%s' or '%s'", CABundleOldestFirst, CABundleNewestFirst)
+	}
+
 	return nil
 
 }
 
+// validateRenewBefore checks the renew before fractions as set, before
+// defaulting folds them into the overlap intervals
+func (o *Options) validateRenewBefore() error {
+	if o.CARenewBeforeFraction < 0 || o.CARenewBeforeFraction >= 1 {
+		return fmt.Errorf("failed validating certificate options, 'CARenewBeforeFraction' has to be >= 0 and < 1")
+	}
+
+	if o.CertRenewBeforeFraction < 0 || o.CertRenewBeforeFraction >= 1 {
+		return fmt.Errorf("failed validating certificate options, 'CertRenewBeforeFraction' has to be >= 0 and < 1")
+	}
+
+	if o.CARenewBeforeFraction != 0 && o.CAOverlapInterval != 0 {
+		return fmt.Errorf("failed validating certificate options, 'CARenewBeforeFraction' and 'CAOverlapInterval' are mutually exclusive")
+	}
+
+	if o.CertRenewBeforeFraction != 0 && o.CertOverlapInterval != 0 {
+		return fmt.Errorf("failed validating certificate options, 'CertRenewBeforeFraction' and 'CertOverlapInterval' are mutually exclusive")
+	}
+	return nil
+}
+
+func hasServerAuthUsage(usages []x509.ExtKeyUsage) bool {
+	for _, usage := range usages {
+		if usage == x509.ExtKeyUsageServerAuth {
+			return true
+		}
+	}
+	return false
+}
+
 func (o Options) withDefaults() Options {
 	withDefaultsOptions := o
 
@@ -33,8 +159,26 @@ func (o Options) withDefaults() Options {
 		withDefaultsOptions.CARotateInterval = OneYearDuration
 	}
 
+	if o.CAMaxRotateInterval == 0 {
+		withDefaultsOptions.CAMaxRotateInterval = DefaultCAMaxRotateInterval
+	}
+
+	if withDefaultsOptions.CAMaxRotateInterval > 0 && withDefaultsOptions.CARotateInterval > withDefaultsOptions.CAMaxRotateInterval {
+		optionsLog.Info("WARNING: 'CARotateInterval' exceeds 'CAMaxRotateInterval', clamping it",
+			"CARotateInterval", withDefaultsOptions.CARotateInterval,
+			"CAMaxRotateInterval", withDefaultsOptions.CAMaxRotateInterval)
+		withDefaultsOptions.CARotateInterval = withDefaultsOptions.CAMaxRotateInterval
+	}
+
+	// renew before fractions are folded into the overlap intervals, so
+	// defaulting the options again keeps them
 	if o.CAOverlapInterval == 0 {
-		withDefaultsOptions.CAOverlapInterval = withDefaultsOptions.CARotateInterval / 3
+		if o.CARenewBeforeFraction > 0 {
+			withDefaultsOptions.CAOverlapInterval = time.Duration(o.CARenewBeforeFraction * float64(withDefaultsOptions.CARotateInterval))
+			withDefaultsOptions.CARenewBeforeFraction = 0
+		} else {
+			withDefaultsOptions.CAOverlapInterval = withDefaultsOptions.CARotateInterval / 3
+		}
 	}
 
 	if o.CertRotateInterval == 0 {
@@ -42,14 +186,67 @@ func (o Options) withDefaults() Options {
 	}
 
 	if o.CertOverlapInterval == 0 {
-		withDefaultsOptions.CertOverlapInterval = withDefaultsOptions.CertRotateInterval / 3
+		if o.CertRenewBeforeFraction > 0 {
+			withDefaultsOptions.CertOverlapInterval = time.Duration(o.CertRenewBeforeFraction * float64(withDefaultsOptions.CertRotateInterval))
+			withDefaultsOptions.CertRenewBeforeFraction = 0
+		} else {
+			withDefaultsOptions.CertOverlapInterval = withDefaultsOptions.CertRotateInterval / 3
+		}
+	}
+
+	if math.IsNaN(o.RotationJitter) || o.RotationJitter < 0 || o.RotationJitter > MaxRotationJitter {
+		clampedRotationJitter := 0.0
+		if o.RotationJitter > MaxRotationJitter {
+			clampedRotationJitter = MaxRotationJitter
+		}
+		optionsLog.Info("WARNING: 'RotationJitter' out of range, clamping it",
+			"RotationJitter", o.RotationJitter,
+			"clampedRotationJitter", clampedRotationJitter)
+		withDefaultsOptions.RotationJitter = clampedRotationJitter
+	}
+
+	if o.KeyAlgorithm == "" {
+		withDefaultsOptions.KeyAlgorithm = triple.KeyAlgorithmRSA
+	}
+	// key sizes only apply to RSA keys
+	if withDefaultsOptions.KeyAlgorithm == triple.KeyAlgorithmRSA {
+		if o.CAKeySize == 0 {
+			withDefaultsOptions.CAKeySize = triple.DefaultRSAKeySize
+		}
+		if o.CertKeySize == 0 {
+			withDefaultsOptions.CertKeySize = triple.DefaultRSAKeySize
+		}
+	}
+
+	if o.SerialNumberBits == 0 {
+		withDefaultsOptions.SerialNumberBits = triple.DefaultSerialNumberBits
+	}
+
+	if len(o.CertUsages) == 0 {
+		withDefaultsOptions.CertUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	if o.CABundleOrder == "" {
+		withDefaultsOptions.CABundleOrder = CABundleOldestFirst
+	}
+
+	if o.NotYetValidPolicy == "" {
+		withDefaultsOptions.NotYetValidPolicy = NotYetValidRegenerate
+	}
+
+	if o.ReducedValidityPolicy == "" {
+		withDefaultsOptions.ReducedValidityPolicy = ReducedValidityWarn
 	}
 	return withDefaultsOptions
 }
 
 func (o *Options) SetDefaultsAndValidate() error {
+	err := o.validateRenewBefore()
+	if err != nil {
+		return err
+	}
 	withDefaultsOptions := o.withDefaults()
-	err := withDefaultsOptions.validate()
+	err = withDefaultsOptions.validate()
 	if err != nil {
 		return err
 	}
@@ -1,11 +1,16 @@
 package chain
 
 import (
+	"crypto/x509"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
+
+	"github.com/go-logr/logr"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
 )
 
 var _ = Describe("Certificate Options", func() {
@@ -22,7 +27,11 @@ var _ = Describe("Certificate Options", func() {
 			} else {
 				Expect(err).ToNot(Succeed(), "should not succeed validating the options")
 			}
-			Expect(c.options).To(Equal(c.expectedOptions), "should equal expected options after setting defaults")
+			expectedOptions := c.expectedOptions
+			if c.isValid {
+				expectedOptions = withDefaultKeysAndPolicies(expectedOptions)
+			}
+			Expect(c.options).To(Equal(expectedOptions), "should equal expected options after setting defaults")
 		},
 		Entry("Empty options should be valid", setDefaultsAndValidateCase{
 			expectedOptions: Options{
@@ -107,6 +116,322 @@ var _ = Describe("Certificate Options", func() {
 			isValid: false,
 		}),
 
+		Entry("CARotateInterval has to be clamped to CAMaxRotateInterval", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval:    100 * OneYearDuration,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    20 * OneYearDuration,
+				CAOverlapInterval:   20 * OneYearDuration / 3,
+				CertRotateInterval:  20 * OneYearDuration,
+				CertOverlapInterval: 20 * OneYearDuration / 3,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			},
+			isValid: true,
+		}),
+		Entry("CARotateInterval has to be clamped to the default CAMaxRotateInterval", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval: 100 * OneYearDuration,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    20 * OneYearDuration,
+				CAOverlapInterval:   20 * OneYearDuration / 3,
+				CertRotateInterval:  20 * OneYearDuration,
+				CertOverlapInterval: 20 * OneYearDuration / 3,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			},
+			isValid: true,
+		}),
+		Entry("CARotateInterval has to be clamped to a CAMaxRotateInterval over the default", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval:    100 * OneYearDuration,
+				CAMaxRotateInterval: 50 * OneYearDuration,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    50 * OneYearDuration,
+				CAOverlapInterval:   50 * OneYearDuration / 3,
+				CertRotateInterval:  50 * OneYearDuration,
+				CertOverlapInterval: 50 * OneYearDuration / 3,
+				CAMaxRotateInterval: 50 * OneYearDuration,
+			},
+			isValid: true,
+		}),
+		Entry("CARotateInterval under CAMaxRotateInterval should not be clamped", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval:    2 * OneYearDuration,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    2 * OneYearDuration,
+				CAOverlapInterval:   2 * OneYearDuration / 3,
+				CertRotateInterval:  2 * OneYearDuration,
+				CertOverlapInterval: 2 * OneYearDuration / 3,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			},
+			isValid: true,
+		}),
+		Entry("RotationJitter in range should not be clamped", setDefaultsAndValidateCase{
+			options: Options{
+				RotationJitter: 0.5,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    OneYearDuration,
+				CAOverlapInterval:   OneYearDuration / 3,
+				CertRotateInterval:  OneYearDuration,
+				CertOverlapInterval: OneYearDuration / 3,
+				RotationJitter:      0.5,
+			},
+			isValid: true,
+		}),
+		Entry("RotationJitter has to be clamped to MaxRotationJitter", setDefaultsAndValidateCase{
+			options: Options{
+				RotationJitter: 1.5,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    OneYearDuration,
+				CAOverlapInterval:   OneYearDuration / 3,
+				CertRotateInterval:  OneYearDuration,
+				CertOverlapInterval: OneYearDuration / 3,
+				RotationJitter:      MaxRotationJitter,
+			},
+			isValid: true,
+		}),
+		Entry("Negative RotationJitter has to be clamped to 0", setDefaultsAndValidateCase{
+			options: Options{
+				RotationJitter: -0.5,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    OneYearDuration,
+				CAOverlapInterval:   OneYearDuration / 3,
+				CertRotateInterval:  OneYearDuration,
+				CertOverlapInterval: OneYearDuration / 3,
+				RotationJitter:      0,
+			},
+			isValid: true,
+		}),
+		Entry("Negative CARotateInterval should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval: -time.Hour,
+			},
+			expectedOptions: Options{
+				CARotateInterval: -time.Hour,
+			},
+			isValid: false,
+		}),
+		Entry("Negative CAOverlapInterval should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CAOverlapInterval: -time.Minute,
+			},
+			expectedOptions: Options{
+				CAOverlapInterval: -time.Minute,
+			},
+			isValid: false,
+		}),
+		Entry("Negative CertRotateInterval should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CertRotateInterval: -30 * time.Minute,
+			},
+			expectedOptions: Options{
+				CertRotateInterval: -30 * time.Minute,
+			},
+			isValid: false,
+		}),
+		Entry("Negative CertOverlapInterval should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CertOverlapInterval: -time.Minute,
+			},
+			expectedOptions: Options{
+				CertOverlapInterval: -time.Minute,
+			},
+			isValid: false,
+		}),
+		Entry("Negative CAMaxRotateInterval should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CAMaxRotateInterval: -time.Hour,
+			},
+			expectedOptions: Options{
+				CAMaxRotateInterval: -time.Hour,
+			},
+			isValid: false,
+		}),
+		Entry("NotYetValidPolicy has to be a known policy", setDefaultsAndValidateCase{
+			options: Options{
+				NotYetValidPolicy: "Ignore",
+			},
+			expectedOptions: Options{
+				NotYetValidPolicy: "Ignore",
+			},
+			isValid: false,
+		}),
+		Entry("ReducedValidityPolicy has to be a known policy", setDefaultsAndValidateCase{
+			options: Options{
+				ReducedValidityPolicy: "Ignore",
+			},
+			expectedOptions: Options{
+				ReducedValidityPolicy: "Ignore",
+			},
+			isValid: false,
+		}),
+		Entry("CABundleOrder has to be a known order", setDefaultsAndValidateCase{
+			options: Options{
+				CABundleOrder: "Random",
+			},
+			expectedOptions: Options{
+				CABundleOrder: "Random",
+			},
+			isValid: false,
+		}),
+		Entry("Renew before fractions have to set CA and certificate overlaps independently", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval:        1 * time.Hour,
+				CertRotateInterval:      30 * time.Minute,
+				CARenewBeforeFraction:   0.5,
+				CertRenewBeforeFraction: 0.1,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    1 * time.Hour,
+				CAOverlapInterval:   30 * time.Minute,
+				CertRotateInterval:  30 * time.Minute,
+				CertOverlapInterval: 3 * time.Minute,
+			},
+			isValid: true,
+		}),
+		Entry("CARenewBeforeFraction and CAOverlapInterval should be mutually exclusive even if they match", setDefaultsAndValidateCase{
+			options: Options{
+				CARotateInterval:      1 * time.Hour,
+				CAOverlapInterval:     30 * time.Minute,
+				CARenewBeforeFraction: 0.5,
+			},
+			expectedOptions: Options{
+				CARotateInterval:      1 * time.Hour,
+				CAOverlapInterval:     30 * time.Minute,
+				CARenewBeforeFraction: 0.5,
+			},
+			isValid: false,
+		}),
+		Entry("CARenewBeforeFraction >= 1 should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CARenewBeforeFraction: 1,
+			},
+			expectedOptions: Options{
+				CARenewBeforeFraction: 1,
+			},
+			isValid: false,
+		}),
+		Entry("CertRenewBeforeFraction and CertOverlapInterval should be mutually exclusive", setDefaultsAndValidateCase{
+			options: Options{
+				CertOverlapInterval:     time.Hour,
+				CertRenewBeforeFraction: 0.5,
+			},
+			expectedOptions: Options{
+				CertOverlapInterval:     time.Hour,
+				CertRenewBeforeFraction: 0.5,
+			},
+			isValid: false,
+		}),
+		Entry("CertUsages without ServerAuth should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CertUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			},
+			expectedOptions: Options{
+				CertUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			},
+			isValid: false,
+		}),
+		Entry("CertUsages including ServerAuth should be valid", setDefaultsAndValidateCase{
+			options: Options{
+				CertUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			},
+			expectedOptions: Options{
+				CARotateInterval:    OneYearDuration,
+				CAOverlapInterval:   OneYearDuration / 3,
+				CertRotateInterval:  OneYearDuration,
+				CertOverlapInterval: OneYearDuration / 3,
+				CertUsages:          []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			},
+			isValid: true,
+		}),
+		Entry("ReconcileInterval not shorter than CertRotateInterval should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CertRotateInterval: 1 * time.Hour,
+				ReconcileInterval:  1 * time.Hour,
+			},
+			expectedOptions: Options{
+				CertRotateInterval: 1 * time.Hour,
+				ReconcileInterval:  1 * time.Hour,
+			},
+			isValid: false,
+		}),
+		Entry("ReconcileInterval shorter than CertRotateInterval should be valid", setDefaultsAndValidateCase{
+			options: Options{
+				ReconcileInterval: 24 * time.Hour,
+			},
+			expectedOptions: Options{
+				CARotateInterval:    OneYearDuration,
+				CAOverlapInterval:   OneYearDuration / 3,
+				CertRotateInterval:  OneYearDuration,
+				CertOverlapInterval: OneYearDuration / 3,
+				ReconcileInterval:   24 * time.Hour,
+			},
+			isValid: true,
+		}),
+		Entry("CAKeySize below the minimum should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CAKeySize: 1024,
+			},
+			expectedOptions: Options{
+				CAKeySize: 1024,
+			},
+			isValid: false,
+		}),
+		Entry("CertKeySize not a multiple of 8 should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				CertKeySize: 2049,
+			},
+			expectedOptions: Options{
+				CertKeySize: 2049,
+			},
+			isValid: false,
+		}),
+		Entry("Unknown KeyAlgorithm should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				KeyAlgorithm: "DSA",
+			},
+			expectedOptions: Options{
+				KeyAlgorithm: "DSA",
+			},
+			isValid: false,
+		}),
+		Entry("CAKeySize with a KeyAlgorithm other than RSA should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				KeyAlgorithm: triple.KeyAlgorithmECDSAP256,
+				CAKeySize:    3072,
+			},
+			expectedOptions: Options{
+				KeyAlgorithm: triple.KeyAlgorithmECDSAP256,
+				CAKeySize:    3072,
+			},
+			isValid: false,
+		}),
+		Entry("SerialNumberBits above the maximum should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				SerialNumberBits: 160,
+			},
+			expectedOptions: Options{
+				SerialNumberBits: 160,
+			},
+			isValid: false,
+		}),
+		Entry("SerialNumberBits below the minimum should be invalid", setDefaultsAndValidateCase{
+			options: Options{
+				SerialNumberBits: 62,
+			},
+			expectedOptions: Options{
+				SerialNumberBits: 62,
+			},
+			isValid: false,
+		}),
 		Entry("Passing all options override defaults", setDefaultsAndValidateCase{
 			options: Options{
 				CARotateInterval:    1 * time.Hour,
@@ -123,4 +448,127 @@ var _ = Describe("Certificate Options", func() {
 			isValid: true,
 		}),
 	)
+
+	It("should default the keys, serial numbers, usages and policies", func() {
+		options := Options{}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should succeed validating the options")
+		Expect(options).To(Equal(Options{
+			CARotateInterval:      OneYearDuration,
+			CAOverlapInterval:     OneYearDuration / 3,
+			CertRotateInterval:    OneYearDuration,
+			CertOverlapInterval:   OneYearDuration / 3,
+			KeyAlgorithm:          triple.KeyAlgorithmRSA,
+			CAKeySize:             triple.DefaultRSAKeySize,
+			CertKeySize:           triple.DefaultRSAKeySize,
+			SerialNumberBits:      triple.DefaultSerialNumberBits,
+			CertUsages:            []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			CAMaxRotateInterval:   DefaultCAMaxRotateInterval,
+			CABundleOrder:         CABundleOldestFirst,
+			NotYetValidPolicy:     NotYetValidRegenerate,
+			ReducedValidityPolicy: ReducedValidityWarn,
+		}), "should default them")
+
+		By("Defaulting them again")
+		defaulted := options
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should succeed validating the options")
+		Expect(options).To(Equal(defaulted), "should keep them")
+	})
+
+	It("should not default the key sizes of other than RSA keys", func() {
+		options := Options{KeyAlgorithm: triple.KeyAlgorithmECDSAP256}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should succeed validating the options")
+		Expect(options.CAKeySize).To(BeZero(), "should not default the CA key size")
+		Expect(options.CertKeySize).To(BeZero(), "should not default the service key size")
+	})
+
+	Context("when CARotateInterval exceeds CAMaxRotateInterval", func() {
+		var (
+			log         *recordingLogger
+			previousLog logr.Logger
+		)
+		BeforeEach(func() {
+			log = &recordingLogger{}
+			previousLog, optionsLog = optionsLog, log
+		})
+		AfterEach(func() {
+			optionsLog = previousLog
+		})
+		It("should warn about clamping it", func() {
+			options := Options{
+				CARotateInterval:    100 * OneYearDuration,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should succeed validating the options")
+			Expect(options.CARotateInterval).To(Equal(DefaultCAMaxRotateInterval), "should clamp CARotateInterval")
+			Expect(log.messages).To(ConsistOf(ContainSubstring("'CARotateInterval' exceeds 'CAMaxRotateInterval', clamping it")), "should warn once about the clamping")
+
+			By("Defaulting the clamped options again")
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should succeed validating the options")
+			Expect(log.messages).To(HaveLen(1), "should not warn again")
+		})
+		It("should not warn if it does not exceed it", func() {
+			options := Options{
+				CARotateInterval:    2 * OneYearDuration,
+				CAMaxRotateInterval: DefaultCAMaxRotateInterval,
+			}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should succeed validating the options")
+			Expect(log.messages).To(BeEmpty(), "should not warn")
+		})
+	})
 })
+
+// withDefaultKeysAndPolicies returns options with the key, serial number,
+// usage and policy defaults applied to the ones not set
+func withDefaultKeysAndPolicies(options Options) Options {
+	if options.KeyAlgorithm == "" {
+		options.KeyAlgorithm = triple.KeyAlgorithmRSA
+	}
+	if options.KeyAlgorithm == triple.KeyAlgorithmRSA {
+		if options.CAKeySize == 0 {
+			options.CAKeySize = triple.DefaultRSAKeySize
+		}
+		if options.CertKeySize == 0 {
+			options.CertKeySize = triple.DefaultRSAKeySize
+		}
+	}
+	if options.SerialNumberBits == 0 {
+		options.SerialNumberBits = triple.DefaultSerialNumberBits
+	}
+	if len(options.CertUsages) == 0 {
+		options.CertUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if options.CABundleOrder == "" {
+		options.CABundleOrder = CABundleOldestFirst
+	}
+	if options.CAMaxRotateInterval == 0 {
+		options.CAMaxRotateInterval = DefaultCAMaxRotateInterval
+	}
+	if options.NotYetValidPolicy == "" {
+		options.NotYetValidPolicy = NotYetValidRegenerate
+	}
+	if options.ReducedValidityPolicy == "" {
+		options.ReducedValidityPolicy = ReducedValidityWarn
+	}
+	return options
+}
+
+// recordingLogger records the messages logged through it
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Enabled() bool { return true }
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) V(level int) logr.Logger { return l }
+
+func (l *recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger { return l }
+
+func (l *recordingLogger) WithName(name string) logr.Logger { return l }
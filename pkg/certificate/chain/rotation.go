@@ -1,6 +1,13 @@
 package chain
 
 import (
+	"crypto"
+	"crypto/x509"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
 	"github.com/pkg/errors"
 
 	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
@@ -10,12 +17,29 @@ func (r *certificateChain) rotateAll() error {
 	r.log.WithName("rotateAll").Info("Rotating CA key pair")
 
 	duration := r.getCARotateInterval()
-	caKeyPair, err := triple.NewCA(r.data.CA.Name, duration)
+	var caKey crypto.Signer
+	if r.ReuseCAKey && r.data.CA.keyPair != nil && r.data.CA.keyPair.Key != nil {
+		r.log.WithName("rotateAll").Info("Re-signing CA certificate with the current CA key")
+		caKey = r.data.CA.keyPair.Key
+	} else {
+		var err error
+		caKey, err = r.newKey(r.getCAKeySize())
+		if err != nil {
+			return errors.Wrap(err, "Failed generating CA key")
+		}
+	}
+	caKeyPair, err := triple.NewCAWithConfig(triple.Config{
+		CommonName:       r.data.CA.Name,
+		SerialNumberBits: r.SerialNumberBits,
+	}, caKey, duration)
 	if err != nil {
 		return errors.Wrap(err, "Failed generating CA key pair")
 	}
 
-	r.setCaKeyPair(caKeyPair)
+	err = r.setCaKeyPair(caKeyPair)
+	if err != nil {
+		return errors.Wrap(err, "Failed setting CA key pair")
+	}
 
 	// We have rotate the CA we need to reset the TLS removing previous certs
 	err = r.rotateCertsWithoutOverlap()
@@ -26,28 +50,156 @@ func (r *certificateChain) rotateAll() error {
 	return nil
 }
 
-func (c *certificateChain) rotateCerts(applyFn func(*certificateChain, *CertificateIssue, *triple.KeyPair)) error {
+func (c *certificateChain) rotateCerts(applyFn func(*certificateChain, *CertificateIssue, *triple.KeyPair) error) error {
 	logger := c.log.WithName("rotateCerts")
 
 	for _, certificateIssued := range c.data.CertificatesIssued {
 		logger.Info("Rotating key pair for certificate", "name", certificateIssued.Name)
 		duration := c.getCertRotateInterval()
-		keyPair, err := triple.NewServerKeyPair(
+		ips, hostnames, err := c.limitSANs(certificateIssued)
+		if err != nil {
+			return err
+		}
+		key, err := c.newKey(c.getCertKeySize())
+		if err != nil {
+			return errors.Wrapf(err, "Failed creating key for certificate %s", certificateIssued.Name)
+		}
+		keyPair, err := triple.NewServerKeyPairWithConfig(
 			c.data.CA.keyPair,
-			certificateIssued.Name,
-			certificateIssued.IPs,
-			certificateIssued.Hostnames,
+			key,
+			triple.Config{
+				CommonName:       certificateIssued.Name,
+				Usages:           c.getCertUsages(),
+				SerialNumberBits: c.SerialNumberBits,
+			},
+			ips,
+			hostnames,
 			duration,
 		)
 		if err != nil {
 			return errors.Wrapf(err, "Failed creating key pair for certificate %s", certificateIssued.Name)
 		}
-		applyFn(c, certificateIssued, keyPair)
+		err = c.checkReducedValidity(certificateIssued, keyPair.Cert)
+		if err != nil {
+			return err
+		}
+		err = applyFn(c, certificateIssued, keyPair)
+		if err != nil {
+			return errors.Wrapf(err, "Failed setting key pair for certificate %s", certificateIssued.Name)
+		}
 	}
 
 	return nil
 }
 
+// checkReducedValidity guards against rotating the certificate currently
+// served with one expiring before it, either failing or warning as
+// configured. Certificates expiring after their CA are compared by the CA
+// expiration since it bounds their validity, and the ones not signed by the
+// current CA are not checked since they are rotated with a new CA.
+func (c *certificateChain) checkReducedValidity(certificateIssued *CertificateIssue, cert *x509.Certificate) error {
+	served := getLastCert(certificateIssued.certs)
+	if served == nil || c.data.CA.keyPair == nil || served.CheckSignatureFrom(c.data.CA.keyPair.Cert) != nil {
+		return nil
+	}
+	servedNotAfter := served.NotAfter
+	if c.data.CA.keyPair.Cert.NotAfter.Before(servedNotAfter) {
+		servedNotAfter = c.data.CA.keyPair.Cert.NotAfter
+	}
+	if !cert.NotAfter.Before(servedNotAfter) {
+		return nil
+	}
+	if c.ReducedValidityPolicy == ReducedValidityRefuse {
+		return errors.Errorf("Certificate %s would expire at %s, before the one currently served at %s",
+			certificateIssued.Name, cert.NotAfter.UTC().Format(time.RFC3339), servedNotAfter.UTC().Format(time.RFC3339))
+	}
+	c.log.WithName("checkReducedValidity").Info("WARNING: rotated certificate expires before the one currently served",
+		"name", certificateIssued.Name, "notAfter", cert.NotAfter, "servedNotAfter", servedNotAfter)
+	return nil
+}
+
+// limitSANs guards against issuing certificates with more than MaxSANs SANs,
+// either failing or truncating them as configured.
+func (c *certificateChain) limitSANs(certificateIssued *CertificateIssue) ([]string, []string, error) {
+	ips, hostnames := certificateIssued.IPs, certificateIssued.Hostnames
+	sans := len(ips) + len(hostnames)
+	if c.MaxSANs == 0 || sans <= c.MaxSANs {
+		return ips, hostnames, nil
+	}
+	if !c.TruncateSANs {
+		return nil, nil, errors.Errorf("Certificate %s has %d SANs, exceeding the maximum of %d", certificateIssued.Name, sans, c.MaxSANs)
+	}
+
+	c.log.WithName("limitSANs").Info("WARNING: truncating certificate SANs to the maximum",
+		"name", certificateIssued.Name, "SANs", sans, "MaxSANs", c.MaxSANs)
+	ips, hostnames = truncateSANs(ips, hostnames, c.MaxSANs)
+	return ips, hostnames, nil
+}
+
+// truncateSANs keeps the first max SANs, DNS names first
+func truncateSANs(ips, hostnames []string, max int) ([]string, []string) {
+	if max == 0 || len(ips)+len(hostnames) <= max {
+		return ips, hostnames
+	}
+	if len(hostnames) >= max {
+		return nil, hostnames[:max]
+	}
+	return ips[:max-len(hostnames)], hostnames
+}
+
+// sansChanged returns the name of the first certificate issue, if any, whose
+// last issued certificate IPs and hostnames are not the ones it would be
+// issued with now
+func (c *certificateChain) sansChanged() (string, bool) {
+	names := make([]string, 0, len(c.data.CertificatesIssued))
+	for name := range c.data.CertificatesIssued {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		certificateIssued := c.data.CertificatesIssued[name]
+		cert := getLastCert(certificateIssued.certs)
+		if cert == nil {
+			continue
+		}
+		ips, hostnames := certificateIssued.IPs, certificateIssued.Hostnames
+		if c.MaxSANs > 0 && len(ips)+len(hostnames) > c.MaxSANs {
+			if !c.TruncateSANs {
+				// rotating would fail, keep the certificate
+				continue
+			}
+			ips, hostnames = truncateSANs(ips, hostnames, c.MaxSANs)
+		}
+		expectedIPs := []string{}
+		for _, ip := range ips {
+			if parsedIP := net.ParseIP(ip); parsedIP != nil {
+				expectedIPs = append(expectedIPs, parsedIP.String())
+			}
+		}
+		certIPs := []string{}
+		for _, ip := range cert.IPAddresses {
+			certIPs = append(certIPs, ip.String())
+		}
+		if !sameStrings(expectedIPs, certIPs) || !sameStrings(hostnames, cert.DNSNames) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// sameStrings returns whether a and b hold the same strings regardless of
+// their order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+	return reflect.DeepEqual(sortedA, sortedB)
+}
+
 func (r *certificateChain) rotateCertsWithoutOverlap() error {
 	r.log.WithName("rotateCertsWithoutOverlap").Info("Rotating certificates without overlap")
 	return r.rotateCerts((*certificateChain).setKeyResetCert)
@@ -4,19 +4,25 @@ import (
 	"context"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
 )
 
 // get wraps controller-runtime client `Get` to ensure that client cache
 // is ready, sometimes after controller-runtime manager is ready the
 // cache is still not ready, specially if you webhook or plain runnable
 // is being used since it miss some controller bits.
-func (m *Manager) get(key types.NamespacedName, value client.Object) error {
-	return wait.PollImmediate(5*time.Second, 30*time.Second, func() (bool, error) {
-		err := m.client.Get(context.TODO(), key, value)
+func (m *Manager) get(ctx context.Context, key types.NamespacedName, value client.Object) error {
+	if m.getCachedSecret(key, value) {
+		return nil
+	}
+	err := wait.PollImmediate(5*time.Second, 30*time.Second, func() (bool, error) {
+		err := m.client.Get(ctx, key, value)
 		if err != nil {
 			if _, cacheNotStarted := err.(*cache.ErrCacheNotStarted); cacheNotStarted {
 				m.log.Error(err, "Retrying...")
@@ -26,4 +32,86 @@ func (m *Manager) get(key types.NamespacedName, value client.Object) error {
 		}
 		return true, nil
 	})
+	if err != nil {
+		return err
+	}
+	m.cacheSecret(value)
+	return nil
+}
+
+// getCachedSecret fills value with the cached secret by key, if the secret
+// cache is enabled and has it, and returns whether it did.
+func (m *Manager) getCachedSecret(key types.NamespacedName, value client.Object) bool {
+	secret, ok := value.(*corev1.Secret)
+	if !ok || m.secretCache == nil {
+		return false
+	}
+	m.secretCacheLock.Lock()
+	defer m.secretCacheLock.Unlock()
+	cached, found := m.secretCache[key]
+	if !found {
+		return false
+	}
+	cached.DeepCopyInto(secret)
+	return true
+}
+
+// cacheSecret keeps a copy of value, as of its resource version, if it is a
+// secret and the secret cache is enabled.
+func (m *Manager) cacheSecret(value client.Object) {
+	secret, ok := value.(*corev1.Secret)
+	if !ok || m.secretCache == nil {
+		return
+	}
+	m.secretCacheLock.Lock()
+	defer m.secretCacheLock.Unlock()
+	m.secretCache[types.NamespacedName{Namespace: secret.Namespace, Name: secret.Name}] = secret.DeepCopy()
+}
+
+// forgetSecret removes the secret by key from the secret cache, if enabled,
+// so it is read again.
+func (m *Manager) forgetSecret(key types.NamespacedName) {
+	if m.secretCache == nil {
+		return
+	}
+	m.secretCacheLock.Lock()
+	defer m.secretCacheLock.Unlock()
+	delete(m.secretCache, key)
+}
+
+// forgetSecrets empties the secret cache, if enabled, so that all secrets are
+// read again.
+func (m *Manager) forgetSecrets() {
+	if m.secretCache == nil {
+		return
+	}
+	m.secretCacheLock.Lock()
+	defer m.secretCacheLock.Unlock()
+	m.secretCache = map[types.NamespacedName]*corev1.Secret{}
+}
+
+// expireSecrets schedules the secret cache, if enabled, to be emptied after
+// requeueAfter, when the scheduled reconcile is due, so that it reads all the
+// secrets again in case an event for them was missed.
+func (m *Manager) expireSecrets(requeueAfter time.Duration) {
+	if m.secretCache == nil {
+		return
+	}
+	m.secretCacheLock.Lock()
+	defer m.secretCacheLock.Unlock()
+	m.secretCacheExpiry = triple.Now().Add(requeueAfter)
+}
+
+// forgetExpiredSecrets empties the secret cache, if enabled, if the scheduled
+// reconcile is due.
+func (m *Manager) forgetExpiredSecrets() {
+	if m.secretCache == nil {
+		return
+	}
+	m.secretCacheLock.Lock()
+	defer m.secretCacheLock.Unlock()
+	if !m.secretCacheExpiry.IsZero() && !triple.Now().Before(m.secretCacheExpiry) {
+		m.secretCache = map[types.NamespacedName]*corev1.Secret{}
+		m.secretCacheExpiry = time.Time{}
+	}
 }
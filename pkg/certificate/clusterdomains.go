@@ -0,0 +1,56 @@
+package certificate
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+// clusterdomains.go issues the service certificates for the service fully
+// qualified domain names at every configured cluster domain instead of at
+// cluster.local only, so that a single certificate serves a service exposed
+// under several cluster domains, as in multi-cluster service meshes.
+
+// validateClusterDomains checks that the cluster domains are DNS subdomains
+func validateClusterDomains(domains []string) error {
+	if domains != nil && len(domains) == 0 {
+		return errors.New("cluster domains cannot be empty")
+	}
+	for _, domain := range domains {
+		if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+			return errors.Errorf("cluster domain %q is invalid: %s", domain, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// applyClusterDomains replaces the service fully qualified domain names of
+// the certificate issues of the services backing the webhooks of the object
+// map with the ones at every configured cluster domain, if any.
+func (m *Manager) applyClusterDomains(objects objectMap, certificateChain *chain.CertificateChainData) {
+	if m.clusterDomains == nil {
+		return
+	}
+	for name := range serviceCertificateIssueNames(objects) {
+		certificateIssue := certificateChain.CertificatesIssued[name]
+		if certificateIssue == nil {
+			continue
+		}
+		// service hostnames are name.namespace.svc, the certificate issue
+		// name, and their fully qualified domain names start with it
+		hostnames := []string{}
+		for _, hostname := range certificateIssue.Hostnames {
+			if !strings.HasPrefix(hostname, name+".") {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		for _, domain := range m.clusterDomains {
+			hostnames = append(hostnames, name+"."+domain)
+		}
+		certificateIssue.Hostnames = hostnames
+	}
+}
@@ -0,0 +1,80 @@
+package certificate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Cluster domains", func() {
+	webhooks := []WebhookReference{{Type: MutatingWebhook, Name: "foo"}}
+
+	DescribeTable("when validating the cluster domains",
+		func(domains []string, expectedErr string) {
+			_, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithClusterDomains(domains...))
+			if expectedErr == "" {
+				Expect(err).To(Succeed(), "should succeed validating the cluster domains")
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)), "should fail validating the cluster domains")
+			}
+		},
+		Entry("with two domains should succeed", []string{"cluster.local", "cluster-b.local"}, ""),
+		Entry("with dots around should succeed", []string{".cluster.local."}, ""),
+		Entry("with no domains should fail", []string{}, "cluster domains cannot be empty"),
+		Entry("with an invalid domain should fail", []string{"cluster_b.local"}, `cluster domain "cluster_b.local" is invalid`),
+	)
+
+	It("should issue the service certificate for every cluster domain", func() {
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		object := &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		objects := objectMap{object.key: object}
+		certificateChain := chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objects, &certificateChain)
+
+		mgr, err := NewManager(webhook.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithClusterDomains("cluster.local", "cluster-b.local"))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		mgr.applyClusterDomains(objects, &certificateChain)
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+
+		hostname := serviceHostname(expectedService.Name, expectedService.Namespace)
+		certs, err := triple.ParseCertsPEM(certificateChain.CertificatesIssued[hostname].CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the service certificate")
+		Expect(certs[0].DNSNames).To(ConsistOf(
+			expectedService.Name,
+			namespacedHostname(expectedService.Name, expectedService.Namespace),
+			hostname,
+			hostname+".cluster.local",
+			hostname+".cluster-b.local",
+		), "should issue the certificate for the service at every cluster domain")
+	})
+
+	It("should issue the service certificate for the configured cluster domains only", func() {
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		object := &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		objects := objectMap{object.key: object}
+		certificateChain := chain.CertificateChainData{}
+		mapWebhookToChain(object, objects, &certificateChain)
+
+		mgr, err := NewManager(webhook.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithClusterDomains("cluster-b.local"))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		mgr.applyClusterDomains(objects, &certificateChain)
+
+		hostname := serviceHostname(expectedService.Name, expectedService.Namespace)
+		Expect(certificateChain.CertificatesIssued[hostname].Hostnames).To(ContainElement(hostname+".cluster-b.local"), "should add the configured cluster domain")
+		Expect(certificateChain.CertificatesIssued[hostname].Hostnames).ToNot(ContainElement(hostname+".cluster.local"), "should not keep the default cluster domain")
+	})
+})
@@ -0,0 +1,248 @@
+package certificate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// CAConfigMapLayout is the way the CA bundle is stored at the CA ConfigMap
+type CAConfigMapLayout string
+
+const (
+	// CAConfigMapConcatenated stores the whole CA bundle under CACertKey
+	CAConfigMapConcatenated CAConfigMapLayout = "Concatenated"
+
+	// CAConfigMapSplit stores every CA certificate of the CA bundle under
+	// its own indexed key: ca-0.crt, ca-1.crt...
+	CAConfigMapSplit CAConfigMapLayout = "Split"
+)
+
+// mirrorCABundle writes the CA bundle of a certificate chain to the CA
+// ConfigMap at every target namespace, if configured, so that clients other
+// than the API server can trust the webhook services, and deletes it from the
+// namespaces no longer targeted. A failure at a namespace does not prevent
+// mirroring it at the others.
+func (m *Manager) mirrorCABundle(ctx context.Context, certificateChain *chain.CertificateChainData) error {
+	if m.caConfigMapName == "" {
+		return nil
+	}
+
+	data, err := caConfigMapData(chainCABundle(certificateChain), m.caConfigMapLayout)
+	if err != nil {
+		return err
+	}
+
+	namespaces, err := m.caConfigMapTargetNamespaces(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed listing CA ConfigMap namespaces")
+	}
+	staleNamespaces, err := m.staleCAConfigMapNamespaces(ctx, namespaces)
+	if err != nil {
+		return errors.Wrap(err, "failed listing stale CA ConfigMap namespaces")
+	}
+
+	errs := []error{}
+	mirrored := sets.NewString(namespaces...)
+	for _, namespace := range namespaces {
+		err = m.mirrorCABundleAt(ctx, namespace, data)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed mirroring CA bundle at namespace %s", namespace))
+		}
+	}
+	for _, namespace := range staleNamespaces {
+		err = m.cleanupCABundleMirrorAt(ctx, namespace)
+		if err != nil {
+			// keep it so that it is deleted on the next reconcile
+			mirrored.Insert(namespace)
+			errs = append(errs, errors.Wrapf(err, "failed cleaning up CA bundle mirror at namespace %s", namespace))
+		}
+	}
+	m.caConfigMapMirrored = mirrored
+	return utilerrors.NewAggregate(errs)
+}
+
+// staleCAConfigMapNamespaces returns the namespaces the CA ConfigMap was
+// written to that are no longer targeted. Until it is written once, with a
+// namespace selector every namespace not targeted is checked, since they may
+// have stopped matching it while the manager was not running.
+func (m *Manager) staleCAConfigMapNamespaces(ctx context.Context, namespaces []string) ([]string, error) {
+	targets := sets.NewString(namespaces...)
+	if m.caConfigMapMirrored != nil {
+		return m.caConfigMapMirrored.Difference(targets).List(), nil
+	}
+	if m.caConfigMapNamespaceSelector == nil {
+		return nil, nil
+	}
+	namespaceList := corev1.NamespaceList{}
+	err := m.client.List(ctx, &namespaceList)
+	if err != nil {
+		return nil, err
+	}
+	stale := []string{}
+	for _, namespace := range namespaceList.Items {
+		if !targets.Has(namespace.Name) {
+			stale = append(stale, namespace.Name)
+		}
+	}
+	return stale, nil
+}
+
+// mirrorCABundleAt writes the CA ConfigMap data at a namespace
+func (m *Manager) mirrorCABundleAt(ctx context.Context, namespace string, data map[string]string) error {
+	logger := m.log.WithName("mirrorCABundle").WithValues("name", m.caConfigMapName, "namespace", namespace)
+
+	configMap := &corev1.ConfigMap{}
+	err := m.get(ctx, types.NamespacedName{Namespace: namespace, Name: m.caConfigMapName}, configMap)
+	notFound := apierrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return err
+	}
+
+	for key, value := range data {
+		err = refusePrivateKeyPEM([]byte(value), "CA ConfigMap key "+key)
+		if err != nil {
+			return err
+		}
+	}
+
+	old := configMap.DeepCopy()
+	configMap.Name = m.caConfigMapName
+	configMap.Namespace = namespace
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	configMap.Annotations[secretManagedAnnotationKey] = ""
+	m.setIssuerLabel(configMap)
+	configMap.Data = data
+
+	if notFound {
+		logger.Info("Create CA ConfigMap")
+		return m.client.Create(ctx, configMap)
+	}
+	if reflect.DeepEqual(old, configMap) {
+		// noop
+		return nil
+	}
+	logger.Info("Update CA ConfigMap")
+	return m.client.Update(ctx, configMap)
+}
+
+// cleanupCABundleMirror deletes the CA ConfigMap at every target namespace,
+// and at the ones it was written to before, if configured and created by this
+// library.
+func (m *Manager) cleanupCABundleMirror(ctx context.Context) error {
+	if m.caConfigMapName == "" {
+		return nil
+	}
+
+	namespaces, err := m.caConfigMapTargetNamespaces(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed listing CA ConfigMap namespaces")
+	}
+
+	errs := []error{}
+	for _, namespace := range sets.NewString(namespaces...).Union(m.caConfigMapMirrored).List() {
+		err = m.cleanupCABundleMirrorAt(ctx, namespace)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed cleaning up CA bundle mirror at namespace %s", namespace))
+		}
+	}
+	if len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	m.caConfigMapMirrored = nil
+	return nil
+}
+
+// cleanupCABundleMirrorAt deletes the CA ConfigMap at a namespace, if created
+// by this library and carrying the issuer label if configured.
+func (m *Manager) cleanupCABundleMirrorAt(ctx context.Context, namespace string) error {
+	configMap := &corev1.ConfigMap{}
+	err := m.get(ctx, types.NamespacedName{Namespace: namespace, Name: m.caConfigMapName}, configMap)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, managed := configMap.Annotations[secretManagedAnnotationKey]; !managed || !m.issuedByManager(configMap) {
+		return nil
+	}
+
+	m.log.WithName("cleanupCABundleMirror").Info("Delete CA ConfigMap", "name", m.caConfigMapName, "namespace", namespace)
+	err = m.client.Delete(ctx, configMap)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// caConfigMapTargetNamespaces returns the namespaces the CA ConfigMap is
+// written to: the configured ones plus the ones matching the configured
+// selector, or the manager namespace if none is configured.
+func (m *Manager) caConfigMapTargetNamespaces(ctx context.Context) ([]string, error) {
+	if len(m.caConfigMapNamespaces) == 0 && m.caConfigMapNamespaceSelector == nil {
+		return []string{m.namespace}, nil
+	}
+
+	namespaces := sets.NewString(m.caConfigMapNamespaces...)
+	if m.caConfigMapNamespaceSelector != nil {
+		namespaceList := corev1.NamespaceList{}
+		err := m.client.List(ctx, &namespaceList, client.MatchingLabelsSelector{Selector: m.caConfigMapNamespaceSelector})
+		if err != nil {
+			return nil, err
+		}
+		for _, namespace := range namespaceList.Items {
+			namespaces.Insert(namespace.Name)
+		}
+	}
+	return namespaces.List(), nil
+}
+
+// chainCABundle returns the CA bundle injected for the certificate chain, the
+// CA certificate if there is none.
+func chainCABundle(certificateChain *chain.CertificateChainData) []byte {
+	names := make([]string, 0, len(certificateChain.CertificatesIssued))
+	for name := range certificateChain.CertificatesIssued {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if caBundle := injectedCABundle(certificateChain.CertificatesIssued[name]); caBundle != nil {
+			return caBundle
+		}
+	}
+	return certificateChain.CA.CertPEM
+}
+
+// caConfigMapData returns the CA ConfigMap data storing caBundle with the
+// given layout.
+func caConfigMapData(caBundle []byte, layout CAConfigMapLayout) (map[string]string, error) {
+	if layout != CAConfigMapSplit {
+		return map[string]string{CACertKey: string(caBundle)}, nil
+	}
+
+	caCerts, err := triple.ParseCertsPEM(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]string{}
+	for i, caCert := range caCerts {
+		data[fmt.Sprintf("ca-%d.crt", i)] = string(triple.EncodeCertPEM(caCert))
+	}
+	return data, nil
+}
@@ -0,0 +1,292 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("CA ConfigMap", func() {
+	const caConfigMapName = "foowebhook-ca-bundle"
+
+	var (
+		caBundle []byte
+	)
+
+	BeforeEach(func() {
+		caBundle = []byte{}
+		for _, name := range []string{"foo-ca-1", "foo-ca-2"} {
+			ca, err := triple.NewCA(name, time.Hour)
+			Expect(err).To(Succeed(), "should succeed creating a CA")
+			caBundle = append(caBundle, triple.EncodeCertPEM(ca.Cert)...)
+		}
+	})
+
+	DescribeTable("caConfigMapData",
+		func(layout CAConfigMapLayout, expectedKeys []string) {
+			data, err := caConfigMapData(caBundle, layout)
+			Expect(err).To(Succeed(), "should succeed laying out the CA bundle")
+			Expect(data).To(HaveLen(len(expectedKeys)), "should store only the expected keys")
+			caBundleFromData := []byte{}
+			for _, key := range expectedKeys {
+				Expect(data).To(HaveKey(key), "should store the expected keys")
+				caBundleFromData = append(caBundleFromData, data[key]...)
+			}
+			Expect(caBundleFromData).To(Equal(caBundle), "should store the whole CA bundle")
+		},
+		Entry("not set should store the concatenated bundle", CAConfigMapLayout(""), []string{CACertKey}),
+		Entry("concatenated should store the bundle under ca.crt", CAConfigMapConcatenated, []string{CACertKey}),
+		Entry("split should store every certificate under an indexed key", CAConfigMapSplit, []string{"ca-0.crt", "ca-1.crt"}),
+	)
+
+	Context("when Apply is called with a split CA ConfigMap", func() {
+		var (
+			mgr *Manager
+		)
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCAConfigMap(caConfigMapName),
+				WithCAConfigMapLayout(CAConfigMapSplit),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			triple.Now = time.Now
+
+			createResources()
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			Expect(mgr.Cleanup(context.TODO())).To(Succeed(), "should succeed cleaning up certificates")
+			deleteResources()
+		})
+		It("should mirror the injected CA bundle", func() {
+			configMap := corev1.ConfigMap{}
+			err := cli.Get(context.TODO(), types.NamespacedName{Namespace: expectedNamespace.Name, Name: caConfigMapName}, &configMap)
+			Expect(err).To(Succeed(), "should succeed getting CA ConfigMap")
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			Expect(configMap.Data).To(Equal(map[string]string{"ca-0.crt": string(caBundle)}), "should mirror the CA bundle")
+		})
+	})
+
+	Context("when Apply is called with CA ConfigMap target namespaces", func() {
+		var (
+			mgr              *Manager
+			targetNamespaces = []string{"foowebhook-target-1", "foowebhook-target-2"}
+		)
+		expectCAConfigMaps := func() {
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			for _, namespace := range targetNamespaces {
+				configMap := corev1.ConfigMap{}
+				err := cli.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: caConfigMapName}, &configMap)
+				ExpectWithOffset(1, err).To(Succeed(), "should succeed getting CA ConfigMap at %s", namespace)
+				ExpectWithOffset(1, configMap.Data).To(Equal(map[string]string{CACertKey: string(caBundle)}), "should mirror the CA bundle at %s", namespace)
+			}
+		}
+		BeforeEach(func() {
+			for _, namespace := range targetNamespaces {
+				err := cli.Create(context.TODO(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+				if !apierrors.IsAlreadyExists(err) {
+					Expect(err).To(Succeed(), "should succeed creating target namespace")
+				}
+			}
+
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCAConfigMap(caConfigMapName),
+				WithCAConfigMapNamespaces(targetNamespaces...),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			triple.Now = time.Now
+
+			createResources()
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			Expect(mgr.Cleanup(context.TODO())).To(Succeed(), "should succeed cleaning up certificates")
+			deleteResources()
+		})
+		It("should create the CA ConfigMap at each target namespace", func() {
+			expectCAConfigMaps()
+		})
+		It("should update the CA ConfigMap at each target namespace on rotation", func() {
+			err := mgr.ForceRotate(context.TODO())
+			Expect(err).To(Succeed(), "should succeed forcing rotation")
+			expectCAConfigMaps()
+		})
+	})
+
+	Context("when Apply is called with a CA ConfigMap target namespace missing", func() {
+		var (
+			mgr             *Manager
+			targetNamespace = "foowebhook-target-1"
+			applyErr        error
+		)
+		BeforeEach(func() {
+			err := cli.Create(context.TODO(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: targetNamespace}})
+			if !apierrors.IsAlreadyExists(err) {
+				Expect(err).To(Succeed(), "should succeed creating target namespace")
+			}
+
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCAConfigMap(caConfigMapName),
+				WithCAConfigMapNamespaces("foowebhook-missing", targetNamespace),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			triple.Now = time.Now
+
+			createResources()
+			applyErr = mgr.Apply(context.TODO())
+		})
+		AfterEach(func() {
+			_ = mgr.Cleanup(context.TODO())
+			deleteResources()
+		})
+		It("should fail for the missing namespace only", func() {
+			Expect(applyErr).To(MatchError(ContainSubstring("failed mirroring CA bundle at namespace foowebhook-missing")), "should fail mirroring at the missing namespace")
+			configMap := corev1.ConfigMap{}
+			err := cli.Get(context.TODO(), types.NamespacedName{Namespace: targetNamespace, Name: caConfigMapName}, &configMap)
+			Expect(err).To(Succeed(), "should still create the CA ConfigMap at the other namespace")
+		})
+	})
+
+	Context("when Apply is called with a CA ConfigMap namespace selector", func() {
+		var (
+			mgr              *Manager
+			targetNamespaces = []string{"foowebhook-selected-1", "foowebhook-selected-2"}
+			selectorLabel    = map[string]string{"foowebhook-ca-bundle": "true"}
+		)
+		getCAConfigMap := func(namespace string) error {
+			return cli.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: caConfigMapName}, &corev1.ConfigMap{})
+		}
+		BeforeEach(func() {
+			for _, name := range targetNamespaces {
+				namespace := &corev1.Namespace{}
+				err := cli.Get(context.TODO(), types.NamespacedName{Name: name}, namespace)
+				if apierrors.IsNotFound(err) {
+					err = cli.Create(context.TODO(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: selectorLabel}})
+				} else if err == nil {
+					namespace.Labels = selectorLabel
+					err = cli.Update(context.TODO(), namespace)
+				}
+				Expect(err).To(Succeed(), "should succeed labeling target namespace")
+			}
+
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCAConfigMap(caConfigMapName),
+				WithCAConfigMapNamespaceSelector(labels.SelectorFromSet(selectorLabel)),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			triple.Now = time.Now
+
+			createResources()
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			Expect(mgr.Cleanup(context.TODO())).To(Succeed(), "should succeed cleaning up certificates")
+			deleteResources()
+		})
+		It("should create the CA ConfigMap at the selected namespaces only", func() {
+			for _, namespace := range targetNamespaces {
+				Expect(getCAConfigMap(namespace)).To(Succeed(), "should create the CA ConfigMap at %s", namespace)
+			}
+			Expect(apierrors.IsNotFound(getCAConfigMap(expectedNamespace.Name))).To(BeTrue(), "should not create the CA ConfigMap at the manager namespace")
+		})
+		It("should delete the CA ConfigMap from a namespace no longer selected", func() {
+			namespace := &corev1.Namespace{}
+			Expect(cli.Get(context.TODO(), types.NamespacedName{Name: targetNamespaces[0]}, namespace)).To(Succeed(), "should succeed getting target namespace")
+			namespace.Labels = nil
+			Expect(cli.Update(context.TODO(), namespace)).To(Succeed(), "should succeed unlabeling target namespace")
+
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(apierrors.IsNotFound(getCAConfigMap(targetNamespaces[0]))).To(BeTrue(), "should delete the CA ConfigMap from the namespace no longer selected")
+			Expect(getCAConfigMap(targetNamespaces[1])).To(Succeed(), "should keep the CA ConfigMap at the selected namespace")
+		})
+	})
+})
+
+var _ = Describe("CA ConfigMap namespace events", func() {
+	var (
+		predicate = (&Manager{caConfigMapNamespaceSelector: labels.SelectorFromSet(map[string]string{"foo": "bar"})}).onCAConfigMapNamespaceEvent()
+		selected  = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo", Labels: map[string]string{"foo": "bar"}}}
+		other     = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+	)
+	It("should reconcile namespaces created matching the selector", func() {
+		Expect(predicate.Create(event.CreateEvent{Object: selected})).To(BeTrue(), "should reconcile the selected namespace")
+		Expect(predicate.Create(event.CreateEvent{Object: other})).To(BeFalse(), "should not reconcile other namespaces")
+	})
+	It("should reconcile namespaces starting or stopping to match the selector", func() {
+		Expect(predicate.Update(event.UpdateEvent{ObjectOld: other, ObjectNew: selected})).To(BeTrue(), "should reconcile the namespace starting to match")
+		Expect(predicate.Update(event.UpdateEvent{ObjectOld: selected, ObjectNew: other})).To(BeTrue(), "should reconcile the namespace stopping to match")
+		Expect(predicate.Update(event.UpdateEvent{ObjectOld: selected, ObjectNew: selected})).To(BeFalse(), "should not reconcile the namespace still matching")
+	})
+})
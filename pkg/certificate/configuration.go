@@ -1,17 +1,38 @@
 package certificate
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"net/url"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -19,7 +40,15 @@ const (
 	CACertKey       = "ca.crt"
 	CAPrivateKeyKey = "ca.key"
 
-	secretManagedAnnotationKey = "kubevirt.io/kube-admission-webhook"
+	secretManagedAnnotationKey            = "kubevirt.io/kube-admission-webhook"
+	secretCertificateHistoryAnnotationKey = "kubevirt.io/kube-admission-webhook-certificate-history"
+	secretCAOwnerAnnotationKey            = "kubevirt.io/kube-admission-webhook-ca-owner"
+	secretCAOwnerHeartbeatAnnotationKey   = "kubevirt.io/kube-admission-webhook-ca-owner-heartbeat"
+
+	// urlSecretPrefix prefixes the names of the secrets of URL hosts
+	urlSecretPrefix = "webhook-url-"
+
+	secretFinalizer = "kubevirt.io/kube-admission-webhook"
 
 	clusterDomain    = ".cluster.local"
 	serviceSubdomain = ".svc"
@@ -28,18 +57,59 @@ const (
 // configuration.go reads & writes certificate chain data from and to K8s
 // resources related to the managed webhooks. This includes CA bundles on
 // webhook resources, secrets for every backing service by the same name
-// where service key pairs are stored, as well as a secret for the CA key
-// pair by the name and namespace the manager operates under.
+// where service key pairs are stored, prefixed secrets named after the URL
+// host for webhooks reached by URL, as well as a secret for the CA key pair by the
+// name and namespace the manager operates under.
+
+// SANPolicy is the way service certificates are issued when the managed
+// webhooks are backed by more than one service or URL
+type SANPolicy string
+
+const (
+	// SANPolicySplit issues a certificate per service or URL with its own
+	// SANs
+	SANPolicySplit SANPolicy = "Split"
+
+	// SANPolicyUnion issues the certificate of every service with the SANs of
+	// all the services, so that any of them can serve every webhook backed by
+	// a service. Webhooks reached by URL get certificates with their own SANs.
+	SANPolicyUnion SANPolicy = "Union"
+)
 
 // objectKind is an internal string representation of K8s resource kinds
 type objectKind string
 
 const (
-	mutatingWebhookType   objectKind = objectKind(MutatingWebhook)
-	validatingWebhookType objectKind = objectKind(ValidatingWebhook)
-	secretType            objectKind = "Secret"
+	mutatingWebhookType          objectKind = objectKind(MutatingWebhook)
+	validatingWebhookType        objectKind = objectKind(ValidatingWebhook)
+	mutatingWebhookV1beta1Type   objectKind = objectKind(MutatingWebhook) + "V1beta1"
+	validatingWebhookV1beta1Type objectKind = objectKind(ValidatingWebhook) + "V1beta1"
+	crdConversionWebhookType     objectKind = objectKind(CRDConversionWebhook)
+	apiServiceType               objectKind = objectKind(APIService)
+	secretType                   objectKind = "Secret"
 )
 
+// webhookObjectKind returns the kind of the webhook configuration referenced
+func webhookObjectKind(webhook WebhookReference) objectKind {
+	if webhook.APIVersion == WebhookAPIVersionV1beta1 {
+		return objectKind(webhook.Type) + "V1beta1"
+	}
+	return objectKind(webhook.Type)
+}
+
+// webhookReference returns the reference of a webhook configuration key,
+// false if the key is not of a webhook configuration
+func webhookReference(key *objectKey) (WebhookReference, bool) {
+	switch key.Kind {
+	case mutatingWebhookType, validatingWebhookType, crdConversionWebhookType, apiServiceType:
+		return WebhookReference{Type: WebhookType(key.Kind), Name: key.Name}, true
+	case mutatingWebhookV1beta1Type, validatingWebhookV1beta1Type:
+		webhookType := WebhookType(strings.TrimSuffix(string(key.Kind), "V1beta1"))
+		return WebhookReference{Type: webhookType, Name: key.Name, APIVersion: WebhookAPIVersionV1beta1}, true
+	}
+	return WebhookReference{}, false
+}
+
 // objectKey uniquely identifies a K8s resource
 type objectKey struct {
 	Kind objectKind
@@ -54,15 +124,56 @@ func (k objectKey) String() string {
 type keyedObject struct {
 	key     *objectKey
 	kobject client.Object
+
+	// certificateIssue, if set, is the name of the certificate issue stored
+	// at a secret not named after it
+	certificateIssue string
 }
 type objectMap map[*objectKey]*keyedObject
 
+// objectKindWriteOrder defines the order in which objects of each kind are
+// written to K8s.
+var objectKindWriteOrder = map[objectKind]int{
+	mutatingWebhookType:          0,
+	validatingWebhookType:        0,
+	mutatingWebhookV1beta1Type:   0,
+	validatingWebhookV1beta1Type: 0,
+	crdConversionWebhookType:     0,
+	apiServiceType:               0,
+	secretType:                   1,
+}
+
+// sorted returns the objects of the map ordered by kind, as defined in
+// objectKindWriteOrder, and then by key.
+func (o objectMap) sorted() []*keyedObject {
+	objects := make([]*keyedObject, 0, len(o))
+	for _, object := range o {
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		ki, kj := objects[i].key, objects[j].key
+		if objectKindWriteOrder[ki.Kind] != objectKindWriteOrder[kj.Kind] {
+			return objectKindWriteOrder[ki.Kind] < objectKindWriteOrder[kj.Kind]
+		}
+		return ki.String() < kj.String()
+	})
+	return objects
+}
+
 // objectOperators defines functors for initializing and mapping k8s resources
 // to/from certificate chain data
 type objectOperators struct {
 	creator         func(name, namespace string) client.Object
 	toChainMapper   func(*keyedObject, objectMap, *chain.CertificateChainData)
 	fromChainMapper func(*keyedObject, *chain.CertificateChainData)
+	// cleaner reverts in place the changes done to the object, returning true
+	// if the object should be deleted instead.
+	cleaner func(*keyedObject) bool
+	// validator, if any, checks the object before it is written
+	validator func(*keyedObject) error
+	// warner, if any, returns warnings about the object to be logged before
+	// it is written
+	warner func(*keyedObject) []string
 }
 
 var (
@@ -71,16 +182,56 @@ var (
 			creator:         initMutatingWebhook,
 			toChainMapper:   mapWebhookToChain,
 			fromChainMapper: mapWebhookFromChain,
+			cleaner:         cleanWebhook,
+			validator:       validateWebhook,
+			warner:          warnWebhook,
 		},
 		validatingWebhookType: {
 			creator:         initValidatingWebhook,
 			toChainMapper:   mapWebhookToChain,
 			fromChainMapper: mapWebhookFromChain,
+			cleaner:         cleanWebhook,
+			validator:       validateWebhook,
+			warner:          warnWebhook,
+		},
+		mutatingWebhookV1beta1Type: {
+			creator:         initMutatingWebhookV1beta1,
+			toChainMapper:   mapWebhookToChain,
+			fromChainMapper: mapWebhookFromChain,
+			cleaner:         cleanWebhook,
+			validator:       validateWebhook,
+			warner:          warnWebhook,
+		},
+		validatingWebhookV1beta1Type: {
+			creator:         initValidatingWebhookV1beta1,
+			toChainMapper:   mapWebhookToChain,
+			fromChainMapper: mapWebhookFromChain,
+			cleaner:         cleanWebhook,
+			validator:       validateWebhook,
+			warner:          warnWebhook,
+		},
+		crdConversionWebhookType: {
+			creator:         initCRDConversionWebhook,
+			toChainMapper:   mapWebhookToChain,
+			fromChainMapper: mapWebhookFromChain,
+			cleaner:         cleanWebhook,
+			validator:       validateWebhook,
+			warner:          warnWebhook,
+		},
+		apiServiceType: {
+			creator:         initAPIService,
+			toChainMapper:   mapWebhookToChain,
+			fromChainMapper: mapWebhookFromChain,
+			cleaner:         cleanWebhook,
+			validator:       validateWebhook,
+			warner:          warnWebhook,
 		},
 		secretType: {
 			creator:         initSecret,
 			toChainMapper:   mapSecretToChain,
 			fromChainMapper: mapSecretFromChain,
+			cleaner:         cleanSecret,
+			validator:       validateSecret,
 		},
 	}
 )
@@ -89,46 +240,98 @@ var (
 // chain data related to the managed webhooks. This information is both tracked
 // as a K8s object map and a certificate chain specific structure which should
 // be supplied to this method initialized and empty.
-func (m *Manager) readCertificateChain(objects objectMap, certificateChain *chain.CertificateChainData) error {
+func (m *Manager) readCertificateChain(ctx context.Context, objects objectMap, certificateChain *chain.CertificateChainData) error {
 	m.initObjects(objects)
 	certificateChain.CA.Name = m.secretCAName().String()
-	err := m.readObjectsToChain(objects, certificateChain)
-	return err
+	err := m.readWebhooksToChain(ctx, objects, certificateChain)
+	if err != nil {
+		return err
+	}
+	err = m.readObjectsToChain(ctx, objects, certificateChain)
+	if err != nil {
+		return err
+	}
+	m.mapCombinedSecretsToChain(objects, certificateChain)
+	m.applyClusterDomains(objects, certificateChain)
+	m.applyExtraAltNames(objects, certificateChain)
+	m.applySANPolicy(objects, certificateChain)
+	return nil
 }
 
 // writeCertificateChain is the entry point to write certificate chain data to K8s.
 // objects & certificateChain should have been previously initialized with
 // readCertificateChain. certificateChain could have had further in place
-// modifications that this method would write back to object map and push to K8s.
-func (m *Manager) writeCertificateChain(objects objectMap, certificateChain *chain.CertificateChainData) error {
-	err := m.writeObjectsFromChain(objects, certificateChain)
-	return err
+// modifications that this method would write back to object map and push to K8s,
+// and to the certificates directory if configured.
+func (m *Manager) writeCertificateChain(ctx context.Context, objects objectMap, certificateChain *chain.CertificateChainData) error {
+	err := m.writeObjectsFromChain(ctx, objects, certificateChain)
+	if err != nil {
+		return err
+	}
+	return m.writeCertDir(certificateChain)
 }
 
-// initObjects adds references of CA secret & managed webhooks to the object map
+// initObjects adds references of CA secret & managed webhooks to the object map.
+// There is no CA secret with the combined secret layout.
 func (m *Manager) initObjects(objects objectMap) {
-	for i := range m.webhooks {
-		key := newObjectKey(objectKind(m.webhooks[i].Type), "", m.webhooks[i].Name)
-		object := keyedObject{key, nil}
+	for _, webhook := range m.managedWebhooks() {
+		key := newObjectKey(webhookObjectKind(webhook), "", webhook.Name)
+		object := keyedObject{key: key}
 		objects[key] = &object
 	}
+	if m.combinedSecrets() {
+		return
+	}
 	caSecretName := m.secretCAName()
 	caSecretKey := newObjectKey(secretType, caSecretName.Namespace, caSecretName.Name)
-	caSecretObject := keyedObject{caSecretKey, nil}
+	caSecretObject := keyedObject{key: caSecretKey}
 	objects[caSecretKey] = &caSecretObject
 }
 
+// readWebhooksToChain reads the webhook configurations referenced in the
+// object map from storage and maps them to certificate chain data, once the
+// stale v1beta1 ones are dropped so that their services are not issued
+// certificates for.
+func (m *Manager) readWebhooksToChain(ctx context.Context, objects objectMap, certificateChain *chain.CertificateChainData) error {
+	for _, object := range objects.sorted() {
+		if _, isWebhook := webhookReference(object.key); !isWebhook {
+			continue
+		}
+		err := m.readObject(ctx, object, objects)
+		if err != nil {
+			return err
+		}
+	}
+	return m.mapWebhooksToChain(objects, certificateChain)
+}
+
+// mapWebhooksToChain maps the webhook configurations read into the object
+// map to certificate chain data, dropping the stale v1beta1 ones first.
+func (m *Manager) mapWebhooksToChain(objects objectMap, certificateChain *chain.CertificateChainData) error {
+	m.preferGAWebhooks(objects)
+	for _, object := range objects.sorted() {
+		if _, isWebhook := webhookReference(object.key); !isWebhook || object.kobject == nil {
+			continue
+		}
+		err := m.mapObjectToChain(object, objects, certificateChain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // readObjectsToChain reads objects referenced in the object map from storage
 // and maps them to certificate chain data. Further object references can be
 // added to the object map as object are read. Thus this method will loop
 // though the objet map until all objects are read.
-func (m *Manager) readObjectsToChain(objects objectMap, certificateChain *chain.CertificateChainData) error {
+func (m *Manager) readObjectsToChain(ctx context.Context, objects objectMap, certificateChain *chain.CertificateChainData) error {
 	for {
 		var objectRead bool
 		for _, object := range objects {
 			if object.kobject == nil {
 				objectRead = true
-				err := m.readObjectToChain(object, objects, certificateChain)
+				err := m.readObjectToChain(ctx, object, objects, certificateChain)
 				if err != nil {
 					return err
 				}
@@ -141,15 +344,44 @@ func (m *Manager) readObjectsToChain(objects objectMap, certificateChain *chain.
 }
 
 // writeObjectsFromChain maps certificate chain data back to the object map and
-// pushed data to K8s.
-func (m *Manager) writeObjectsFromChain(objects objectMap, certificateChain *chain.CertificateChainData) error {
-	for _, object := range objects {
-		err := m.writeObjectFromChain(object, certificateChain)
+// pushed data to K8s. Objects are written in order so that CA bundles are
+// injected on webhooks before the service certificates they verify are stored
+// on secrets. A failed webhook configuration does not prevent injecting the
+// others, its error being recorded against it, but no secret is written then.
+func (m *Manager) writeObjectsFromChain(ctx context.Context, objects objectMap, certificateChain *chain.CertificateChainData) error {
+	webhookErrs := []error{}
+	for _, object := range objects.sorted() {
+		_, isWebhook := webhookReference(object.key)
+		if !isWebhook && len(webhookErrs) > 0 {
+			break
+		}
+		err := m.writeObjectFromChain(ctx, object, certificateChain)
+		if err != nil && isWebhook {
+			m.recordWebhookError(object.key, err)
+			webhookErrs = append(webhookErrs, errors.Wrapf(err, "failed injecting CA bundle into %s", object.key))
+			continue
+		}
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return utilerrors.NewAggregate(webhookErrs)
+}
+
+// mapObjectFromChain maps certificate chain data to an object as it is
+// written, current being the object as found at the cluster and new whether
+// it has to be created.
+func (m *Manager) mapObjectFromChain(object *keyedObject, current runtime.Object, new bool, certificateChain *chain.CertificateChainData) {
+	objectOperatorsMap[object.key.Kind].fromChainMapper(object, certificateChain)
+	m.mapCombinedSecretFromChain(object, certificateChain)
+	m.setImmutable(object.kobject)
+	m.recordCertificateHistory(current, object.kobject)
+	m.recordCAOwner(current, object)
+	m.setFinalizer(object)
+	m.setIssuerLabel(object.kobject)
+	if new {
+		m.setSecretOwner(object)
+	}
 }
 
 // readObjectToChain initializes, reads & maps an object from K8s as defined by
@@ -158,34 +390,57 @@ func (m *Manager) writeObjectsFromChain(objects objectMap, certificateChain *cha
 // Object may not exist in K8s and is reponsibility of the map operator to detect
 // and act on this circumstance, where removing the reference to the object from the
 // map is ap possibility.
-func (m *Manager) readObjectToChain(object *keyedObject, objects objectMap, certificateChain *chain.CertificateChainData) error {
-	logger := m.log.WithName("readObjectToChain").WithValues("key", object.key)
+func (m *Manager) readObjectToChain(ctx context.Context, object *keyedObject, objects objectMap, certificateChain *chain.CertificateChainData) error {
 	if object.kobject != nil {
 		return nil
 	}
+	err := m.readObject(ctx, object, objects)
+	if err != nil {
+		return err
+	}
+	if _, found := objects[object.key]; !found {
+		return nil
+	}
+	return m.mapObjectToChain(object, objects, certificateChain)
+}
+
+// readObject initializes & reads an object from K8s, removing the reference
+// to it from the object map if it is a missing webhook configuration alias.
+func (m *Manager) readObject(ctx context.Context, object *keyedObject, objects objectMap) error {
+	logger := m.log.WithName("readObject").WithValues("key", object.key)
 
 	objectOps := objectOperatorsMap[object.key.Kind]
 	object.kobject = objectOps.creator(object.key.Name, object.key.Namespace)
 
 	logger.Info("Read object")
-	err := m.get(object.key.NamespacedName, object.kobject)
+	err := m.get(ctx, object.key.NamespacedName, object.kobject)
+	if err != nil && m.isWebhookAlias(object.key) && (apierrors.IsNotFound(err) || meta.IsNoMatchError(err)) {
+		logger.Info("Ignoring missing webhook configuration alias")
+		delete(objects, object.key)
+		return nil
+	}
 	notFound := apierrors.IsNotFound(err)
 	if err != nil && (!notFound || m.verifying) {
 		return err
 	}
-
-	objectOps.toChainMapper(object, objects, certificateChain)
 	return nil
 }
 
+// mapObjectToChain maps an object read from K8s to certificate chain data as
+// defined by the map operator in objectOperatorsMap for its kind.
+func (m *Manager) mapObjectToChain(object *keyedObject, objects objectMap, certificateChain *chain.CertificateChainData) error {
+	objectOperatorsMap[object.key.Kind].toChainMapper(object, objects, certificateChain)
+	return m.relocateServiceSecrets(objects, certificateChain)
+}
+
 // writeObjectFromChain maps & writes and object to K8s from certificate chain
 // data. The operation will fail if the object changed since originally read
 // and will be noop if no changes need to be written to the object.
-func (m *Manager) writeObjectFromChain(object *keyedObject, certificateChain *chain.CertificateChainData) error {
+func (m *Manager) writeObjectFromChain(ctx context.Context, object *keyedObject, certificateChain *chain.CertificateChainData) error {
 	logger := m.log.WithName("writeObjectFromChain").WithValues("key", object.key)
 
 	old := object.kobject.DeepCopyObject()
-	err := m.get(object.key.NamespacedName, object.kobject)
+	err := m.get(ctx, object.key.NamespacedName, object.kobject)
 	new := apierrors.IsNotFound(err)
 	current := object.kobject.DeepCopyObject()
 	if err != nil && !new {
@@ -193,28 +448,317 @@ func (m *Manager) writeObjectFromChain(object *keyedObject, certificateChain *ch
 	}
 
 	objectOps := objectOperatorsMap[object.key.Kind]
-	objectOps.fromChainMapper(object, certificateChain)
+	m.mapObjectFromChain(object, current, new, certificateChain)
+	if objectOps.warner != nil {
+		for _, warning := range objectOps.warner(object) {
+			logger.Info("WARNING: " + warning)
+		}
+	}
 
 	if reflect.DeepEqual(old, object.kobject) {
 		// noop
+		m.recordWebhookInjection(object.key, current, object.kobject)
 		return nil
 	}
 
-	if !reflect.DeepEqual(old, current) {
+	// webhook configuration aliases are usually the same object than the one
+	// they are an alias of, just written, so they are written if that is all
+	// that changed
+	if !reflect.DeepEqual(old, current) && !m.aliasChangedByMappingOnly(object.key, old, object.kobject, certificateChain) {
 		return fmt.Errorf("An object changed since originally read: %s", object.key)
 	}
 
+	if objectOps.validator != nil {
+		err = objectOps.validator(object)
+		if err != nil {
+			return errors.Wrapf(err, "Refusing to write invalid object %s", object.key)
+		}
+	}
+
 	if new {
 		logger.Info("Create object")
-		err = m.client.Create(context.TODO(), object.kobject)
+		err = m.client.Create(ctx, object.kobject)
+	} else if isImmutable(current) {
+		logger.Info("Recreate immutable object")
+		err = m.recreate(ctx, object.kobject)
+	} else if secretTypeChanged(current, object.kobject) {
+		logger.Info("Recreate secret changing its type")
+		err = m.recreate(ctx, object.kobject)
 	} else {
 		logger.Info("Update object")
-		err = m.client.Update(context.TODO(), object.kobject)
+		err = m.client.Update(ctx, object.kobject)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.cacheSecret(object.kobject)
+	m.recordWebhookInjection(object.key, current, object.kobject)
+	m.recordInjection(object.key, object.kobject)
+	return nil
+}
+
+// aliasChangedByMappingOnly returns whether a webhook configuration alias,
+// read again and mapped from the certificate chain, equals the one originally
+// read mapped the same way, apart from its object versions. Then it only
+// changed in what the mapping overwrites, by writing the configuration it is
+// an alias of, and not by a concurrent edit.
+func (m *Manager) aliasChangedByMappingOnly(key *objectKey, old runtime.Object, mapped client.Object, certificateChain *chain.CertificateChainData) bool {
+	if !m.isWebhookAlias(key) {
+		return false
+	}
+	remapped := &keyedObject{key: key, kobject: old.DeepCopyObject().(client.Object)}
+	m.mapObjectFromChain(remapped, old, false, certificateChain)
+	mapped = mapped.DeepCopyObject().(client.Object)
+	for _, object := range []client.Object{remapped.kobject, mapped} {
+		object.SetResourceVersion("")
+		object.SetGeneration(0)
+		object.SetManagedFields(nil)
+	}
+	return reflect.DeepEqual(remapped.kobject, mapped)
+}
+
+// cleanupObjects reverts the changes done to K8s for all the objects of the
+// object map.
+func (m *Manager) cleanupObjects(ctx context.Context, objects objectMap) error {
+	for _, object := range objects.sorted() {
+		err := m.cleanupObject(ctx, object)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupObject reads an object from K8s and either deletes it or updates it
+// as defined by the clean operator in objectOperatorsMap for every kind of
+// object. Objects that do not exist are ignored, as are objects to delete not
+// carrying the issuer label if configured.
+func (m *Manager) cleanupObject(ctx context.Context, object *keyedObject) error {
+	logger := m.log.WithName("cleanupObject").WithValues("key", object.key)
+
+	objectOps := objectOperatorsMap[object.key.Kind]
+	object.kobject = objectOps.creator(object.key.Name, object.key.Namespace)
+	err := m.get(ctx, object.key.NamespacedName, object.kobject)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	old := object.kobject.DeepCopyObject()
+	if objectOps.cleaner(object) {
+		if !m.issuedByManager(object.kobject) {
+			logger.Info("Ignoring object not issued by this manager")
+			return nil
+		}
+		logger.Info("Delete object")
+		m.forgetSecret(object.key.NamespacedName)
+		err = m.removeFinalizer(ctx, object.kobject)
+		if err != nil {
+			return err
+		}
+		err = m.client.Delete(ctx, object.kobject)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	m.removeIssuerLabel(object.kobject)
+
+	if reflect.DeepEqual(old, object.kobject) {
+		// noop
+		return nil
 	}
 
+	logger.Info("Update object")
+	m.forgetSecret(object.key.NamespacedName)
+	return m.client.Update(ctx, object.kobject)
+}
+
+// deleteStaleSecrets deletes the secrets written by the previous reconcile
+// that are no longer referenced, like the service secret of a webhook switched
+// to an URL, and records the ones referenced now. They are only tracked in
+// memory, so stale secrets left behind across a restart are not deleted.
+func (m *Manager) deleteStaleSecrets(ctx context.Context, objects objectMap) error {
+	secrets := map[types.NamespacedName]bool{}
+	for key := range objects {
+		if key.Kind == secretType {
+			secrets[key.NamespacedName] = true
+		}
+	}
+	for name := range m.writtenSecrets {
+		if secrets[name] {
+			continue
+		}
+		m.log.WithName("deleteStaleSecrets").Info("Deleting secret no longer referenced", "secret", name)
+		err := m.cleanupObject(ctx, &keyedObject{key: newObjectKey(secretType, name.Namespace, name.Name)})
+		if err != nil {
+			return err
+		}
+	}
+	m.writtenSecrets = secrets
+	return nil
+}
+
+// recreate deletes an object and creates it again, which is the only way to
+// change immutable objects and the type of secrets.
+func (m *Manager) recreate(ctx context.Context, object client.Object) error {
+	m.forgetSecret(types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()})
+	err := m.removeFinalizer(ctx, object)
+	if err != nil {
+		return err
+	}
+	err = m.client.Delete(ctx, object)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	object.SetResourceVersion("")
+	object.SetUID("")
+	return m.client.Create(ctx, object)
+}
+
+// setImmutable marks secrets as immutable if the manager is configured to
+// do so.
+func (m *Manager) setImmutable(object client.Object) {
+	secret, ok := object.(*corev1.Secret)
+	if !ok || !m.immutableSecrets {
+		return
+	}
+	immutable := true
+	secret.Immutable = &immutable
+}
+
+// setFinalizer adds the manager finalizer to service secrets if the manager
+// is configured to do so.
+func (m *Manager) setFinalizer(object *keyedObject) {
+	if !m.secretFinalizer || object.key.Kind != secretType || object.key.NamespacedName == m.secretCAName() {
+		return
+	}
+	finalizers := object.kobject.GetFinalizers()
+	for _, finalizer := range finalizers {
+		if finalizer == secretFinalizer {
+			return
+		}
+	}
+	object.kobject.SetFinalizers(append(finalizers, secretFinalizer))
+}
+
+// removeFinalizer removes the manager finalizer from the stored object about
+// to be deleted, if present, so the deletion is not blocked.
+func (m *Manager) removeFinalizer(ctx context.Context, object client.Object) error {
+	stored := object.DeepCopyObject().(client.Object)
+	err := m.client.Get(ctx, types.NamespacedName{Namespace: object.GetNamespace(), Name: object.GetName()}, stored)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	finalizers := []string{}
+	for _, finalizer := range stored.GetFinalizers() {
+		if finalizer != secretFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	if len(finalizers) == len(stored.GetFinalizers()) {
+		return nil
+	}
+	stored.SetFinalizers(finalizers)
+	err = m.client.Update(ctx, stored)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
 	return err
 }
 
+// recordCAOwner records the manager CA owner identity, if configured, on the
+// CA secret when the CA is generated, along its heartbeat, refreshed every
+// half CA owner TTL while the manager owns the CA.
+func (m *Manager) recordCAOwner(current runtime.Object, object *keyedObject) {
+	if m.caOwnerIdentity == "" || !m.isCASecret(object.key) {
+		return
+	}
+	currentSecret := current.(*corev1.Secret)
+	secret := object.kobject.(*corev1.Secret)
+	if bytes.Equal(currentSecret.Data[CACertKey], secret.Data[CACertKey]) {
+		owned := secret.Annotations[secretCAOwnerAnnotationKey] == m.caOwnerIdentity
+		if !owned || triple.Now().Before(caOwnerHeartbeat(secret).Add(m.caOwnerTTL/2)) {
+			return
+		}
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[secretCAOwnerAnnotationKey] = m.caOwnerIdentity
+	secret.Annotations[secretCAOwnerHeartbeatAnnotationKey] = triple.Now().UTC().Format(time.RFC3339)
+}
+
+// caOwnerHeartbeat returns the time the CA owner recorded its heartbeat at on
+// a CA secret, the zero time if it did not
+func caOwnerHeartbeat(secret client.Object) time.Time {
+	heartbeat, err := time.Parse(time.RFC3339, secret.GetAnnotations()[secretCAOwnerHeartbeatAnnotationKey])
+	if err != nil {
+		return time.Time{}
+	}
+	return heartbeat
+}
+
+// recordCertificateHistory keeps on the secret annotations the PEM of the
+// last certificates replaced on a service secret, up to the configured
+// certificate history size. Private keys are never recorded.
+func (m *Manager) recordCertificateHistory(current runtime.Object, object client.Object) {
+	if m.certificateHistory <= 0 {
+		return
+	}
+	currentSecret, ok := current.(*corev1.Secret)
+	if !ok {
+		return
+	}
+	secret := object.(*corev1.Secret)
+
+	previousCerts, err := triple.ParseCertsPEM(currentSecret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return
+	}
+	certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return
+	}
+	previousCert := previousCerts[len(previousCerts)-1]
+	if previousCert.Equal(certs[len(certs)-1]) {
+		return
+	}
+
+	// An empty or missing history is not an error
+	history, _ := triple.ParseCertsPEM([]byte(secret.Annotations[secretCertificateHistoryAnnotationKey]))
+	history = append(history, previousCert)
+	if len(history) > m.certificateHistory {
+		history = history[len(history)-m.certificateHistory:]
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[secretCertificateHistoryAnnotationKey] = string(triple.EncodeCertsPEM(history))
+}
+
+// isImmutable returns whether an object is an immutable secret
+func isImmutable(object runtime.Object) bool {
+	secret, ok := object.(*corev1.Secret)
+	return ok && secret.Immutable != nil && *secret.Immutable
+}
+
+// secretTypeChanged returns whether a secret is written with a type other
+// than its current one, which K8s does not allow to update
+func secretTypeChanged(current, object runtime.Object) bool {
+	currentSecret, ok := current.(*corev1.Secret)
+	if !ok {
+		return false
+	}
+	return currentSecret.Type != object.(*corev1.Secret).Type
+}
+
 func initMutatingWebhook(name, namespace string) client.Object {
 	return &admissionregistrationv1.MutatingWebhookConfiguration{
 		ObjectMeta: v1.ObjectMeta{
@@ -233,6 +777,9 @@ func initValidatingWebhook(name, namespace string) client.Object {
 	}
 }
 
+// initSecret returns a secret with every field the manager sets specified,
+// its type being further set from its data, so that it does not depend on
+// API server defaulting.
 func initSecret(name, namespace string) client.Object {
 	return &corev1.Secret{
 		ObjectMeta: v1.ObjectMeta{
@@ -242,16 +789,17 @@ func initSecret(name, namespace string) client.Object {
 				secretManagedAnnotationKey: "",
 			},
 		},
+		Type: corev1.SecretTypeOpaque,
 	}
 }
 
 // mapWebhookToChain maps a webhook object to certificate chain data.
 // If the webhook has no relevant data or does not exist, it is removed
 // from the object map so that is no longer considered. For every backing
-// service of the webhook, a reference to the service secret is added to the
-// object map if not already there.
+// service or URL of the webhook, a reference to the secret storing its
+// certificate is added to the object map if not already there.
 func mapWebhookToChain(object *keyedObject, objects objectMap, certificateChain *chain.CertificateChainData) {
-	clientConfigMap := clientConfigMap(object.kobject)
+	clientConfigMap := anyClientConfigMap(object.kobject)
 	if len(clientConfigMap) <= 0 {
 		delete(objects, object.key)
 		return
@@ -262,29 +810,38 @@ func mapWebhookToChain(object *keyedObject, objects objectMap, certificateChain
 	}
 
 	for name, config := range clientConfigMap {
-		serviceName := config.Service.Name
-		serviceNamespace := config.Service.Namespace
-		serviceHostname := serviceHostname(serviceName, serviceNamespace)
+		certificateIssue, secretName := clientConfigCertificateIssue(config, certificateChain)
+		if certificateIssue == nil {
+			continue
+		}
 
-		if _, found := certificateChain.CertificatesIssued[serviceHostname]; !found {
-			certificateChain.CertificatesIssued[serviceHostname] = newCertificateIssue(serviceName, serviceNamespace)
+		if _, found := certificateChain.CertificatesIssued[certificateIssue.Name]; !found {
+			certificateChain.CertificatesIssued[certificateIssue.Name] = certificateIssue
 		}
 
 		caBundleName := caBundleName(object.key.String(), name)
-		certificateChain.CertificatesIssued[serviceHostname].CACertPEM[caBundleName] = config.CABundle
-		key := newObjectKey("Secret", serviceNamespace, serviceName)
+		certificateChain.CertificatesIssued[certificateIssue.Name].CACertPEM[caBundleName] = config.CABundle
+		key := newObjectKey("Secret", secretName.Namespace, secretName.Name)
 		if _, found := objects[key]; !found {
-			objects[key] = &keyedObject{key, nil}
+			objects[key] = &keyedObject{key: key}
+			// secrets of URL hosts are not named after their certificate
+			// issue
+			if config.Service == nil {
+				objects[key].certificateIssue = certificateIssue.Name
+			}
 		}
 	}
 }
 
 // mapWebhookToChain maps a webhook object from certificate chain data.
 func mapWebhookFromChain(object *keyedObject, certificateChain *chain.CertificateChainData) {
-	clientConfigList := clientConfigMap(object.kobject)
+	clientConfigList := anyClientConfigMap(object.kobject)
 	for name, config := range clientConfigList {
-		serviceHostname := serviceHostname(config.Service.Name, config.Service.Namespace)
-		certificateIssue := certificateChain.CertificatesIssued[serviceHostname]
+		certificateIssueName := clientConfigCertificateIssueName(config)
+		if certificateIssueName == "" {
+			continue
+		}
+		certificateIssue := certificateChain.CertificatesIssued[certificateIssueName]
 		if certificateIssue == nil {
 			continue
 		}
@@ -295,6 +852,18 @@ func mapWebhookFromChain(object *keyedObject, certificateChain *chain.Certificat
 		}
 		config.CABundle = caBundle
 	}
+	storeClientConfigs(object.kobject, clientConfigList)
+
+	// Webhooks with neither service nor URL are unusable but get the CA
+	// bundle anyway so that they are ready once fixed.
+	if certificateChain.CA.CertPEM == nil {
+		return
+	}
+	emptyClientConfigs := emptyClientConfigMap(object.kobject)
+	for _, config := range emptyClientConfigs {
+		config.CABundle = certificateChain.CA.CertPEM
+	}
+	storeClientConfigs(object.kobject, emptyClientConfigs)
 }
 
 // mapWebhookToChain maps a secret object to certificate chain data.
@@ -323,10 +892,13 @@ func mapServiceSecretToChain(object *keyedObject, certificateChain *chain.Certif
 		return
 	}
 
-	name := serviceHostname(object.key.NamespacedName.Name, object.key.NamespacedName.Namespace)
+	certificateIssue := secretCertificateIssue(object, certificateChain)
+	if certificateIssue == nil {
+		return
+	}
 
-	certificateChain.CertificatesIssued[name].KeyPEM = key
-	certificateChain.CertificatesIssued[name].CertPEM = cert
+	certificateIssue.KeyPEM = key
+	certificateIssue.CertPEM = cert
 }
 
 func mapCASecretToChain(object *keyedObject, certificateChain *chain.CertificateChainData) {
@@ -342,27 +914,193 @@ func mapCASecretToChain(object *keyedObject, certificateChain *chain.Certificate
 
 func mapServiceSecretFromChain(object *keyedObject, certificateChain *chain.CertificateChainData) {
 	secret := object.kobject.(*corev1.Secret)
-	name := serviceHostname(object.key.NamespacedName.Name, object.key.NamespacedName.Namespace)
-	bundle := certificateChain.CertificatesIssued[name]
+	bundle := secretCertificateIssue(object, certificateChain)
 	if bundle == nil {
 		return
 	}
 	if secret.Data == nil {
 		secret.Data = map[string][]byte{}
 	}
-	secret.Type = corev1.SecretTypeTLS
 	secret.Data[corev1.TLSPrivateKeyKey] = bundle.KeyPEM
 	secret.Data[corev1.TLSCertKey] = bundle.CertPEM
+	// a CA copy stored along the service certificate is kept in sync with
+	// the injected CA bundle
+	if _, found := secret.Data[CACertKey]; found {
+		if caBundle := injectedCABundle(bundle); caBundle != nil {
+			secret.Data[CACertKey] = caBundle
+		}
+	}
+	secret.Type = secretTypeFor(secret.Data)
+}
+
+// injectedCABundle returns the CA bundle injected for a certificate issue,
+// the first one by name if it is injected at more than one webhook.
+func injectedCABundle(certificateIssue *chain.CertificateIssue) []byte {
+	names := make([]string, 0, len(certificateIssue.CACertPEM))
+	for name := range certificateIssue.CACertPEM {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return certificateIssue.CACertPEM[names[0]]
 }
 
 func mapCASecretFromChain(object *keyedObject, certificateChain *chain.CertificateChainData) {
 	secret := object.kobject.(*corev1.Secret)
-	secret.Type = corev1.SecretTypeOpaque
 	if secret.Data == nil {
 		secret.Data = map[string][]byte{}
 	}
 	secret.Data[CAPrivateKeyKey] = certificateChain.CA.KeyPEM
 	secret.Data[CACertKey] = certificateChain.CA.CertPEM
+	secret.Type = secretTypeFor(secret.Data)
+}
+
+// secretTypeFor returns the type of a secret holding data. Only data stored
+// under the standard TLS keys, that K8s validates for the TLS secret type, is
+// stored in TLS secrets, Opaque secrets are used otherwise. Existing secrets
+// of another type are recreated with it, the type being immutable.
+func secretTypeFor(data map[string][]byte) corev1.SecretType {
+	_, hasCert := data[corev1.TLSCertKey]
+	_, hasKey := data[corev1.TLSPrivateKeyKey]
+	if hasCert && hasKey {
+		return corev1.SecretTypeTLS
+	}
+	return corev1.SecretTypeOpaque
+}
+
+// validateSecret checks that the private keys stored on a secret match the
+// public key of the last certificate stored with them, both for the CA and
+// the service key pairs if stored together.
+func validateSecret(object *keyedObject) error {
+	secret := object.kobject.(*corev1.Secret)
+	if _, found := secret.Data[CAPrivateKeyKey]; found {
+		err := validateSecretKeyPair(secret, CAPrivateKeyKey, CACertKey)
+		if err != nil {
+			return err
+		}
+		if _, found := secret.Data[corev1.TLSPrivateKeyKey]; !found {
+			return nil
+		}
+	}
+	return validateSecretKeyPair(secret, corev1.TLSPrivateKeyKey, corev1.TLSCertKey)
+}
+
+// validateSecretKeyPair checks that the private key stored on a secret at
+// keyKey matches the public key of the last certificate stored at certKey.
+func validateSecretKeyPair(secret *corev1.Secret, keyKey, certKey string) error {
+	keyPEM, certPEM := secret.Data[keyKey], secret.Data[certKey]
+	if keyPEM == nil && certPEM == nil {
+		return nil
+	}
+
+	err := triple.ValidatePEMBlockType(keyPEM, triple.ECPrivateKeyBlockType, triple.RSAPrivateKeyBlockType, triple.PrivateKeyBlockType)
+	if err != nil {
+		return errors.Wrapf(err, "failed parsing %s", keyKey)
+	}
+	err = triple.ValidatePEMBlockType(certPEM, triple.CertificateBlockType)
+	if err != nil {
+		return errors.Wrapf(err, "failed parsing %s", certKey)
+	}
+
+	key, err := triple.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return errors.Wrapf(err, "failed parsing %s", keyKey)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return errors.Errorf("unsupported private key type at %s", keyKey)
+	}
+	certs, err := triple.ParseCertsPEM(certPEM)
+	if err != nil {
+		return errors.Wrapf(err, "failed parsing %s", certKey)
+	}
+	err = triple.VerifyKeyPair(certs[len(certs)-1], signer)
+	if err != nil {
+		return errors.Wrapf(err, "%s and %s mismatch", certKey, keyKey)
+	}
+	return nil
+}
+
+// validateWebhook checks that no private key made it to the CA bundle of any
+// webhook, and that the CA bundle of the webhooks backed by a service or an
+// URL are raw PEM certificates.
+func validateWebhook(object *keyedObject) error {
+	for name, config := range anyClientConfigMap(object.kobject) {
+		err := refusePrivateKeyPEM(config.CABundle, "CA bundle of webhook "+name)
+		if err != nil {
+			return err
+		}
+		err = refuseEncodedCABundle(config.CABundle, "CA bundle of webhook "+name)
+		if err != nil {
+			return err
+		}
+	}
+	for name, config := range emptyClientConfigMap(object.kobject) {
+		err := refusePrivateKeyPEM(config.CABundle, "CA bundle of webhook "+name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refusePrivateKeyPEM fails if data, to be written to anything but a secret,
+// has any private key PEM block.
+func refusePrivateKeyPEM(data []byte, target string) error {
+	if triple.ContainsPrivateKeyPEM(data) {
+		return errors.Errorf("private key found at %s, only certificates can be written there", target)
+	}
+	return nil
+}
+
+// refuseEncodedCABundle fails if the CA bundle, unless empty, has no raw PEM
+// certificate, with a specific error if it is base64 encoded already since
+// the API server base64 encodes it again.
+func refuseEncodedCABundle(caBundle []byte, target string) error {
+	if len(caBundle) == 0 || x509.NewCertPool().AppendCertsFromPEM(caBundle) {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(caBundle)))
+	if err == nil && x509.NewCertPool().AppendCertsFromPEM(decoded) {
+		return errors.Errorf("base64 encoded %s, only raw PEM certificates can be written there", target)
+	}
+	return errors.Errorf("no PEM certificate found at %s, only raw PEM certificates can be written there", target)
+}
+
+// cleanWebhook clears the CA bundle of every webhook backed by a service, an
+// URL or with an empty client config.
+func cleanWebhook(object *keyedObject) bool {
+	clientConfigs := anyClientConfigMap(object.kobject)
+	for _, config := range clientConfigs {
+		config.CABundle = nil
+	}
+	storeClientConfigs(object.kobject, clientConfigs)
+	emptyClientConfigs := emptyClientConfigMap(object.kobject)
+	for _, config := range emptyClientConfigs {
+		config.CABundle = nil
+	}
+	storeClientConfigs(object.kobject, emptyClientConfigs)
+	return false
+}
+
+// warnWebhook warns about every webhook with neither service nor URL at its
+// client config.
+func warnWebhook(object *keyedObject) []string {
+	warnings := []string{}
+	for name := range emptyClientConfigMap(object.kobject) {
+		warnings = append(warnings, fmt.Sprintf("webhook %s has neither service nor URL at its client config, injecting CA bundle anyway", name))
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// cleanSecret flags for deletion secrets annotated as managed by this
+// library, leaving any other secret untouched.
+func cleanSecret(object *keyedObject) bool {
+	_, managed := object.kobject.GetAnnotations()[secretManagedAnnotationKey]
+	return managed
 }
 
 func newObjectKey(kind objectKind, namespace, name string) *objectKey {
@@ -377,7 +1115,7 @@ func newObjectKey(kind objectKind, namespace, name string) *objectKey {
 }
 
 func (m *Manager) secretCAName() types.NamespacedName {
-	return types.NamespacedName{m.namespace, m.name + "-ca"}
+	return types.NamespacedName{Namespace: m.namespace, Name: m.name + "-ca"}
 }
 
 func caBundleName(webhookName, configName string) string {
@@ -412,6 +1150,146 @@ func newCertificateIssue(name, namespace string) *chain.CertificateIssue {
 	return &certificateBundle
 }
 
+// applySANPolicy sets the SANs of the certificate issues as the SAN policy
+// mandates.
+func (m *Manager) applySANPolicy(objects objectMap, certificateChain *chain.CertificateChainData) {
+	if m.sanPolicy == SANPolicyUnion {
+		unionSANs(certificateChain, serviceCertificateIssueNames(objects))
+	}
+}
+
+// serviceCertificateIssueNames returns the names of the certificate issues of
+// the services backing the webhooks of the object map, leaving out the ones
+// of webhooks reached by URL.
+func serviceCertificateIssueNames(objects objectMap) map[string]bool {
+	names := map[string]bool{}
+	for key, object := range objects {
+		if _, isWebhook := webhookReference(key); !isWebhook || object.kobject == nil {
+			continue
+		}
+		for _, config := range anyClientConfigMap(object.kobject) {
+			if config.Service != nil {
+				names[clientConfigCertificateIssueName(config)] = true
+			}
+		}
+	}
+	return names
+}
+
+// unionSANs sets the SANs of every certificate issue by name at unioned to
+// the union of the SANs of all of them. The other certificate issues keep
+// their own SANs.
+func unionSANs(certificateChain *chain.CertificateChainData, unioned map[string]bool) {
+	names := make([]string, 0, len(unioned))
+	for name := range certificateChain.CertificatesIssued {
+		if unioned[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	ips, hostnames := []string{}, []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		certificateIssue := certificateChain.CertificatesIssued[name]
+		for _, ip := range certificateIssue.IPs {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+		for _, hostname := range certificateIssue.Hostnames {
+			if !seen[hostname] {
+				seen[hostname] = true
+				hostnames = append(hostnames, hostname)
+			}
+		}
+	}
+
+	for _, name := range names {
+		certificateIssue := certificateChain.CertificatesIssued[name]
+		certificateIssue.IPs = append([]string{}, ips...)
+		certificateIssue.Hostnames = append([]string{}, hostnames...)
+	}
+}
+
+// newURLCertificateIssue returns the certificate issue for webhooks reached
+// by URL, with the URL host as its only SAN, an IP one if the host is an IP.
+func newURLCertificateIssue(host string) *chain.CertificateIssue {
+	certificateIssue := chain.CertificateIssue{
+		Name:      host,
+		CACertPEM: make(map[string][]byte),
+	}
+	if net.ParseIP(host) != nil {
+		certificateIssue.IPs = []string{host}
+	} else {
+		certificateIssue.Hostnames = []string{host}
+	}
+	return &certificateIssue
+}
+
+// urlSecretName returns the name of the secret storing the certificate of an
+// URL host, prefixed so that it does not collide with the secrets of the
+// services at the CA namespace. Hosts that are not valid secret names, like
+// IPv6 ones, are hashed.
+func urlSecretName(host string) string {
+	name := urlSecretPrefix + host
+	if len(validation.IsDNS1123Subdomain(name)) == 0 {
+		return name
+	}
+	hash := sha256.Sum256([]byte(host))
+	return urlSecretPrefix + hex.EncodeToString(hash[:8])
+}
+
+// urlHost returns the host of a webhook URL, empty if it cannot be parsed.
+func urlHost(webhookURL string) string {
+	parsedURL, err := url.Parse(webhookURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedURL.Hostname())
+}
+
+// clientConfigCertificateIssueName returns the name of the certificate issue
+// serving a webhook client config, empty if there is none.
+func clientConfigCertificateIssueName(config *admissionregistrationv1.WebhookClientConfig) string {
+	if config.Service != nil {
+		return serviceHostname(config.Service.Name, config.Service.Namespace)
+	}
+	if config.URL != nil {
+		return urlHost(*config.URL)
+	}
+	return ""
+}
+
+// clientConfigCertificateIssue returns a new certificate issue serving a
+// webhook client config along with the secret to store it at: the service
+// one for webhooks reached by service or one named after the URL host, see
+// urlSecretName, at the CA secret namespace for webhooks reached by URL. Switching a webhook
+// between both changes the certificate issue and so its SANs.
+func clientConfigCertificateIssue(config *admissionregistrationv1.WebhookClientConfig, certificateChain *chain.CertificateChainData) (*chain.CertificateIssue, types.NamespacedName) {
+	if config.Service != nil {
+		return newCertificateIssue(config.Service.Name, config.Service.Namespace),
+			types.NamespacedName{Namespace: config.Service.Namespace, Name: config.Service.Name}
+	}
+	host := clientConfigCertificateIssueName(config)
+	if host == "" {
+		return nil, types.NamespacedName{}
+	}
+	caNamespace := strings.SplitN(certificateChain.CA.Name, string(types.Separator), 2)[0]
+	return newURLCertificateIssue(host), types.NamespacedName{Namespace: caNamespace, Name: urlSecretName(host)}
+}
+
+// secretCertificateIssue returns the certificate issue stored at a secret,
+// either for a service, or the one of the URL host the secret is for or was
+// relocated for.
+func secretCertificateIssue(object *keyedObject, certificateChain *chain.CertificateChainData) *chain.CertificateIssue {
+	if object.certificateIssue != "" {
+		return certificateChain.CertificatesIssued[object.certificateIssue]
+	}
+	return certificateChain.CertificatesIssued[serviceHostname(object.key.Name, object.key.Namespace)]
+}
+
 func mutatingWebhookConfig(webhook client.Object) *admissionregistrationv1.MutatingWebhookConfiguration {
 	return webhook.(*admissionregistrationv1.MutatingWebhookConfiguration)
 }
@@ -427,14 +1305,28 @@ func validatingWebhookConfig(webhook client.Object) *admissionregistrationv1.Val
 //
 // [1] https://godoc.org/k8s.io/kubernetes/pkg/apis/admissionregistration#WebhookClientConfig
 func clientConfigMap(webhook client.Object) map[string]*admissionregistrationv1.WebhookClientConfig {
+	return filterClientConfigMap(webhook, func(clientConfig *admissionregistrationv1.WebhookClientConfig) bool {
+		return clientConfig.Service != nil
+	})
+}
+
+// emptyClientConfigMap returns the webhooks's WebhookClientConfig with
+// neither service nor URL, which are malformed.
+func emptyClientConfigMap(webhook client.Object) map[string]*admissionregistrationv1.WebhookClientConfig {
+	return filterClientConfigMap(webhook, func(clientConfig *admissionregistrationv1.WebhookClientConfig) bool {
+		return clientConfig.Service == nil && clientConfig.URL == nil
+	})
+}
+
+func filterClientConfigMap(webhook client.Object, filter func(*admissionregistrationv1.WebhookClientConfig) bool) map[string]*admissionregistrationv1.WebhookClientConfig {
 	clientConfigMap := map[string]*admissionregistrationv1.WebhookClientConfig{}
-	switch webhook.(type) {
+	switch webhook := webhook.(type) {
 	case *admissionregistrationv1.MutatingWebhookConfiguration:
 		mutatingWebhookConfig := mutatingWebhookConfig(webhook)
 		for i := range mutatingWebhookConfig.Webhooks {
 			name := mutatingWebhookConfig.Webhooks[i].Name
 			clientConfig := &mutatingWebhookConfig.Webhooks[i].ClientConfig
-			if clientConfig.Service == nil {
+			if !filter(clientConfig) {
 				continue
 			}
 			clientConfigMap[name] = clientConfig
@@ -444,11 +1336,64 @@ func clientConfigMap(webhook client.Object) map[string]*admissionregistrationv1.
 		for i := range validatingWebhookConfig.Webhooks {
 			name := validatingWebhookConfig.Webhooks[i].Name
 			clientConfig := &validatingWebhookConfig.Webhooks[i].ClientConfig
-			if clientConfig.Service == nil {
+			if !filter(clientConfig) {
 				continue
 			}
 			clientConfigMap[name] = clientConfig
 		}
+	case *admissionregistrationv1beta1.MutatingWebhookConfiguration:
+		for i := range webhook.Webhooks {
+			clientConfig := v1beta1ClientConfig(&webhook.Webhooks[i].ClientConfig)
+			if !filter(clientConfig) {
+				continue
+			}
+			clientConfigMap[webhook.Webhooks[i].Name] = clientConfig
+		}
+	case *admissionregistrationv1beta1.ValidatingWebhookConfiguration:
+		for i := range webhook.Webhooks {
+			clientConfig := v1beta1ClientConfig(&webhook.Webhooks[i].ClientConfig)
+			if !filter(clientConfig) {
+				continue
+			}
+			clientConfigMap[webhook.Webhooks[i].Name] = clientConfig
+		}
+	case *apiextensionsv1.CustomResourceDefinition:
+		clientConfig := crdConversionClientConfig(webhook)
+		if clientConfig != nil && filter(clientConfig) {
+			clientConfigMap[crdConversionWebhookName] = clientConfig
+		}
+	case *unstructured.Unstructured:
+		apiService, ok := isAPIService(webhook)
+		if !ok {
+			break
+		}
+		clientConfig := apiServiceClientConfig(apiService)
+		if clientConfig != nil && filter(clientConfig) {
+			clientConfigMap[apiServiceName] = clientConfig
+		}
 	}
 	return clientConfigMap
 }
+
+// storeClientConfigs stores back the CA bundles of client configs not
+// sharing memory with their webhook object, the ones of v1beta1 webhook
+// configurations, of CustomResourceDefinitions and of APIServices.
+func storeClientConfigs(webhook client.Object, clientConfigs map[string]*admissionregistrationv1.WebhookClientConfig) {
+	switch webhook := webhook.(type) {
+	case *admissionregistrationv1beta1.MutatingWebhookConfiguration:
+		for i := range webhook.Webhooks {
+			storeV1beta1ClientConfig(&webhook.Webhooks[i].ClientConfig, clientConfigs[webhook.Webhooks[i].Name])
+		}
+	case *admissionregistrationv1beta1.ValidatingWebhookConfiguration:
+		for i := range webhook.Webhooks {
+			storeV1beta1ClientConfig(&webhook.Webhooks[i].ClientConfig, clientConfigs[webhook.Webhooks[i].Name])
+		}
+	case *apiextensionsv1.CustomResourceDefinition:
+		storeCRDConversionClientConfig(webhook, clientConfigs)
+	case *unstructured.Unstructured:
+		apiService, ok := isAPIService(webhook)
+		if ok {
+			storeAPIServiceClientConfig(apiService, clientConfigs)
+		}
+	}
+}
@@ -0,0 +1,936 @@
+package certificate
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Certificates configuration", func() {
+	var (
+		mgr *Manager
+	)
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		triple.Now = time.Now
+
+		createResources()
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	Context("when the generated certificate does not match its key", func() {
+		var (
+			err error
+		)
+		BeforeEach(func() {
+			objects := objectMap{}
+			certificateChain := chain.CertificateChainData{}
+			err = mgr.readCertificateChain(context.TODO(), objects, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed reading certificate data")
+			_, err = chain.Update(&mgr.options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed updating certificate data")
+
+			By("Replacing the generated keys with unrelated ones")
+			for _, certificateIssued := range certificateChain.CertificatesIssued {
+				key, err := triple.NewPrivateKey()
+				Expect(err).To(Succeed(), "should succeed generating a private key")
+				certificateIssued.KeyPEM = triple.EncodePrivateKeyPEM(key)
+			}
+
+			err = mgr.writeCertificateChain(context.TODO(), objects, &certificateChain)
+		})
+		It("should refuse to write the secret", func() {
+			Expect(err).To(MatchError(ContainSubstring("tls.crt and tls.key mismatch")), "should fail with a clear error")
+			_, err = getSecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not write the TLS secret")
+		})
+	})
+
+	Context("when the CA bundle to inject is base64 encoded", func() {
+		var (
+			err error
+		)
+		BeforeEach(func() {
+			objects := objectMap{}
+			certificateChain := chain.CertificateChainData{}
+			err = mgr.readCertificateChain(context.TODO(), objects, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed reading certificate data")
+			_, err = chain.Update(&mgr.options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed updating certificate data")
+
+			By("Encoding the CA bundles with base64")
+			for _, certificateIssued := range certificateChain.CertificatesIssued {
+				for name, caBundle := range certificateIssued.CACertPEM {
+					certificateIssued.CACertPEM[name] = []byte(base64.StdEncoding.EncodeToString(caBundle))
+				}
+			}
+
+			err = mgr.writeCertificateChain(context.TODO(), objects, &certificateChain)
+		})
+		It("should refuse to write the webhook configuration and inject the raw CA bundle on the next reconcile", func() {
+			Expect(err).To(MatchError(ContainSubstring("base64 encoded CA bundle of webhook")), "should fail with a clear error")
+			Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).To(BeEmpty(), "should not inject the CA bundle")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			_, err = triple.ParseCertsPEM(caBundle)
+			Expect(err).To(Succeed(), "should inject raw PEM certificates")
+		})
+	})
+
+	Context("when the CA bundle to inject holds a private key", func() {
+		var (
+			err error
+		)
+		BeforeEach(func() {
+			objects := objectMap{}
+			certificateChain := chain.CertificateChainData{}
+			err = mgr.readCertificateChain(context.TODO(), objects, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed reading certificate data")
+			_, err = chain.Update(&mgr.options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed updating certificate data")
+
+			By("Appending the CA key to the CA bundles")
+			for _, certificateIssued := range certificateChain.CertificatesIssued {
+				for name, caBundle := range certificateIssued.CACertPEM {
+					certificateIssued.CACertPEM[name] = append(caBundle, certificateChain.CA.KeyPEM...)
+				}
+			}
+
+			err = mgr.writeCertificateChain(context.TODO(), objects, &certificateChain)
+		})
+		It("should refuse to write the webhook configuration", func() {
+			Expect(err).To(MatchError(ContainSubstring("private key found at CA bundle of webhook")), "should fail with a clear error")
+			Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).To(BeEmpty(), "should not inject the CA bundle")
+		})
+	})
+})
+
+var _ = Describe("Webhook CA bundle", func() {
+	DescribeTable("validateWebhook",
+		func(caBundle func(ca *triple.KeyPair) []byte, expectedError string) {
+			ca, err := triple.NewCA("foo-ca", time.Hour)
+			Expect(err).To(Succeed(), "should succeed creating a CA")
+			webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+			webhook.Webhooks[0].ClientConfig.CABundle = caBundle(ca)
+			err = validateWebhook(&keyedObject{
+				key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+				kobject: webhook,
+			})
+			if expectedError == "" {
+				Expect(err).To(Succeed(), "should accept the CA bundle")
+				return
+			}
+			Expect(err).To(MatchError(expectedError), "should refuse the CA bundle")
+		},
+		Entry("with certificates only", func(ca *triple.KeyPair) []byte {
+			return triple.EncodeCertPEM(ca.Cert)
+		}, ""),
+		Entry("with a private key", func(ca *triple.KeyPair) []byte {
+			return append(triple.EncodeCertPEM(ca.Cert), triple.EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey))...)
+		}, "private key found at CA bundle of webhook "+expectedMutatingWebhookConfiguration.Webhooks[0].Name+", only certificates can be written there"),
+		Entry("base64 encoded", func(ca *triple.KeyPair) []byte {
+			return []byte(base64.StdEncoding.EncodeToString(triple.EncodeCertPEM(ca.Cert)))
+		}, "base64 encoded CA bundle of webhook "+expectedMutatingWebhookConfiguration.Webhooks[0].Name+", only raw PEM certificates can be written there"),
+		Entry("without certificates", func(ca *triple.KeyPair) []byte {
+			return []byte("foo")
+		}, "no PEM certificate found at CA bundle of webhook "+expectedMutatingWebhookConfiguration.Webhooks[0].Name+", only raw PEM certificates can be written there"),
+		Entry("empty", func(ca *triple.KeyPair) []byte {
+			return nil
+		}, ""),
+	)
+})
+
+var _ = Describe("Secret type", func() {
+	type secretTypeForCase struct {
+		data         map[string][]byte
+		expectedType corev1.SecretType
+	}
+	DescribeTable("secretTypeFor",
+		func(c secretTypeForCase) {
+			Expect(secretTypeFor(c.data)).To(Equal(c.expectedType))
+		},
+		Entry("standard TLS keys should use TLS type", secretTypeForCase{
+			data: map[string][]byte{
+				corev1.TLSCertKey:       []byte("cert"),
+				corev1.TLSPrivateKeyKey: []byte("key"),
+			},
+			expectedType: corev1.SecretTypeTLS,
+		}),
+		Entry("custom keys should use Opaque type", secretTypeForCase{
+			data: map[string][]byte{
+				CACertKey:       []byte("cert"),
+				CAPrivateKeyKey: []byte("key"),
+			},
+			expectedType: corev1.SecretTypeOpaque,
+		}),
+		Entry("only one of the standard TLS keys should use Opaque type", secretTypeForCase{
+			data: map[string][]byte{
+				corev1.TLSCertKey: []byte("cert"),
+			},
+			expectedType: corev1.SecretTypeOpaque,
+		}),
+	)
+})
+
+var _ = Describe("Webhook with an empty client config", func() {
+	var (
+		object           *keyedObject
+		certificateChain chain.CertificateChainData
+	)
+	BeforeEach(func() {
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		webhook.Webhooks = append(webhook.Webhooks, admissionregistrationv1.MutatingWebhook{
+			Name: "empty.qinqon.io",
+		})
+		object = &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		objects := objectMap{object.key: object}
+		certificateChain = chain.CertificateChainData{
+			CA: chain.CA{
+				Name: "foo-ca",
+			},
+		}
+		mapWebhookToChain(object, objects, &certificateChain)
+		options := chain.Options{}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed updating certificate data")
+		mapWebhookFromChain(object, &certificateChain)
+	})
+	It("should warn about the offending webhook", func() {
+		Expect(warnWebhook(object)).To(ConsistOf(
+			"webhook empty.qinqon.io has neither service nor URL at its client config, injecting CA bundle anyway",
+		), "should warn only about the webhook with an empty client config")
+	})
+	It("should still inject the CA bundle", func() {
+		webhooks := object.kobject.(*admissionregistrationv1.MutatingWebhookConfiguration).Webhooks
+		Expect(webhooks[0].ClientConfig.CABundle).ToNot(BeEmpty(), "should inject the CA bundle to the service webhook")
+		Expect(webhooks[1].ClientConfig.CABundle).To(Equal(certificateChain.CA.CertPEM), "should inject the CA certificate to the empty webhook")
+	})
+})
+
+var _ = Describe("Webhook switching from service to URL", func() {
+	var (
+		object           *keyedObject
+		objects          objectMap
+		certificateChain chain.CertificateChainData
+	)
+	BeforeEach(func() {
+		options := chain.Options{}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		object = &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		serviceChain := chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objectMap{object.key: object}, &serviceChain)
+		_, err := chain.Update(&options, &serviceChain)
+		Expect(err).To(Succeed(), "should succeed issuing the service certificate")
+		mapWebhookFromChain(object, &serviceChain)
+
+		By("Switching the webhook client config to an URL")
+		url := "https://foowebhook.example.com:8443/mutate"
+		webhook.Webhooks[0].ClientConfig.Service = nil
+		webhook.Webhooks[0].ClientConfig.URL = &url
+
+		objects = objectMap{object.key: object}
+		certificateChain = chain.CertificateChainData{
+			CA: serviceChain.CA,
+		}
+		mapWebhookToChain(object, objects, &certificateChain)
+		_, err = chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing the URL certificate")
+		mapWebhookFromChain(object, &certificateChain)
+	})
+	It("should issue a certificate for the URL host", func() {
+		Expect(certificateChain.CertificatesIssued).To(HaveLen(1), "should only issue the URL certificate")
+		certificateIssue := certificateChain.CertificatesIssued["foowebhook.example.com"]
+		Expect(certificateIssue).ToNot(BeNil(), "should issue a certificate named after the URL host")
+		certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the URL certificate")
+		Expect(certs[len(certs)-1].DNSNames).To(Equal([]string{"foowebhook.example.com"}), "should carry the URL host SAN")
+		Expect(certificateChain.RotationReason).To(Equal(chain.RotationReasonMissing), "should rotate since the URL certificate is missing")
+	})
+	It("should store it at a secret named after the URL host at the CA namespace", func() {
+		secretKeys := []types.NamespacedName{}
+		for key := range objects {
+			if key.Kind == secretType {
+				secretKeys = append(secretKeys, key.NamespacedName)
+			}
+		}
+		Expect(secretKeys).To(ConsistOf(types.NamespacedName{
+			Namespace: expectedCASecret.Namespace,
+			Name:      "webhook-url-foowebhook.example.com",
+		}), "should reference the URL secret")
+	})
+	DescribeTable("should issue the certificate of an URL host",
+		func(host string, expectedHostnames, expectedIPs []string, expectedSecretName string) {
+			certificateIssue := newURLCertificateIssue(host)
+			Expect(certificateIssue.Hostnames).To(Equal(expectedHostnames), "should carry the DNS SANs")
+			Expect(certificateIssue.IPs).To(Equal(expectedIPs), "should carry the IP SANs")
+			secretName := urlSecretName(host)
+			Expect(secretName).To(Equal(expectedSecretName), "should store it at a prefixed secret")
+			Expect(validation.IsDNS1123Subdomain(secretName)).To(BeEmpty(), "should store it at a valid secret name")
+		},
+		Entry("DNS name", "foowebhook.example.com", []string{"foowebhook.example.com"}, nil, "webhook-url-foowebhook.example.com"),
+		Entry("IPv4", "10.0.0.1", nil, []string{"10.0.0.1"}, "webhook-url-10.0.0.1"),
+		Entry("IPv6", "fd00::1", nil, []string{"fd00::1"}, "webhook-url-cb2a2b4daa420349"),
+	)
+	It("should inject the CA bundle to the URL webhook", func() {
+		webhooks := object.kobject.(*admissionregistrationv1.MutatingWebhookConfiguration).Webhooks
+		Expect(webhooks[0].ClientConfig.CABundle).ToNot(BeEmpty(), "should inject the CA bundle")
+	})
+})
+
+var _ = Describe("Webhook backed by two services", func() {
+	var (
+		certificateChain chain.CertificateChainData
+	)
+	BeforeEach(func() {
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		otherWebhook := webhook.Webhooks[0].DeepCopy()
+		otherWebhook.Name = "barwebhook.qinqon.io"
+		otherWebhook.ClientConfig.Service.Name = "barwebhook-service"
+		webhook.Webhooks = append(webhook.Webhooks, *otherWebhook)
+		object := &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		certificateChain = chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objectMap{object.key: object}, &certificateChain)
+		options := chain.Options{}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+	})
+	It("should issue each certificate with the CommonName of its service", func() {
+		Expect(certificateChain.CertificatesIssued).To(HaveLen(2), "should issue a certificate per service")
+		for _, serviceName := range []string{expectedService.Name, "barwebhook-service"} {
+			hostname := serviceHostname(serviceName, expectedService.Namespace)
+			certificateIssue := certificateChain.CertificatesIssued[hostname]
+			Expect(certificateIssue).ToNot(BeNil(), "should issue a certificate for %s", serviceName)
+			certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+			Expect(err).To(Succeed(), "should succeed parsing the certificate for %s", serviceName)
+			Expect(certs[len(certs)-1].Subject.CommonName).To(Equal(hostname), "should use the %s DNS name as CommonName", serviceName)
+		}
+	})
+})
+
+var _ = Describe("Webhook configuration with entries backed by different services and an URL", func() {
+	It("should inject every entry and issue one certificate serving all the services", func() {
+		webhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		barWebhook := webhook.Webhooks[0].DeepCopy()
+		barWebhook.Name = "barwebhook.qinqon.io"
+		barWebhook.ClientConfig.Service.Name = "barwebhook-service"
+		urlWebhook := webhook.Webhooks[0].DeepCopy()
+		urlWebhook.Name = "urlwebhook.qinqon.io"
+		urlWebhook.ClientConfig.Service = nil
+		webhookURL := "https://webhook.example.com/mutate"
+		urlWebhook.ClientConfig.URL = &webhookURL
+		webhook.Webhooks = append(webhook.Webhooks, *barWebhook, *urlWebhook)
+		object := &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", webhook.Name),
+			kobject: webhook,
+		}
+		objects := objectMap{object.key: object}
+		certificateChain := chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objects, &certificateChain)
+
+		mgr, err := NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithSANPolicy(SANPolicyUnion))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		mgr.applySANPolicy(objects, &certificateChain)
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		mapWebhookFromChain(object, &certificateChain)
+
+		for _, entry := range webhook.Webhooks {
+			Expect(entry.ClientConfig.CABundle).To(Equal(certificateChain.CA.CertPEM), "should inject the CA bundle into %s", entry.Name)
+		}
+
+		serviceHostnames := append(
+			newCertificateIssue(expectedService.Name, expectedService.Namespace).Hostnames,
+			newCertificateIssue(barWebhook.ClientConfig.Service.Name, expectedService.Namespace).Hostnames...)
+		for _, serviceName := range []string{expectedService.Name, barWebhook.ClientConfig.Service.Name} {
+			certs, err := triple.ParseCertsPEM(certificateChain.CertificatesIssued[serviceHostname(serviceName, expectedService.Namespace)].CertPEM)
+			Expect(err).To(Succeed(), "should succeed parsing the certificate for %s", serviceName)
+			Expect(certs[0].DNSNames).To(ConsistOf(serviceHostnames), "should issue the certificate for %s with the SANs of every service only", serviceName)
+		}
+		certs, err := triple.ParseCertsPEM(certificateChain.CertificatesIssued["webhook.example.com"].CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the certificate for the URL")
+		Expect(certs[0].DNSNames).To(ConsistOf("webhook.example.com"), "should issue the certificate for the URL with its own SANs")
+	})
+})
+
+var _ = Describe("Webhook configurations backed by different services", func() {
+	var (
+		certificateChain chain.CertificateChainData
+		objects          objectMap
+		barHostname      string
+	)
+	BeforeEach(func() {
+		mutatingWebhook := expectedMutatingWebhookConfiguration.DeepCopy()
+		mutatingObject := &keyedObject{
+			key:     newObjectKey(mutatingWebhookType, "", mutatingWebhook.Name),
+			kobject: mutatingWebhook,
+		}
+		barClientConfig := mutatingWebhook.Webhooks[0].ClientConfig.DeepCopy()
+		barClientConfig.Service.Name = "barwebhook-service"
+		validatingWebhook := &admissionregistrationv1.ValidatingWebhookConfiguration{
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{
+					Name:         "barwebhook.qinqon.io",
+					ClientConfig: *barClientConfig,
+				},
+			},
+		}
+		validatingWebhook.Name = "barwebhook"
+		validatingObject := &keyedObject{
+			key:     newObjectKey(validatingWebhookType, "", validatingWebhook.Name),
+			kobject: validatingWebhook,
+		}
+		barHostname = serviceHostname(barClientConfig.Service.Name, barClientConfig.Service.Namespace)
+
+		certificateChain = chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		objects = objectMap{mutatingObject.key: mutatingObject, validatingObject.key: validatingObject}
+		mapWebhookToChain(mutatingObject, objects, &certificateChain)
+		mapWebhookToChain(validatingObject, objects, &certificateChain)
+	})
+	DescribeTable("should issue the certificates with the SANs of the SAN policy",
+		func(policy SANPolicy, shouldUnion bool) {
+			mgr, err := NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithSANPolicy(policy))
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			mgr.applySANPolicy(objects, &certificateChain)
+			_, err = chain.Update(&mgr.options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed issuing certificates")
+
+			fooHostnames := newCertificateIssue(expectedService.Name, expectedService.Namespace).Hostnames
+			barHostnames := newCertificateIssue("barwebhook-service", expectedService.Namespace).Hostnames
+			allHostnames := append(append([]string{}, fooHostnames...), barHostnames...)
+			Expect(certificateChain.CertificatesIssued).To(HaveLen(2), "should issue a certificate per service")
+			for hostname, ownHostnames := range map[string][]string{
+				serviceHostname(expectedService.Name, expectedService.Namespace): fooHostnames,
+				barHostname: barHostnames,
+			} {
+				certs, err := triple.ParseCertsPEM(certificateChain.CertificatesIssued[hostname].CertPEM)
+				Expect(err).To(Succeed(), "should succeed parsing the certificate for %s", hostname)
+				if shouldUnion {
+					Expect(certs[0].DNSNames).To(ConsistOf(allHostnames), "should issue %s with the SANs of both services", hostname)
+				} else {
+					Expect(certs[0].DNSNames).To(ConsistOf(ownHostnames), "should issue %s with its own SANs only", hostname)
+				}
+			}
+		},
+		Entry("split by default", SANPolicy(""), false),
+		Entry("split", SANPolicySplit, false),
+		Entry("union", SANPolicyUnion, true),
+	)
+	It("should refuse an unknown SAN policy", func() {
+		_, err := NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithSANPolicy("Random"))
+		Expect(err).ToNot(Succeed(), "should fail constructing certificate manager")
+	})
+})
+
+var _ = Describe("Webhook configurations of both API versions", func() {
+	DescribeTable("should inject the CA bundle",
+		func(webhook client.Object, kind objectKind, caBundles func(client.Object) [][]byte) {
+			object := &keyedObject{
+				key:     newObjectKey(kind, "", webhook.GetName()),
+				kobject: webhook,
+			}
+			certificateChain := chain.CertificateChainData{
+				CA: chain.CA{
+					Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+				},
+			}
+			mapWebhookToChain(object, objectMap{object.key: object}, &certificateChain)
+			Expect(certificateChain.CertificatesIssued).To(HaveKey(serviceHostname(expectedService.Name, expectedService.Namespace)), "should issue a certificate for the service")
+			options := chain.Options{}
+			Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+			_, err := chain.Update(&options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed issuing certificates")
+			mapWebhookFromChain(object, &certificateChain)
+
+			for _, caBundle := range caBundles(object.kobject) {
+				Expect(caBundle).To(Equal(certificateChain.CA.CertPEM), "should inject the CA certificate as CA bundle")
+			}
+		},
+		Entry("v1 mutating", expectedMutatingWebhookConfiguration.DeepCopy(), mutatingWebhookType, func(webhook client.Object) [][]byte {
+			return [][]byte{webhook.(*admissionregistrationv1.MutatingWebhookConfiguration).Webhooks[0].ClientConfig.CABundle}
+		}),
+		Entry("v1beta1 mutating", &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foowebhook"},
+			Webhooks: []admissionregistrationv1beta1.MutatingWebhook{
+				{
+					Name: "foowebhook.qinqon.io",
+					ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+						Service: &admissionregistrationv1beta1.ServiceReference{
+							Name:      expectedService.Name,
+							Namespace: expectedService.Namespace,
+						},
+					},
+				},
+			},
+		}, mutatingWebhookV1beta1Type, func(webhook client.Object) [][]byte {
+			return [][]byte{webhook.(*admissionregistrationv1beta1.MutatingWebhookConfiguration).Webhooks[0].ClientConfig.CABundle}
+		}),
+		Entry("v1beta1 validating", &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foowebhook"},
+			Webhooks: []admissionregistrationv1beta1.ValidatingWebhook{
+				{
+					Name: "foowebhook.qinqon.io",
+					ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+						Service: &admissionregistrationv1beta1.ServiceReference{
+							Name:      expectedService.Name,
+							Namespace: expectedService.Namespace,
+						},
+					},
+				},
+			},
+		}, validatingWebhookV1beta1Type, func(webhook client.Object) [][]byte {
+			return [][]byte{webhook.(*admissionregistrationv1beta1.ValidatingWebhookConfiguration).Webhooks[0].ClientConfig.CABundle}
+		}),
+		Entry("v1beta1 mutating with an empty client config", &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foowebhook"},
+			Webhooks: []admissionregistrationv1beta1.MutatingWebhook{
+				{
+					Name: "foowebhook.qinqon.io",
+					ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+						Service: &admissionregistrationv1beta1.ServiceReference{
+							Name:      expectedService.Name,
+							Namespace: expectedService.Namespace,
+						},
+					},
+				},
+				{
+					Name: "empty.qinqon.io",
+				},
+			},
+		}, mutatingWebhookV1beta1Type, func(webhook client.Object) [][]byte {
+			webhooks := webhook.(*admissionregistrationv1beta1.MutatingWebhookConfiguration).Webhooks
+			return [][]byte{webhooks[0].ClientConfig.CABundle, webhooks[1].ClientConfig.CABundle}
+		}),
+	)
+	It("should clean the CA bundle of v1beta1 ones", func() {
+		webhook := &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foowebhook"},
+			Webhooks: []admissionregistrationv1beta1.ValidatingWebhook{
+				{
+					Name: "foowebhook.qinqon.io",
+					ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+						Service: &admissionregistrationv1beta1.ServiceReference{
+							Name:      expectedService.Name,
+							Namespace: expectedService.Namespace,
+						},
+						CABundle: []byte("foo"),
+					},
+				},
+				{
+					Name: "empty.qinqon.io",
+					ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+						CABundle: []byte("foo"),
+					},
+				},
+			},
+		}
+		cleanWebhook(&keyedObject{key: newObjectKey(validatingWebhookV1beta1Type, "", webhook.Name), kobject: webhook})
+		for _, w := range webhook.Webhooks {
+			Expect(w.ClientConfig.CABundle).To(BeNil(), "should clean the CA bundle of %s", w.Name)
+		}
+	})
+	It("should manage the aliases at the other API version only if configured", func() {
+		mgr := &Manager{
+			webhooks: []WebhookReference{
+				{Type: MutatingWebhook, Name: "foo"},
+				{Type: ValidatingWebhook, Name: "bar", APIVersion: WebhookAPIVersionV1beta1},
+				{Type: ValidatingWebhook, Name: "bar"},
+				{Type: CRDConversionWebhook, Name: "foos.qinqon.io"},
+			},
+		}
+		Expect(mgr.managedWebhooks()).To(Equal(mgr.webhooks), "should only manage the configured webhooks")
+
+		mgr.webhookAPIVersionAliases = true
+		alias := WebhookReference{Type: MutatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1beta1}
+		Expect(mgr.managedWebhooks()).To(Equal(append(mgr.webhooks, alias)), "should add the aliases not configured already")
+		Expect(mgr.isWebhookAlias(newObjectKey(webhookObjectKind(alias), "", alias.Name))).To(BeTrue(), "should flag the alias")
+		Expect(mgr.isWebhookAlias(newObjectKey(mutatingWebhookType, "", "foo"))).To(BeFalse(), "should not flag a configured webhook")
+		Expect(mgr.isWebhookAlias(newObjectKey(validatingWebhookV1beta1Type, "", "bar"))).To(BeFalse(), "should not flag a configured webhook of the other API version")
+	})
+	It("should map the webhook references to their API version kinds", func() {
+		for _, webhook := range []WebhookReference{
+			{Type: MutatingWebhook, Name: "foo"},
+			{Type: ValidatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1},
+			{Type: MutatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1beta1},
+			{Type: ValidatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1beta1},
+			{Type: CRDConversionWebhook, Name: "foo"},
+			{Type: APIService, Name: "foo"},
+		} {
+			key := newObjectKey(webhookObjectKind(webhook), "", webhook.Name)
+			Expect(objectOperatorsMap).To(HaveKey(key.Kind), "should have operators for %s", webhook)
+			reference, isWebhook := webhookReference(key)
+			Expect(isWebhook).To(BeTrue(), "should be a webhook key")
+			Expect(reference.String()).To(Equal(webhook.String()), "should map back to %s", webhook)
+		}
+	})
+})
+
+var _ = Describe("Webhook configurations diverged between API versions", func() {
+	newObjects := func(v1Webhooks, v1beta1Webhooks []string) (objectMap, *objectKey, *objectKey) {
+		v1Webhook := &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", UID: "foo-uid"},
+		}
+		for _, name := range v1Webhooks {
+			v1Webhook.Webhooks = append(v1Webhook.Webhooks, admissionregistrationv1.MutatingWebhook{
+				Name: name,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{Name: "foo", Namespace: "bar"},
+				},
+			})
+		}
+		v1beta1Webhook := &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", UID: "foo-uid"},
+		}
+		for _, name := range v1beta1Webhooks {
+			v1beta1Webhook.Webhooks = append(v1beta1Webhook.Webhooks, admissionregistrationv1beta1.MutatingWebhook{
+				Name: name,
+				ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+					Service: &admissionregistrationv1beta1.ServiceReference{Name: "stale", Namespace: "bar"},
+				},
+			})
+		}
+		v1Key := newObjectKey(mutatingWebhookType, "", "foo")
+		v1beta1Key := newObjectKey(mutatingWebhookV1beta1Type, "", "foo")
+		return objectMap{
+			v1Key:      &keyedObject{key: v1Key, kobject: v1Webhook},
+			v1beta1Key: &keyedObject{key: v1beta1Key, kobject: v1beta1Webhook},
+		}, v1Key, v1beta1Key
+	}
+
+	var (
+		mgr *Manager
+		log *recordingLogger
+	)
+	BeforeEach(func() {
+		log = &recordingLogger{}
+		mgr = &Manager{
+			webhooks:                 []WebhookReference{{Type: MutatingWebhook, Name: "foo"}},
+			webhookAPIVersionAliases: true,
+			log:                      log,
+		}
+	})
+
+	It("should inject the v1 one only and warn about the divergence", func() {
+		objects, v1Key, v1beta1Key := newObjects([]string{"a.qinqon.io", "b.qinqon.io"}, []string{"a.qinqon.io"})
+		certificateChain := chain.CertificateChainData{}
+		Expect(mgr.mapWebhooksToChain(objects, &certificateChain)).To(Succeed(), "should succeed mapping the webhook configurations")
+		Expect(objects).To(HaveKey(v1Key), "should inject the v1 webhook configuration")
+		Expect(objects).ToNot(HaveKey(v1beta1Key), "should not inject the v1beta1 webhook configuration")
+		Expect(log.messages).To(ContainElement(ContainSubstring("stale v1beta1 one should be cleaned up")), "should warn about the divergence")
+		Expect(certificateChain.CertificatesIssued).To(HaveKey(serviceHostname("foo", "bar")), "should issue a certificate for the service of the v1 one")
+		Expect(certificateChain.CertificatesIssued).ToNot(HaveKey(serviceHostname("stale", "bar")), "should not issue a certificate for the service of the stale v1beta1 one")
+		Expect(objects).To(HaveKey(newObjectKey(secretType, "bar", "foo")), "should write the secret of the service of the v1 one")
+		Expect(objects).ToNot(HaveKey(newObjectKey(secretType, "bar", "stale")), "should not write a secret for the service of the stale v1beta1 one")
+	})
+
+	It("should inject both if not diverged", func() {
+		objects, v1Key, v1beta1Key := newObjects([]string{"a.qinqon.io"}, []string{"a.qinqon.io"})
+		Expect(mgr.mapWebhooksToChain(objects, &chain.CertificateChainData{})).To(Succeed(), "should succeed mapping the webhook configurations")
+		Expect(objects).To(HaveKey(v1Key), "should inject the v1 webhook configuration")
+		Expect(objects).To(HaveKey(v1beta1Key), "should inject the v1beta1 webhook configuration")
+		Expect(log.messages).To(BeEmpty(), "should not warn")
+	})
+})
+
+var _ = Describe("CustomResourceDefinition conversion webhook", func() {
+	var (
+		object           *keyedObject
+		certificateChain chain.CertificateChainData
+		options          chain.Options
+		now              time.Time
+	)
+	caBundle := func() []byte {
+		return object.kobject.(*apiextensionsv1.CustomResourceDefinition).Spec.Conversion.Webhook.ClientConfig.CABundle
+	}
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second).UTC()
+		triple.Now = func() time.Time { return now }
+
+		crd := &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: "foos.qinqon.io"},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Conversion: &apiextensionsv1.CustomResourceConversion{
+					Strategy: apiextensionsv1.WebhookConverter,
+					Webhook: &apiextensionsv1.WebhookConversion{
+						ClientConfig: &apiextensionsv1.WebhookClientConfig{
+							Service: &apiextensionsv1.ServiceReference{
+								Name:      expectedService.Name,
+								Namespace: expectedService.Namespace,
+							},
+						},
+					},
+				},
+			},
+		}
+		object = &keyedObject{
+			key:     newObjectKey(crdConversionWebhookType, "", crd.Name),
+			kobject: crd,
+		}
+		certificateChain = chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objectMap{object.key: object}, &certificateChain)
+		options = chain.Options{
+			CARotateInterval:   time.Hour,
+			CertRotateInterval: 30 * time.Minute,
+		}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		mapWebhookFromChain(object, &certificateChain)
+	})
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+	It("should issue a certificate for the conversion webhook service", func() {
+		certificateIssue := certificateChain.CertificatesIssued[serviceHostname(expectedService.Name, expectedService.Namespace)]
+		Expect(certificateIssue).ToNot(BeNil(), "should issue a certificate for the service")
+		certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the certificate")
+		Expect(certs[0].DNSNames).To(ContainElement(serviceFqdn(expectedService.Name, expectedService.Namespace)), "should have the service SANs")
+	})
+	It("should inject the CA bundle and refresh it on rotation", func() {
+		Expect(caBundle()).To(Equal(certificateChain.CA.CertPEM), "should inject the CA certificate as CA bundle")
+		Expect(validateWebhook(object)).To(Succeed(), "should only inject certificates")
+
+		By("Rotating the CA")
+		previousCABundle := caBundle()
+		now = now.Add(2 * options.CARotateInterval)
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed rotating certificates")
+		mapWebhookFromChain(object, &certificateChain)
+		Expect(caBundle()).ToNot(Equal(previousCABundle), "should refresh the CA bundle")
+		Expect(caBundle()).To(ContainSubstring(string(certificateChain.CA.CertPEM)), "should inject the rotated CA certificate")
+	})
+	It("should track the CRD as a conversion webhook", func() {
+		Expect(anyClientConfigMap(object.kobject)).To(HaveKey(crdConversionWebhookName), "should map the conversion webhook client config")
+		Expect(cleanWebhook(object)).To(BeFalse(), "should not delete the CRD on cleanup")
+		Expect(caBundle()).To(BeEmpty(), "should clear the CA bundle on cleanup")
+	})
+})
+
+var _ = Describe("APIService", func() {
+	var (
+		object           *keyedObject
+		certificateChain chain.CertificateChainData
+		options          chain.Options
+		now              time.Time
+	)
+	caBundle := func() []byte {
+		encoded, _, err := unstructured.NestedString(object.kobject.(*unstructured.Unstructured).Object, "spec", "caBundle")
+		Expect(err).To(Succeed(), "should have a string CA bundle")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		Expect(err).To(Succeed(), "should have a base64 encoded CA bundle")
+		return decoded
+	}
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second).UTC()
+		triple.Now = func() time.Time { return now }
+
+		apiService := initAPIService("v1beta1.metrics.qinqon.io", "").(*unstructured.Unstructured)
+		apiService.Object["spec"] = map[string]interface{}{
+			"group":   "metrics.qinqon.io",
+			"version": "v1beta1",
+			"service": map[string]interface{}{
+				"name":      expectedService.Name,
+				"namespace": expectedService.Namespace,
+				"port":      int64(8443),
+			},
+		}
+		object = &keyedObject{
+			key:     newObjectKey(apiServiceType, "", apiService.GetName()),
+			kobject: apiService,
+		}
+		certificateChain = chain.CertificateChainData{
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		mapWebhookToChain(object, objectMap{object.key: object}, &certificateChain)
+		options = chain.Options{
+			CARotateInterval:   time.Hour,
+			CertRotateInterval: 30 * time.Minute,
+		}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		mapWebhookFromChain(object, &certificateChain)
+	})
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+	It("should issue a certificate for the backing service", func() {
+		certificateIssue := certificateChain.CertificatesIssued[serviceHostname(expectedService.Name, expectedService.Namespace)]
+		Expect(certificateIssue).ToNot(BeNil(), "should issue a certificate for the service")
+		certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the certificate")
+		Expect(certs[0].DNSNames).To(ContainElement(serviceFqdn(expectedService.Name, expectedService.Namespace)), "should have the service SANs")
+	})
+	It("should inject the CA bundle and refresh it on rotation", func() {
+		Expect(caBundle()).To(Equal(certificateChain.CA.CertPEM), "should inject the CA certificate as CA bundle")
+		port, _, _ := unstructured.NestedInt64(object.kobject.(*unstructured.Unstructured).Object, "spec", "service", "port")
+		Expect(port).To(Equal(int64(8443)), "should leave the rest of the spec untouched")
+
+		By("Rotating the CA")
+		previousCABundle := caBundle()
+		now = now.Add(2 * options.CARotateInterval)
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed rotating certificates")
+		mapWebhookFromChain(object, &certificateChain)
+		Expect(caBundle()).ToNot(Equal(previousCABundle), "should refresh the CA bundle")
+		Expect(caBundle()).To(ContainSubstring(string(certificateChain.CA.CertPEM)), "should inject the rotated CA certificate")
+	})
+	It("should remove the CA bundle on cleanup", func() {
+		Expect(cleanWebhook(object)).To(BeFalse(), "should not delete the APIService on cleanup")
+		_, found, _ := unstructured.NestedString(object.kobject.(*unstructured.Unstructured).Object, "spec", "caBundle")
+		Expect(found).To(BeFalse(), "should remove the CA bundle")
+	})
+	It("should ignore an APIService served by the API server", func() {
+		unstructured.RemoveNestedField(object.kobject.(*unstructured.Unstructured).Object, "spec", "service")
+		Expect(anyClientConfigMap(object.kobject)).To(BeEmpty(), "should have no client config")
+	})
+})
+
+var _ = Describe("Webhook configuration alias written after the one it is an alias of", func() {
+	var (
+		mgr              *Manager
+		certificateChain = chain.CertificateChainData{CA: chain.CA{CertPEM: []byte("ca")}}
+		old              *admissionregistrationv1beta1.MutatingWebhookConfiguration
+	)
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{},
+			[]WebhookReference{{Type: MutatingWebhook, Name: "foo"}}, WithWebhookAPIVersionAliases())
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		old = &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "1", Generation: 1},
+			Webhooks:   []admissionregistrationv1beta1.MutatingWebhook{{Name: "foo.example.com"}},
+		}
+	})
+
+	// readAgain returns the alias as read again after being changed by
+	// change, mapped from the certificate chain
+	readAgain := func(change func(*admissionregistrationv1beta1.MutatingWebhookConfiguration)) client.Object {
+		current := old.DeepCopy()
+		current.ResourceVersion = "2"
+		current.Generation = 2
+		change(current)
+		object := &keyedObject{key: newObjectKey(mutatingWebhookV1beta1Type, "", "foo"), kobject: current}
+		mgr.mapObjectFromChain(object, current.DeepCopy(), false, &certificateChain)
+		return object.kobject
+	}
+
+	It("should be written if it only changed in the injected CA bundle", func() {
+		mapped := readAgain(func(current *admissionregistrationv1beta1.MutatingWebhookConfiguration) {
+			current.Webhooks[0].ClientConfig.CABundle = []byte("ca")
+		})
+		Expect(mgr.aliasChangedByMappingOnly(newObjectKey(mutatingWebhookV1beta1Type, "", "foo"), old, mapped, &certificateChain)).To(BeTrue(), "should consider it unchanged")
+	})
+
+	It("should not be written if it was edited concurrently", func() {
+		mapped := readAgain(func(current *admissionregistrationv1beta1.MutatingWebhookConfiguration) {
+			current.Webhooks = append(current.Webhooks, admissionregistrationv1beta1.MutatingWebhook{Name: "bar.example.com"})
+		})
+		Expect(mgr.aliasChangedByMappingOnly(newObjectKey(mutatingWebhookV1beta1Type, "", "foo"), old, mapped, &certificateChain)).To(BeFalse(), "should consider it changed")
+	})
+
+	It("should not apply to the configurations managed", func() {
+		current := &admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+		Expect(mgr.aliasChangedByMappingOnly(newObjectKey(mutatingWebhookType, "", "foo"), current.DeepCopy(), current, &certificateChain)).To(BeFalse(), "should not consider it an alias")
+	})
+})
+
+// recordingLogger records the messages logged through it
+type recordingLogger struct {
+	messages []string
+}
+
+func (l *recordingLogger) Enabled() bool { return true }
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordingLogger) V(level int) logr.Logger { return l }
+
+func (l *recordingLogger) WithValues(keysAndValues ...interface{}) logr.Logger { return l }
+
+func (l *recordingLogger) WithName(name string) logr.Logger { return l }
@@ -2,11 +2,17 @@ package certificate
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/workqueue"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
@@ -15,8 +21,16 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
 )
 
+// deferredRequeueAfter is how long a reconcile deferring the rotation of the
+// certificates waits to check its precondition again, such as the service
+// endpoints being ready, which are not watched, unless it knows when it is
+// met
+const deferredRequeueAfter = 30 * time.Second
+
 // Add creates a new Node Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func (m *Manager) Add(mgr manager.Manager) error {
@@ -32,6 +46,108 @@ func (m *Manager) add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return errors.Wrap(err, "failed instanciating certificate controller")
 	}
 
+	onEventForThisWebhook := m.onEventForThisWebhook()
+	enqueueForThisWebhook := m.enqueueForThisWebhook()
+
+	logger.Info("Starting to watch secrets")
+	err = c.Watch(&source.Kind{Type: &corev1.Secret{}}, enqueueForThisWebhook, onEventForThisWebhook)
+	if err != nil {
+		return errors.Wrap(err, "failed watching Secret")
+	}
+
+	if m.caConfigMapName != "" {
+		logger.Info("Starting to watch configmaps")
+		err = c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, enqueueForThisWebhook, onEventForThisWebhook)
+		if err != nil {
+			return errors.Wrap(err, "failed watching ConfigMap")
+		}
+	}
+
+	if m.caConfigMapName != "" && m.caConfigMapNamespaceSelector != nil {
+		logger.Info("Starting to watch namespaces")
+		err = c.Watch(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestForObject{}, m.onCAConfigMapNamespaceEvent())
+		if err != nil {
+			return errors.Wrap(err, "failed watching Namespace")
+		}
+	}
+
+	logger.Info("Starting to watch validatingwebhookconfiguration")
+	err = c.Watch(&source.Kind{Type: &admissionregistrationv1.ValidatingWebhookConfiguration{}}, enqueueForThisWebhook, onEventForThisWebhook)
+	if err != nil {
+		return errors.Wrap(err, "failed watching ValidatingWebhookConfiguration")
+	}
+
+	logger.Info("Starting to watch mutatingwebhookconfiguration")
+	err = c.Watch(&source.Kind{Type: &admissionregistrationv1.MutatingWebhookConfiguration{}}, enqueueForThisWebhook, onEventForThisWebhook)
+	if err != nil {
+		return errors.Wrap(err, "failed watching MutatingWebhookConfiguration")
+	}
+
+	if m.managesWebhookAPIVersion(WebhookAPIVersionV1beta1) || m.webhookAPIVersionAliases && servesWebhookAPIVersion(mgr, WebhookAPIVersionV1beta1) {
+		logger.Info("Starting to watch v1beta1 validatingwebhookconfiguration")
+		err = c.Watch(&source.Kind{Type: &admissionregistrationv1beta1.ValidatingWebhookConfiguration{}}, enqueueForThisWebhook, onEventForThisWebhook)
+		if err != nil {
+			return errors.Wrap(err, "failed watching v1beta1 ValidatingWebhookConfiguration")
+		}
+
+		logger.Info("Starting to watch v1beta1 mutatingwebhookconfiguration")
+		err = c.Watch(&source.Kind{Type: &admissionregistrationv1beta1.MutatingWebhookConfiguration{}}, enqueueForThisWebhook, onEventForThisWebhook)
+		if err != nil {
+			return errors.Wrap(err, "failed watching v1beta1 MutatingWebhookConfiguration")
+		}
+	}
+
+	if m.managesWebhookType(CRDConversionWebhook) {
+		logger.Info("Starting to watch customresourcedefinition")
+		err = c.Watch(&source.Kind{Type: &apiextensionsv1.CustomResourceDefinition{}}, enqueueForThisWebhook, onEventForThisWebhook)
+		if err != nil {
+			return errors.Wrap(err, "failed watching CustomResourceDefinition")
+		}
+	}
+
+	if m.managesWebhookType(APIService) {
+		logger.Info("Starting to watch apiservice")
+		err = c.Watch(&source.Kind{Type: initAPIService("", "")}, enqueueForThisWebhook, onEventForThisWebhook)
+		if err != nil {
+			return errors.Wrap(err, "failed watching APIService")
+		}
+	}
+
+	return nil
+}
+
+// managesWebhookAPIVersion returns whether any of the managed webhook
+// configurations is managed with apiVersion
+func (m *Manager) managesWebhookAPIVersion(apiVersion WebhookAPIVersion) bool {
+	for _, webhookRef := range m.webhooks {
+		if webhookRef.APIVersion == apiVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// servesWebhookAPIVersion returns whether the cluster serves the webhook
+// configurations with apiVersion
+func servesWebhookAPIVersion(mgr manager.Manager, apiVersion WebhookAPIVersion) bool {
+	_, err := mgr.GetRESTMapper().RESTMapping(admissionregistrationv1.SchemeGroupVersion.WithKind("MutatingWebhookConfiguration").GroupKind(), string(apiVersion))
+	return err == nil
+}
+
+// managesWebhookType returns whether any of the managed webhooks is of the
+// given type
+func (m *Manager) managesWebhookType(webhookType WebhookType) bool {
+	for _, webhookRef := range m.webhooks {
+		if webhookRef.Type == webhookType {
+			return true
+		}
+	}
+	return false
+}
+
+// onEventForThisWebhook filters the events of the objects related to the
+// managed webhooks
+func (m *Manager) onEventForThisWebhook() predicate.Funcs {
 	isAnnotatedResource := func(object client.Object) bool {
 		_, foundAnnotation := object.GetAnnotations()[secretManagedAnnotationKey]
 		return foundAnnotation
@@ -39,16 +155,34 @@ func (m *Manager) add(mgr manager.Manager, r reconcile.Reconciler) error {
 
 	isWebhookConfig := func(object client.Object) bool {
 		var webhookType WebhookType
+		apiVersion := WebhookAPIVersionV1
 		switch object.(type) {
 		case *admissionregistrationv1.MutatingWebhookConfiguration:
 			webhookType = MutatingWebhook
 		case *admissionregistrationv1.ValidatingWebhookConfiguration:
 			webhookType = ValidatingWebhook
+		case *admissionregistrationv1beta1.MutatingWebhookConfiguration:
+			webhookType = MutatingWebhook
+			apiVersion = WebhookAPIVersionV1beta1
+		case *admissionregistrationv1beta1.ValidatingWebhookConfiguration:
+			webhookType = ValidatingWebhook
+			apiVersion = WebhookAPIVersionV1beta1
+		case *apiextensionsv1.CustomResourceDefinition:
+			webhookType = CRDConversionWebhook
+		case *unstructured.Unstructured:
+			if _, ok := isAPIService(object); !ok {
+				return false
+			}
+			webhookType = APIService
 		default:
 			return false
 		}
-		for _, webhookRef := range m.webhooks {
-			if webhookRef.Name == object.GetName() && webhookRef.Type == webhookType {
+		for _, webhookRef := range m.managedWebhooks() {
+			webhookRefAPIVersion := webhookRef.APIVersion
+			if webhookRefAPIVersion == "" {
+				webhookRefAPIVersion = WebhookAPIVersionV1
+			}
+			if webhookRef.Name == object.GetName() && webhookRef.Type == webhookType && webhookRefAPIVersion == apiVersion {
 				return true
 			}
 		}
@@ -56,7 +190,7 @@ func (m *Manager) add(mgr manager.Manager, r reconcile.Reconciler) error {
 	}
 
 	// Watch only events for selected m.webhookName
-	onEventForThisWebhook := predicate.Funcs{
+	return predicate.Funcs{
 		CreateFunc: func(createEvent event.CreateEvent) bool {
 			return isWebhookConfig(createEvent.Object) || isAnnotatedResource(createEvent.Object)
 		},
@@ -70,38 +204,102 @@ func (m *Manager) add(mgr manager.Manager, r reconcile.Reconciler) error {
 			return isWebhookConfig(genericEvent.Object) || isAnnotatedResource(genericEvent.Object)
 		},
 	}
+}
 
-	logger.Info("Starting to watch secrets")
-	err = c.Watch(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForObject{}, onEventForThisWebhook)
-	if err != nil {
-		return errors.Wrap(err, "failed watching Secret")
-	}
+// relistEnqueue enqueues the objects as handler.EnqueueRequestForObject does,
+// forgetting the cached secrets on updates of unchanged objects. Informers
+// notify unchanged objects on relist after a watch reset or on resync, the
+// cached view may have missed events so the following reconcile has to read
+// everything again.
+type relistEnqueue struct {
+	handler.EnqueueRequestForObject
+	forgetSecrets func()
+}
 
-	logger.Info("Starting to watch validatingwebhookconfiguration")
-	err = c.Watch(&source.Kind{Type: &admissionregistrationv1.ValidatingWebhookConfiguration{}}, &handler.EnqueueRequestForObject{}, onEventForThisWebhook)
-	if err != nil {
-		return errors.Wrap(err, "failed watching ValidatingWebhookConfiguration")
+// Update forgets the cached secrets if the object is unchanged and enqueues it
+func (e *relistEnqueue) Update(updateEvent event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	if updateEvent.ObjectOld != nil && updateEvent.ObjectNew != nil &&
+		updateEvent.ObjectOld.GetResourceVersion() == updateEvent.ObjectNew.GetResourceVersion() {
+		e.forgetSecrets()
 	}
+	e.EnqueueRequestForObject.Update(updateEvent, q)
+}
 
-	logger.Info("Starting to watch mutatingwebhookconfiguration")
-	err = c.Watch(&source.Kind{Type: &admissionregistrationv1.MutatingWebhookConfiguration{}}, &handler.EnqueueRequestForObject{}, onEventForThisWebhook)
-	if err != nil {
-		return errors.Wrap(err, "failed watching MutatingWebhookConfiguration")
-	}
+// enqueueForThisWebhook enqueues the events of the objects related to the
+// managed webhooks, as filtered by onEventForThisWebhook
+func (m *Manager) enqueueForThisWebhook() handler.EventHandler {
+	return &relistEnqueue{forgetSecrets: m.forgetSecrets}
+}
 
-	return nil
+// onCAConfigMapNamespaceEvent filters the events of the namespaces starting
+// or stopping to match the CA ConfigMap namespace selector, so that the CA
+// ConfigMap is written to or deleted from them
+func (m *Manager) onCAConfigMapNamespaceEvent() predicate.Funcs {
+	matches := func(object client.Object) bool {
+		return m.caConfigMapNamespaceSelector.Matches(labels.Set(object.GetLabels()))
+	}
+	return predicate.Funcs{
+		CreateFunc: func(createEvent event.CreateEvent) bool {
+			return matches(createEvent.Object)
+		},
+		DeleteFunc: func(event.DeleteEvent) bool {
+			return false
+		},
+		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+			return matches(updateEvent.ObjectOld) != matches(updateEvent.ObjectNew)
+		},
+		GenericFunc: func(event.GenericEvent) bool {
+			return false
+		},
+	}
 }
 
 func (m *Manager) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
 	logger := m.log.WithName("Reconcile")
 	logger.Info("Incoming reconcile request", "Request.Namespace", request.Namespace, "Request.Name", request.Name)
 
-	requeueAfter, err := m.reconcileCertificates()
+	// there is an event or a requeue for the object, read it again, and
+	// every secret on the scheduled requeue
+	m.forgetSecret(request.NamespacedName)
+	m.forgetExpiredSecrets()
+
+	requeueAfter, err := m.reconcileCertificates(ctx)
+	if IsDeferred(err) {
+		requeueAfter = m.capRequeue(deferredRetryAfter(err))
+		logger.Info("Reconcile deferred, requeuing", "reason", err.Error(), "RequeueAfter", requeueAfter)
+		return reconcile.Result{Requeue: true, RequeueAfter: requeueAfter}, nil
+	}
 	if err != nil {
 		logger.Error(err, "Reconcile failed, inmediate requeue")
+		m.handleError(err)
+		// the cached secrets may be stale and the cause of the failure
+		m.forgetSecrets()
 		return reconcile.Result{}, err
 	}
 
+	requeueAfter = m.capRequeue(requeueAfter)
+	m.expireSecrets(requeueAfter)
+
 	logger.Info("Reconcile done, requeuing", "RequeueAfter", requeueAfter)
 	return reconcile.Result{Requeue: true, RequeueAfter: requeueAfter}, nil
 }
+
+// capRequeue caps the requeue interval to the reconcile interval of the
+// certificate options, if set, since the certificates expiring before it are
+// the only ones rotated ahead of their rotation deadline
+func (m *Manager) capRequeue(requeueAfter time.Duration) time.Duration {
+	if m.options.ReconcileInterval > 0 && requeueAfter > m.options.ReconcileInterval {
+		return m.options.ReconcileInterval
+	}
+	return requeueAfter
+}
+
+// deferredRetryAfter returns the duration a deferred reconcile is retried
+// after, deferredRequeueAfter unless the deferral knows when to retry
+func deferredRetryAfter(err error) time.Duration {
+	deferred := &DeferredError{}
+	if !errors.As(err, &deferred) || deferred.RetryAt.IsZero() {
+		return deferredRequeueAfter
+	}
+	return deferred.RetryAt.Sub(triple.Now())
+}
@@ -4,15 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -379,6 +384,125 @@ var _ = Describe("Certificates controller", func() {
 	})
 })
 
+var _ = Describe("Relisted objects events", func() {
+	var (
+		mgr                  *Manager
+		webhookConfiguration *admissionregistrationv1.MutatingWebhookConfiguration
+		queue                workqueue.RateLimitingInterface
+	)
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManagerWithOptions("foo", "bar", nil, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}}, WithCache())
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		mgr.secretCache[types.NamespacedName{Namespace: "bar", Name: "foo-ca"}] = &corev1.Secret{}
+		webhookConfiguration = &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "1"},
+		}
+		queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	})
+	AfterEach(func() {
+		queue.ShutDown()
+	})
+	It("should forget the cached secrets at the event handler and not at the predicate", func() {
+		relistEvent := event.UpdateEvent{
+			ObjectOld: webhookConfiguration.DeepCopy(),
+			ObjectNew: webhookConfiguration.DeepCopy(),
+		}
+		Expect(mgr.onEventForThisWebhook().Update(relistEvent)).To(BeTrue(), "should reconcile the relisted webhook configuration")
+		Expect(mgr.secretCache).To(HaveLen(1), "should not forget the cached secrets filtering the event")
+
+		mgr.enqueueForThisWebhook().Update(relistEvent, queue)
+		Expect(mgr.secretCache).To(BeEmpty(), "should forget the cached secrets handling the event")
+		Expect(queue.Len()).To(Equal(1), "should enqueue the relisted webhook configuration")
+	})
+	It("should keep the cached secrets on changed objects", func() {
+		updated := webhookConfiguration.DeepCopy()
+		updated.ResourceVersion = "2"
+		mgr.enqueueForThisWebhook().Update(event.UpdateEvent{
+			ObjectOld: webhookConfiguration,
+			ObjectNew: updated,
+		}, queue)
+		Expect(mgr.secretCache).To(HaveLen(1), "should keep the cached secrets")
+		Expect(queue.Len()).To(Equal(1), "should enqueue the updated webhook configuration")
+	})
+})
+
+var _ = Describe("Reconcile interval", func() {
+	DescribeTable("should cap the requeue interval to it",
+		func(reconcileInterval, requeueAfter, expectedRequeueAfter time.Duration) {
+			mgr, err := NewManager("foo", "bar", nil, chain.Options{ReconcileInterval: reconcileInterval}, []WebhookReference{})
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			Expect(mgr.capRequeue(requeueAfter)).To(Equal(expectedRequeueAfter), "should requeue at the expected interval")
+		},
+		Entry("without reconcile interval", time.Duration(0), 24*time.Hour, 24*time.Hour),
+		Entry("with a requeue beyond it", time.Hour, 24*time.Hour, time.Hour),
+		Entry("with a requeue before it", time.Hour, 10*time.Minute, 10*time.Minute),
+	)
+})
+
+var _ = Describe("Reconcile jitter", func() {
+	const jitter = 0.1
+	It("should vary the rotation deadlines of certificates issued together within the configured jitter band", func() {
+		now := time.Now()
+		triple.Now = func() time.Time { return now }
+		defer func() { triple.Now = time.Now }()
+		mgr, err := NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{CARotateInterval: 3 * time.Hour},
+			[]WebhookReference{},
+			WithReconcileJitter(jitter),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		unjittered := now.Add(mgr.options.CertRotateInterval - mgr.options.CertOverlapInterval)
+		life := unjittered.Sub(now)
+
+		deadlines := map[time.Time]struct{}{}
+		for i := 0; i < 10; i++ {
+			certificateChain := chain.CertificateChainData{
+				CertificatesIssued: map[string]*chain.CertificateIssue{
+					"foo": {Name: "foo", Hostnames: []string{"foo"}, CACertPEM: map[string][]byte{}},
+				},
+			}
+			_, err := chain.Update(&mgr.options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed issuing certificates")
+			_, deadline, err := chain.RotationDeadlines(&mgr.options, &certificateChain)
+			Expect(err).To(Succeed(), "should succeed finding deadlines")
+			Expect(deadline).To(BeTemporally("<=", unjittered), "should not delay the rotation")
+			Expect(deadline).To(BeTemporally(">=", unjittered.Add(-time.Duration(jitter*float64(life)))), "should not bring forward the rotation more than the jitter")
+
+			By("Reconciling again closer to the deadline")
+			triple.Now = func() time.Time { return now.Add(deadline.Sub(now) / 2) }
+			_, laterDeadline, err := chain.RotationDeadlines(&mgr.options, &certificateChain)
+			triple.Now = func() time.Time { return now }
+			Expect(err).To(Succeed(), "should succeed finding deadlines")
+			Expect(laterDeadline).To(Equal(deadline), "should keep the rotation deadline between reconciles")
+			deadlines[deadline] = struct{}{}
+		}
+		Expect(len(deadlines)).To(BeNumerically(">", 1), "should vary the rotation deadline")
+	})
+	DescribeTable("should clamp the configured jitter to its range",
+		func(jitter, expectedJitter float64) {
+			mgr, err := NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{},
+				[]WebhookReference{},
+				WithReconcileJitter(jitter),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			Expect(mgr.options.RotationJitter).To(Equal(expectedJitter), "should clamp the jitter")
+		},
+		Entry("within the range", 0.5, 0.5),
+		Entry("at the maximum", MaxReconcileJitter, MaxReconcileJitter),
+		Entry("above the maximum", 1.0, MaxReconcileJitter),
+		Entry("negative", -0.5, 0.0),
+		Entry("not a number", math.NaN(), 0.0),
+	)
+})
+
 func getCASecret() (corev1.Secret, error) {
 	obtainedSecret := corev1.Secret{}
 	err := cli.Get(context.TODO(), types.NamespacedName{Namespace: expectedCASecret.Namespace, Name: expectedCASecret.Name}, &obtainedSecret)
@@ -0,0 +1,64 @@
+package certificate
+
+import (
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// crd.go handles the conversion webhooks of CustomResourceDefinitions. They
+// are mapped to and from certificate chain data as admission webhooks are,
+// through their client config, which the manager client has to be able to
+// get and update, apiextensions v1 being part of its scheme.
+
+// crdConversionWebhookName is the name the conversion webhook of a
+// CustomResourceDefinition is tracked with, as if it was one of the webhooks
+// of a webhook configuration.
+const crdConversionWebhookName = "conversion"
+
+func initCRDConversionWebhook(name, namespace string) client.Object {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+// crdConversionClientConfig returns the client config of the conversion
+// webhook of a CustomResourceDefinition converted to an admission webhook one,
+// nil if it has no conversion webhook. It does not share memory with the
+// CustomResourceDefinition, CA bundles set on it are stored back with
+// storeClientConfigs.
+func crdConversionClientConfig(crd *apiextensionsv1.CustomResourceDefinition) *admissionregistrationv1.WebhookClientConfig {
+	conversion := crd.Spec.Conversion
+	if conversion == nil || conversion.Webhook == nil || conversion.Webhook.ClientConfig == nil {
+		return nil
+	}
+	clientConfig := conversion.Webhook.ClientConfig
+	converted := &admissionregistrationv1.WebhookClientConfig{
+		URL:      clientConfig.URL,
+		CABundle: clientConfig.CABundle,
+	}
+	if clientConfig.Service != nil {
+		converted.Service = &admissionregistrationv1.ServiceReference{
+			Namespace: clientConfig.Service.Namespace,
+			Name:      clientConfig.Service.Name,
+			Path:      clientConfig.Service.Path,
+			Port:      clientConfig.Service.Port,
+		}
+	}
+	return converted
+}
+
+// storeCRDConversionClientConfig stores back at a CustomResourceDefinition
+// the CA bundle of the client config of its conversion webhook, if any.
+func storeCRDConversionClientConfig(crd *apiextensionsv1.CustomResourceDefinition, clientConfigs map[string]*admissionregistrationv1.WebhookClientConfig) {
+	converted, found := clientConfigs[crdConversionWebhookName]
+	conversion := crd.Spec.Conversion
+	if !found || conversion == nil || conversion.Webhook == nil || conversion.Webhook.ClientConfig == nil {
+		return
+	}
+	conversion.Webhook.ClientConfig.CABundle = converted.CABundle
+}
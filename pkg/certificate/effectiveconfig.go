@@ -0,0 +1,135 @@
+package certificate
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// EffectiveConfig is the configuration a Manager runs with, as resolved from
+// its options with the defaults applied, for debugging purposes.
+type EffectiveConfig struct {
+	// Name and Namespace of the manager
+	Name      string
+	Namespace string
+
+	// Webhooks are the webhook configurations the CA bundle is injected
+	// into, with their API version resolved
+	Webhooks []WebhookReference
+
+	// Certificate are the certificate options, with their durations and
+	// renew before intervals resolved and their key sizes, serial number
+	// size, usages and policies defaulted
+	Certificate chain.Options
+
+	// KeyAlgorithm is the algorithm of the CA and service keys
+	KeyAlgorithm triple.KeyAlgorithm
+
+	// ClusterDomains are the cluster domains the service certificates are
+	// issued for
+	ClusterDomains []string
+
+	// ExtraAltNames, if set, are SANs the service certificates are issued
+	// with along the ones of the services
+	ExtraAltNames *triple.AltNames
+
+	// CASecret is the secret the CA key pair is stored at, unset with the
+	// combined secret layout
+	CASecret types.NamespacedName
+
+	// ServiceSecret, if set, is the secret the service certificate is stored
+	// at instead of the one named after the service
+	ServiceSecret *types.NamespacedName
+
+	// SecretLayout, SANPolicy, HealthPolicy and CAConfigMapLayout are the
+	// policies the manager runs with
+	SecretLayout      SecretLayout
+	SANPolicy         SANPolicy
+	HealthPolicy      HealthPolicy
+	CAConfigMapLayout CAConfigMapLayout
+
+	// CAConfigMapName, if set, is the ConfigMap the CA bundle is mirrored to
+	CAConfigMapName string
+
+	// CertificateHistory is the number of rotated certificates kept on
+	// service secrets
+	CertificateHistory int
+
+	// CARotationNoticeLead is the time ahead of a CA rotation it is notified
+	// at
+	CARotationNoticeLead time.Duration
+
+	// EndpointsReadinessTimeout, if set, is the time scheduled rotations are
+	// deferred for while the webhook services have no ready endpoints
+	EndpointsReadinessTimeout time.Duration
+
+	// CertDir, if set, is the directory the service key pair is written to
+	CertDir string
+
+	// AuditLog is set if rotated certificates are written to an audit log
+	AuditLog bool
+
+	// ExternalCABundle is set if the CA bundle is injected as is instead of
+	// generating certificates
+	ExternalCABundle bool
+}
+
+// EffectiveConfig returns the configuration the manager runs with, its options
+// resolved with the defaults applied, so that it can be checked against the
+// inputs it was constructed with.
+func (m *Manager) EffectiveConfig() EffectiveConfig {
+	config := EffectiveConfig{
+		Name:                      m.name,
+		Namespace:                 m.namespace,
+		Certificate:               m.options,
+		KeyAlgorithm:              m.options.KeyAlgorithm,
+		SecretLayout:              m.secretLayout,
+		SANPolicy:                 m.sanPolicy,
+		HealthPolicy:              m.healthPolicy,
+		CAConfigMapLayout:         m.caConfigMapLayout,
+		CAConfigMapName:           m.caConfigMapName,
+		CertificateHistory:        m.certificateHistory,
+		CARotationNoticeLead:      m.caRotationNoticeLead,
+		EndpointsReadinessTimeout: m.endpointsReadinessTimeout,
+		CertDir:                   m.certDir,
+		AuditLog:                  m.auditLog != nil,
+		ExternalCABundle:          m.externalCABundle != nil,
+	}
+
+	for _, webhook := range m.webhooks {
+		if webhook.APIVersion == "" {
+			webhook.APIVersion = WebhookAPIVersionV1
+		}
+		config.Webhooks = append(config.Webhooks, webhook)
+	}
+
+	config.Certificate.CertUsages = append([]x509.ExtKeyUsage{}, config.Certificate.CertUsages...)
+
+	if m.clusterDomains != nil {
+		config.ClusterDomains = append([]string{}, m.clusterDomains...)
+	} else {
+		config.ClusterDomains = []string{strings.TrimPrefix(clusterDomain, ".")}
+	}
+
+	if !m.combinedSecrets() {
+		config.CASecret = m.secretCAName()
+	}
+	if m.extraAltNames != nil {
+		extraAltNames := triple.AltNames{
+			DNSNames: append([]string{}, m.extraAltNames.DNSNames...),
+			IPs:      append([]net.IP{}, m.extraAltNames.IPs...),
+		}
+		config.ExtraAltNames = &extraAltNames
+	}
+	if m.serviceSecretName != nil {
+		serviceSecret := *m.serviceSecretName
+		config.ServiceSecret = &serviceSecret
+	}
+	return config
+}
@@ -0,0 +1,82 @@
+package certificate
+
+import (
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Effective configuration", func() {
+	It("should reflect the applied defaults", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil,
+			[]WebhookReference{
+				{Type: MutatingWebhook, Name: "foo"},
+				{Type: ValidatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1beta1},
+			},
+			WithCADuration(30*time.Hour),
+			WithKeySize(4096, 0),
+			WithReconcileJitter(0.1),
+			WithSecretName("", "foo-tls"),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+		Expect(mgr.EffectiveConfig()).To(Equal(EffectiveConfig{
+			Name:      "foo",
+			Namespace: "bar",
+			Webhooks: []WebhookReference{
+				{Type: MutatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1},
+				{Type: ValidatingWebhook, Name: "foo", APIVersion: WebhookAPIVersionV1beta1},
+			},
+			Certificate: chain.Options{
+				CARotateInterval:      30 * time.Hour,
+				CAOverlapInterval:     10 * time.Hour,
+				CertRotateInterval:    30 * time.Hour,
+				CertOverlapInterval:   10 * time.Hour,
+				CAKeySize:             4096,
+				CertKeySize:           triple.DefaultRSAKeySize,
+				KeyAlgorithm:          triple.KeyAlgorithmRSA,
+				SerialNumberBits:      triple.DefaultSerialNumberBits,
+				CertUsages:            []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				CAMaxRotateInterval:   chain.DefaultCAMaxRotateInterval,
+				CABundleOrder:         chain.CABundleOldestFirst,
+				NotYetValidPolicy:     chain.NotYetValidRegenerate,
+				ReducedValidityPolicy: chain.ReducedValidityWarn,
+				RotationJitter:        0.1,
+			},
+			KeyAlgorithm:      triple.KeyAlgorithmRSA,
+			ClusterDomains:    []string{"cluster.local"},
+			CASecret:          types.NamespacedName{Namespace: "bar", Name: "foo-ca"},
+			ServiceSecret:     &types.NamespacedName{Namespace: "bar", Name: "foo-tls"},
+			SecretLayout:      SecretLayoutSeparate,
+			SANPolicy:         SANPolicySplit,
+			HealthPolicy:      HealthPolicyAll,
+			CAConfigMapLayout: CAConfigMapConcatenated,
+		}), "should resolve the configuration with the defaults")
+		Expect(mgr.EffectiveConfig().Certificate).To(Equal(mgr.options), "should read back the options the manager runs with")
+	})
+
+	It("should not leave the CA secret set with the combined secret layout", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}},
+			WithSecretLayout(SecretLayoutCombined))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		config := mgr.EffectiveConfig()
+		Expect(config.SecretLayout).To(Equal(SecretLayoutCombined), "should keep the configured secret layout")
+		Expect(config.CASecret).To(BeZero(), "should not store the CA at a secret of its own")
+	})
+
+	It("should reflect the configured key type", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}},
+			WithKeyType(triple.KeyAlgorithmECDSAP256))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		config := mgr.EffectiveConfig()
+		Expect(config.KeyAlgorithm).To(Equal(triple.KeyAlgorithmECDSAP256), "should report the configured key type")
+		Expect(config.Certificate.KeyAlgorithm).To(Equal(triple.KeyAlgorithmECDSAP256), "should keep the configured key type")
+	})
+})
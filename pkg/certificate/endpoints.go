@@ -0,0 +1,103 @@
+package certificate
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// endpoints.go defers the scheduled rotations of the certificates while the
+// services backing the webhooks have no ready endpoints, for instance during
+// a rollout, there being no server to pick the new certificates up.
+
+// rotationDeadline returns the earliest rotation deadline of a certificate
+// chain if the endpoints readiness check is configured, the zero time
+// otherwise or if it cannot be computed.
+func (m *Manager) rotationDeadline(certificateChain *chain.CertificateChainData) time.Time {
+	if m.endpointsReadinessTimeout == 0 {
+		return time.Time{}
+	}
+	caDeadline, certsDeadline, err := chain.RotationDeadlines(&m.options, certificateChain)
+	if err != nil {
+		return time.Time{}
+	}
+	if caDeadline.Before(certsDeadline) {
+		return caDeadline
+	}
+	return certsDeadline
+}
+
+// webhookServices returns the services backing the webhooks of objects, by
+// name
+func webhookServices(objects objectMap) []types.NamespacedName {
+	services := map[types.NamespacedName]struct{}{}
+	for _, object := range objects {
+		if _, isWebhook := webhookReference(object.key); !isWebhook || object.kobject == nil {
+			continue
+		}
+		for _, config := range clientConfigMap(object.kobject) {
+			services[types.NamespacedName{Namespace: config.Service.Namespace, Name: config.Service.Name}] = struct{}{}
+		}
+	}
+	names := make([]types.NamespacedName, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].String() < names[j].String() })
+	return names
+}
+
+// endpointsReady returns whether a service has at least one ready endpoint
+func (m *Manager) endpointsReady(ctx context.Context, service types.NamespacedName) (bool, error) {
+	endpoints := corev1.Endpoints{}
+	err := m.client.Get(ctx, service, &endpoints)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkEndpointsReady defers a scheduled rotation of a certificate chain,
+// returning a DeferredError, if any service backing the webhooks has no ready
+// endpoints, unless the
+// rotation deadline was reached longer than the configured timeout ago.
+// Nothing is checked if there is no timeout configured or the rotation was
+// forced or is not a scheduled one, missing or invalid certificates being
+// always issued.
+func (m *Manager) checkEndpointsReady(ctx context.Context, objects objectMap, rotationDeadline time.Time, certificateChain *chain.CertificateChainData, force bool) error {
+	if m.endpointsReadinessTimeout == 0 || force || certificateChain.RotationReason != chain.RotationReasonScheduled {
+		return nil
+	}
+	logger := m.log.WithName("checkEndpointsReady")
+	if !triple.Now().Before(rotationDeadline.Add(m.endpointsReadinessTimeout)) {
+		logger.Info("Endpoints readiness timed out, rotating certificates anyway", "rotationDeadline", rotationDeadline)
+		return nil
+	}
+	for _, service := range webhookServices(objects) {
+		ready, err := m.endpointsReady(ctx, service)
+		if err != nil {
+			return errors.Wrapf(err, "failed reading endpoints of service %s", service)
+		}
+		if !ready {
+			return &DeferredError{Err: errors.Errorf("service %s has no ready endpoints", service)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Endpoints readiness check", func() {
+	var (
+		mgr                *Manager
+		handledErrors      []error
+		now                time.Time
+		readinessTimeout   = 5 * time.Minute
+		certRotateInterval = 30 * time.Minute
+		endpoints          = corev1.Endpoints{
+			ObjectMeta: expectedService.ObjectMeta,
+			Subsets: []corev1.EndpointSubset{
+				{
+					Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+					Ports:     []corev1.EndpointPort{{Name: "https", Port: 8443}},
+				},
+			},
+		}
+	)
+
+	rotationDeadline := func() time.Time {
+		return mgr.Status().CertsRotationTime
+	}
+
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second).UTC()
+		triple.Now = func() time.Time { return now }
+		createResources()
+
+		handledErrors = nil
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: certRotateInterval,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithEndpointsReadinessCheck(readinessTimeout),
+			WithErrorHandler(func(err error) { handledErrors = append(handledErrors, err) }),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should issue the missing certificates without ready endpoints")
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &endpoints)
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should defer the rotation until the service has ready endpoints", func() {
+		previousSecret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+		now = rotationDeadline().Add(time.Minute)
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring("has no ready endpoints")), "should defer the rotation")
+		Expect(IsDeferred(err)).To(BeTrue(), "should report the rotation as deferred")
+		result, err := mgr.Reconcile(context.TODO(), reconcile.Request{})
+		Expect(err).To(Succeed(), "should not fail the reconcile")
+		Expect(result.RequeueAfter).To(Equal(deferredRequeueAfter), "should check the endpoints again later")
+		Expect(handledErrors).To(BeEmpty(), "should not call the error handler")
+		rotationFailures := &dto.Metric{}
+		Expect(mgr.metrics.rotationFailures.Write(rotationFailures)).To(Succeed(), "should succeed reading the rotation failures")
+		Expect(rotationFailures.Counter.GetValue()).To(BeZero(), "should not count the deferral as a rotation failure")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.Data).To(Equal(previousSecret.Data), "should not rotate the service certificate")
+
+		By("Making the service endpoints ready")
+		err = cli.Create(context.TODO(), endpoints.DeepCopy())
+		Expect(err).To(Succeed(), "should succeed creating endpoints")
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret, err = getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.Data).ToNot(Equal(previousSecret.Data), "should rotate the service certificate")
+		Expect(mgr.Status().LastRotationReason).To(Equal(chain.RotationReasonScheduled), "should record a scheduled rotation")
+	})
+
+	It("should rotate without ready endpoints once timed out", func() {
+		previousSecret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+		now = rotationDeadline().Add(readinessTimeout)
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.Data).ToNot(Equal(previousSecret.Data), "should rotate the service certificate")
+	})
+
+	It("should not defer forced rotations", func() {
+		previousSecret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.Data).ToNot(Equal(previousSecret.Data), "should rotate the service certificate")
+	})
+})
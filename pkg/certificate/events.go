@@ -0,0 +1,60 @@
+package certificate
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+const (
+	// EventReasonCertificateRotated is the reason of the Normal event
+	// emitted on the webhook configurations after a successful rotation
+	EventReasonCertificateRotated = "CertificateRotated"
+
+	// EventReasonCertificateRotationFailed is the reason of the Warning event
+	// emitted on the webhook configurations after a failed rotation
+	EventReasonCertificateRotationFailed = "CertificateRotationFailed"
+)
+
+// noopEventRecorder drops every event, it is the event recorder of managers
+// not configured with one
+type noopEventRecorder struct{}
+
+var _ record.EventRecorder = noopEventRecorder{}
+
+func (noopEventRecorder) Event(object runtime.Object, eventtype, reason, message string) {}
+
+func (noopEventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+func (noopEventRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+}
+
+// recordRotationEvents emits an event on every existing webhook configuration
+// of objects about a certificates rotation, if there was one and it was not
+// deferred, as failed if err is set or as successful otherwise.
+func (m *Manager) recordRotationEvents(objects objectMap, rotation bool, certificateChain *chain.CertificateChainData, err error) {
+	if !rotation || IsDeferred(err) {
+		return
+	}
+	for _, object := range objects.sorted() {
+		if _, isWebhook := webhookReference(object.key); !isWebhook || object.kobject == nil || object.kobject.GetUID() == "" {
+			continue
+		}
+		if err != nil {
+			m.eventRecorder.Eventf(object.kobject, corev1.EventTypeWarning, EventReasonCertificateRotationFailed,
+				"Failed rotating certificates: %v", err)
+			continue
+		}
+		notAfter := "unknown"
+		if leafCertificate := firstLeafCertificate(certificateChain); leafCertificate != nil {
+			notAfter = leafCertificate.NotAfter.UTC().Format(time.RFC3339)
+		}
+		m.eventRecorder.Eventf(object.kobject, corev1.EventTypeNormal, EventReasonCertificateRotated,
+			"Certificates rotated (%s), service certificate valid until %s", certificateChain.RotationReason, notAfter)
+	}
+}
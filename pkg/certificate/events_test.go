@@ -0,0 +1,81 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/tools/record"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Rotation events", func() {
+	var (
+		mgr      *Manager
+		failing  *updateFailingClient
+		recorder *record.FakeRecorder
+	)
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		failing = &updateFailingClient{Client: cli}
+		recorder = record.NewFakeRecorder(10)
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			failing,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithEventRecorder(recorder),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should emit an event on the webhook configuration for successful and failed rotations", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Eventually(recorder.Events).Should(Receive(HavePrefix("Normal "+EventReasonCertificateRotated)), "should emit a rotation event for the generated certificates")
+
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Consistently(recorder.Events, time.Second).ShouldNot(Receive(), "should not emit an event without rotation")
+
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+		notAfter := mgr.LeafCertificate().NotAfter.UTC().Format(time.RFC3339)
+		Eventually(recorder.Events).Should(Receive(And(
+			HavePrefix("Normal "+EventReasonCertificateRotated),
+			ContainSubstring(string(chain.RotationReasonForced)),
+			ContainSubstring(notAfter),
+		)), "should emit a rotation event with the new certificate expiration")
+
+		By("Failing to write the rotated certificates")
+		failing.fail = true
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(HaveOccurred(), "should fail forcing rotation")
+		Eventually(recorder.Events).Should(Receive(And(
+			HavePrefix("Warning "+EventReasonCertificateRotationFailed),
+			ContainSubstring("update refused"),
+		)), "should emit a rotation failure event")
+	})
+})
@@ -0,0 +1,125 @@
+package certificate
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// external.go handles the external CA bundle mode where serving certificates
+// are managed externally, for instance issued by a public CA for webhooks
+// exposed at a public URL, and the CA bundle injected on the managed webhooks
+// is provided as is instead of generated.
+
+// reconcileExternalCABundle injects the external CA bundle on every webhook
+// of the managed webhook configurations. It returns the duration after which
+// it should be called again.
+func (m *Manager) reconcileExternalCABundle(ctx context.Context) (time.Duration, error) {
+	logger := m.log.WithName("reconcileExternalCABundle")
+	logger.Info("Reconciling webhook external CA bundle")
+
+	err := m.injectCABundle(ctx, m.externalCABundle)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed injecting external CA bundle")
+	}
+
+	reconcileAt := triple.Now().Add(m.options.CertRotateInterval - m.options.CertOverlapInterval)
+	certificateChain := chain.CertificateChainData{
+		CA: chain.CA{
+			CertPEM: m.externalCABundle,
+		},
+	}
+	m.updateStatus(&certificateChain, reconcileAt)
+
+	logger.Info("Webhook external CA bundle reconciled succesfuly", "reconcileAt", reconcileAt.UTC().Format(time.RFC3339))
+	return reconcileAt.Sub(triple.Now()), nil
+}
+
+// verifyExternalCABundle verifies that the external CA bundle is injected on
+// every webhook of the managed webhook configurations.
+func (m *Manager) verifyExternalCABundle(ctx context.Context) error {
+	for _, webhookRef := range m.managedWebhooks() {
+		key := newObjectKey(webhookObjectKind(webhookRef), "", webhookRef.Name)
+		webhook := objectOperatorsMap[key.Kind].creator(key.Name, key.Namespace)
+		err := m.get(ctx, key.NamespacedName, webhook)
+		if m.isWebhookAlias(key) && (apierrors.IsNotFound(err) || meta.IsNoMatchError(err)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for name, config := range anyClientConfigMap(webhook) {
+			if !bytes.Equal(config.CABundle, m.externalCABundle) {
+				return errors.Errorf("External CA bundle not injected at webhook %s of %s", name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// injectCABundle sets caBundle on every webhook of the managed webhook
+// configurations, webhook configurations that do not exist are ignored.
+func (m *Manager) injectCABundle(ctx context.Context, caBundle []byte) error {
+	for _, webhookRef := range m.managedWebhooks() {
+		key := newObjectKey(webhookObjectKind(webhookRef), "", webhookRef.Name)
+		logger := m.log.WithName("injectCABundle").WithValues("key", key)
+
+		webhook := objectOperatorsMap[key.Kind].creator(key.Name, key.Namespace)
+		err := m.get(ctx, key.NamespacedName, webhook)
+		if apierrors.IsNotFound(err) || m.isWebhookAlias(key) && meta.IsNoMatchError(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		old := webhook.DeepCopyObject()
+		clientConfigs := anyClientConfigMap(webhook)
+		for _, config := range clientConfigs {
+			config.CABundle = caBundle
+		}
+		storeClientConfigs(webhook, clientConfigs)
+		if caBundle != nil {
+			m.setIssuerLabel(webhook)
+		} else {
+			m.removeIssuerLabel(webhook)
+		}
+		if reflect.DeepEqual(old, webhook) {
+			continue
+		}
+
+		err = validateWebhook(&keyedObject{key: key, kobject: webhook})
+		if err != nil {
+			return errors.Wrapf(err, "Refusing to write invalid object %s", key)
+		}
+
+		logger.Info("Update object")
+		err = m.client.Update(ctx, webhook)
+		if err != nil {
+			return err
+		}
+		if caBundle != nil {
+			m.recordInjection(key, webhook)
+		}
+	}
+	return nil
+}
+
+// anyClientConfigMap returns the webhooks's WebhookClientConfig either by
+// service or by URL.
+func anyClientConfigMap(webhook client.Object) map[string]*admissionregistrationv1.WebhookClientConfig {
+	return filterClientConfigMap(webhook, func(clientConfig *admissionregistrationv1.WebhookClientConfig) bool {
+		return clientConfig.Service != nil || clientConfig.URL != nil
+	})
+}
@@ -0,0 +1,275 @@
+package certificate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// FakeManager is a CertManager that does not reconcile anything at the
+// cluster, it holds a valid certificate chain issued at creation for a
+// service, so it can be injected at unit tests of webhooks wiring. The chain
+// only changes on ForceRotate.
+type FakeManager struct {
+	// CABundle contains the PEM encoded CA certificate
+	CABundle []byte
+
+	// CertPEM and KeyPEM contains the PEM encoded service certificate and key
+	CertPEM []byte
+	KeyPEM  []byte
+
+	serviceName      types.NamespacedName
+	options          chain.Options
+	certificateChain chain.CertificateChainData
+
+	status             Status
+	servingCertificate *tls.Certificate
+	statusLock         sync.RWMutex
+}
+
+var _ CertManager = &FakeManager{}
+
+// NewFakeManager creates a FakeManager with a certificate issued for the
+// service with same hostnames as the ones from a Manager.
+func NewFakeManager(serviceName, serviceNamespace string) (*FakeManager, error) {
+	options := chain.Options{}
+	err := options.SetDefaultsAndValidate()
+	if err != nil {
+		return nil, err
+	}
+
+	certificateIssue := newCertificateIssue(serviceName, serviceNamespace)
+	certificateChain := chain.CertificateChainData{
+		CertificatesIssued: map[string]*chain.CertificateIssue{
+			certificateIssue.Name: certificateIssue,
+		},
+	}
+
+	_, err = chain.Update(&options, &certificateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &FakeManager{
+		serviceName:      types.NamespacedName{Namespace: serviceNamespace, Name: serviceName},
+		options:          options,
+		certificateChain: certificateChain,
+	}
+	err = m.updateCertificates()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Add does nothing, there is no reconcile loop to register.
+func (m *FakeManager) Add(mgr manager.Manager) error {
+	return nil
+}
+
+// Apply does not change the certificates, it only updates the status.
+func (m *FakeManager) Apply(ctx context.Context) error {
+	m.updateStatus()
+	return nil
+}
+
+// ForceRotate rotates the CA and service certificates in memory, updating
+// CABundle, CertPEM and KeyPEM. Unlike the one of Manager, it is not safe to
+// call concurrently with the other methods.
+func (m *FakeManager) ForceRotate(ctx context.Context) error {
+	_, err := chain.Rotate(&m.options, &m.certificateChain)
+	if err != nil {
+		return errors.Wrap(err, "Failed rotating certificate data")
+	}
+	return m.updateCertificates()
+}
+
+// Cleanup does nothing, there is nothing at the cluster to remove.
+func (m *FakeManager) Cleanup(ctx context.Context) error {
+	return nil
+}
+
+// VerifyTLS verifies the certificate chain.
+func (m *FakeManager) VerifyTLS() error {
+	return chain.Verify(&m.options, &m.certificateChain)
+}
+
+// Status returns a status as if a reconcile has just happened.
+func (m *FakeManager) Status() Status {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.status
+}
+
+// LeafCertificate returns a copy of the service certificate.
+func (m *FakeManager) LeafCertificate() *x509.Certificate {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	leafCertificate, err := x509.ParseCertificate(m.servingCertificate.Leaf.Raw)
+	if err != nil {
+		return nil
+	}
+	return leafCertificate
+}
+
+// CheckReadiness fails if the service certificate is not valid.
+func (m *FakeManager) CheckReadiness(_ *http.Request) error {
+	_, err := m.TLSCertificate()
+	if err != nil {
+		return errors.Errorf("certificates not ready: %v", err)
+	}
+	return nil
+}
+
+// Healthz fails if the service certificate is not valid.
+func (m *FakeManager) Healthz(_ *http.Request) error {
+	_, err := m.TLSCertificate()
+	return err
+}
+
+// TLSCertificate returns the service key pair, failing while it is not valid.
+func (m *FakeManager) TLSCertificate() (*tls.Certificate, error) {
+	m.statusLock.RLock()
+	servingCertificate := m.servingCertificate
+	m.statusLock.RUnlock()
+	err := checkServingCertificateValidity(servingCertificate)
+	if err != nil {
+		return nil, err
+	}
+	return servingCertificate, nil
+}
+
+// GetTLSConfig returns a TLS configuration serving TLSCertificate.
+func (m *FakeManager) GetTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.TLSCertificate()
+		},
+	}
+}
+
+// Plan reports no rotation until the rotation deadlines of the certificate
+// chain, and no webhook configuration to inject the CA bundle into.
+func (m *FakeManager) Plan(ctx context.Context) (RotationPlan, error) {
+	plan := RotationPlan{SANs: map[string][]string{}}
+	reason, _, err := chain.PendingRotation(&m.options, &m.certificateChain)
+	if err != nil {
+		return RotationPlan{}, errors.Wrap(err, "Failed planning certificates rotation")
+	}
+	plan.Rotate = reason != ""
+	plan.Reason = reason
+
+	status := m.Status()
+	plan.Deadline = status.CARotationTime
+	if status.CertsRotationTime.Before(plan.Deadline) {
+		plan.Deadline = status.CertsRotationTime
+	}
+
+	for name, certificateIssue := range m.certificateChain.CertificatesIssued {
+		plan.SANs[name] = append(append([]string{}, certificateIssue.Hostnames...), certificateIssue.IPs...)
+	}
+	return plan, nil
+}
+
+// SchedulePlan returns the upcoming rotations projected from the rotation
+// deadlines of the certificate chain.
+func (m *FakeManager) SchedulePlan() []ScheduledRotation {
+	return schedulePlan(&m.options, m.Status())
+}
+
+// BuildSecret returns the service secret, named after the service, and the
+// CA secret, named after the service with the "-ca" suffix, holding the
+// certificate chain.
+func (m *FakeManager) BuildSecret(ctx context.Context) (secret, caSecret *corev1.Secret, err error) {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	secret = &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: m.serviceName.Namespace, Name: m.serviceName.Name},
+		Data: map[string][]byte{
+			corev1.TLSPrivateKeyKey: m.KeyPEM,
+			corev1.TLSCertKey:       m.CertPEM,
+		},
+	}
+	secret.Type = secretTypeFor(secret.Data)
+	caSecret = &corev1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: m.serviceName.Namespace, Name: m.serviceName.Name + "-ca"},
+		Data: map[string][]byte{
+			CAPrivateKeyKey: m.certificateChain.CA.KeyPEM,
+			CACertKey:       m.CABundle,
+		},
+	}
+	caSecret.Type = secretTypeFor(caSecret.Data)
+	return secret, caSecret, nil
+}
+
+// EffectiveConfig returns the certificate options, the defaults, the fake
+// manager runs with, named after the service.
+func (m *FakeManager) EffectiveConfig() EffectiveConfig {
+	config := EffectiveConfig{
+		Name:              m.serviceName.Name,
+		Namespace:         m.serviceName.Namespace,
+		Certificate:       m.options,
+		KeyAlgorithm:      m.options.KeyAlgorithm,
+		ClusterDomains:    []string{strings.TrimPrefix(clusterDomain, ".")},
+		CASecret:          types.NamespacedName{Namespace: m.serviceName.Namespace, Name: m.serviceName.Name + "-ca"},
+		SecretLayout:      SecretLayoutSeparate,
+		SANPolicy:         SANPolicySplit,
+		HealthPolicy:      HealthPolicyAll,
+		CAConfigMapLayout: CAConfigMapConcatenated,
+	}
+	config.Certificate.CertUsages = append([]x509.ExtKeyUsage{}, config.Certificate.CertUsages...)
+	return config
+}
+
+// updateCertificates publishes the certificate chain at the exported fields
+// and the status
+func (m *FakeManager) updateCertificates() error {
+	servingCertificate, err := firstServingCertificate(&m.certificateChain)
+	if err != nil {
+		return err
+	}
+	certificateIssue := firstCertificateIssue(&m.certificateChain)
+
+	m.statusLock.Lock()
+	m.CABundle = m.certificateChain.CA.CertPEM
+	m.CertPEM = certificateIssue.CertPEM
+	m.KeyPEM = certificateIssue.KeyPEM
+	m.servingCertificate = servingCertificate
+	m.statusLock.Unlock()
+
+	m.updateStatus()
+	return nil
+}
+
+func (m *FakeManager) updateStatus() {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	now := triple.Now().UTC()
+	m.status.LastReconcileTime = now
+	m.status.NextReconcileTime = now.Add(m.options.CertRotateInterval - m.options.CertOverlapInterval)
+	caCerts, err := triple.ParseCertsPEM(m.CABundle)
+	if err == nil {
+		m.status.CANotAfter = caCerts[len(caCerts)-1].NotAfter.UTC()
+	}
+	caDeadline, certsDeadline, err := chain.RotationDeadlines(&m.options, &m.certificateChain)
+	if err == nil {
+		m.status.CARotationTime = caDeadline.UTC()
+		m.status.CertsRotationTime = certsDeadline.UTC()
+	}
+}
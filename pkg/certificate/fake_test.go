@@ -0,0 +1,88 @@
+package certificate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Fake certificates manager", func() {
+	var (
+		fakeManager CertManager
+		fake        *FakeManager
+	)
+	BeforeEach(func() {
+		var err error
+		fake, err = NewFakeManager(expectedService.Name, expectedService.Namespace)
+		Expect(err).ToNot(HaveOccurred(), "should create a fake manager")
+		fakeManager = fake
+	})
+	It("should behave as a CertManager without touching the cluster", func() {
+		Expect(fakeManager.Add(nil)).To(Succeed())
+		Expect(fakeManager.Apply(context.TODO())).To(Succeed())
+		Expect(fakeManager.Cleanup(context.TODO())).To(Succeed())
+		Expect(fakeManager.VerifyTLS()).To(Succeed())
+		Expect(fakeManager.Status().CANotAfter).ToNot(BeZero())
+		Expect(fakeManager.CheckReadiness(nil)).To(Succeed())
+		Expect(fakeManager.Healthz(nil)).To(Succeed())
+		Expect(fakeManager.SchedulePlan()).To(HaveLen(SchedulePlanLength))
+		Expect(fakeManager.EffectiveConfig().Namespace).To(Equal(expectedService.Namespace))
+
+		plan, err := fakeManager.Plan(context.TODO())
+		Expect(err).ToNot(HaveOccurred(), "should plan the rotation")
+		Expect(plan.Rotate).To(BeFalse(), "should not plan a rotation of valid certificates")
+		Expect(plan.Deadline).ToNot(BeZero(), "should plan the rotation deadline")
+	})
+	It("should serve the service key pair", func() {
+		tlsCertificate, err := fakeManager.TLSCertificate()
+		Expect(err).ToNot(HaveOccurred(), "should return the service key pair")
+		Expect(tlsCertificate.Leaf.Raw).To(Equal(fakeManager.LeafCertificate().Raw), "should serve the service certificate")
+		tlsConfig := fakeManager.GetTLSConfig()
+		served, err := tlsConfig.GetCertificate(nil)
+		Expect(err).ToNot(HaveOccurred(), "should serve the service key pair")
+		Expect(served).To(Equal(tlsCertificate), "should serve the service key pair")
+	})
+	It("should build the secrets holding the certificate chain", func() {
+		secret, caSecret, err := fakeManager.BuildSecret(context.TODO())
+		Expect(err).ToNot(HaveOccurred(), "should build the secrets")
+		Expect(secret.Name).To(Equal(expectedService.Name), "should name the service secret after the service")
+		Expect(secret.Data).To(Equal(map[string][]byte{
+			corev1.TLSPrivateKeyKey: fake.KeyPEM,
+			corev1.TLSCertKey:       fake.CertPEM,
+		}), "should store the service key pair")
+		Expect(caSecret.Data[CACertKey]).To(Equal(fake.CABundle), "should store the CA certificate")
+	})
+	It("should rotate the certificates in memory", func() {
+		previousCABundle, previousCertPEM := fake.CABundle, fake.CertPEM
+		Expect(fakeManager.ForceRotate(context.TODO())).To(Succeed())
+		Expect(fake.CABundle).ToNot(Equal(previousCABundle), "should rotate the CA")
+		Expect(fake.CertPEM).ToNot(Equal(previousCertPEM), "should rotate the service certificate")
+		Expect(fakeManager.VerifyTLS()).To(Succeed(), "should keep a valid certificate chain")
+		tlsCertificate, err := fakeManager.TLSCertificate()
+		Expect(err).ToNot(HaveOccurred(), "should return the service key pair")
+		Expect(triple.EncodeCertPEM(tlsCertificate.Leaf)).To(Equal(fake.CertPEM), "should serve the rotated service certificate")
+	})
+	It("should return material verifiable for the service", func() {
+		keyPair, err := tls.X509KeyPair(fake.CertPEM, fake.KeyPEM)
+		Expect(err).ToNot(HaveOccurred(), "should load the service key pair")
+
+		cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+		Expect(err).ToNot(HaveOccurred(), "should parse the service certificate")
+
+		roots := x509.NewCertPool()
+		Expect(roots.AppendCertsFromPEM(fake.CABundle)).To(BeTrue(), "should load the CA bundle")
+
+		_, err = cert.Verify(x509.VerifyOptions{
+			DNSName: serviceFqdn(expectedService.Name, expectedService.Namespace),
+			Roots:   roots,
+		})
+		Expect(err).ToNot(HaveOccurred(), "should verify the service certificate with the CA bundle")
+	})
+})
@@ -0,0 +1,90 @@
+package certificate
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// HealthPolicy is the policy Healthz reports the manager health by, out of the
+// health of its webhook configurations
+type HealthPolicy string
+
+const (
+	// HealthPolicyAll requires all the webhook configurations to be healthy
+	HealthPolicyAll HealthPolicy = "All"
+
+	// HealthPolicyAny requires any webhook configuration to be healthy
+	HealthPolicyAny HealthPolicy = "Any"
+)
+
+var (
+	_ healthz.Checker = (&Manager{}).Healthz
+	_ healthz.Checker = (&Manager{}).CheckReadiness
+)
+
+// Healthz is a healthz.Checker failing if the webhook configurations of the
+// manager are not healthy as required by its health policy, HealthPolicyAll
+// by default. A webhook configuration is not healthy if the last CA bundle
+// injection into it failed, see WebhookStatus.Error. It also fails while the
+// serving certificate of the last successful reconcile is not valid yet and
+// once it expires, but not while reconciles fail with it still valid, so that
+// an API server outage alone does not fail the health check.
+func (m *Manager) Healthz(_ *http.Request) error {
+	if servingCertificate := m.lastServingCertificate(); servingCertificate != nil {
+		err := checkServingCertificateValidity(servingCertificate)
+		if err != nil {
+			return err
+		}
+	}
+	status := m.Status()
+	unhealthy := []string{}
+	for _, webhook := range m.webhooks {
+		webhookStatus, found := status.Webhooks[webhook.String()]
+		if found && webhookStatus.Error != nil {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s: %v", webhook, webhookStatus.Error))
+		}
+	}
+	sort.Strings(unhealthy)
+	if len(unhealthy) == 0 || (m.healthPolicy == HealthPolicyAny && len(unhealthy) < len(m.webhooks)) {
+		return nil
+	}
+	return fmt.Errorf("unhealthy webhook configurations: %s", strings.Join(unhealthy, ", "))
+}
+
+// CheckReadiness is a healthz.Checker failing until a reconcile provisioned
+// certificates that verified against the CA bundle injected on the webhook
+// configurations, as VerifyTLS does, while the serving certificate is not
+// valid yet and once it expires, so that a readiness probe gates the webhook
+// traffic until they are provisioned. In external CA bundle mode it fails until the CA bundle is
+// injected. It fails too while the last CA bundle injection into any webhook
+// configuration failed. It checks the state of the last successful reconcile
+// kept in memory, without reading from the cluster nor waiting for an ongoing
+// reconcile, so it is cheap enough for frequent probes.
+func (m *Manager) CheckReadiness(_ *http.Request) error {
+	status := m.Status()
+	if status.LastReconcileTime.IsZero() {
+		return fmt.Errorf("certificates not ready: not reconciled yet")
+	}
+	for _, webhook := range m.webhooks {
+		webhookStatus, found := status.Webhooks[webhook.String()]
+		if found && webhookStatus.Error != nil {
+			return fmt.Errorf("certificates not ready: CA bundle not injected into %s: %v", webhook, webhookStatus.Error)
+		}
+	}
+	if m.externalCABundle != nil {
+		return nil
+	}
+	servingCertificate := m.lastServingCertificate()
+	if servingCertificate == nil {
+		return fmt.Errorf("certificates not ready: no service certificate provisioned yet")
+	}
+	err := checkServingCertificateValidity(servingCertificate)
+	if err != nil {
+		return fmt.Errorf("certificates not ready: %v", err)
+	}
+	return nil
+}
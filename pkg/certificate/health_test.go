@@ -0,0 +1,260 @@
+package certificate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Healthz", func() {
+	mutating := WebhookReference{Type: MutatingWebhook, Name: "foo"}
+	validating := WebhookReference{Type: ValidatingWebhook, Name: "foo"}
+
+	type healthzCase struct {
+		policy     HealthPolicy
+		statuses   map[string]WebhookStatus
+		shouldFail bool
+	}
+	DescribeTable("should report the health of the webhook configurations by policy",
+		func(c healthzCase) {
+			m := &Manager{
+				webhooks:     []WebhookReference{mutating, validating},
+				healthPolicy: c.policy,
+			}
+			m.status.Webhooks = c.statuses
+			err := m.Healthz(nil)
+			if c.shouldFail {
+				Expect(err).To(HaveOccurred(), "should report unhealthy")
+			} else {
+				Expect(err).To(Succeed(), "should report healthy")
+			}
+		},
+		Entry("before any injection", healthzCase{
+			policy: HealthPolicyAll,
+		}),
+		Entry("all healthy, by default", healthzCase{
+			statuses: map[string]WebhookStatus{mutating.String(): {}, validating.String(): {}},
+		}),
+		Entry("one failing, by default", healthzCase{
+			statuses:   map[string]WebhookStatus{mutating.String(): {}, validating.String(): {Error: errors.New("failed")}},
+			shouldFail: true,
+		}),
+		Entry("one failing, with all required", healthzCase{
+			policy:     HealthPolicyAll,
+			statuses:   map[string]WebhookStatus{mutating.String(): {}, validating.String(): {Error: errors.New("failed")}},
+			shouldFail: true,
+		}),
+		Entry("one failing, with any required", healthzCase{
+			policy:   HealthPolicyAny,
+			statuses: map[string]WebhookStatus{mutating.String(): {}, validating.String(): {Error: errors.New("failed")}},
+		}),
+		Entry("all failing, with any required", healthzCase{
+			policy:     HealthPolicyAny,
+			statuses:   map[string]WebhookStatus{mutating.String(): {Error: errors.New("failed")}, validating.String(): {Error: errors.New("failed")}},
+			shouldFail: true,
+		}),
+	)
+})
+
+var _ = Describe("Webhook configuration error isolation", func() {
+	var (
+		mgr        *Manager
+		failing    *validatingUpdateFailingClient
+		validating = admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "foowebhook-validating",
+			},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{
+					SideEffects:             &sideEffects,
+					AdmissionReviewVersions: []string{"v1"},
+					Name:                    "foowebhook.qinqon.io",
+					ClientConfig:            expectedMutatingWebhookConfiguration.Webhooks[0].ClientConfig,
+				},
+			},
+		}
+		mutatingReference   = WebhookReference{Type: MutatingWebhook, Name: expectedMutatingWebhookConfiguration.Name}
+		validatingReference = WebhookReference{Type: ValidatingWebhook, Name: validating.Name}
+	)
+
+	newManager := func(policy HealthPolicy) {
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			failing,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{mutatingReference, validatingReference},
+			WithHealthPolicy(policy),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	}
+
+	BeforeEach(func() {
+		createResources()
+		err := cli.Create(context.TODO(), validating.DeepCopy())
+		Expect(err).To(Succeed(), "should succeed creating validatingwebhookconfiguration")
+		failing = &validatingUpdateFailingClient{Client: cli}
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &validating)
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should record the error against the failing webhook configuration only", func() {
+		newManager(HealthPolicyAll)
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(MatchError(ContainSubstring("update refused")), "should fail applying certificates")
+
+		status := mgr.Status()
+		Expect(status.Webhooks).To(HaveKey(validatingReference.String()), "should report the failing webhook configuration")
+		Expect(status.Webhooks[validatingReference.String()].Error).To(MatchError(ContainSubstring("update refused")), "should record the error against the failing webhook configuration")
+		Expect(status.Webhooks).To(HaveKey(mutatingReference.String()), "should report the healthy webhook configuration")
+		Expect(status.Webhooks[mutatingReference.String()].Error).To(Succeed(), "should not record the error against the healthy webhook configuration")
+		Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).ToNot(BeEmpty(), "should inject the healthy webhook configuration")
+
+		_, err = getSecret()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not store the service certificates")
+		Expect(mgr.Healthz(nil)).ToNot(Succeed(), "should be unhealthy with all required")
+
+		By("Requiring any webhook configuration to be healthy")
+		newManager(HealthPolicyAny)
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(HaveOccurred(), "should fail applying certificates")
+		Expect(mgr.Healthz(nil)).To(Succeed(), "should be healthy with any required")
+
+		By("Recovering the failing webhook configuration")
+		failing.recovered = true
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(mgr.Status().Webhooks[validatingReference.String()].Error).To(Succeed(), "should clear the error of the recovered webhook configuration")
+		Expect(mgr.Healthz(nil)).To(Succeed(), "should be healthy")
+	})
+})
+
+// validatingUpdateFailingClient fails every update of validating webhook
+// configurations until recovered
+type validatingUpdateFailingClient struct {
+	client.Client
+	recovered bool
+}
+
+func (c *validatingUpdateFailingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if _, ok := obj.(*admissionregistrationv1.ValidatingWebhookConfiguration); ok && !c.recovered {
+		return errors.New("update refused")
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+var _ = Describe("Readiness of the last reconcile", func() {
+	var (
+		mgr *Manager
+	)
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+		options := chain.Options{}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+		certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+		certificateChain := chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				certificateIssue.Name: certificateIssue,
+			},
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		reconcileAt, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		mgr.updateStatus(&certificateChain, reconcileAt)
+	})
+
+	It("should be ready without waiting for an ongoing reconcile", func() {
+		mgr.active.Lock()
+		defer mgr.active.Unlock()
+		Expect(mgr.CheckReadiness(nil)).To(Succeed(), "should be ready")
+	})
+
+	It("should not be ready while the CA bundle injection fails", func() {
+		mgr.webhooks = []WebhookReference{{Type: MutatingWebhook, Name: "foo"}}
+		mgr.recordWebhookError(newObjectKey(mutatingWebhookType, "", "foo"), errors.New("update refused"))
+		Expect(mgr.CheckReadiness(nil)).To(MatchError(ContainSubstring("update refused")), "should not be ready")
+	})
+})
+
+var _ = Describe("Readiness", func() {
+	var (
+		mgr        *Manager
+		now        time.Time
+		certRotate = 30 * time.Minute
+	)
+
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second).UTC()
+		triple.Now = func() time.Time { return now }
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: certRotate,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should not be ready before the certificates are provisioned", func() {
+		Expect(mgr.CheckReadiness(nil)).To(MatchError(ContainSubstring("certificates not ready")), "should not be ready")
+	})
+
+	It("should be ready once the certificates are provisioned", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(mgr.CheckReadiness(nil)).To(Succeed(), "should be ready")
+	})
+
+	It("should not be ready once the certificate expires", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		now = now.Add(certRotate + time.Minute)
+		err = mgr.CheckReadiness(nil)
+		Expect(err).To(MatchError(ContainSubstring("certificates not ready")), "should not be ready")
+		Expect(err).To(MatchError(ContainSubstring("expired")), "should report the certificate expired")
+	})
+})
@@ -0,0 +1,59 @@
+package certificate
+
+import (
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// inject.go runs the after inject hook for every webhook configuration a CA
+// bundle was injected into during a reconcile, once the reconcile is done,
+// so that operators can trigger follow up steps such as a downstream sync.
+
+// TargetInfo identifies a webhook configuration a CA bundle was injected
+// into
+type TargetInfo struct {
+	// Webhook is the reference of the webhook configuration
+	Webhook WebhookReference
+
+	// Generation and ResourceVersion of the webhook configuration as
+	// injected
+	Generation      int64
+	ResourceVersion string
+}
+
+// recordInjection records a webhook configuration written with a CA bundle
+// as a target for the after inject hook, the active lock has to be held
+func (m *Manager) recordInjection(key *objectKey, injected client.Object) {
+	webhook, isWebhook := webhookReference(key)
+	if !isWebhook {
+		return
+	}
+	m.injected = append(m.injected, TargetInfo{
+		Webhook:         webhook,
+		Generation:      injected.GetGeneration(),
+		ResourceVersion: injected.GetResourceVersion(),
+	})
+}
+
+// takeInjected returns and forgets the targets recorded since the last call,
+// the active lock has to be held
+func (m *Manager) takeInjected() []TargetInfo {
+	injected := m.injected
+	m.injected = nil
+	return injected
+}
+
+// runAfterInject calls the after inject hook for every target, hook failures
+// are not fatal.
+func (m *Manager) runAfterInject(targets []TargetInfo) {
+	if m.afterInject == nil {
+		return
+	}
+	for _, target := range targets {
+		err := m.afterInject(target)
+		if err != nil {
+			m.log.WithName("runAfterInject").Error(err, "After inject hook failed", "webhook", target.Webhook.String())
+			m.handleError(errors.Wrapf(err, "After inject hook failed for %s", target.Webhook))
+		}
+	}
+}
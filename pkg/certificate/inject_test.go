@@ -0,0 +1,115 @@
+package certificate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("After inject hook", func() {
+	var (
+		mgr        *Manager
+		targets    []TargetInfo
+		errs       []error
+		hookErr    error
+		validating = admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "foowebhook-validating",
+			},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{
+				{
+					SideEffects:             &sideEffects,
+					AdmissionReviewVersions: []string{"v1"},
+					Name:                    "foowebhook.qinqon.io",
+					ClientConfig:            expectedMutatingWebhookConfiguration.Webhooks[0].ClientConfig,
+				},
+			},
+		}
+		mutatingReference   = WebhookReference{Type: MutatingWebhook, Name: expectedMutatingWebhookConfiguration.Name}
+		validatingReference = WebhookReference{Type: ValidatingWebhook, Name: validating.Name}
+	)
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+		err := cli.Create(context.TODO(), validating.DeepCopy())
+		Expect(err).To(Succeed(), "should succeed creating validatingwebhookconfiguration")
+
+		targets = nil
+		errs = nil
+		hookErr = nil
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{mutatingReference, validatingReference},
+			WithAfterInject(func(target TargetInfo) error {
+				targets = append(targets, target)
+				return hookErr
+			}),
+			WithErrorHandler(func(err error) {
+				errs = append(errs, err)
+			}),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &validating)
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	injectedWebhooks := func() []WebhookReference {
+		webhooks := []WebhookReference{}
+		for _, target := range targets {
+			webhooks = append(webhooks, target.Webhook)
+		}
+		targets = nil
+		return webhooks
+	}
+
+	It("should be called once per webhook configuration injected", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(targets).To(HaveLen(2), "should be called once per webhook configuration")
+		for _, target := range targets {
+			Expect(target.ResourceVersion).ToNot(BeEmpty(), "should be called with the injected resource version of %s", target.Webhook)
+		}
+		Expect(injectedWebhooks()).To(ConsistOf(mutatingReference, validatingReference), "should be called with the injected webhook configurations")
+
+		By("Reconciling without rotation")
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(targets).To(BeEmpty(), "should not be called without injection")
+
+		By("Forcing a rotation")
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+		Expect(injectedWebhooks()).To(ConsistOf(mutatingReference, validatingReference), "should be called once per webhook configuration after the rotation")
+		Expect(errs).To(BeEmpty(), "should not report errors")
+	})
+
+	It("should pass its failures to the error handler without failing the reconcile", func() {
+		hookErr = errors.New("sync failed")
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(errs).To(HaveLen(2), "should pass every failure to the error handler")
+		for _, err := range errs {
+			Expect(err).To(MatchError(ContainSubstring("sync failed")), "should pass the hook failure to the error handler")
+		}
+	})
+})
@@ -0,0 +1,67 @@
+package certificate
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// IssuerLabel is a label identifying the manager that issued an object, set
+// on every object the manager creates or updates
+type IssuerLabel struct {
+	Key   string
+	Value string
+}
+
+// validate checks that the issuer label is a valid label
+func (l IssuerLabel) validate() error {
+	if errs := validation.IsQualifiedName(l.Key); len(errs) > 0 {
+		return errors.Errorf("issuer label key %q is invalid: %s", l.Key, strings.Join(errs, ", "))
+	}
+	if errs := validation.IsValidLabelValue(l.Value); len(errs) > 0 {
+		return errors.Errorf("issuer label value %q is invalid: %s", l.Value, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// setIssuerLabel sets the issuer label on object, if configured
+func (m *Manager) setIssuerLabel(object client.Object) {
+	if m.issuerLabel == nil {
+		return
+	}
+	labels := object.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[m.issuerLabel.Key] = m.issuerLabel.Value
+	object.SetLabels(labels)
+}
+
+// removeIssuerLabel removes the issuer label from object, if configured
+func (m *Manager) removeIssuerLabel(object client.Object) {
+	if m.issuerLabel == nil {
+		return
+	}
+	labels := object.GetLabels()
+	if _, found := labels[m.issuerLabel.Key]; !found {
+		return
+	}
+	delete(labels, m.issuerLabel.Key)
+	if len(labels) == 0 {
+		labels = nil
+	}
+	object.SetLabels(labels)
+}
+
+// issuedByManager returns whether object carries the issuer label, always
+// true if not configured
+func (m *Manager) issuedByManager(object client.Object) bool {
+	if m.issuerLabel == nil {
+		return true
+	}
+	value, found := object.GetLabels()[m.issuerLabel.Key]
+	return found && value == m.issuerLabel.Value
+}
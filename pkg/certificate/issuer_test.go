@@ -0,0 +1,99 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+var _ = Describe("Issuer label validation", func() {
+	DescribeTable("should validate the issuer label",
+		func(label IssuerLabel, expectedError string) {
+			_, err := NewManagerWithOptions("foo", "bar", nil, nil, WithIssuerLabel(label))
+			if expectedError == "" {
+				Expect(err).To(Succeed(), "should accept the issuer label")
+			} else {
+				Expect(err).To(MatchError(ContainSubstring(expectedError)), "should refuse the issuer label")
+			}
+		},
+		Entry("valid", IssuerLabel{Key: "webhook.qinqon.io/issued-by", Value: "foo"}, ""),
+		Entry("with an empty value", IssuerLabel{Key: "issued-by", Value: ""}, ""),
+		Entry("with an invalid key", IssuerLabel{Key: "not a key", Value: "foo"}, "issuer label key"),
+		Entry("with an invalid value", IssuerLabel{Key: "issued-by", Value: "not a value"}, "issuer label value"),
+	)
+})
+
+var _ = Describe("Issuer label", func() {
+	var (
+		mgr         *Manager
+		issuerLabel = IssuerLabel{Key: "webhook.qinqon.io/issued-by", Value: "foo-manager"}
+	)
+
+	getCASecret := func() corev1.Secret {
+		caSecret := corev1.Secret{}
+		err := cli.Get(context.TODO(), types.NamespacedName{Namespace: expectedCASecret.Namespace, Name: expectedCASecret.Name}, &caSecret)
+		Expect(err).To(Succeed(), "should succeed getting CA secret")
+		return caSecret
+	}
+
+	BeforeEach(func() {
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval: time.Hour,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithIssuerLabel(issuerLabel),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should label the written objects and scope cleanup with it", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.Labels).To(HaveKeyWithValue(issuerLabel.Key, issuerLabel.Value), "should label the service secret")
+		Expect(getCASecret().Labels).To(HaveKeyWithValue(issuerLabel.Key, issuerLabel.Value), "should label the CA secret")
+		Expect(getWebhookConfiguration().Labels).To(HaveKeyWithValue(issuerLabel.Key, issuerLabel.Value), "should label the webhook configuration")
+
+		By("Issuing the CA secret by another manager")
+		caSecret := getCASecret()
+		caSecret.Labels[issuerLabel.Key] = "bar-manager"
+		err = cli.Update(context.TODO(), &caSecret)
+		Expect(err).To(Succeed(), "should succeed updating CA secret")
+
+		err = mgr.Cleanup(context.TODO())
+		Expect(err).To(Succeed(), "should succeed cleaning up")
+
+		_, err = getSecret()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should delete the service secret issued by the manager")
+		Expect(getCASecret().Labels).To(HaveKeyWithValue(issuerLabel.Key, "bar-manager"), "should keep the CA secret issued by another manager")
+		Expect(getWebhookConfiguration().Labels).ToNot(HaveKey(issuerLabel.Key), "should remove the label from the webhook configuration")
+	})
+})
@@ -1,14 +1,28 @@
 package certificate
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
 	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
@@ -34,14 +48,203 @@ type Manager struct {
 	// options
 	options chain.Options
 
-	active sync.Mutex
+	// immutableSecrets marks secrets as immutable
+	immutableSecrets bool
+
+	// secretFinalizer adds a finalizer to service secrets that is only
+	// removed on Cleanup
+	secretFinalizer bool
+
+	// webhookAPIVersionAliases also manages the webhook configurations at the
+	// other admissionregistration API version of the managed ones
+	webhookAPIVersionAliases bool
+
+	// sanPolicy is the way certificates are issued for more than one
+	// service or URL
+	sanPolicy SANPolicy
+
+	// clusterDomains, if set, are the cluster domains the service
+	// certificates are issued for instead of cluster.local
+	clusterDomains []string
+
+	// extraAltNames, if set, are SANs the service certificates are issued
+	// with along the ones of the services
+	extraAltNames *triple.AltNames
+
+	// certificateHistory is the number of rotated certificates kept on
+	// service secrets
+	certificateHistory int
+
+	// caRotationNoticeLead is the time ahead of a CA rotation that
+	// caRotationNotify is called at
+	caRotationNoticeLead time.Duration
+	caRotationNotify     func(rotateAt time.Time)
+	// caRotationNoticed is the CA rotation time last notified
+	caRotationNoticed time.Time
+
+	// externalCABundle, if set, is injected as is instead of generating
+	// certificates
+	externalCABundle []byte
+
+	// caConfigMapName, if set, is the name of the ConfigMap the CA bundle is
+	// mirrored to with caConfigMapLayout
+	caConfigMapName   string
+	caConfigMapLayout CAConfigMapLayout
+	// caConfigMapNamespaces and caConfigMapNamespaceSelector, if set, select
+	// the namespaces the CA ConfigMap is written to instead of namespace
+	caConfigMapNamespaces        []string
+	caConfigMapNamespaceSelector labels.Selector
+	// caConfigMapMirrored are the namespaces the CA ConfigMap was last
+	// written to, nil until it is written once, so that it is deleted from
+	// the ones that are no longer selected
+	caConfigMapMirrored sets.String
+
+	// beforeCARotation runs before the CA is rotated, deferring the
+	// rotation if it fails
+	beforeCARotation func(ctx context.Context) error
+
+	// caOwnerIdentity, if set, is recorded at the CA secret when the CA is
+	// generated, and other identities refuse to generate it again while its
+	// heartbeat is not older than caOwnerTTL
+	caOwnerIdentity string
+	caOwnerTTL      time.Duration
+
+	// secretCache, if not nil, keeps the last known secrets so they are not
+	// read again until there is an event for them
+	secretCache     map[types.NamespacedName]*corev1.Secret
+	secretCacheLock sync.Mutex
+	// secretCacheExpiry is the time the next reconcile is scheduled at, the
+	// secret cache is emptied once it is due
+	secretCacheExpiry time.Time
+
+	// writtenSecrets are the secrets written by the last successful
+	// reconcile, the ones no longer referenced by the next one are deleted
+	writtenSecrets map[types.NamespacedName]bool
+
+	// eventRecorder emits the rotation events
+	eventRecorder record.EventRecorder
+
+	// endpointsReadinessTimeout, if set, defers scheduled rotations while
+	// the webhook services have no ready endpoints, up to it past the
+	// rotation deadline
+	endpointsReadinessTimeout time.Duration
+
+	// errorHandler, if set, is called with the errors of the background
+	// reconciles and issuance hooks
+	errorHandler ErrorHandler
+
+	// healthPolicy is the policy Healthz reports the health by
+	healthPolicy HealthPolicy
+
+	// issuerLabel, if set, is set on every object written and scopes the
+	// objects deleted on cleanup
+	issuerLabel *IssuerLabel
+
+	// serviceSecretName, if set, is the secret the service certificate is
+	// stored at instead of the one named after the service
+	serviceSecretName *types.NamespacedName
+
+	// secretOwner, if set, is referenced as owner by the service secrets
+	// the manager creates
+	secretOwner *SecretOwner
+
+	// secretLayout is the way the CA key pair is stored, at its own secret
+	// or along the service key pairs
+	secretLayout SecretLayout
+
+	// certDir, if set, is the directory the service certificate and key are
+	// written to along the Secret
+	certDir string
+
+	// metrics collects the certificate metrics
+	metrics *MetricsCollector
+
+	// auditLog, if set, is written an audit record for every rotated
+	// certificate
+	auditLog io.Writer
+
+	// onIssue is called with every issued certificate
+	onIssue func(cert *x509.Certificate) error
+
+	// afterInject is called with every webhook configuration injected with
+	// a CA bundle, injected being the ones of the ongoing reconcile
+	afterInject func(target TargetInfo) error
+	injected    []TargetInfo
+
+	// trustDistributionCheck runs before activating service certificates
+	// issued by a new CA
+	trustDistributionCheck   TrustDistributionCheck
+	trustDistributionTimeout time.Duration
+
+	// admissionCheck runs after CA bundles are injected
+	admissionCheck        AdmissionCheck
+	admissionCheckTimeout time.Duration
+
+	// active serializes the reconciles, forced rotations, cleanups and
+	// verifications of the manager
+	active    sync.Mutex
 	verifying bool
 
+	// status of the last succesful reconcile
+	status             Status
+	leafCertificate    *x509.Certificate
+	servingCertificate *tls.Certificate
+	statusLock         sync.RWMutex
+
 	// log initialized log that containes the webhook configuration name and
 	// namespace so it's easy to debug.
 	log logr.Logger
 }
 
+// CertManager is the interface implemented by Manager, downstream unit tests
+// can replace it with a FakeManager.
+type CertManager interface {
+	// Add registers the certificates reconcile loop at a controller-runtime
+	// manager
+	Add(mgr manager.Manager) error
+
+	// Apply reconciles the certificates in a single pass
+	Apply(ctx context.Context) error
+
+	// Cleanup removes the certificates material from the cluster
+	Cleanup(ctx context.Context) error
+
+	// VerifyTLS verifies the certificate chain
+	VerifyTLS() error
+
+	// Status returns the state of the certificates as of the last reconcile
+	Status() Status
+
+	// ForceRotate rotates the CA and service certificates right away
+	ForceRotate(ctx context.Context) error
+
+	// LeafCertificate returns the current service certificate
+	LeafCertificate() *x509.Certificate
+
+	// CheckReadiness and Healthz are the readiness and health checkers
+	CheckReadiness(req *http.Request) error
+	Healthz(req *http.Request) error
+
+	// TLSCertificate returns the service key pair to serve, GetTLSConfig a
+	// TLS configuration serving it
+	TLSCertificate() (*tls.Certificate, error)
+	GetTLSConfig() *tls.Config
+
+	// Plan reports what a reconcile would do with the certificates
+	Plan(ctx context.Context) (RotationPlan, error)
+
+	// SchedulePlan returns the upcoming rotations
+	SchedulePlan() []ScheduledRotation
+
+	// BuildSecret returns the service and CA secrets as they are stored
+	BuildSecret(ctx context.Context) (secret, caSecret *corev1.Secret, err error)
+
+	// EffectiveConfig returns the configuration the manager runs with
+	EffectiveConfig() EffectiveConfig
+}
+
+var _ CertManager = &Manager{}
+
 // NewManager with create a Manager that generates and updates at expiration a secret
 // containing certificates per service backing the set of webhooks provided.
 // These secrets name will be the same as the service.
@@ -59,56 +262,649 @@ type Manager struct {
 //
 // It will also update the webhook caBundle field with the CA certificates used
 // to issue the service certificates.
-func NewManager(name string, namespace string, client client.Client, options chain.Options, webhooks []WebhookReference) (*Manager, error) {
-	err := options.SetDefaultsAndValidate()
-	if err != nil {
-		return nil, err
-	}
+//
+// Further optional behavior can be configured with managerOpts.
+func NewManager(name string, namespace string, client client.Client, options chain.Options, webhooks []WebhookReference, managerOpts ...Option) (*Manager, error) {
+	return NewManagerWithOptions(name, namespace, client, webhooks, append([]Option{WithCertificateOptions(options)}, managerOpts...)...)
+}
 
+// NewManagerWithOptions creates a Manager as NewManager does, with the
+// certificate options configured with managerOpts too, such as
+// WithCADuration, WithCertDuration or WithKeySize, and their defaults
+// otherwise.
+func NewManagerWithOptions(name string, namespace string, client client.Client, webhooks []WebhookReference, managerOpts ...Option) (*Manager, error) {
 	m := &Manager{
 		name:      name,
 		namespace: namespace,
 		client:    client,
-		options:   options,
 		webhooks:  webhooks,
 		log:       logf.Log.WithName("certificate/Manager"),
+
+		eventRecorder: noopEventRecorder{},
+	}
+	m.metrics = newMetricsCollector(m)
+	for _, managerOpt := range managerOpts {
+		managerOpt(m)
+	}
+	m.setDefaults()
+
+	err := m.options.SetDefaultsAndValidate()
+	if err != nil {
+		return nil, err
+	}
+	err = m.validate()
+	if err != nil {
+		return nil, err
 	}
 	return m, nil
 }
 
+// Apply checks, updates and cleans up the certificate chain associated to the
+// existing webhook configurations provided to this manager in a single pass,
+// the same one done on every reconcile. CA bundles are injected on the webhook
+// configurations first, then service certificates are written to their
+// secrets, pruning expired certificates along the way. Finally the resulting
+// certificate chain is verified.
+func (m *Manager) Apply(ctx context.Context) error {
+	_, err := m.reconcileCertificates(ctx)
+	return err
+}
+
+// ForceRotate rotates the CA and service certificates right away regardless
+// of their rotation deadlines, for instance on a suspected key compromise,
+// injecting the new CA bundle and storing the new certificates as Apply does.
+// In external CA bundle mode there is nothing to rotate and it does as Apply.
+// It is safe to call concurrently with the reconciles of the controller, it
+// waits for any ongoing one to finish.
+func (m *Manager) ForceRotate(ctx context.Context) error {
+	_, err := m.reconcile(ctx, true)
+	return err
+}
+
 // reconcileCertificates checks, updates and cleans up the certificate chain
 // associated to the existing webhook configurations provided to this manager.
-func (m *Manager) reconcileCertificates() (time.Duration, error) {
+// It returns the duration after which it should be called again.
+func (m *Manager) reconcileCertificates(ctx context.Context) (time.Duration, error) {
+	return m.reconcile(ctx, false)
+}
+
+// reconciliation is the certificate chain of an ongoing reconcile, carried
+// through its steps along the state it was read with.
+type reconciliation struct {
+	// force rotates the certificate chain regardless of deadlines
+	force bool
+
+	objects          objectMap
+	certificateChain chain.CertificateChainData
+
+	// previousCABundles, previousCA, previousCerts and previousIssues are the
+	// certificate chain as read, or as last written by the reconcile
+	previousCABundles map[string][]byte
+	previousCA        []byte
+	previousCerts     map[string][]byte
+	previousIssues    map[string]chain.CertificateIssue
+
+	// rotationDeadline is the earliest rotation deadline of the certificate
+	// chain as read, if the endpoints readiness check needs it
+	rotationDeadline time.Time
+
+	// rotation is set once a rotation of the certificate chain was attempted
+	rotation bool
+
+	// reconcileAt is the time the next reconcile is due at
+	reconcileAt time.Time
+
+	// issued are the certificates the reconcile issued and stored
+	issued []*x509.Certificate
+
+	// caDeferral is the DeferredError of a CA rotation deferred while the
+	// service certificates are kept current with the current CA
+	caDeferral error
+}
+
+// reconcile does reconcileCertificates, rotating the certificate chain
+// regardless of deadlines if force is set. It goes through the steps of
+// loading the certificate chain, updating it, keeping the current CA if its
+// rotation is held back, writing it and publishing it, each failing with a
+// DeferredError if the reconcile is deferred or with any other error if it
+// failed. A deferred CA rotation does not stop the reconcile, it is returned
+// once the service certificates are kept current with the current CA.
+func (m *Manager) reconcile(ctx context.Context, force bool) (_ time.Duration, err error) {
 	logger := m.log.WithName("reconcileCertificates")
+	r := &reconciliation{force: force, objects: objectMap{}}
+	// issuance and injection hooks, the admission check and the CA rotation
+	// notice run once the reconcile is done, without holding it
+	var (
+		injected         []TargetInfo
+		checkAdmission   bool
+		caRotationNotice time.Time
+	)
+	defer func() {
+		m.runOnIssue(r.issued)
+		m.runAfterInject(injected)
+		if checkAdmission {
+			m.checkAdmission(ctx)
+		}
+		if !caRotationNotice.IsZero() {
+			m.caRotationNotify(caRotationNotice)
+		}
+	}()
 	m.active.Lock()
 	defer m.active.Unlock()
+	defer func() { injected = m.takeInjected() }()
+
+	if m.externalCABundle != nil {
+		return m.reconcileExternalCABundle(ctx)
+	}
 
 	logger.Info("Reconciling webhook certificates")
+	defer func() {
+		// the service certificates rotated while the CA rotation is deferred
+		// are rotated successfully
+		rotationErr := err
+		if r.caDeferral != nil && rotationErr == r.caDeferral {
+			rotationErr = nil
+		}
+		m.metrics.observeRotation(r.rotation, r.certificateChain.RotationReason, rotationErr)
+		m.recordRotationEvents(r.objects, r.rotation, &r.certificateChain, rotationErr)
+	}()
+
+	err = m.loadCertificateChain(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.updateCertificateChain(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	caRetryAt, caErr := m.checkCARotation(ctx, r)
+	if caErr != nil {
+		logger.Info("Deferring CA generation, rotating the service certificates only", "reason", caErr.Error())
+		err = m.keepCurrentCA(ctx, r)
+		if err != nil {
+			return 0, err
+		}
+		if !caRetryAt.IsZero() && caRetryAt.Before(r.reconcileAt) {
+			r.reconcileAt = caRetryAt
+		}
+		if IsDeferred(caErr) {
+			r.caDeferral = caErr
+		}
+	}
+	if r.certificateChain.RotationReason != "" {
+		logger.Info("Certificates rotated", "reason", r.certificateChain.RotationReason)
+	}
+
+	err = m.writeCertificates(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = m.publishCertificates(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	r.reconcileAt = m.refreshCAOwnerHeartbeatAt(r.objects, r.reconcileAt)
+	m.updateStatus(&r.certificateChain, r.reconcileAt)
+	checkAdmission = m.admissionCheckPending(r.previousCABundles, &r.certificateChain)
+	r.reconcileAt, caRotationNotice = m.noticeCARotation(r.reconcileAt)
+
+	if r.caDeferral != nil {
+		logger.Info("Webhook certificates reconciled with the CA rotation deferred", "reconcileAt", r.reconcileAt.UTC().Format(time.RFC3339))
+		return r.reconcileAt.Sub(triple.Now()), r.caDeferral
+	}
+	logger.Info("Webhook certificates reconciled succesfuly", "reconcileAt", r.reconcileAt.UTC().Format(time.RFC3339))
+	return r.reconcileAt.Sub(triple.Now()), nil
+}
+
+// loadCertificateChain reads the certificate chain of a reconcile, recording
+// it as the previous one.
+func (m *Manager) loadCertificateChain(ctx context.Context, r *reconciliation) error {
+	err := m.readCertificateChain(ctx, r.objects, &r.certificateChain)
+	if err != nil {
+		return errors.Wrap(err, "Failed reading certificate data")
+	}
+	r.previousCABundles = caBundles(&r.certificateChain)
+	r.previousCA = r.certificateChain.CA.CertPEM
+	r.previousCerts = issuedCertPEMs(&r.certificateChain)
+	r.previousIssues = certificateIssuesCopy(&r.certificateChain)
+	r.rotationDeadline = m.rotationDeadline(&r.certificateChain)
+	return nil
+}
+
+// updateCertificateChain updates the certificate chain of a reconcile,
+// rotating it if due or forced. Scheduled rotations are deferred while the
+// endpoints are not ready.
+func (m *Manager) updateCertificateChain(ctx context.Context, r *reconciliation) error {
+	update := chain.Update
+	if r.force {
+		update = chain.Rotate
+	}
+	var err error
+	r.reconcileAt, err = update(&m.options, &r.certificateChain)
+	if err != nil {
+		r.rotation = true
+		return errors.Wrap(err, "Failed updating certificate data")
+	}
+	r.rotation = r.certificateChain.RotationReason != ""
+
+	err = m.checkEndpointsReady(ctx, r.objects, r.rotationDeadline, &r.certificateChain, r.force)
+	if err != nil {
+		return errors.Wrap(err, "Deferring certificates rotation")
+	}
+	return nil
+}
+
+// checkCARotation returns an error if the CA generated by the update of the
+// certificate chain of a reconcile has to be held back, along the time to
+// retry it at, the zero time if unknown. It is a DeferredError if the
+// before CA rotation hook failed, the CA rotation being retried by the next
+// reconcile.
+func (m *Manager) checkCARotation(ctx context.Context, r *reconciliation) (time.Time, error) {
+	retryAt, err := m.checkCAOwner(r.objects, r.previousCA, &r.certificateChain, r.force)
+	if err != nil {
+		return retryAt, err
+	}
+	err = m.runBeforeCARotation(ctx, r)
+	if err != nil {
+		return time.Time{}, &DeferredError{Err: errors.Wrap(err, "Deferring CA rotation")}
+	}
+	return time.Time{}, nil
+}
+
+// keepCurrentCA reads the certificate chain of a reconcile again, dropping
+// the CA generated by its update, and updates its service certificates only,
+// with the current CA.
+func (m *Manager) keepCurrentCA(ctx context.Context, r *reconciliation) error {
+	r.objects, r.certificateChain = objectMap{}, chain.CertificateChainData{}
+	err := m.readCertificateChain(ctx, r.objects, &r.certificateChain)
+	if err != nil {
+		return errors.Wrap(err, "Failed reading certificate data")
+	}
+	r.reconcileAt, err = chain.UpdateCerts(&m.options, &r.certificateChain)
+	if err != nil {
+		r.rotation = true
+		return errors.Wrap(err, "Failed updating certificate data")
+	}
+	r.rotation = r.certificateChain.RotationReason != ""
+	return nil
+}
+
+// writeCertificates writes the certificate chain of a reconcile to the
+// secrets and its CA bundle to the webhook configurations, staging the
+// activation of service certificates issued by a new CA if configured, and
+// deletes the secrets no longer referenced.
+func (m *Manager) writeCertificates(ctx context.Context, r *reconciliation) error {
+	// the new CA is written along the previous service certificates, it is
+	// reported as issued right away since a retry reads it as the previous one
+	staged, err := m.distributeCATrust(ctx, r.objects, r.previousIssues, &r.certificateChain)
+	if staged != nil {
+		r.issued = issuedCertificates(r.previousCA, r.previousCerts, staged)
+		m.auditRotation(r.previousCA, r.previousCerts, staged)
+		r.previousCA = staged.CA.CertPEM
+		r.previousCerts = issuedCertPEMs(staged)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Deferring certificates activation")
+	}
+
+	err = m.writeCertificateChain(ctx, r.objects, &r.certificateChain)
+	if err != nil {
+		return errors.Wrap(err, "Failed writing certificate data")
+	}
+	m.metrics.observeCertificatesIssued(r.previousCerts, &r.certificateChain)
+	err = m.deleteStaleSecrets(ctx, r.objects)
+	if err != nil {
+		return errors.Wrap(err, "Failed deleting stale secrets")
+	}
+	r.issued = append(r.issued, issuedCertificates(r.previousCA, r.previousCerts, &r.certificateChain)...)
+	m.auditRotation(r.previousCA, r.previousCerts, &r.certificateChain)
+	return nil
+}
+
+// publishCertificates verifies the certificate chain written by a reconcile
+// and mirrors its CA bundle to the CA ConfigMaps. A certificate chain not
+// valid yet is kept with a DeferredError retried once it is valid.
+func (m *Manager) publishCertificates(ctx context.Context, r *reconciliation) error {
+	err := chain.Verify(&m.options, &r.certificateChain)
+	notYetValid := &chain.NotYetValidError{}
+	if errors.As(err, &notYetValid) {
+		return &DeferredError{Err: errors.Wrap(err, "Waiting for certificate data to be valid"), RetryAt: notYetValid.ValidAt}
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed verifying certificate data")
+	}
+
+	err = m.mirrorCABundle(ctx, &r.certificateChain)
+	if err != nil {
+		return errors.Wrap(err, "Failed mirroring CA bundle")
+	}
+	return nil
+}
+
+// issuedCertPEMs returns the certificates of every certificate issue by name
+func issuedCertPEMs(certificateChain *chain.CertificateChainData) map[string][]byte {
+	certPEMs := map[string][]byte{}
+	for name, certificateIssue := range certificateChain.CertificatesIssued {
+		certPEMs[name] = certificateIssue.CertPEM
+	}
+	return certPEMs
+}
+
+// issuedCertificates returns the CA and service certificates of a
+// certificate chain that were not there before, the CA one first and then
+// the service ones by name.
+func issuedCertificates(previousCA []byte, previousCerts map[string][]byte, certificateChain *chain.CertificateChainData) []*x509.Certificate {
+	issued := []*x509.Certificate{}
+	if !bytes.Equal(previousCA, certificateChain.CA.CertPEM) {
+		caCerts, err := triple.ParseCertsPEM(certificateChain.CA.CertPEM)
+		if err == nil {
+			issued = append(issued, caCerts[len(caCerts)-1])
+		}
+	}
+
+	names := make([]string, 0, len(certificateChain.CertificatesIssued))
+	for name := range certificateChain.CertificatesIssued {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		certs, err := triple.ParseCertsPEM(certificateChain.CertificatesIssued[name].CertPEM)
+		if err != nil {
+			continue
+		}
+		previous, _ := triple.ParseCertsPEM(previousCerts[name])
+		for _, cert := range certs {
+			if !containsCertificate(previous, cert) {
+				issued = append(issued, cert)
+			}
+		}
+	}
+	return issued
+}
+
+func containsCertificate(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// runOnIssue calls the issuance hook for every issued certificate, hook
+// failures are not fatal.
+func (m *Manager) runOnIssue(issued []*x509.Certificate) {
+	if m.onIssue == nil {
+		return
+	}
+	for _, cert := range issued {
+		err := m.onIssue(cert)
+		if err != nil {
+			m.log.WithName("runOnIssue").Error(err, "Issuance hook failed", "commonName", cert.Subject.CommonName, "serial", cert.SerialNumber)
+			m.handleError(errors.Wrapf(err, "Issuance hook failed for certificate %s", cert.Subject.CommonName))
+		}
+	}
+}
+
+// DeferredError is the error of a reconcile deferring the rotation of the
+// certificates until a precondition is met. It is retried and it is not a
+// rotation failure.
+type DeferredError struct {
+	Err error
+
+	// RetryAt, if set, is the time the precondition is met at, the
+	// reconcile is retried then instead of after a fixed interval
+	RetryAt time.Time
+}
+
+func (e *DeferredError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeferredError) Unwrap() error {
+	return e.Err
+}
+
+// IsDeferred returns true if err is, or wraps, a DeferredError
+func IsDeferred(err error) bool {
+	deferred := &DeferredError{}
+	return errors.As(err, &deferred)
+}
+
+// ErrorHandler is called with the errors the manager cannot return to a
+// caller, wrapped with the phase that failed
+type ErrorHandler func(err error)
+
+// handleError calls the error handler, if configured, with err unless it is
+// a deferral
+func (m *Manager) handleError(err error) {
+	if m.errorHandler == nil || IsDeferred(err) {
+		return
+	}
+	m.errorHandler(err)
+}
+
+// checkCAOwner refuses to generate a new CA if the CA secret is owned by a
+// live identity other than the manager's, unless forced, returning the time
+// the owner is considered gone at and the CA can be taken over. Owners are
+// live while their heartbeat is not older than the CA owner TTL.
+func (m *Manager) checkCAOwner(objects objectMap, previousCA []byte, certificateChain *chain.CertificateChainData, force bool) (time.Time, error) {
+	if m.caOwnerIdentity == "" || force || bytes.Equal(previousCA, certificateChain.CA.CertPEM) {
+		return time.Time{}, nil
+	}
+	for key, object := range objects {
+		if !m.isCASecret(key) {
+			continue
+		}
+		owner := object.kobject.GetAnnotations()[secretCAOwnerAnnotationKey]
+		if owner == "" || owner == m.caOwnerIdentity {
+			continue
+		}
+		takeOverAt := caOwnerHeartbeat(object.kobject).Add(m.caOwnerTTL)
+		if !triple.Now().Before(takeOverAt) {
+			m.log.Info("CA owner heartbeat expired, taking over the CA", "owner", owner, "identity", m.caOwnerIdentity)
+			continue
+		}
+		return takeOverAt, errors.Errorf("CA is owned by %s, refusing to generate a new one as %s", owner, m.caOwnerIdentity)
+	}
+	return time.Time{}, nil
+}
+
+// refreshCAOwnerHeartbeatAt returns the time reconcile should happen at for
+// the manager to refresh its heartbeat as CA owner in time, reconcileAt if it
+// is earlier or the manager does not own the CA.
+func (m *Manager) refreshCAOwnerHeartbeatAt(objects objectMap, reconcileAt time.Time) time.Time {
+	if m.caOwnerIdentity == "" {
+		return reconcileAt
+	}
+	for key, object := range objects {
+		if !m.isCASecret(key) || object.kobject.GetAnnotations()[secretCAOwnerAnnotationKey] != m.caOwnerIdentity {
+			continue
+		}
+		refreshAt := caOwnerHeartbeat(object.kobject).Add(m.caOwnerTTL / 2)
+		if refreshAt.Before(reconcileAt) {
+			reconcileAt = refreshAt
+		}
+	}
+	return reconcileAt
+}
+
+// runBeforeCARotation runs the before CA rotation hook, if any, when the
+// update of the certificate chain of a reconcile rotated an existing CA,
+// either due, forced or invalid.
+func (m *Manager) runBeforeCARotation(ctx context.Context, r *reconciliation) error {
+	if m.beforeCARotation == nil || len(r.previousCA) == 0 || bytes.Equal(r.previousCA, r.certificateChain.CA.CertPEM) {
+		return nil
+	}
+	m.log.Info("Running before CA rotation hook", "reason", r.certificateChain.RotationReason)
+	return m.beforeCARotation(ctx)
+}
+
+// noticeCARotation returns the time of the next CA rotation the CA rotation
+// notify function has to be called with, if the current time is within the
+// notice lead time of it and it was not noticed yet, the zero time otherwise.
+// The function is called by the caller once the reconcile is done, without
+// holding it. It also returns the time reconcile should happen at for the
+// notice to be timely.
+func (m *Manager) noticeCARotation(reconcileAt time.Time) (time.Time, time.Time) {
+	rotateAt := m.Status().CARotationTime
+	if m.caRotationNotify == nil || rotateAt.IsZero() {
+		return reconcileAt, time.Time{}
+	}
+
+	noticeAt := rotateAt.Add(-m.caRotationNoticeLead)
+	now := triple.Now()
+	if now.Before(noticeAt) {
+		if noticeAt.Before(reconcileAt) {
+			return noticeAt, time.Time{}
+		}
+		return reconcileAt, time.Time{}
+	}
+
+	if now.Before(rotateAt) && !m.caRotationNoticed.Equal(rotateAt) {
+		m.log.Info("CA rotation imminent", "rotateAt", rotateAt.Format(time.RFC3339))
+		m.caRotationNoticed = rotateAt
+		return reconcileAt, rotateAt
+	}
+	return reconcileAt, time.Time{}
+}
+
+// Cleanup reverses what this manager did on the webhook configurations provided
+// to it: the injected CA bundles are cleared and both the CA and service
+// secrets deleted. Secrets not annotated as managed by this library, and thus
+// not created by it, are never deleted, nor are the ones not carrying the
+// issuer label if configured.
+func (m *Manager) Cleanup(ctx context.Context) error {
+	logger := m.log.WithName("Cleanup")
+	m.active.Lock()
+	defer m.active.Unlock()
+
+	logger.Info("Cleaning up webhook certificates")
+	if m.externalCABundle != nil {
+		err := m.injectCABundle(ctx, nil)
+		if err != nil {
+			return errors.Wrap(err, "Failed clearing external CA bundle")
+		}
+		logger.Info("Webhook external CA bundle cleaned up succesfully")
+		return nil
+	}
+
 	objects := objectMap{}
 	certificateChain := chain.CertificateChainData{}
 
-	err := m.readCertificateChain(objects, &certificateChain)
+	err := m.readCertificateChain(ctx, objects, &certificateChain)
+	if err != nil {
+		return errors.Wrap(err, "Failed reading certificate data")
+	}
+
+	err = m.cleanupObjects(ctx, objects)
 	if err != nil {
-		return 0, errors.Wrap(err, "Failed reading certificate data")
+		return errors.Wrap(err, "Failed cleaning up certificate data")
 	}
 
-	reconcileAt, err := chain.Update(&m.options, &certificateChain)
+	err = m.cleanupCABundleMirror(ctx)
 	if err != nil {
-		return 0, errors.Wrap(err, "Failed updating certificate data")
+		return errors.Wrap(err, "Failed cleaning up CA bundle mirror")
 	}
 
-	err = m.writeCertificateChain(objects, &certificateChain)
+	logger.Info("Webhook certificates cleaned up succesfully")
+	return nil
+}
+
+// BuildSecret returns the service secret, the one of the first service by
+// name if the webhooks are backed by more than one, and the CA secret it is
+// issued by as the manager writes them, without writing anything to the
+// cluster. It is a render of the certificates stored at the cluster, it does
+// not issue nor rotate any, failing if there are none or they do not verify,
+// so calling it does not change the secrets it returns. The CA secret is nil
+// with the combined secret layout, the CA being stored at the service secret.
+// This allows rendering the secrets to apply them with other tooling.
+func (m *Manager) BuildSecret(ctx context.Context) (secret, caSecret *corev1.Secret, err error) {
+	m.active.Lock()
+	defer m.active.Unlock()
+
+	if m.externalCABundle != nil {
+		return nil, nil, errors.New("There is no service secret with an external CA bundle")
+	}
+
+	objects := objectMap{}
+	certificateChain := chain.CertificateChainData{}
+
+	err = m.readCertificateChain(ctx, objects, &certificateChain)
 	if err != nil {
-		return 0, errors.Wrap(err, "Failed writing certificate data")
+		return nil, nil, errors.Wrap(err, "Failed reading certificate data")
 	}
 
-	logger.Info("Webhook certificates reconciled succesfuly")
-	return reconcileAt.Sub(triple.Now()), nil
+	if len(certificateChain.CA.CertPEM) == 0 {
+		return nil, nil, errors.New("There are no certificates to build the secrets with")
+	}
+	err = chain.Verify(&m.options, &certificateChain)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed verifying certificate data")
+	}
+
+	for _, object := range objects.sorted() {
+		if object.key.Kind != secretType {
+			continue
+		}
+		isCA := object.key.NamespacedName == m.secretCAName()
+		if !isCA && secret != nil {
+			continue
+		}
+		built, err := m.buildSecret(object, &certificateChain)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isCA {
+			caSecret = built
+		} else {
+			secret = built
+		}
+	}
+	if secret == nil {
+		return nil, nil, errors.New("There is no service backing the webhooks")
+	}
+	if caSecret == nil && !m.combinedSecrets() {
+		return nil, nil, errors.New("There is no CA secret issuing the service secret")
+	}
+	return secret, caSecret, nil
+}
+
+// buildSecret maps certificate chain data to a secret as writeObjectFromChain
+// does, returning a copy of it with the fields set by the cluster cleared
+func (m *Manager) buildSecret(object *keyedObject, certificateChain *chain.CertificateChainData) (*corev1.Secret, error) {
+	current := object.kobject.DeepCopyObject()
+	m.mapObjectFromChain(object, current, object.kobject.GetResourceVersion() == "", certificateChain)
+	validator := objectOperatorsMap[object.key.Kind].validator
+	if validator != nil {
+		err := validator(object)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Refusing to build invalid secret %s", object.key)
+		}
+	}
+	secret := object.kobject.(*corev1.Secret).DeepCopy()
+	secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	secret.ResourceVersion = ""
+	secret.UID = ""
+	secret.CreationTimestamp = metav1.Time{}
+	secret.ManagedFields = nil
+	return secret, nil
 }
 
 // VerifyTLS verifies that a certificate chain exists and is valid for the
 // webhook configurations provided to this manager.
 func (m *Manager) VerifyTLS() error {
+	_, err := m.verifyTLS()
+	return err
+}
+
+// verifyTLS does VerifyTLS, returning the verified certificate chain, nil in
+// external CA bundle mode.
+func (m *Manager) verifyTLS() (*chain.CertificateChainData, error) {
 	logger := m.log.WithName("VerifyTLS")
 	m.active.Lock()
 	m.verifying = true
@@ -118,20 +914,28 @@ func (m *Manager) VerifyTLS() error {
 	}()
 
 	logger.Info("Verifying webhook certificates")
+	if m.externalCABundle != nil {
+		err := m.verifyExternalCABundle(context.TODO())
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed verifying external CA bundle")
+		}
+		logger.Info("Webhook external CA bundle verified succesfully")
+		return nil, nil
+	}
 
 	objects := objectMap{}
 	certificateChain := chain.CertificateChainData{}
 
-	err := m.readCertificateChain(objects, &certificateChain)
+	err := m.readCertificateChain(context.TODO(), objects, &certificateChain)
 	if err != nil {
-		return errors.Wrap(err, "Failed reading certificate data")
+		return nil, errors.Wrap(err, "Failed reading certificate data")
 	}
 
 	err = chain.Verify(&m.options, &certificateChain)
 	if err != nil {
-		return errors.Wrap(err, "Failed verifying certificate data")
+		return nil, errors.Wrap(err, "Failed verifying certificate data")
 	}
 
 	logger.Info("Webhook certificates verified succesfully")
-	return nil
+	return &certificateChain, nil
 }
@@ -0,0 +1,1419 @@
+package certificate
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Certificates manager", func() {
+	var (
+		mgr *Manager
+	)
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		triple.Now = time.Now
+
+		createResources()
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	Context("when Apply is called once", func() {
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should leave a consistent secret, CA bundle and verified chain", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Type).To(Equal(corev1.SecretTypeTLS), "should be a TLS secret")
+
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			Expect(caBundle).To(Equal(caSecret.Data[CACertKey]), "should inject the CA certificate as CA bundle")
+
+			err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caBundle)
+			Expect(err).To(Succeed(), "should verify service certificate with injected CA bundle")
+
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when a webhook switches from service to URL", func() {
+		var (
+			urlSecretKey = types.NamespacedName{Namespace: expectedNamespace.Name, Name: "webhook-url-foowebhook.example.com"}
+		)
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+
+			url := "https://foowebhook.example.com:8443/mutate"
+			webhookConfiguration := getWebhookConfiguration()
+			webhookConfiguration.Webhooks[0].ClientConfig.Service = nil
+			webhookConfiguration.Webhooks[0].ClientConfig.URL = &url
+			updateWebhookConfiguration(webhookConfiguration)
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			_ = cli.Delete(context.TODO(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: urlSecretKey.Namespace, Name: urlSecretKey.Name}})
+		})
+		It("should store the URL certificate and delete the service secret", func() {
+			urlSecret := corev1.Secret{}
+			Expect(cli.Get(context.TODO(), urlSecretKey, &urlSecret)).To(Succeed(), "should create the URL secret")
+			_, err := getSecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should delete the service secret")
+		})
+	})
+
+	Context("when Apply creates the secrets", func() {
+		var (
+			recordingCli *secretCreateRecordingClient
+		)
+		BeforeEach(func() {
+			recordingCli = &secretCreateRecordingClient{Client: cli}
+			mgr.client = recordingCli
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should fully specify them without relying on API server defaulting", func() {
+			Expect(recordingCli.created).To(HaveKey(expectedSecret.Name), "should create the TLS secret")
+			secret := recordingCli.created[expectedSecret.Name]
+			Expect(secret.Type).To(Equal(corev1.SecretTypeTLS), "should set the TLS secret type")
+			Expect(secret.Data).To(HaveKey(corev1.TLSCertKey), "should set the certificate")
+			Expect(secret.Data).To(HaveKey(corev1.TLSPrivateKeyKey), "should set the private key")
+			Expect(secret.Annotations).To(HaveKey(secretManagedAnnotationKey), "should set the managed annotation")
+
+			Expect(recordingCli.created).To(HaveKey(expectedCASecret.Name), "should create the CA secret")
+			caSecret := recordingCli.created[expectedCASecret.Name]
+			Expect(caSecret.Type).To(Equal(corev1.SecretTypeOpaque), "should set the CA secret type")
+			Expect(caSecret.Data).To(HaveKey(CACertKey), "should set the CA certificate")
+			Expect(caSecret.Data).To(HaveKey(CAPrivateKeyKey), "should set the CA private key")
+		})
+	})
+
+	Context("when the TLS secret exists with the Opaque type", func() {
+		BeforeEach(func() {
+			secret := corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: expectedSecret.Namespace, Name: expectedSecret.Name},
+				Type:       corev1.SecretTypeOpaque,
+			}
+			err := cli.Create(context.TODO(), &secret)
+			Expect(err).To(Succeed(), "should succeed creating the Opaque secret")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should recreate it with the TLS type", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Type).To(Equal(corev1.SecretTypeTLS), "should change the secret type")
+			Expect(secret.Data).To(HaveKey(corev1.TLSCertKey), "should set the certificate")
+			Expect(secret.Data).To(HaveKey(corev1.TLSPrivateKeyKey), "should set the private key")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when Cleanup is called after Apply", func() {
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			err = mgr.Cleanup(context.TODO())
+			Expect(err).To(Succeed(), "should succeed cleaning up certificates")
+		})
+		It("should remove the owned secrets and clear the CA bundle", func() {
+			_, err := getSecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should delete the TLS secret")
+			_, err = getCASecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should delete the CA secret")
+			Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).To(BeEmpty(), "should clear the CA bundle")
+		})
+	})
+
+	Context("when configured with a secret finalizer", func() {
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithSecretFinalizer(),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should add the finalizer to the TLS secret and remove it on Cleanup", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Finalizers).To(ContainElement(secretFinalizer), "should add the finalizer")
+
+			err = mgr.Cleanup(context.TODO())
+			Expect(err).To(Succeed(), "should succeed cleaning up certificates")
+			_, err = getSecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should remove the finalizer and delete the TLS secret")
+		})
+	})
+
+	Context("when Cleanup is called with a secret not created by the manager", func() {
+		BeforeEach(func() {
+			err := cli.Create(context.TODO(), expectedSecret.DeepCopy())
+			Expect(err).To(Succeed(), "should succeed creating a foreign TLS secret")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			err = mgr.Cleanup(context.TODO())
+			Expect(err).To(Succeed(), "should succeed cleaning up certificates")
+		})
+		It("should not delete the foreign secret", func() {
+			_, err := getSecret()
+			Expect(err).To(Succeed(), "should keep the foreign TLS secret")
+		})
+	})
+	Context("when configured with immutable secrets and certificates are rotated", func() {
+		var (
+			previousSecret corev1.Secret
+		)
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithImmutableSecrets(),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			previousSecret, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+			now := time.Now().Add(25 * time.Minute)
+			triple.Now = func() time.Time { return now }
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed rotating certificates")
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should create a fresh immutable secret with updated data", func() {
+			Expect(isImmutable(&previousSecret)).To(BeTrue(), "should have created an immutable secret")
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(isImmutable(&secret)).To(BeTrue(), "should be an immutable secret")
+			Expect(secret.UID).ToNot(Equal(previousSecret.UID), "should be a fresh secret")
+			Expect(secret.Data[corev1.TLSCertKey]).ToNot(Equal(previousSecret.Data[corev1.TLSCertKey]), "should have rotated the certificate")
+		})
+	})
+	Context("when Apply is called with a clock in a non UTC location", func() {
+		BeforeEach(func() {
+			location := time.FixedZone("UTC+5", 5*60*60)
+			triple.Now = func() time.Time { return time.Now().In(location) }
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should report status times normalized to UTC", func() {
+			status := mgr.Status()
+			Expect(status.LastReconcileTime).ToNot(BeZero(), "should report last reconcile time")
+			Expect(status.NextReconcileTime).To(BeTemporally(">", status.LastReconcileTime), "should report next reconcile time")
+			Expect(status.CANotAfter).To(BeTemporally(">", status.LastReconcileTime), "should report CA expiration time")
+			for _, t := range []time.Time{status.LastReconcileTime, status.NextReconcileTime, status.CANotAfter} {
+				Expect(t.Location()).To(Equal(time.UTC), "should be in UTC")
+			}
+		})
+	})
+	Context("when configured with a certificate history of one and certificates are rotated twice", func() {
+		var (
+			certs [][]byte
+		)
+		lastCert := func() []byte {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			parsedCerts, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+			Expect(err).To(Succeed(), "should succeed parsing TLS certificates")
+			return triple.EncodeCertPEM(parsedCerts[len(parsedCerts)-1])
+		}
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCertificateHistory(1),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+			now := time.Now()
+			triple.Now = func() time.Time { return now }
+			certs = [][]byte{}
+			for _, future := range []time.Duration{0, 25 * time.Minute, 25 * time.Minute} {
+				now = now.Add(future)
+				err = mgr.Apply(context.TODO())
+				Expect(err).To(Succeed(), "should succeed applying certificates")
+				certs = append(certs, lastCert())
+			}
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should retain the previous certificate and not the current one", func() {
+			Expect(certs[1]).ToNot(Equal(certs[0]), "should have rotated the certificate once")
+			Expect(certs[2]).ToNot(Equal(certs[1]), "should have rotated the certificate twice")
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Annotations[secretCertificateHistoryAnnotationKey]).To(Equal(string(certs[1])), "should only retain the previous certificate")
+			Expect(secret.Annotations[secretCertificateHistoryAnnotationKey]).ToNot(ContainSubstring("PRIVATE KEY"), "should never retain private keys")
+		})
+	})
+	Context("when configured with a CA rotation notice and the clock advances into the lead window", func() {
+		var (
+			t0                   time.Time
+			notices              []time.Time
+			previousCASecret     corev1.Secret
+			caRotateInterval     = time.Hour
+			caOverlapInterval    = 20 * time.Minute
+			caRotationNoticeLead = 10 * time.Minute
+		)
+		BeforeEach(func() {
+			notices = []time.Time{}
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   caRotateInterval,
+					CAOverlapInterval:  caOverlapInterval,
+					CertRotateInterval: caRotateInterval,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCARotationNotice(caRotationNoticeLead, func(rotateAt time.Time) {
+					// the manager is not held while notifying
+					_, planErr := mgr.Plan(context.TODO())
+					Expect(planErr).To(Succeed(), "should succeed planning the rotation from the notice")
+					notices = append(notices, rotateAt)
+				}),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+			t0 = time.Now().Truncate(time.Second).UTC()
+			now := t0
+			triple.Now = func() time.Time { return now }
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(notices).To(BeEmpty(), "should not notify before the lead window")
+			previousCASecret, err = getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+
+			now = t0.Add(caRotateInterval - caOverlapInterval - caRotationNoticeLead/2)
+			for i := 0; i < 2; i++ {
+				err = mgr.Apply(context.TODO())
+				Expect(err).To(Succeed(), "should succeed applying certificates")
+			}
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should notify once ahead of the CA rotation", func() {
+			Expect(notices).To(Equal([]time.Time{t0.Add(caRotateInterval - caOverlapInterval)}), "should notify once with the CA rotation time")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(caSecret.Data).To(Equal(previousCASecret.Data), "should not rotate the CA yet")
+		})
+	})
+	Context("when an external writer updates the TLS secret with a valid certificate", func() {
+		var (
+			externalSecret corev1.Secret
+		)
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+
+			By("Issuing a certificate with the current CA out of band")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			caKey, err := triple.ParsePrivateKeyPEM(caSecret.Data[CAPrivateKeyKey])
+			Expect(err).To(Succeed(), "should succeed parsing CA key")
+			caCerts, err := triple.ParseCertsPEM(caSecret.Data[CACertKey])
+			Expect(err).To(Succeed(), "should succeed parsing CA certificate")
+			ca := &triple.KeyPair{Key: caKey.(*rsa.PrivateKey), Cert: caCerts[0]}
+			certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+			keyPair, err := triple.NewServerKeyPair(ca, certificateIssue.Name, nil, certificateIssue.Hostnames, 30*time.Minute)
+			Expect(err).To(Succeed(), "should succeed issuing a certificate")
+
+			externalSecret, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			externalSecret.Data[corev1.TLSCertKey] = triple.EncodeCertPEM(keyPair.Cert)
+			externalSecret.Data[corev1.TLSPrivateKeyKey] = triple.EncodePrivateKeyPEM(keyPair.Key.(*rsa.PrivateKey))
+			err = cli.Update(context.TODO(), &externalSecret)
+			Expect(err).To(Succeed(), "should succeed updating TLS secret")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should adopt the external certificate instead of regenerating it", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Data).To(Equal(externalSecret.Data), "should keep the external certificate")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when the CA copy stored at the TLS secret is edited out of band", func() {
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			hackedCA, err := triple.NewCA("hacked-ca", time.Hour)
+			Expect(err).To(Succeed(), "should succeed creating new hacked CA")
+			secret.Data[CACertKey] = triple.EncodeCertPEM(hackedCA.Cert)
+			err = cli.Update(context.TODO(), &secret)
+			Expect(err).To(Succeed(), "should succeed updating TLS secret")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should reconcile it to match the injected CA bundle", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			Expect(secret.Data[CACertKey]).To(Equal(caBundle), "should sync the CA copy with the CA bundle")
+		})
+	})
+
+	Context("when the TLS secret is seeded with a CA copy that did not issue its certificate", func() {
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+
+			foreignCA, err := triple.NewCA("foreign-ca", time.Hour)
+			Expect(err).To(Succeed(), "should succeed creating foreign CA")
+			otherCA, err := triple.NewCA("other-ca", time.Hour)
+			Expect(err).To(Succeed(), "should succeed creating other CA")
+			keyPair, err := triple.NewServerKeyPair(foreignCA, "foo-service", nil, newCertificateIssue(expectedService.Name, expectedService.Namespace).Hostnames, time.Hour)
+			Expect(err).To(Succeed(), "should succeed issuing foreign certificate")
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			secret.Data[corev1.TLSPrivateKeyKey] = triple.EncodePrivateKeyPEM(keyPair.Key.(*rsa.PrivateKey))
+			secret.Data[corev1.TLSCertKey] = triple.EncodeCertPEM(keyPair.Cert)
+			secret.Data[CACertKey] = triple.EncodeCertPEM(otherCA.Cert)
+			err = cli.Update(context.TODO(), &secret)
+			Expect(err).To(Succeed(), "should succeed updating TLS secret")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should repair it to the active CA and its issued certificate", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			Expect(secret.Data[CACertKey]).To(Equal(caBundle), "should sync the CA copy with the CA bundle")
+			err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caSecret.Data[CACertKey])
+			Expect(err).To(Succeed(), "should issue the certificate with the active CA")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when configured with an external CA bundle", func() {
+		var (
+			publicRoots []byte
+		)
+		BeforeEach(func() {
+			for _, name := range []string{"public-root-1", "public-root-2"} {
+				root, err := triple.NewCA(name, time.Hour)
+				Expect(err).To(Succeed(), "should succeed creating a public root")
+				publicRoots = append(publicRoots, triple.EncodeCertPEM(root.Cert)...)
+			}
+
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithExternalCABundle(publicRoots),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should inject the external CA bundle verbatim without generating certificates", func() {
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			Expect(caBundle).To(Equal(publicRoots), "should inject the external CA bundle verbatim")
+
+			_, err := getSecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not create the TLS secret")
+			_, err = getCASecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not create the CA secret")
+
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the external CA bundle is injected")
+		})
+	})
+
+	Context("when the TLS secret is seeded with a CA certificate", func() {
+		BeforeEach(func() {
+			ca, err := triple.NewCA("foo-ca", time.Hour)
+			Expect(err).To(Succeed(), "should succeed creating a CA")
+			secret := expectedSecret.DeepCopy()
+			secret.Data = map[string][]byte{
+				corev1.TLSCertKey:       triple.EncodeCertPEM(ca.Cert),
+				corev1.TLSPrivateKeyKey: triple.EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey)),
+			}
+			err = cli.Create(context.TODO(), secret)
+			Expect(err).To(Succeed(), "should succeed creating TLS secret")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should refuse it and regenerate a proper leaf certificate", func() {
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+			Expect(err).To(Succeed(), "should succeed parsing TLS certificate")
+			Expect(certs[len(certs)-1].IsCA).To(BeFalse(), "should regenerate a leaf certificate")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when configured with a before CA rotation hook that fails once and the CA is due for rotation", func() {
+		var (
+			hookCalls          int
+			firstApplyErr      error
+			previousCASecret   corev1.Secret
+			previousSecret     corev1.Secret
+			caSecretAfterFirst corev1.Secret
+			secretAfterFirst   corev1.Secret
+			caRotateInterval   = time.Hour
+			caOverlapInterval  = 20 * time.Minute
+		)
+		BeforeEach(func() {
+			hookCalls = 0
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   caRotateInterval,
+					CAOverlapInterval:  caOverlapInterval,
+					CertRotateInterval: caRotateInterval,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithBeforeCARotation(func(ctx context.Context) error {
+					hookCalls++
+					if hookCalls == 1 {
+						return errors.New("draining traffic")
+					}
+					return nil
+				}),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+			t0 := time.Now().Truncate(time.Second).UTC()
+			now := t0
+			triple.Now = func() time.Time { return now }
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(hookCalls).To(BeZero(), "should not run the hook on initial CA generation")
+			previousCASecret, err = getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			previousSecret, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+			now = t0.Add(caRotateInterval - caOverlapInterval + time.Minute)
+			firstApplyErr = mgr.Apply(context.TODO())
+			caSecretAfterFirst, err = getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			secretAfterFirst, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should defer the CA rotation and proceed once the hook succeeds", func() {
+			Expect(firstApplyErr).To(MatchError(ContainSubstring("draining traffic")), "should return the hook error")
+			Expect(IsDeferred(firstApplyErr)).To(BeTrue(), "should defer the CA rotation instead of failing")
+			Expect(caSecretAfterFirst.Data).To(Equal(previousCASecret.Data), "should defer the CA rotation")
+			Expect(secretAfterFirst.Data[corev1.TLSCertKey]).ToNot(Equal(previousSecret.Data[corev1.TLSCertKey]), "should rotate the due service certificate meanwhile")
+			certs, err := triple.ParseCertsPEM(secretAfterFirst.Data[corev1.TLSCertKey])
+			Expect(err).To(Succeed(), "should succeed parsing the service certificates")
+			caCerts, err := triple.ParseCertsPEM(previousCASecret.Data[CACertKey])
+			Expect(err).To(Succeed(), "should succeed parsing the CA certificate")
+			Expect(certs[len(certs)-1].CheckSignatureFrom(caCerts[0])).To(Succeed(), "should rotate the service certificate with the current CA")
+			Expect(hookCalls).To(Equal(2), "should run the hook again")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(caSecret.Data).ToNot(Equal(previousCASecret.Data), "should rotate the CA")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when configured with a secret cache and reconciled repeatedly", func() {
+		var (
+			countingCli *secretGetCountingClient
+		)
+		BeforeEach(func() {
+			countingCli = &secretGetCountingClient{Client: cli}
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				countingCli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithCache(),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			countingCli.secretGets = 0
+		})
+		It("should not read the secrets again", func() {
+			for i := 0; i < 3; i++ {
+				err := mgr.Apply(context.TODO())
+				Expect(err).To(Succeed(), "should succeed applying certificates")
+			}
+			Expect(countingCli.secretGets).To(BeZero(), "should serve the secrets from the cache")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+		It("should read every secret again and restore them after a relist", func() {
+			By("Deleting the TLS secret while the watch is down")
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			err = cli.Delete(context.TODO(), &secret)
+			Expect(err).To(Succeed(), "should succeed deleting TLS secret")
+
+			By("Relisting the unchanged webhook configuration")
+			webhookConfiguration := getWebhookConfiguration()
+			relistEvent := event.UpdateEvent{
+				ObjectOld: webhookConfiguration.DeepCopy(),
+				ObjectNew: webhookConfiguration.DeepCopy(),
+			}
+			relisted := mgr.onEventForThisWebhook().Update(relistEvent)
+			Expect(relisted).To(BeTrue(), "should reconcile the relisted webhook configuration")
+			queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+			defer queue.ShutDown()
+			mgr.enqueueForThisWebhook().Update(relistEvent, queue)
+			Expect(queue.Len()).To(Equal(1), "should enqueue the relisted webhook configuration")
+			countingCli.secretGets = 0
+			_, err = mgr.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: webhookConfiguration.Name},
+			})
+			Expect(err).To(Succeed(), "should succeed reconciling")
+			Expect(countingCli.secretGets).To(BeNumerically(">=", 2), "should read the TLS and CA secrets again")
+			_, err = getSecret()
+			Expect(err).To(Succeed(), "should re-create the TLS secret")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+		It("should read every secret again on the scheduled requeue", func() {
+			defer func() { triple.Now = time.Now }()
+			result, err := mgr.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: expectedMutatingWebhookConfiguration.Name},
+			})
+			Expect(err).To(Succeed(), "should succeed reconciling")
+			Expect(countingCli.secretGets).To(BeZero(), "should serve the secrets from the cache")
+
+			requeueAt := time.Now().Add(result.RequeueAfter)
+			triple.Now = func() time.Time { return requeueAt }
+			_, err = mgr.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: expectedMutatingWebhookConfiguration.Name},
+			})
+			Expect(err).To(Succeed(), "should succeed reconciling")
+			Expect(countingCli.secretGets).To(BeNumerically(">=", 2), "should read the TLS and CA secrets again")
+		})
+		It("should read a secret again on an event for it", func() {
+			_, err := mgr.Reconcile(context.TODO(), reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: expectedSecret.Namespace, Name: expectedSecret.Name},
+			})
+			Expect(err).To(Succeed(), "should succeed reconciling")
+			Expect(countingCli.secretGets).To(Equal(1), "should only read the secret with the event")
+		})
+	})
+
+	Context("when two managers with different CA owner identities share the CA and it is due for rotation", func() {
+		var (
+			newManagerWithIdentity func(identity string) *Manager
+			ownerMgr, otherMgr     *Manager
+			now                    time.Time
+			previousCASecret       corev1.Secret
+			previousSecret         corev1.Secret
+			caOwnerTTL             = time.Hour
+		)
+		BeforeEach(func() {
+			newManagerWithIdentity = func(identity string) *Manager {
+				identityMgr, err := NewManager(
+					expectedMutatingWebhookConfiguration.Name,
+					expectedNamespace.Name,
+					cli,
+					chain.Options{
+						CARotateInterval:   time.Hour,
+						CertRotateInterval: 30 * time.Minute,
+					},
+					[]WebhookReference{
+						{
+							Type: MutatingWebhook,
+							Name: expectedMutatingWebhookConfiguration.Name,
+						},
+					},
+					WithCAOwnerIdentity(identity, caOwnerTTL),
+				)
+				Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+				return identityMgr
+			}
+			ownerMgr = newManagerWithIdentity("owner")
+			otherMgr = newManagerWithIdentity("other")
+
+			now = time.Now().Truncate(time.Second).UTC()
+			triple.Now = func() time.Time { return now }
+			err := ownerMgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			previousCASecret, err = getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(previousCASecret.Annotations).To(HaveKeyWithValue(secretCAOwnerAnnotationKey, "owner"), "should record the CA owner")
+			Expect(previousCASecret.Annotations).To(HaveKeyWithValue(secretCAOwnerHeartbeatAnnotationKey, now.Format(time.RFC3339)), "should record the CA owner heartbeat")
+			previousSecret, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+			now = now.Add(ownerMgr.options.CARotateInterval - ownerMgr.options.CAOverlapInterval + time.Minute)
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should only let the owner regenerate the CA", func() {
+			err := otherMgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should defer the CA generation without failing")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(caSecret.Data).To(Equal(previousCASecret.Data), "should refuse to regenerate a CA owned by another identity")
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Data).ToNot(Equal(previousSecret.Data), "should rotate the service certificate meanwhile")
+			err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caSecret.Data[CACertKey])
+			Expect(err).To(Succeed(), "should issue the service certificate with the current CA")
+
+			err = ownerMgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			caSecret, err = getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(caSecret.Data).ToNot(Equal(previousCASecret.Data), "should regenerate the CA")
+			Expect(caSecret.Annotations).To(HaveKeyWithValue(secretCAOwnerAnnotationKey, "owner"), "should keep the CA owner")
+		})
+		It("should let other identities take over the CA once the owner is gone", func() {
+			now = now.Add(caOwnerTTL)
+			err := otherMgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(caSecret.Data).ToNot(Equal(previousCASecret.Data), "should regenerate the CA")
+			Expect(caSecret.Annotations).To(HaveKeyWithValue(secretCAOwnerAnnotationKey, "other"), "should record the new CA owner")
+		})
+		It("should let other identities take over the CA when forced", func() {
+			err := otherMgr.ForceRotate(context.TODO())
+			Expect(err).To(Succeed(), "should succeed forcing rotation")
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(caSecret.Data).ToNot(Equal(previousCASecret.Data), "should regenerate the CA")
+			Expect(caSecret.Annotations).To(HaveKeyWithValue(secretCAOwnerAnnotationKey, "other"), "should record the new CA owner")
+		})
+	})
+
+	Context("when rotation is triggered", func() {
+		var (
+			now time.Time
+		)
+		BeforeEach(func() {
+			now = time.Now().Truncate(time.Second).UTC()
+			triple.Now = func() time.Time { return now }
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(mgr.Status().LastRotationReason).To(Equal(chain.RotationReasonMissing), "should record the initial issuance")
+		})
+		AfterEach(func() {
+			triple.Now = time.Now
+		})
+		It("should record a forced reason when forcing it", func() {
+			previousSecret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			previousCABundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+
+			err = mgr.ForceRotate(context.TODO())
+			Expect(err).To(Succeed(), "should succeed forcing rotation")
+			Expect(mgr.Status().LastRotationReason).To(Equal(chain.RotationReasonForced), "should record a forced rotation")
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Data).ToNot(Equal(previousSecret.Data), "should rotate the service certificate")
+			Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).ToNot(Equal(previousCABundle), "should inject the new CA bundle")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+		It("should serialize forced rotations with concurrent reconciles", func() {
+			previousSecret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+			errs := make(chan error, 10)
+			for i := 0; i < 5; i++ {
+				go func() { errs <- mgr.ForceRotate(context.TODO()) }()
+				go func() { errs <- mgr.Apply(context.TODO()) }()
+			}
+			for i := 0; i < 10; i++ {
+				Expect(<-errs).To(Succeed(), "should succeed forcing rotation and applying certificates concurrently")
+			}
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Data).ToNot(Equal(previousSecret.Data), "should rotate the service certificate")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+		It("should record a scheduled reason when reaching the deadline", func() {
+			now = now.Add(mgr.options.CertRotateInterval - mgr.options.CertOverlapInterval + time.Minute)
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(mgr.Status().LastRotationReason).To(Equal(chain.RotationReasonScheduled), "should record a scheduled rotation")
+			Expect(mgr.Status().LastRotationTime).To(Equal(now), "should record the rotation time")
+		})
+	})
+
+	Context("when building the service secret", func() {
+		It("should fail without certificates", func() {
+			_, _, err := mgr.BuildSecret(context.TODO())
+			Expect(err).To(MatchError(ContainSubstring("There are no certificates")), "should not issue certificates")
+			_, err = getSecret()
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not write the TLS secret")
+		})
+		It("should return it populated without rotating nor writing it", func() {
+			mgr.issuerLabel = &IssuerLabel{Key: "issuer", Value: "foo"}
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			storedSecret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			storedCASecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+
+			secret, caSecret, err := mgr.BuildSecret(context.TODO())
+			Expect(err).To(Succeed(), "should succeed building the TLS secret")
+			Expect(secret.Namespace).To(Equal(expectedSecret.Namespace), "should be at the service namespace")
+			Expect(secret.Name).To(Equal(expectedSecret.Name), "should be named after the service")
+			Expect(secret.Type).To(Equal(corev1.SecretTypeTLS), "should be a TLS secret")
+			Expect(secret.Data).To(HaveKey(corev1.TLSCertKey), "should contain the certificate")
+			Expect(secret.Data).To(HaveKey(corev1.TLSPrivateKeyKey), "should contain the private key")
+			Expect(secret.Annotations).To(HaveKey(secretManagedAnnotationKey), "should be annotated as managed")
+
+			Expect(caSecret.Namespace).To(Equal(expectedCASecret.Namespace), "should return the CA secret")
+			Expect(caSecret.Name).To(Equal(expectedCASecret.Name), "should return the CA secret")
+			Expect(secret.Labels).To(HaveKeyWithValue("issuer", "foo"), "should label the TLS secret as issued by the manager")
+			Expect(caSecret.Labels).To(HaveKeyWithValue("issuer", "foo"), "should label the CA secret as issued by the manager")
+			caBundle := caSecret.Data[CACertKey]
+			Expect(triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caBundle)).To(Succeed(), "should issue the TLS secret with the CA secret")
+			Expect(secret.Data).To(Equal(storedSecret.Data), "should render the stored service certificate")
+			Expect(caSecret.Data).To(Equal(storedCASecret.Data), "should render the stored CA")
+
+			By("Building the secrets again")
+			secretAgain, caSecretAgain, err := mgr.BuildSecret(context.TODO())
+			Expect(err).To(Succeed(), "should succeed building the TLS secret again")
+			Expect(secretAgain.Data).To(Equal(secret.Data), "should not rotate the service certificate")
+			Expect(caSecretAgain.Data).To(Equal(caSecret.Data), "should not rotate the CA")
+
+			obtainedSecret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(obtainedSecret.ResourceVersion).To(Equal(storedSecret.ResourceVersion), "should not write the TLS secret")
+			obtainedCASecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(obtainedCASecret.ResourceVersion).To(Equal(storedCASecret.ResourceVersion), "should not write the CA secret")
+		})
+	})
+
+	Context("when injecting the CA bundle into the webhook configuration", func() {
+		var (
+			reference string
+		)
+		BeforeEach(func() {
+			reference = WebhookReference{Type: MutatingWebhook, Name: expectedMutatingWebhookConfiguration.Name}.String()
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should record the injected generation and flag external modifications", func() {
+			webhookConfiguration := getWebhookConfiguration()
+			Expect(mgr.Status().Webhooks).To(HaveKeyWithValue(reference, WebhookStatus{
+				Generation:      webhookConfiguration.Generation,
+				ResourceVersion: webhookConfiguration.ResourceVersion,
+			}), "should record the injected generation")
+
+			By("Reverting the CA bundle externally")
+			webhookConfiguration.Webhooks[0].ClientConfig.CABundle = nil
+			updateWebhookConfiguration(webhookConfiguration)
+			reverted := getWebhookConfiguration()
+			Expect(reverted.Generation).To(BeNumerically(">", webhookConfiguration.Generation), "should advance the generation")
+
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			injected := getWebhookConfiguration()
+			Expect(mgr.Status().Webhooks).To(HaveKeyWithValue(reference, WebhookStatus{
+				Generation:         injected.Generation,
+				ResourceVersion:    injected.ResourceVersion,
+				ExternallyModified: true,
+			}), "should flag the external modification and record the new injected generation")
+			Expect(injected.Generation).To(BeNumerically(">", reverted.Generation), "should inject the CA bundle again")
+
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(mgr.Status().Webhooks[reference].ExternallyModified).To(BeFalse(), "should clear the flag once unchanged")
+		})
+	})
+
+	Context("when managing webhook configurations of both API versions", func() {
+		var (
+			v1beta1Webhook *admissionregistrationv1beta1.MutatingWebhookConfiguration
+		)
+		BeforeEach(func() {
+			v1beta1Webhook = &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foowebhook-v1beta1",
+				},
+				Webhooks: []admissionregistrationv1beta1.MutatingWebhook{
+					{
+						Name: "foowebhook.qinqon.io",
+						ClientConfig: admissionregistrationv1beta1.WebhookClientConfig{
+							Service: &admissionregistrationv1beta1.ServiceReference{
+								Name:      expectedService.Name,
+								Namespace: expectedService.Namespace,
+							},
+						},
+					},
+				},
+			}
+			err := cli.Create(context.TODO(), v1beta1Webhook)
+			if meta.IsNoMatchError(err) {
+				Skip("admissionregistration v1beta1 is not served")
+			}
+			Expect(err).To(Succeed(), "should succeed creating the v1beta1 webhook configuration")
+
+			mgr.webhooks = append(mgr.webhooks, WebhookReference{
+				Type:       MutatingWebhook,
+				Name:       v1beta1Webhook.Name,
+				APIVersion: WebhookAPIVersionV1beta1,
+			})
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		AfterEach(func() {
+			_ = cli.Delete(context.TODO(), v1beta1Webhook)
+		})
+		It("should inject the CA bundle into both", func() {
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).To(Equal(caSecret.Data[CACertKey]), "should inject the CA bundle into the v1 webhook configuration")
+
+			obtained := admissionregistrationv1beta1.MutatingWebhookConfiguration{}
+			err = cli.Get(context.TODO(), types.NamespacedName{Name: v1beta1Webhook.Name}, &obtained)
+			Expect(err).To(Succeed(), "should succeed getting the v1beta1 webhook configuration")
+			Expect(obtained.Webhooks[0].ClientConfig.CABundle).To(Equal(caSecret.Data[CACertKey]), "should inject the CA bundle into the v1beta1 webhook configuration")
+		})
+	})
+
+	Context("when configured with an error handler", func() {
+		var (
+			failing *updateFailingClient
+			handled []error
+		)
+		BeforeEach(func() {
+			handled = nil
+			failing = &updateFailingClient{Client: cli}
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				failing,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithErrorHandler(func(err error) {
+					handled = append(handled, err)
+				}),
+				WithOnIssue(func(cert *x509.Certificate) error {
+					return errors.New("inventory unavailable")
+				}),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		})
+		It("should handle the errors of the background reconciles and issuance hooks", func() {
+			By("Failing to inject the CA bundle")
+			failing.fail = true
+			_, err := mgr.Reconcile(context.TODO(), reconcile.Request{NamespacedName: types.NamespacedName{Name: expectedMutatingWebhookConfiguration.Name}})
+			Expect(err).To(HaveOccurred(), "should fail reconciling")
+			Expect(handled).To(HaveLen(1), "should handle the reconcile error")
+			Expect(handled[0]).To(MatchError(ContainSubstring("Failed writing certificate data")), "should wrap the error with the failed phase")
+			Expect(handled[0]).To(MatchError(ContainSubstring("update refused")), "should handle the client error")
+
+			By("Failing the issuance hooks")
+			handled = nil
+			failing.fail = false
+			_, err = mgr.Reconcile(context.TODO(), reconcile.Request{NamespacedName: types.NamespacedName{Name: expectedMutatingWebhookConfiguration.Name}})
+			Expect(err).To(Succeed(), "should succeed reconciling")
+			Expect(handled).To(HaveLen(2), "should handle the issuance hook error of the CA and service certificates")
+			for _, err := range handled {
+				Expect(err).To(MatchError(ContainSubstring("Issuance hook failed")), "should wrap the error with the failed phase")
+			}
+
+			By("Returning the errors of Apply instead")
+			handled = nil
+			failing.fail = true
+			err = mgr.ForceRotate(context.TODO())
+			Expect(err).To(HaveOccurred(), "should fail forcing rotation")
+			Expect(handled).To(BeEmpty(), "should not handle the error returned")
+		})
+	})
+
+	Context("when configured with an issuance hook", func() {
+		var (
+			issued []*x509.Certificate
+		)
+		BeforeEach(func() {
+			issued = nil
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithOnIssue(func(cert *x509.Certificate) error {
+					issued = append(issued, cert)
+					return errors.New("inventory unavailable")
+				}),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates despite the hook failing")
+		})
+		It("should receive the newly issued CA and service certificates", func() {
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			caCerts, err := triple.ParseCertsPEM(caSecret.Data[CACertKey])
+			Expect(err).To(Succeed(), "should succeed parsing CA certificate")
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+			Expect(err).To(Succeed(), "should succeed parsing service certificate")
+
+			Expect(issued).To(HaveLen(2), "should call the hook for the CA and the service certificates")
+			for i, expected := range []*x509.Certificate{caCerts[0], certs[0]} {
+				Expect(issued[i].SerialNumber).To(Equal(expected.SerialNumber), "should receive the issued certificate serial")
+				Expect(issued[i].NotAfter).To(Equal(expected.NotAfter), "should receive the issued certificate expiry")
+			}
+
+			By("Reconciling without rotation")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(issued).To(HaveLen(2), "should not call the hook without issuing certificates")
+		})
+	})
+
+	Context("when configured with webhook API version aliases", func() {
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(
+				expectedMutatingWebhookConfiguration.Name,
+				expectedNamespace.Name,
+				cli,
+				chain.Options{
+					CARotateInterval:   time.Hour,
+					CertRotateInterval: 30 * time.Minute,
+				},
+				[]WebhookReference{
+					{
+						Type: MutatingWebhook,
+						Name: expectedMutatingWebhookConfiguration.Name,
+					},
+				},
+				WithWebhookAPIVersionAliases(),
+			)
+			Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should inject the CA bundle into both API versions", func() {
+			caSecret, err := getCASecret()
+			Expect(err).To(Succeed(), "should succeed getting CA secret")
+			Expect(getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle).To(Equal(caSecret.Data[CACertKey]), "should inject the CA bundle into the v1 webhook configuration")
+
+			obtained := admissionregistrationv1beta1.MutatingWebhookConfiguration{}
+			err = cli.Get(context.TODO(), types.NamespacedName{Name: expectedMutatingWebhookConfiguration.Name}, &obtained)
+			if meta.IsNoMatchError(err) {
+				Skip("admissionregistration v1beta1 is not served")
+			}
+			Expect(err).To(Succeed(), "should succeed getting the v1beta1 webhook configuration")
+			Expect(obtained.Webhooks[0].ClientConfig.CABundle).To(Equal(caSecret.Data[CACertKey]), "should inject the CA bundle into the v1beta1 webhook configuration")
+
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+
+	Context("when asking for the leaf certificate", func() {
+		It("should return nil before the first rotation", func() {
+			Expect(mgr.LeafCertificate()).To(BeNil(), "should not return a certificate")
+		})
+		It("should return the current certificate with the configured SANs after a rotation", func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			err = mgr.ForceRotate(context.TODO())
+			Expect(err).To(Succeed(), "should succeed forcing rotation")
+
+			leafCertificate := mgr.LeafCertificate()
+			Expect(leafCertificate).ToNot(BeNil(), "should return a certificate")
+			certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+			Expect(leafCertificate.DNSNames).To(Equal(certificateIssue.Hostnames), "should include the configured SANs")
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+			Expect(err).To(Succeed(), "should succeed parsing TLS certificate")
+			Expect(leafCertificate.Raw).To(Equal(certs[len(certs)-1].Raw), "should return the stored certificate")
+		})
+	})
+})
+
+var _ = Describe("Certificates manager with certificates not valid yet", func() {
+	var (
+		mgr           *Manager
+		now           time.Time
+		issued        time.Time
+		handledErrors []error
+	)
+
+	BeforeEach(func() {
+		issued = time.Now().Truncate(time.Second).UTC()
+		now = issued
+		triple.Now = func() time.Time { return now }
+		handledErrors = nil
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithNotYetValidPolicy(chain.NotYetValidWait),
+			WithErrorHandler(func(err error) { handledErrors = append(handledErrors, err) }),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+
+		By("Going back in time as if issued with a clock ahead")
+		now = issued.Add(-10 * time.Minute)
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should not verify the certificates until they are valid", func() {
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(mgr.VerifyTLS()).To(MatchError(ContainSubstring("Certificate chain not valid until")), "should fail verifying the certificates")
+
+		_, err = mgr.TLSCertificate()
+		Expect(err).To(MatchError(ContainSubstring("serving certificate not valid until")), "should not serve the certificate until it is valid")
+		Expect(mgr.CheckReadiness(nil)).To(MatchError(ContainSubstring("serving certificate not valid until")), "should not be ready until the certificate is valid")
+		Expect(mgr.Healthz(nil)).To(MatchError(ContainSubstring("serving certificate not valid until")), "should not be healthy until the certificate is valid")
+
+		err = mgr.Apply(context.TODO())
+		Expect(IsDeferred(err)).To(BeTrue(), "should defer applying certificates not valid yet")
+		result, err := mgr.Reconcile(context.TODO(), reconcile.Request{})
+		Expect(err).To(Succeed(), "should not fail reconciling certificates not valid yet")
+		Expect(result.RequeueAfter).To(Equal(10*time.Minute), "should requeue once the certificates are valid")
+		Expect(handledErrors).To(BeEmpty(), "should not report waiting for the certificates as an error")
+		rotatedSecret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(rotatedSecret.Data).To(Equal(secret.Data), "should wait for the certificates instead of regenerating them")
+
+		now = issued
+		Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificates once valid")
+		Expect(mgr.Apply(context.TODO())).To(Succeed(), "should succeed applying the certificates once valid")
+		Expect(mgr.CheckReadiness(nil)).To(Succeed(), "should be ready once the certificate is valid")
+	})
+})
+
+var _ = Describe("Certificates manager with options", func() {
+	webhooks := []WebhookReference{{Type: MutatingWebhook, Name: "foo"}}
+
+	It("should apply the options to the manager", func() {
+		recorder := noopEventRecorder{}
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, webhooks,
+			WithCADuration(2*time.Hour),
+			WithCertDuration(time.Hour),
+			WithKeySize(3072, 4096),
+			WithEventRecorder(recorder),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		Expect(mgr.name).To(Equal("foo"), "should set the name")
+		Expect(mgr.namespace).To(Equal("bar"), "should set the namespace")
+		Expect(mgr.webhooks).To(Equal(webhooks), "should set the webhooks")
+		Expect(mgr.options.CARotateInterval).To(Equal(2*time.Hour), "should set the CA duration")
+		Expect(mgr.options.CertRotateInterval).To(Equal(time.Hour), "should set the service certificate duration")
+		Expect(mgr.options.CAKeySize).To(Equal(3072), "should set the CA key size")
+		Expect(mgr.options.CertKeySize).To(Equal(4096), "should set the service certificate key size")
+		Expect(mgr.eventRecorder).To(Equal(recorder), "should set the event recorder")
+		Expect(mgr.options.CAOverlapInterval).To(Equal(40*time.Minute), "should default the CA overlap")
+		Expect(mgr.options.CertOverlapInterval).To(Equal(20*time.Minute), "should default the service certificate overlap")
+	})
+
+	It("should default the certificate options", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, webhooks)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		Expect(mgr.options.CARotateInterval).To(Equal(chain.OneYearDuration), "should default the CA duration")
+		Expect(mgr.options.CertRotateInterval).To(Equal(chain.OneYearDuration), "should default the service certificate duration")
+	})
+
+	It("should fail with invalid certificate options", func() {
+		_, err := NewManagerWithOptions("foo", "bar", nil, webhooks,
+			WithCADuration(time.Hour),
+			WithCertDuration(2*time.Hour),
+		)
+		Expect(err).To(MatchError(ContainSubstring("'CertRotateInterval' has to be <= 'CARotateInterval'")), "should fail validating the options")
+	})
+
+	It("should fail with key sizes for a key type other than RSA", func() {
+		_, err := NewManagerWithOptions("foo", "bar", nil, webhooks,
+			WithKeyType(triple.KeyAlgorithmEd25519),
+			WithKeySize(3072, 3072),
+		)
+		Expect(err).To(MatchError(ContainSubstring("'CAKeySize' and 'CertKeySize' only apply to 'RSA' keys")), "should fail validating the options")
+	})
+
+	It("should fail with a CA owner identity without TTL", func() {
+		_, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithCAOwnerIdentity("owner", 0))
+		Expect(err).To(MatchError(ContainSubstring("CA owner TTL has to be > 0")), "should fail validating the options")
+	})
+
+	It("should fail with an unknown secret layout", func() {
+		_, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithSecretLayout("Shared"))
+		Expect(err).To(MatchError(ContainSubstring("secret layout has to be 'Separate' or 'Combined'")), "should fail validating the options")
+	})
+
+	It("should keep NewManager certificate options", func() {
+		mgr, err := NewManager("foo", "bar", nil, chain.Options{
+			CARotateInterval:   2 * time.Hour,
+			CertRotateInterval: time.Hour,
+		}, webhooks, WithReconcileJitter(0.5))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		Expect(mgr.options.CARotateInterval).To(Equal(2*time.Hour), "should set the CA duration")
+		Expect(mgr.options.CertRotateInterval).To(Equal(time.Hour), "should set the service certificate duration")
+		Expect(mgr.options.RotationJitter).To(Equal(0.5), "should apply the manager options")
+	})
+})
+
+var _ = Describe("CA rotation notice", func() {
+	const caRotationNoticeLead = 10 * time.Minute
+	var (
+		mgr *Manager
+		now time.Time
+	)
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManagerWithOptions("foo", "bar", nil, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}},
+			WithCARotationNotice(caRotationNoticeLead, func(time.Time) {}))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		now = time.Now().Truncate(time.Second).UTC()
+		triple.Now = func() time.Time { return now }
+	})
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+	It("should notice the CA rotation at the CA rotation time of the status", func() {
+		// a jittered rotation time, earlier than the CA expiration minus
+		// the overlap
+		rotateAt := now.Add(caRotationNoticeLead / 2)
+		mgr.status.CANotAfter = now.Add(mgr.options.CAOverlapInterval + time.Hour)
+		mgr.status.CARotationTime = rotateAt
+		reconcileAt := now.Add(time.Hour)
+
+		nextReconcileAt, noticeAt := mgr.noticeCARotation(reconcileAt)
+		Expect(noticeAt).To(Equal(rotateAt), "should notice the status CA rotation time")
+		Expect(nextReconcileAt).To(Equal(reconcileAt), "should keep the reconcile time")
+
+		_, noticeAt = mgr.noticeCARotation(reconcileAt)
+		Expect(noticeAt).To(BeZero(), "should notice the CA rotation once")
+	})
+	It("should reconcile at the notice time ahead of the status CA rotation time", func() {
+		rotateAt := now.Add(time.Hour)
+		mgr.status.CANotAfter = rotateAt.Add(mgr.options.CAOverlapInterval + time.Hour)
+		mgr.status.CARotationTime = rotateAt
+
+		nextReconcileAt, noticeAt := mgr.noticeCARotation(now.Add(2 * time.Hour))
+		Expect(noticeAt).To(BeZero(), "should not notice the CA rotation before the lead time")
+		Expect(nextReconcileAt).To(Equal(rotateAt.Add(-caRotationNoticeLead)), "should reconcile at the notice time")
+	})
+	It("should not notice without CA rotation time", func() {
+		reconcileAt := now.Add(time.Hour)
+		nextReconcileAt, noticeAt := mgr.noticeCARotation(reconcileAt)
+		Expect(noticeAt).To(BeZero(), "should not notice a CA rotation")
+		Expect(nextReconcileAt).To(Equal(reconcileAt), "should keep the reconcile time")
+	})
+})
+
+// secretGetCountingClient counts the secrets read from the API server
+type secretGetCountingClient struct {
+	client.Client
+	secretGets int
+}
+
+func (c *secretGetCountingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		c.secretGets++
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+// secretCreateRecordingClient records the secrets as sent to the API server
+// on creation, before any server side defaulting
+type secretCreateRecordingClient struct {
+	client.Client
+	created map[string]*corev1.Secret
+}
+
+func (c *secretCreateRecordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if secret, ok := obj.(*corev1.Secret); ok {
+		if c.created == nil {
+			c.created = map[string]*corev1.Secret{}
+		}
+		c.created[secret.Name] = secret.DeepCopy()
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
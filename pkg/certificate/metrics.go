@@ -0,0 +1,113 @@
+package certificate
+
+import (
+	"bytes"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// MetricsCollector is a prometheus collector of the certificates handled by a
+// Manager, labeled with the manager name. It is not registered by the
+// manager, it can be registered with the controller-runtime metrics registry
+// as:
+//
+//	metrics.Registry.MustRegister(manager.MetricsCollector())
+type MetricsCollector struct {
+	manager *Manager
+
+	caExpiry   *prometheus.Desc
+	certExpiry *prometheus.Desc
+
+	certIssued       *prometheus.GaugeVec
+	rotations        *prometheus.CounterVec
+	rotationFailures prometheus.Counter
+}
+
+func newMetricsCollector(m *Manager) *MetricsCollector {
+	labels := prometheus.Labels{"manager": m.name}
+	return &MetricsCollector{
+		manager: m,
+		caExpiry: prometheus.NewDesc("webhook_certificate_ca_expiry_seconds",
+			"Seconds until the current CA certificate expires", nil, labels),
+		certExpiry: prometheus.NewDesc("webhook_certificate_cert_expiry_seconds",
+			"Seconds until the current service certificate expires", nil, labels),
+		certIssued: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "webhook_certificate_issued_timestamp_seconds",
+			Help:        "Unix timestamp of the NotBefore field of the last stored service certificate by certificate issue",
+			ConstLabels: labels,
+		}, []string{"name"}),
+		rotations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "webhook_certificate_rotations_total",
+			Help:        "Number of successful certificate rotations by reason",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		rotationFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "webhook_certificate_rotation_failures_total",
+			Help:        "Number of failed certificate rotations",
+			ConstLabels: labels,
+		}),
+	}
+}
+
+// MetricsCollector returns the prometheus collector of the certificates
+// handled by the manager
+func (m *Manager) MetricsCollector() *MetricsCollector {
+	return m.metrics
+}
+
+// Describe implements prometheus.Collector
+func (c *MetricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.caExpiry
+	ch <- c.certExpiry
+	c.certIssued.Describe(ch)
+	c.rotations.Describe(ch)
+	c.rotationFailures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector, the expiry gauges being computed
+// as of the last successful reconcile and only once there was one, and the
+// issued timestamp gauges being set as service certificates are stored. It is
+// safe to call concurrently with reconciles: both expiry gauges are taken
+// from the same reconcile and the counters are updated atomically.
+func (c *MetricsCollector) Collect(ch chan<- prometheus.Metric) {
+	now := triple.Now()
+	status, leafCertificate := c.manager.statusAndLeafCertificate()
+	if !status.CANotAfter.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.caExpiry, prometheus.GaugeValue, status.CANotAfter.Sub(now).Seconds())
+	}
+	if leafCertificate != nil {
+		ch <- prometheus.MustNewConstMetric(c.certExpiry, prometheus.GaugeValue, leafCertificate.NotAfter.Sub(now).Seconds())
+	}
+	c.certIssued.Collect(ch)
+	c.rotations.Collect(ch)
+	c.rotationFailures.Collect(ch)
+}
+
+// observeCertificatesIssued sets the issued timestamp gauge of the
+// certificate issues whose service certificate changed from previousCerts,
+// once the certificate chain is stored.
+func (c *MetricsCollector) observeCertificatesIssued(previousCerts map[string][]byte, certificateChain *chain.CertificateChainData) {
+	for name, certificateIssue := range certificateChain.CertificatesIssued {
+		cert := lastCertificate(certificateIssue.CertPEM)
+		if cert == nil || bytes.Equal(previousCerts[name], certificateIssue.CertPEM) {
+			continue
+		}
+		c.certIssued.WithLabelValues(name).Set(float64(cert.NotBefore.Unix()))
+	}
+}
+
+// observeRotation counts a certificates rotation, if there was one and it was
+// not deferred, as failed if err is set or as successful for reason otherwise.
+func (c *MetricsCollector) observeRotation(rotation bool, reason chain.RotationReason, err error) {
+	if !rotation || IsDeferred(err) {
+		return
+	}
+	if err != nil {
+		c.rotationFailures.Inc()
+		return
+	}
+	c.rotations.WithLabelValues(string(reason)).Inc()
+}
@@ -0,0 +1,330 @@
+package certificate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Metrics collector", func() {
+	var (
+		mgr        *Manager
+		failing    *updateFailingClient
+		registry   *prometheus.Registry
+		caRotate   = time.Hour
+		certRotate = 30 * time.Minute
+	)
+
+	// metricValues returns the values of a metric family by its reason
+	// label, if any
+	metricValues := func(name string) map[string]float64 {
+		families, err := registry.Gather()
+		Expect(err).To(Succeed(), "should succeed gathering metrics")
+		values := map[string]float64{}
+		for _, family := range families {
+			if family.GetName() != name {
+				continue
+			}
+			for _, metric := range family.Metric {
+				labels := map[string]string{}
+				for _, label := range metric.Label {
+					labels[label.GetName()] = label.GetValue()
+				}
+				Expect(labels).To(HaveKeyWithValue("manager", mgr.name), "should label the metric with the manager name")
+				reason := labels["reason"]
+				switch {
+				case metric.Counter != nil:
+					values[reason] = metric.Counter.GetValue()
+				case metric.Gauge != nil:
+					values[reason] = metric.Gauge.GetValue()
+				}
+			}
+		}
+		return values
+	}
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		failing = &updateFailingClient{Client: cli}
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			failing,
+			chain.Options{
+				CARotateInterval:   caRotate,
+				CertRotateInterval: certRotate,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(mgr.MetricsCollector())
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should not report expiry before the first reconcile", func() {
+		Expect(metricValues("webhook_certificate_ca_expiry_seconds")).To(BeEmpty(), "should not report CA expiry")
+		Expect(metricValues("webhook_certificate_cert_expiry_seconds")).To(BeEmpty(), "should not report service certificate expiry")
+	})
+
+	It("should count successful and failed rotations and report expiry", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+
+		Expect(metricValues("webhook_certificate_rotations_total")).To(Equal(map[string]float64{
+			string(chain.RotationReasonMissing): 1,
+			string(chain.RotationReasonForced):  1,
+		}), "should count the rotations by reason")
+		Expect(metricValues("webhook_certificate_rotation_failures_total")).To(Equal(map[string]float64{"": 0}), "should not count failures")
+
+		Expect(metricValues("webhook_certificate_ca_expiry_seconds")[""]).To(BeNumerically("~", caRotate.Seconds(), 60), "should report the seconds until the CA expires")
+		Expect(metricValues("webhook_certificate_cert_expiry_seconds")[""]).To(BeNumerically("~", certRotate.Seconds(), 60), "should report the seconds until the service certificate expires")
+		issuedAt := map[string]float64{"": float64(mgr.LeafCertificate().NotBefore.Unix())}
+		Expect(metricValues("webhook_certificate_issued_timestamp_seconds")).To(Equal(issuedAt), "should report the issue time of the stored service certificate")
+
+		By("Failing to write the rotated certificates")
+		failing.fail = true
+		triple.Now = func() time.Time { return time.Now().Add(time.Minute) }
+		err = mgr.ForceRotate(context.TODO())
+		triple.Now = time.Now
+		Expect(err).To(HaveOccurred(), "should fail forcing rotation")
+		Expect(metricValues("webhook_certificate_issued_timestamp_seconds")).To(Equal(issuedAt), "should not report the issue time of a service certificate not stored")
+		Expect(metricValues("webhook_certificate_rotation_failures_total")).To(Equal(map[string]float64{"": 1}), "should count the failure")
+		Expect(metricValues("webhook_certificate_rotations_total")[string(chain.RotationReasonForced)]).To(Equal(float64(1)), "should not count the failure as a rotation")
+
+		By("Reconciling without rotation")
+		failing.fail = false
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(metricValues("webhook_certificate_rotations_total")[string(chain.RotationReasonForced)]).To(Equal(float64(1)), "should not count a reconcile without rotation")
+	})
+})
+
+var _ = Describe("Metrics collector certificate issued timestamp", func() {
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+
+	It("should report the issue time of the changed service certificates only", func() {
+		now := time.Now().Truncate(time.Second)
+		triple.Now = func() time.Time { return now }
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}})
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(mgr.MetricsCollector())
+		issuedAt := func() map[string]float64 {
+			families, err := registry.Gather()
+			Expect(err).To(Succeed(), "should succeed gathering metrics")
+			values := map[string]float64{}
+			for _, family := range families {
+				if family.GetName() != "webhook_certificate_issued_timestamp_seconds" {
+					continue
+				}
+				for _, metric := range family.Metric {
+					for _, label := range metric.Label {
+						if label.GetName() == "name" {
+							values[label.GetValue()] = metric.Gauge.GetValue()
+						}
+					}
+				}
+			}
+			return values
+		}
+
+		certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+		certificateChain := chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				certificateIssue.Name: certificateIssue,
+			},
+			CA: chain.CA{Name: "foo-ca"},
+		}
+		_, err = chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		Expect(issuedAt()).To(BeEmpty(), "should not report certificates issued but not stored")
+
+		mgr.metrics.observeCertificatesIssued(map[string][]byte{}, &certificateChain)
+		Expect(issuedAt()).To(Equal(map[string]float64{certificateIssue.Name: float64(now.Unix())}), "should report the issue time of the stored certificate")
+
+		By("Storing the same certificate later")
+		previousCerts := issuedCertPEMs(&certificateChain)
+		now = now.Add(time.Minute)
+		mgr.metrics.observeCertificatesIssued(previousCerts, &certificateChain)
+		Expect(issuedAt()).To(Equal(map[string]float64{certificateIssue.Name: float64(now.Add(-time.Minute).Unix())}), "should keep the issue time of the unchanged certificate")
+
+		By("Storing a rotated certificate")
+		_, err = chain.Rotate(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed rotating certificates")
+		mgr.metrics.observeCertificatesIssued(previousCerts, &certificateChain)
+		Expect(issuedAt()).To(Equal(map[string]float64{certificateIssue.Name: float64(now.Unix())}), "should report the issue time of the rotated certificate")
+	})
+})
+
+var _ = Describe("Metrics collector under concurrent reconciles", func() {
+	const (
+		rotators   = 4
+		rotations  = 20
+		collectors = 4
+	)
+	type expiry struct {
+		ca, cert float64
+	}
+
+	t0 := time.Now().Truncate(time.Second).UTC()
+
+	BeforeEach(func() {
+		triple.Now = func() time.Time { return t0 }
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+
+	// certificateChain generates a certificate chain with the CA and the
+	// service certificate expiring at the given durations from t0
+	certificateChain := func(caDuration, certDuration time.Duration) *chain.CertificateChainData {
+		certificateChain := &chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				"foo.bar.svc": {
+					Name:      "foo.bar.svc",
+					Hostnames: []string{"foo.bar.svc"},
+					CACertPEM: map[string][]byte{},
+				},
+			},
+			CA: chain.CA{Name: "foo-ca"},
+		}
+		_, err := chain.Update(&chain.Options{
+			CARotateInterval:   caDuration,
+			CertRotateInterval: certDuration,
+		}, certificateChain)
+		Expect(err).To(Succeed(), "should succeed generating the certificate chain")
+		return certificateChain
+	}
+
+	It("should collect consistent expiry and count every rotation", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}})
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(mgr.MetricsCollector())
+
+		certificateChains := []*chain.CertificateChainData{
+			certificateChain(2*time.Hour, time.Hour),
+			certificateChain(4*time.Hour, 3*time.Hour),
+		}
+		expected := []expiry{
+			{ca: (2 * time.Hour).Seconds(), cert: time.Hour.Seconds()},
+			{ca: (4 * time.Hour).Seconds(), cert: (3 * time.Hour).Seconds()},
+		}
+		mgr.updateStatus(certificateChains[0], t0)
+
+		var (
+			wg        sync.WaitGroup
+			collected []expiry
+			gatherErr error
+			lock      sync.Mutex
+			done      = make(chan struct{})
+		)
+		for i := 0; i < collectors; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					families, err := registry.Gather()
+					lock.Lock()
+					if err != nil {
+						gatherErr = err
+					}
+					current := expiry{}
+					for _, family := range families {
+						switch family.GetName() {
+						case "webhook_certificate_ca_expiry_seconds":
+							current.ca = family.Metric[0].Gauge.GetValue()
+						case "webhook_certificate_cert_expiry_seconds":
+							current.cert = family.Metric[0].Gauge.GetValue()
+						}
+					}
+					collected = append(collected, current)
+					lock.Unlock()
+				}
+			}()
+		}
+
+		var rotatorsWg sync.WaitGroup
+		for i := 0; i < rotators; i++ {
+			rotatorsWg.Add(1)
+			go func() {
+				defer rotatorsWg.Done()
+				for j := 0; j < rotations; j++ {
+					mgr.updateStatus(certificateChains[j%len(certificateChains)], t0)
+					mgr.metrics.observeRotation(true, chain.RotationReasonForced, nil)
+				}
+			}()
+		}
+		rotatorsWg.Wait()
+		close(done)
+		wg.Wait()
+
+		Expect(gatherErr).To(Succeed(), "should succeed gathering metrics")
+		Expect(collected).ToNot(BeEmpty(), "should have collected metrics")
+		for _, current := range collected {
+			Expect(expected).To(ContainElement(current), "should collect the expiry of the CA and service certificate of the same certificate chain")
+		}
+
+		families, err := registry.Gather()
+		Expect(err).To(Succeed(), "should succeed gathering metrics")
+		for _, family := range families {
+			if family.GetName() == "webhook_certificate_rotations_total" {
+				Expect(family.Metric).To(HaveLen(1), "should only count forced rotations")
+				Expect(family.Metric[0].Counter.GetValue()).To(Equal(float64(rotators*rotations)), "should count every rotation")
+			}
+		}
+		status := mgr.Status()
+		lastChain := certificateChains[(rotations-1)%len(certificateChains)]
+		caCerts, err := triple.ParseCertsPEM(lastChain.CA.CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the CA certificate")
+		Expect(status.CANotAfter).To(Equal(caCerts[len(caCerts)-1].NotAfter.UTC()), "should end at the CA of the last rotation")
+		Expect(mgr.LeafCertificate().NotAfter).To(Equal(t0.Add(3*time.Hour)), "should end at the service certificate of the last rotation")
+	})
+})
+
+// updateFailingClient fails every update once set to
+type updateFailingClient struct {
+	client.Client
+	fail bool
+}
+
+func (c *updateFailingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if c.fail {
+		return errors.New("update refused")
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
@@ -0,0 +1,537 @@
+package certificate
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// MaxReconcileJitter is the largest fraction of the certificate life a
+// rotation deadline can be brought forward by, see WithReconcileJitter
+const MaxReconcileJitter = chain.MaxRotationJitter
+
+// Option configures optional behavior of a Manager
+type Option func(m *Manager)
+
+// WithCertificateOptions configures the certificates with options, replacing
+// the certificate options configured by previous options such as
+// WithCADuration.
+func WithCertificateOptions(options chain.Options) Option {
+	return func(m *Manager) {
+		m.options = options
+	}
+}
+
+// WithCADuration sets the duration of the CA certificates, see
+// chain.Options.CARotateInterval.
+func WithCADuration(duration time.Duration) Option {
+	return func(m *Manager) {
+		m.options.CARotateInterval = duration
+	}
+}
+
+// WithCertDuration sets the duration of the service certificates, see
+// chain.Options.CertRotateInterval.
+func WithCertDuration(duration time.Duration) Option {
+	return func(m *Manager) {
+		m.options.CertRotateInterval = duration
+	}
+}
+
+// WithKeySize sets the size in bits of the RSA keys of the CA and service
+// certificates, see chain.Options.CAKeySize and chain.Options.CertKeySize.
+func WithKeySize(caKeySize, certKeySize int) Option {
+	return func(m *Manager) {
+		m.options.CAKeySize = caKeySize
+		m.options.CertKeySize = certKeySize
+	}
+}
+
+// WithKeyType sets the algorithm of the keys of the CA and service
+// certificates, see chain.Options.KeyAlgorithm.
+func WithKeyType(algorithm triple.KeyAlgorithm) Option {
+	return func(m *Manager) {
+		m.options.KeyAlgorithm = algorithm
+	}
+}
+
+// WithNotYetValidPolicy sets how certificates not valid yet, issued with a
+// clock ahead of the current one, are handled, see
+// chain.Options.NotYetValidPolicy. With chain.NotYetValidWait reconciles are
+// deferred, see DeferredError, and retried once they are valid, while
+// VerifyTLS and the readiness and health checks fail.
+func WithNotYetValidPolicy(policy chain.NotYetValidPolicy) Option {
+	return func(m *Manager) {
+		m.options.NotYetValidPolicy = policy
+	}
+}
+
+// WithSerialNumberBits sets the size in bits of the serial numbers of the CA
+// and service certificates, see chain.Options.SerialNumberBits.
+func WithSerialNumberBits(bits int) Option {
+	return func(m *Manager) {
+		m.options.SerialNumberBits = bits
+	}
+}
+
+// WithReconcileJitter spreads the reconciles of managers issuing
+// certificates at the same time by bringing forward each rotation deadline,
+// and so the reconcile rotating it, by up to the given fraction of the
+// certificate life before it, see chain.Options.RotationJitter. Valid values
+// are in the [0, MaxReconcileJitter] range, values out of it are clamped to
+// it, the default being 0 which disables the jitter.
+func WithReconcileJitter(fraction float64) Option {
+	return func(m *Manager) {
+		if math.IsNaN(fraction) {
+			fraction = 0
+		}
+		m.options.RotationJitter = math.Min(math.Max(fraction, 0), MaxReconcileJitter)
+	}
+}
+
+// WithImmutableSecrets marks the secrets created by the manager as immutable.
+// Since immutable secrets cannot be updated, they are deleted and created
+// again on rotation.
+func WithImmutableSecrets() Option {
+	return func(m *Manager) {
+		m.immutableSecrets = true
+	}
+}
+
+// WithSecretFinalizer adds a finalizer to the service secrets created by the
+// manager so they are not accidentally deleted while the webhook is serving.
+// The finalizer is removed by Cleanup, and before recreating immutable
+// secrets.
+func WithSecretFinalizer() Option {
+	return func(m *Manager) {
+		m.secretFinalizer = true
+	}
+}
+
+// WithCertificateHistory keeps on the service secrets the last size rotated
+// certificates, for debugging purposes. Only certificates are kept, never
+// private keys. The default size is 0, which disables the history.
+func WithCertificateHistory(size int) Option {
+	return func(m *Manager) {
+		m.certificateHistory = size
+	}
+}
+
+// WithCARotationNotice calls notify with the scheduled CA rotation time once
+// the current time is within the given lead time of it, ahead of the actual
+// rotation, so operators can get ready to watch the new CA bundle roll out.
+// notify is called once per CA rotation, once the reconcile noticing it is
+// done, so it can call the manager back.
+func WithCARotationNotice(lead time.Duration, notify func(rotateAt time.Time)) Option {
+	return func(m *Manager) {
+		m.caRotationNoticeLead = lead
+		m.caRotationNotify = notify
+	}
+}
+
+// WithBeforeCARotation runs hook before the CA is rotated, for instance to
+// drain traffic. If hook fails, the CA rotation is deferred, see
+// DeferredError, and retried on the next reconcile while the service
+// certificates keep being rotated with the current CA. It does not run on the
+// initial CA generation.
+func WithBeforeCARotation(hook func(ctx context.Context) error) Option {
+	return func(m *Manager) {
+		m.beforeCARotation = hook
+	}
+}
+
+// WithCAOwnerIdentity records identity as the owner of the CA at the CA
+// secret when the manager generates it, along a heartbeat the owner refreshes
+// every half ttl. Managers sharing the CA with a different identity refuse to
+// generate it again while the owner heartbeat is not older than ttl, so they
+// do not duel on CA regeneration without leader election, and keep rotating
+// the service certificates with the current CA meanwhile. Once the owner is
+// gone they take over the CA. ForceRotate overrides the ownership.
+func WithCAOwnerIdentity(identity string, ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.caOwnerIdentity = identity
+		m.caOwnerTTL = ttl
+	}
+}
+
+// WithSANPolicy sets how service certificates are issued when the managed
+// webhooks are backed by more than one service or URL, SANPolicySplit by
+// default. With SANPolicyUnion the union grows with every service, the
+// MaxSANs chain option guards it from growing too large, and leaves out the
+// webhooks reached by URL. Certificates keep their SANs until rotated.
+func WithSANPolicy(policy SANPolicy) Option {
+	return func(m *Manager) {
+		m.sanPolicy = policy
+	}
+}
+
+// WithOnIssue calls hook with every CA and service certificate issued, once
+// stored, for instance to record it at a certificate inventory. The hook runs
+// after the reconcile that issued the certificate, its failures are logged
+// and do not fail the reconcile.
+func WithOnIssue(hook func(cert *x509.Certificate) error) Option {
+	return func(m *Manager) {
+		m.onIssue = hook
+	}
+}
+
+// WithAuditLog writes a JSON line to w for every rotated certificate, the CA
+// and the service ones, as described by AuditRecord, for audit pipelines to
+// ingest. Each line is written with a single call to w.
+func WithAuditLog(w io.Writer) Option {
+	return func(m *Manager) {
+		m.auditLog = w
+	}
+}
+
+// WithAfterInject calls hook for every webhook configuration a CA bundle is
+// injected into, for instance to trigger a downstream sync. It is not called
+// for webhook configurations already injected with the CA bundle. The hook
+// runs after the reconcile that injected the CA bundle, its failures are
+// passed to the error handler and do not fail the reconcile.
+func WithAfterInject(hook func(target TargetInfo) error) Option {
+	return func(m *Manager) {
+		m.afterInject = hook
+	}
+}
+
+// WithCache keeps in memory the secrets as last read or written by the
+// manager and serves them on the following reconciles instead of reading them
+// again from the API server. A cached secret is read again once a watch event
+// for it is reconciled, and every secret is read again on the scheduled
+// requeue and after a failed reconcile, so it is only meant for managers
+// added to a controller-runtime manager with Add.
+func WithCache() Option {
+	return func(m *Manager) {
+		m.secretCache = map[types.NamespacedName]*corev1.Secret{}
+	}
+}
+
+// WithAdmissionCheck runs check, bounded by timeout, every time a new CA
+// bundle is injected into the webhook configurations to confirm that
+// admission keeps working with the new trust. It runs once the reconcile is
+// done, without holding back other reconciles, and the result is reported on
+// the manager Status. NewDryRunAdmissionCheck provides a check that sends an
+// admission request through the API server.
+func WithAdmissionCheck(check AdmissionCheck, timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.admissionCheck = check
+		m.admissionCheckTimeout = timeout
+	}
+}
+
+// WithTrustDistributionCheck stages the activation of service certificates
+// issued by a new CA: the CA bundle trusting both the previous and the new CA
+// is injected and mirrored first, keeping the previous service certificates,
+// and check, bounded by timeout, has to confirm the new CA is trusted before
+// the new service certificates are stored. If it does not in time, the
+// previous service certificates keep being served with that CA bundle, the
+// reconcile fails and is retried. The result is reported on the manager
+// Status.
+func WithTrustDistributionCheck(check TrustDistributionCheck, timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.trustDistributionCheck = check
+		m.trustDistributionTimeout = timeout
+	}
+}
+
+// WithWebhookAPIVersionAliases also injects the CA bundle into the webhook
+// configurations with the same name as the managed ones at the other
+// admissionregistration API version, v1beta1 for v1 ones and the other way
+// around, when they exist. This fits cluster upgrade windows where clients
+// may still go through either version.
+func WithWebhookAPIVersionAliases() Option {
+	return func(m *Manager) {
+		m.webhookAPIVersionAliases = true
+	}
+}
+
+// WithEventRecorder emits with recorder, on every managed webhook
+// configuration, a Normal EventReasonCertificateRotated event after every
+// successful certificates rotation and a Warning
+// EventReasonCertificateRotationFailed event after every failed one. Events
+// are dropped if not configured.
+func WithEventRecorder(recorder record.EventRecorder) Option {
+	return func(m *Manager) {
+		m.eventRecorder = recorder
+	}
+}
+
+// WithEndpointsReadinessCheck defers the scheduled certificate rotations
+// while any service backing the webhooks has no ready endpoints, avoiding
+// rotations during rollouts and cold starts. Rotations proceed anyway once
+// timeout has passed since their deadline, so it should be shorter than the
+// certificates overlap. Endpoints are not watched, deferred rotations are
+// retried every 30 seconds and are neither counted nor reported as failures.
+// Forced rotations and the issuance of missing or invalid certificates are
+// never deferred.
+func WithEndpointsReadinessCheck(timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.endpointsReadinessTimeout = timeout
+	}
+}
+
+// WithSecretLayout sets how the CA key pair is stored, SecretLayoutSeparate
+// by default. With SecretLayoutCombined every service secret holds ca.crt and
+// ca.key along tls.crt and tls.key, all of them rotated with a single update,
+// and no CA secret is used. Switching layouts generates a new CA.
+func WithSecretLayout(layout SecretLayout) Option {
+	return func(m *Manager) {
+		m.secretLayout = layout
+	}
+}
+
+// WithCertDir writes the service certificate and key, as tls.crt and
+// tls.key, to dir after every reconcile that changes them, in addition to
+// the Secret, for webhook servers loading them from disk such as the
+// controller-runtime one with its CertDir. Only the current certificate is
+// written, without the previous one kept during a rotation overlap, and both
+// files are swapped at once through a ..data symlink as with projected
+// volumes. Only the certificate of the first service by name is written if
+// the webhooks are backed by more than one.
+func WithCertDir(dir string) Option {
+	return func(m *Manager) {
+		m.certDir = dir
+	}
+}
+
+// WithErrorHandler calls handler with the error of every failed reconcile of
+// the controller, such as failing to generate the certificates, to store
+// them or to inject the CA bundle, and of every failed issuance hook, so they
+// can be surfaced beyond the logs. Errors are wrapped with the phase that
+// failed. Deferred rotations, see DeferredError, are not errors and the
+// handler is not called with them. Apply and ForceRotate return their errors
+// instead.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(m *Manager) {
+		m.errorHandler = handler
+	}
+}
+
+// WithClusterDomains issues the service certificates for the fully qualified
+// domain name of the service at each of domains, such as cluster.local and
+// cluster-b.local, instead of at cluster.local only, so that a certificate
+// serves a service exposed under several cluster domains.
+func WithClusterDomains(domains ...string) Option {
+	return func(m *Manager) {
+		m.clusterDomains = []string{}
+		for _, domain := range domains {
+			m.clusterDomains = append(m.clusterDomains, strings.Trim(domain, "."))
+		}
+	}
+}
+
+// WithExtraAltNames issues the service certificates with the DNS names and
+// IPs of altNames along the ones derived from the services, for webhooks
+// also reachable at an external DNS name or at a LoadBalancer IP. SANs
+// already derived from the services are not repeated.
+func WithExtraAltNames(altNames triple.AltNames) Option {
+	return func(m *Manager) {
+		m.extraAltNames = &altNames
+	}
+}
+
+// WithHealthPolicy sets the policy Healthz reports the manager health by,
+// HealthPolicyAll or HealthPolicyAny, the default being HealthPolicyAll.
+func WithHealthPolicy(policy HealthPolicy) Option {
+	return func(m *Manager) {
+		m.healthPolicy = policy
+	}
+}
+
+// WithIssuerLabel sets label on every secret, CA ConfigMap and webhook
+// configuration the manager writes, identifying it as their issuer. Cleanup
+// only deletes the secrets and CA ConfigMaps carrying it, and removes it from
+// the webhook configurations.
+func WithIssuerLabel(label IssuerLabel) Option {
+	return func(m *Manager) {
+		m.issuerLabel = &label
+	}
+}
+
+// WithSecretName stores the service certificate and key at the secret by
+// name at namespace, the manager namespace if empty, instead of at a secret
+// named after the service backing the webhooks, which they are still issued
+// for. The webhooks have to be backed by a single service.
+func WithSecretName(namespace, name string) Option {
+	return func(m *Manager) {
+		if namespace == "" {
+			namespace = m.namespace
+		}
+		m.serviceSecretName = &types.NamespacedName{Namespace: namespace, Name: name}
+	}
+}
+
+// WithSecretOwner sets an owner reference to owner, of kind gvk, on the
+// service secrets when the manager creates them, so that they are garbage
+// collected along it, such as the operator deployment or a cluster scoped
+// webhook configuration. Existing secrets and their owner references are left
+// as found. A namespaced owner is only referenced by the secrets at its
+// namespace.
+func WithSecretOwner(owner metav1.Object, gvk schema.GroupVersionKind) Option {
+	return func(m *Manager) {
+		m.secretOwner = &SecretOwner{Object: owner, GVK: gvk}
+	}
+}
+
+// WithExternalCABundle injects caBundle, PEM encoded certificates, into the
+// webhook configurations instead of a CA bundle generated by the manager. This
+// fits webhooks exposed at a public URL with serving certificates issued by a
+// public CA, caBundle being its roots. In this mode serving certificates are
+// managed externally, the manager neither generates nor stores any
+// certificate and injects caBundle as is into every webhook, either by service
+// or by URL.
+func WithExternalCABundle(caBundle []byte) Option {
+	return func(m *Manager) {
+		m.externalCABundle = caBundle
+	}
+}
+
+// WithCAConfigMap mirrors the CA bundle injected into the webhook
+// configurations to a ConfigMap by the given name at the manager namespace,
+// for clients other than the API server to trust the webhook services.
+func WithCAConfigMap(name string) Option {
+	return func(m *Manager) {
+		m.caConfigMapName = name
+	}
+}
+
+// WithCAConfigMapNamespaces writes the CA ConfigMap to each one of the given
+// namespaces instead of to the manager namespace.
+func WithCAConfigMapNamespaces(namespaces ...string) Option {
+	return func(m *Manager) {
+		m.caConfigMapNamespaces = namespaces
+	}
+}
+
+// WithCAConfigMapNamespaceSelector writes the CA ConfigMap to each namespace
+// matching selector instead of to the manager namespace. Namespaces are
+// watched, so the ones starting to match it get the CA ConfigMap and the ones
+// no longer matching it have it deleted.
+func WithCAConfigMapNamespaceSelector(selector labels.Selector) Option {
+	return func(m *Manager) {
+		m.caConfigMapNamespaceSelector = selector
+	}
+}
+
+// WithCAConfigMapLayout configures how the CA bundle is stored at the CA
+// ConfigMap, the default being CAConfigMapConcatenated.
+func WithCAConfigMapLayout(layout CAConfigMapLayout) Option {
+	return func(m *Manager) {
+		m.caConfigMapLayout = layout
+	}
+}
+
+// setDefaults sets the policies not configured to their defaults
+func (m *Manager) setDefaults() {
+	if m.secretLayout == "" {
+		m.secretLayout = SecretLayoutSeparate
+	}
+	if m.sanPolicy == "" {
+		m.sanPolicy = SANPolicySplit
+	}
+	if m.healthPolicy == "" {
+		m.healthPolicy = HealthPolicyAll
+	}
+	if m.caConfigMapLayout == "" {
+		m.caConfigMapLayout = CAConfigMapConcatenated
+	}
+}
+
+func (m *Manager) validate() error {
+	if m.certificateHistory < 0 {
+		return fmt.Errorf("failed validating manager options, certificate history size has to be >= 0")
+	}
+	if m.admissionCheck != nil && m.admissionCheckTimeout <= 0 {
+		return fmt.Errorf("failed validating manager options, admission check timeout has to be > 0")
+	}
+	if m.endpointsReadinessTimeout < 0 {
+		return fmt.Errorf("failed validating manager options, endpoints readiness timeout has to be >= 0")
+	}
+	if m.trustDistributionCheck != nil && m.trustDistributionTimeout <= 0 {
+		return fmt.Errorf("failed validating manager options, trust distribution timeout has to be > 0")
+	}
+	if m.caOwnerIdentity != "" && m.caOwnerTTL <= 0 {
+		return fmt.Errorf("failed validating manager options, CA owner TTL has to be > 0")
+	}
+	if m.eventRecorder == nil {
+		return fmt.Errorf("failed validating manager options, event recorder cannot be nil")
+	}
+	if m.caConfigMapLayout != CAConfigMapConcatenated && m.caConfigMapLayout != CAConfigMapSplit {
+		return fmt.Errorf("failed validating manager options, CA ConfigMap layout has to be '%s' or '%s'", CAConfigMapConcatenated, CAConfigMapSplit)
+	}
+	for _, webhook := range m.webhooks {
+		if webhook.APIVersion != "" && webhook.APIVersion != WebhookAPIVersionV1 && webhook.APIVersion != WebhookAPIVersionV1beta1 {
+			return fmt.Errorf("failed validating manager options, webhook %s API version has to be '%s' or '%s'", webhook.Name, WebhookAPIVersionV1, WebhookAPIVersionV1beta1)
+		}
+		if (webhook.Type == CRDConversionWebhook || webhook.Type == APIService) && webhook.APIVersion == WebhookAPIVersionV1beta1 {
+			return fmt.Errorf("failed validating manager options, %s webhook %s API version has to be '%s'", webhook.Type, webhook.Name, WebhookAPIVersionV1)
+		}
+	}
+	if m.issuerLabel != nil {
+		err := m.issuerLabel.validate()
+		if err != nil {
+			return errors.Wrap(err, "failed validating manager options")
+		}
+	}
+	if m.serviceSecretName != nil {
+		if m.serviceSecretName.Name == "" {
+			return fmt.Errorf("failed validating manager options, secret name cannot be empty")
+		}
+		if *m.serviceSecretName == m.secretCAName() {
+			return fmt.Errorf("failed validating manager options, secret name cannot be the CA secret name %s", m.secretCAName())
+		}
+	}
+	if m.secretOwner != nil {
+		err := m.secretOwner.validate()
+		if err != nil {
+			return errors.Wrap(err, "failed validating manager options")
+		}
+	}
+	err := validateClusterDomains(m.clusterDomains)
+	if err != nil {
+		return errors.Wrap(err, "failed validating manager options")
+	}
+	err = validateExtraAltNames(m.extraAltNames)
+	if err != nil {
+		return errors.Wrap(err, "failed validating manager options")
+	}
+	if m.healthPolicy != HealthPolicyAll && m.healthPolicy != HealthPolicyAny {
+		return fmt.Errorf("failed validating manager options, health policy has to be '%s' or '%s'", HealthPolicyAll, HealthPolicyAny)
+	}
+	if m.secretLayout != SecretLayoutSeparate && m.secretLayout != SecretLayoutCombined {
+		return fmt.Errorf("failed validating manager options, secret layout has to be '%s' or '%s'", SecretLayoutSeparate, SecretLayoutCombined)
+	}
+	if m.sanPolicy != SANPolicySplit && m.sanPolicy != SANPolicyUnion {
+		return fmt.Errorf("failed validating manager options, SAN policy has to be '%s' or '%s'", SANPolicySplit, SANPolicyUnion)
+	}
+	if m.externalCABundle != nil {
+		_, err := triple.ParseCertsPEM(m.externalCABundle)
+		if err != nil {
+			return errors.Wrap(err, "failed validating manager options, external CA bundle has to be PEM encoded certificates")
+		}
+		if triple.ContainsPrivateKeyPEM(m.externalCABundle) {
+			return fmt.Errorf("failed validating manager options, external CA bundle has to be PEM encoded certificates, found a private key")
+		}
+	}
+	if m.caRotationNoticeLead < 0 || m.caRotationNoticeLead >= m.options.CARotateInterval-m.options.CAOverlapInterval {
+		return fmt.Errorf("failed validating manager options, CA rotation notice lead time has to be >= 0 and < 'CARotateInterval' - 'CAOverlapInterval'")
+	}
+	return nil
+}
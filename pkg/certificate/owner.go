@@ -0,0 +1,55 @@
+package certificate
+
+import (
+	"github.com/pkg/errors"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SecretOwner is the object set as owner of the service secrets created by
+// the manager, so that they are garbage collected along it
+type SecretOwner struct {
+	Object metav1.Object
+	GVK    schema.GroupVersionKind
+}
+
+// validate checks that the owner can be referenced
+func (o SecretOwner) validate() error {
+	if o.Object == nil {
+		return errors.New("secret owner cannot be nil")
+	}
+	if o.Object.GetName() == "" || o.Object.GetUID() == "" {
+		return errors.New("secret owner has to have a name and an UID")
+	}
+	if o.GVK.Version == "" || o.GVK.Kind == "" {
+		return errors.New("secret owner has to have a version and a kind")
+	}
+	return nil
+}
+
+// ownerReference returns the reference to the owner
+func (o SecretOwner) ownerReference() metav1.OwnerReference {
+	apiVersion, kind := o.GVK.ToAPIVersionAndKind()
+	return metav1.OwnerReference{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Name:       o.Object.GetName(),
+		UID:        o.Object.GetUID(),
+	}
+}
+
+// setSecretOwner adds the reference to the secret owner, if configured, to a
+// service secret about to be created. Existing secrets are left as found, as
+// are secrets at a namespace other than the one of a namespaced owner, which
+// cannot reference it.
+func (m *Manager) setSecretOwner(object *keyedObject) {
+	if m.secretOwner == nil || object.key.Kind != secretType || object.key.NamespacedName == m.secretCAName() {
+		return
+	}
+	if namespace := m.secretOwner.Object.GetNamespace(); namespace != "" && namespace != object.key.Namespace {
+		m.log.Info("WARNING: not setting the secret owner from another namespace", "key", object.key, "ownerNamespace", namespace)
+		return
+	}
+	object.kobject.SetOwnerReferences(append(object.kobject.GetOwnerReferences(), m.secretOwner.ownerReference()))
+}
@@ -0,0 +1,123 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Secret owner validation", func() {
+	gvk := admissionregistrationv1.SchemeGroupVersion.WithKind("MutatingWebhookConfiguration")
+
+	DescribeTable("when validating the secret owner",
+		func(owner SecretOwner, expectedErr string) {
+			err := owner.validate()
+			if expectedErr == "" {
+				Expect(err).To(Succeed(), "should succeed validating the owner")
+			} else {
+				Expect(err).To(MatchError(expectedErr), "should fail validating the owner")
+			}
+		},
+		Entry("with a named owner with UID should succeed",
+			SecretOwner{Object: &metav1.ObjectMeta{Name: "foo", UID: types.UID("bar")}, GVK: gvk}, ""),
+		Entry("with a nil owner should fail",
+			SecretOwner{GVK: gvk}, "secret owner cannot be nil"),
+		Entry("with an owner without UID should fail",
+			SecretOwner{Object: &metav1.ObjectMeta{Name: "foo"}, GVK: gvk}, "secret owner has to have a name and an UID"),
+		Entry("with an owner without kind should fail",
+			SecretOwner{Object: &metav1.ObjectMeta{Name: "foo", UID: types.UID("bar")}, GVK: schema.GroupVersionKind{Version: "v1"}}, "secret owner has to have a version and a kind"),
+	)
+})
+
+var _ = Describe("Secret owner", func() {
+	var (
+		mgr      *Manager
+		expected metav1.OwnerReference
+	)
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		owner := getWebhookConfiguration()
+		expected = metav1.OwnerReference{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "MutatingWebhookConfiguration",
+			Name:       owner.Name,
+			UID:        owner.UID,
+		}
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithSecretOwner(&owner, admissionregistrationv1.SchemeGroupVersion.WithKind("MutatingWebhookConfiguration")),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should reference the owner from the created secret", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.OwnerReferences).To(ConsistOf(expected), "should reference the owner")
+
+		By("Forcing a rotation")
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+		secret, err = getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.OwnerReferences).To(ConsistOf(expected), "should keep a single reference to the owner")
+	})
+
+	Context("when the secret already exists", func() {
+		var existing metav1.OwnerReference
+		BeforeEach(func() {
+			existing = metav1.OwnerReference{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Name:       expectedService.Name,
+				UID:        types.UID("foo"),
+			}
+			secret := expectedSecret.DeepCopy()
+			secret.OwnerReferences = []metav1.OwnerReference{existing}
+			err := cli.Create(context.TODO(), secret)
+			Expect(err).To(Succeed(), "should succeed creating the TLS secret")
+		})
+		It("should keep its owner references", func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.OwnerReferences).To(ConsistOf(existing), "should not change the owner references")
+		})
+	})
+})
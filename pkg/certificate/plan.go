@@ -0,0 +1,135 @@
+package certificate
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+// RotationPlan is what a reconcile would do with the certificates as they
+// are at the cluster
+type RotationPlan struct {
+	// Rotate is true if the certificates would be rotated
+	Rotate bool
+
+	// Reason is the trigger of the rotation, if any
+	Reason chain.RotationReason
+
+	// Deadline is the earliest rotation deadline of the current
+	// certificates, the zero time if there are none
+	Deadline time.Time
+
+	// SANs are the DNS names and IPs the service certificates would carry,
+	// by certificate issue name
+	SANs map[string][]string
+
+	// Targets are the webhook configurations whose CA bundle would be
+	// injected
+	Targets []WebhookReference
+}
+
+// Plan reads the certificates and webhook configurations as a reconcile
+// does and reports what it would do with them, without issuing certificates
+// nor writing anything to the cluster. The rotation could still be deferred by the before CA
+// rotation hook, the CA owner identity or the endpoints readiness check. With
+// an external CA bundle there is nothing to rotate and only the webhook
+// configurations missing it are reported as targets.
+func (m *Manager) Plan(ctx context.Context) (RotationPlan, error) {
+	m.active.Lock()
+	defer m.active.Unlock()
+
+	if m.externalCABundle != nil {
+		return m.planExternalCABundle(ctx)
+	}
+
+	objects := objectMap{}
+	certificateChain := chain.CertificateChainData{}
+	err := m.readCertificateChain(ctx, objects, &certificateChain)
+	if err != nil {
+		return RotationPlan{}, errors.Wrap(err, "Failed reading certificate data")
+	}
+
+	plan := RotationPlan{}
+	caDeadline, certsDeadline, err := chain.RotationDeadlines(&m.options, &certificateChain)
+	if err == nil {
+		plan.Deadline = caDeadline
+		if certsDeadline.Before(caDeadline) {
+			plan.Deadline = certsDeadline
+		}
+	}
+
+	reason, rotateCA, err := chain.PendingRotation(&m.options, &certificateChain)
+	if err != nil {
+		return RotationPlan{}, errors.Wrap(err, "Failed planning certificates rotation")
+	}
+	plan.Rotate = reason != ""
+	plan.Reason = reason
+
+	plan.SANs = map[string][]string{}
+	for name, certificateIssue := range certificateChain.CertificatesIssued {
+		plan.SANs[name] = append(append([]string{}, certificateIssue.Hostnames...), certificateIssue.IPs...)
+	}
+
+	for _, object := range objects.sorted() {
+		webhook, isWebhook := webhookReference(object.key)
+		if !isWebhook {
+			continue
+		}
+		// a new CA is injected into every webhook configuration
+		if rotateCA {
+			plan.Targets = append(plan.Targets, webhook)
+			continue
+		}
+		planned := &keyedObject{
+			key:     object.key,
+			kobject: object.kobject.DeepCopyObject().(client.Object),
+		}
+		objectOperatorsMap[object.key.Kind].fromChainMapper(planned, &certificateChain)
+		if !reflect.DeepEqual(clientConfigCABundles(object.kobject), clientConfigCABundles(planned.kobject)) {
+			plan.Targets = append(plan.Targets, webhook)
+		}
+	}
+	return plan, nil
+}
+
+// planExternalCABundle plans the injection of the external CA bundle, there
+// is nothing to rotate
+func (m *Manager) planExternalCABundle(ctx context.Context) (RotationPlan, error) {
+	plan := RotationPlan{}
+	for _, webhookRef := range m.managedWebhooks() {
+		key := newObjectKey(webhookObjectKind(webhookRef), "", webhookRef.Name)
+		webhook := objectOperatorsMap[key.Kind].creator(key.Name, key.Namespace)
+		err := m.get(ctx, key.NamespacedName, webhook)
+		if m.isWebhookAlias(key) && (apierrors.IsNotFound(err) || meta.IsNoMatchError(err)) {
+			continue
+		}
+		if err != nil {
+			return RotationPlan{}, errors.Wrapf(err, "Failed reading webhook configuration %s", key)
+		}
+		for _, config := range anyClientConfigMap(webhook) {
+			if !bytes.Equal(config.CABundle, m.externalCABundle) {
+				plan.Targets = append(plan.Targets, webhookRef)
+				break
+			}
+		}
+	}
+	return plan, nil
+}
+
+// clientConfigCABundles returns the CA bundles of the webhooks of a webhook
+// configuration, by webhook name
+func clientConfigCABundles(webhook client.Object) map[string][]byte {
+	caBundles := map[string][]byte{}
+	for name, config := range anyClientConfigMap(webhook) {
+		caBundles[name] = config.CABundle
+	}
+	return caBundles
+}
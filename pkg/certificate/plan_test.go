@@ -0,0 +1,77 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Rotation plan", func() {
+	var (
+		mgr       *Manager
+		reference = WebhookReference{Type: MutatingWebhook, Name: expectedMutatingWebhookConfiguration.Name}
+	)
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{reference},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should plan to rotate missing certificates without writing them", func() {
+		webhookConfiguration := getWebhookConfiguration()
+
+		plan, err := mgr.Plan(context.TODO())
+		Expect(err).To(Succeed(), "should succeed planning the rotation")
+		Expect(plan.Rotate).To(BeTrue(), "should plan to rotate the certificates")
+		Expect(plan.Reason).To(Equal(chain.RotationReasonMissing), "should report the certificates as missing")
+		Expect(plan.Deadline).To(BeZero(), "should have no deadline without certificates")
+		hostname := serviceHostname(expectedService.Name, expectedService.Namespace)
+		Expect(plan.SANs).To(HaveKeyWithValue(hostname, ContainElement(hostname)), "should report the SANs of the service certificate")
+		Expect(plan.Targets).To(ConsistOf(reference), "should plan to inject the CA bundle into the webhook configuration")
+
+		_, err = getSecret()
+		Expect(err).ToNot(Succeed(), "should not create the TLS secret")
+		Expect(getWebhookConfiguration().ResourceVersion).To(Equal(webhookConfiguration.ResourceVersion), "should not inject the CA bundle")
+	})
+
+	It("should plan to skip valid certificates", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+		plan, err := mgr.Plan(context.TODO())
+		Expect(err).To(Succeed(), "should succeed planning the rotation")
+		Expect(plan.Rotate).To(BeFalse(), "should not plan to rotate the certificates")
+		Expect(plan.Reason).To(BeEmpty(), "should report no rotation reason")
+		Expect(plan.Deadline).To(BeTemporally(">", time.Now()), "should report the upcoming rotation deadline")
+		Expect(plan.Targets).To(BeEmpty(), "should not plan to inject the CA bundle again")
+
+		planned, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(planned.ResourceVersion).To(Equal(secret.ResourceVersion), "should not write the TLS secret")
+	})
+})
@@ -0,0 +1,54 @@
+package certificate
+
+import (
+	"time"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+// SchedulePlanLength is the number of upcoming rotations returned by
+// SchedulePlan
+const SchedulePlanLength = 5
+
+// ScheduledRotation is an upcoming certificates rotation
+type ScheduledRotation struct {
+	// Time the rotation is scheduled at, in UTC
+	Time time.Time
+
+	// CA is true if the CA certificate is rotated, which rotates the service
+	// certificates too, and false if only the service certificates are
+	CA bool
+}
+
+// SchedulePlan returns the next SchedulePlanLength rotations in time order,
+// projected from the rotation deadlines found on the last successful
+// reconcile assuming every rotation happens on time. It returns nil if there
+// was no such reconcile yet.
+func (m *Manager) SchedulePlan() []ScheduledRotation {
+	return schedulePlan(&m.options, m.Status())
+}
+
+// schedulePlan projects the upcoming rotations of SchedulePlan from the
+// rotation deadlines of a status
+func schedulePlan(options *chain.Options, status Status) []ScheduledRotation {
+	if status.CARotationTime.IsZero() || status.CertsRotationTime.IsZero() {
+		return nil
+	}
+
+	caPeriod := options.CARotateInterval - options.CAOverlapInterval
+	certsPeriod := options.CertRotateInterval - options.CertOverlapInterval
+	caAt, certsAt := status.CARotationTime, status.CertsRotationTime
+
+	plan := make([]ScheduledRotation, 0, SchedulePlanLength)
+	for len(plan) < SchedulePlanLength {
+		if certsAt.Before(caAt) {
+			plan = append(plan, ScheduledRotation{Time: certsAt})
+			certsAt = certsAt.Add(certsPeriod)
+			continue
+		}
+		plan = append(plan, ScheduledRotation{Time: caAt, CA: true})
+		certsAt = caAt.Add(certsPeriod)
+		caAt = caAt.Add(caPeriod)
+	}
+	return plan
+}
@@ -0,0 +1,88 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Schedule plan", func() {
+	var (
+		mgr *Manager
+	)
+
+	BeforeEach(func() {
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		triple.Now = time.Now
+
+		createResources()
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should be empty before reconciling", func() {
+		Expect(mgr.SchedulePlan()).To(BeEmpty(), "should not plan anything")
+	})
+
+	Context("when Apply is called", func() {
+		BeforeEach(func() {
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+		})
+		It("should start at the next rotation deadline and advance by the certificates rotation period", func() {
+			plan := mgr.SchedulePlan()
+			Expect(plan).To(HaveLen(SchedulePlanLength), "should plan the next rotations")
+			Expect(plan[0].Time).To(Equal(mgr.Status().NextReconcileTime), "should start at the next rotation deadline")
+			Expect(plan[0].CA).To(BeFalse(), "should rotate service certificates first")
+
+			certsPeriod := mgr.options.CertRotateInterval - mgr.options.CertOverlapInterval
+			for i := 1; i < len(plan); i++ {
+				Expect(plan[i].Time).To(Equal(plan[i-1].Time.Add(certsPeriod)), "should advance by the certificates rotation period")
+			}
+		})
+	})
+
+	Context("when the CA rotation deadline falls between service certificates rotations", func() {
+		var (
+			now time.Time
+		)
+		BeforeEach(func() {
+			now = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			mgr.status.CertsRotationTime = now.Add(20 * time.Minute)
+			mgr.status.CARotationTime = now.Add(30 * time.Minute)
+		})
+		It("should plan the CA rotation and restart service certificates rotations from it", func() {
+			Expect(mgr.SchedulePlan()).To(Equal([]ScheduledRotation{
+				{Time: now.Add(20 * time.Minute)},
+				{Time: now.Add(30 * time.Minute), CA: true},
+				{Time: now.Add(50 * time.Minute)},
+				{Time: now.Add(70 * time.Minute), CA: true},
+				{Time: now.Add(90 * time.Minute)},
+			}), "should interleave CA and service certificates rotations")
+		})
+	})
+})
@@ -0,0 +1,127 @@
+package certificate
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// secretlayout.go stores, with the combined secret layout, the CA key pair
+// along the service key pair at the service secrets instead of at a secret of
+// its own, so that a single secret holds ca.crt, ca.key, tls.crt and tls.key
+// and all of them are rotated with a single write.
+
+// SecretLayout is the way the CA and the service key pairs are stored at
+// secrets
+type SecretLayout string
+
+const (
+	// SecretLayoutSeparate stores the CA key pair at a secret named after the
+	// manager, apart from the service key pairs
+	SecretLayoutSeparate SecretLayout = "Separate"
+
+	// SecretLayoutCombined stores the CA key pair at every service secret,
+	// along the service key pair
+	SecretLayoutCombined SecretLayout = "Combined"
+)
+
+// combinedSecrets returns whether the CA key pair is stored at the service
+// secrets
+func (m *Manager) combinedSecrets() bool {
+	return m.secretLayout == SecretLayoutCombined
+}
+
+// isCASecret returns whether the CA key pair is stored at the secret
+// referenced by key
+func (m *Manager) isCASecret(key *objectKey) bool {
+	if key.Kind != secretType {
+		return false
+	}
+	return m.combinedSecrets() || key.NamespacedName == m.secretCAName()
+}
+
+// mapCombinedSecretsToChain maps the CA key pair stored at the service
+// secrets to certificate chain data, with the combined secret layout. The
+// secrets should agree on it but may not, after a partial write, so the CA is
+// picked deterministically: the newest of the valid ones, not expired and
+// matching its key, or the newest of the others if none is valid. Secrets
+// holding another CA are warned about, they are written the one picked.
+func (m *Manager) mapCombinedSecretsToChain(objects objectMap, certificateChain *chain.CertificateChainData) {
+	if !m.combinedSecrets() {
+		return
+	}
+	var picked *keyedObject
+	var pickedCA *x509.Certificate
+	pickedValid := false
+	for _, object := range objects.sorted() {
+		if object.key.Kind != secretType || object.kobject == nil {
+			continue
+		}
+		ca, valid := combinedSecretCA(object.kobject.(*corev1.Secret))
+		if ca == nil {
+			continue
+		}
+		if picked == nil || valid && !pickedValid || valid == pickedValid && ca.NotBefore.After(pickedCA.NotBefore) {
+			picked, pickedCA, pickedValid = object, ca, valid
+		}
+	}
+	if picked == nil {
+		return
+	}
+	mapCASecretToChain(picked, certificateChain)
+
+	for _, object := range objects.sorted() {
+		if object.key.Kind != secretType || object.kobject == nil || object == picked {
+			continue
+		}
+		secret := object.kobject.(*corev1.Secret)
+		if secret.Data[CACertKey] == nil && secret.Data[CAPrivateKeyKey] == nil {
+			continue
+		}
+		if !bytes.Equal(secret.Data[CACertKey], certificateChain.CA.CertPEM) || !bytes.Equal(secret.Data[CAPrivateKeyKey], certificateChain.CA.KeyPEM) {
+			m.log.WithName("mapCombinedSecretsToChain").Info("WARNING: secret holds a CA other than the one picked, replacing it",
+				"secret", object.key.NamespacedName.String(), "pickedFrom", picked.key.NamespacedName.String())
+		}
+	}
+}
+
+// combinedSecretCA returns the current CA certificate stored at a service
+// secret along with whether it is valid, not expired and matching the CA key,
+// nil if there is no CA key pair
+func combinedSecretCA(secret *corev1.Secret) (*x509.Certificate, bool) {
+	if secret.Data[CAPrivateKeyKey] == nil {
+		return nil, false
+	}
+	ca := lastCertificate(secret.Data[CACertKey])
+	if ca == nil {
+		return nil, false
+	}
+	key, err := triple.ParsePrivateKeyPEM(secret.Data[CAPrivateKeyKey])
+	if err != nil {
+		return ca, false
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || triple.VerifyKeyPair(ca, signer) != nil {
+		return ca, false
+	}
+	return ca, triple.Now().Before(ca.NotAfter)
+}
+
+// mapCombinedSecretFromChain maps the CA key pair from certificate chain data
+// to a service secret, with the combined secret layout. The CA certificate
+// replaces any CA bundle copy stored along the service certificate.
+func (m *Manager) mapCombinedSecretFromChain(object *keyedObject, certificateChain *chain.CertificateChainData) {
+	if !m.combinedSecrets() || object.key.Kind != secretType {
+		return
+	}
+	secret := object.kobject.(*corev1.Secret)
+	if secret.Data[corev1.TLSCertKey] == nil {
+		return
+	}
+	mapCASecretFromChain(object, certificateChain)
+}
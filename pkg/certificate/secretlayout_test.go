@@ -0,0 +1,174 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Combined secret layout", func() {
+	var mgr *Manager
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithSecretLayout(SecretLayoutCombined),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	// expectConsistentSecret checks that the secret holds the CA and the
+	// service key pairs, the service certificate being issued by the CA, and
+	// that the CA key made it nowhere else
+	expectConsistentSecret := func() corev1.Secret {
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(secret.Data).To(HaveLen(4), "should only hold the CA and service key pairs")
+		Expect(secret.Data).To(HaveKey(CACertKey), "should hold the CA certificate")
+		Expect(secret.Data).To(HaveKey(CAPrivateKeyKey), "should hold the CA key")
+		Expect(secret.Data).To(HaveKey(corev1.TLSCertKey), "should hold the service certificate")
+		Expect(secret.Data).To(HaveKey(corev1.TLSPrivateKeyKey), "should hold the service key")
+		Expect(secret.Type).To(Equal(corev1.SecretTypeTLS), "should be a TLS secret")
+
+		err = validateSecret(&keyedObject{key: newObjectKey(secretType, secret.Namespace, secret.Name), kobject: &secret})
+		Expect(err).To(Succeed(), "should hold matching certificates and keys")
+		err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], secret.Data[CACertKey])
+		Expect(err).To(Succeed(), "should hold a service certificate issued by the CA")
+
+		caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+		Expect(triple.ContainsPrivateKeyPEM(caBundle)).To(BeFalse(), "should not inject the CA key")
+		err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caBundle)
+		Expect(err).To(Succeed(), "should inject a CA bundle trusting the service certificate")
+		return secret
+	}
+
+	It("should hold the CA and service key pairs at the service secret and rotate them together", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret := expectConsistentSecret()
+
+		err = cli.Get(context.TODO(), types.NamespacedName{Namespace: expectedCASecret.Namespace, Name: expectedCASecret.Name}, &corev1.Secret{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not create a CA secret")
+
+		By("Reconciling without rotation")
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(expectConsistentSecret().Data).To(Equal(secret.Data), "should read back the CA from the service secret")
+
+		By("Forcing a rotation")
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+		rotatedSecret := expectConsistentSecret()
+		for key := range secret.Data {
+			Expect(rotatedSecret.Data[key]).ToNot(Equal(secret.Data[key]), "should rotate %s", key)
+		}
+		Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+	})
+})
+
+var _ = Describe("Combined secrets CA", func() {
+	var (
+		mgr *Manager
+		now time.Time
+	)
+
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second)
+		triple.Now = func() time.Time { return now }
+		var err error
+		mgr, err = NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil, WithSecretLayout(SecretLayoutCombined))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+
+	// caSecret returns a combined secret holding a CA issued at issuedAt
+	// and valid for duration
+	caSecret := func(name string, issuedAt time.Time, duration time.Duration) *keyedObject {
+		triple.Now = func() time.Time { return issuedAt }
+		defer func() { triple.Now = func() time.Time { return now } }()
+		ca, err := triple.NewCA("test-ca", duration)
+		Expect(err).To(Succeed(), "should succeed creating the CA")
+		keyPEM, err := triple.EncodeSignerPEM(ca.Key)
+		Expect(err).To(Succeed(), "should succeed encoding the CA key")
+		return &keyedObject{
+			key: newObjectKey(secretType, expectedNamespace.Name, name),
+			kobject: &corev1.Secret{Data: map[string][]byte{
+				CACertKey:       triple.EncodeCertPEM(ca.Cert),
+				CAPrivateKeyKey: keyPEM,
+			}},
+		}
+	}
+
+	pickedCA := func(secrets ...*keyedObject) []byte {
+		objects := objectMap{}
+		for _, secret := range secrets {
+			objects[secret.key] = secret
+		}
+		certificateChain := chain.CertificateChainData{}
+		mgr.mapCombinedSecretsToChain(objects, &certificateChain)
+		return certificateChain.CA.CertPEM
+	}
+
+	caCertPEM := func(secret *keyedObject) []byte {
+		return secret.kobject.(*corev1.Secret).Data[CACertKey]
+	}
+
+	It("should pick the newest CA whatever the secret it is stored at", func() {
+		older := caSecret("a", now.Add(-time.Hour), 2*time.Hour)
+		newer := caSecret("b", now.Add(-time.Minute), 2*time.Hour)
+		Expect(pickedCA(older, newer)).To(Equal(caCertPEM(newer)), "should pick the newest CA")
+
+		older = caSecret("b", now.Add(-time.Hour), 2*time.Hour)
+		newer = caSecret("a", now.Add(-time.Minute), 2*time.Hour)
+		Expect(pickedCA(older, newer)).To(Equal(caCertPEM(newer)), "should pick the newest CA")
+	})
+
+	It("should pick a valid CA over a newer invalid one", func() {
+		valid := caSecret("a", now.Add(-time.Hour), 2*time.Hour)
+		expired := caSecret("b", now.Add(-time.Minute), time.Second)
+		Expect(pickedCA(valid, expired)).To(Equal(caCertPEM(valid)), "should pick the valid CA")
+
+		mismatched := caSecret("c", now, 2*time.Hour)
+		mismatched.kobject.(*corev1.Secret).Data[CAPrivateKeyKey] = valid.kobject.(*corev1.Secret).Data[CAPrivateKeyKey]
+		Expect(pickedCA(valid, mismatched)).To(Equal(caCertPEM(valid)), "should pick the CA matching its key")
+	})
+
+	It("should pick the newest of the CAs if none is valid", func() {
+		older := caSecret("a", now.Add(-time.Hour), time.Second)
+		newer := caSecret("b", now.Add(-time.Minute), time.Second)
+		Expect(pickedCA(older, newer)).To(Equal(caCertPEM(newer)), "should pick the newest expired CA")
+	})
+})
@@ -0,0 +1,50 @@
+package certificate
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+)
+
+// relocateServiceSecrets replaces the references to the secrets named after
+// the service backing the webhooks, not read yet, with a reference to the
+// configured service secret, if any. The certificates keep being issued for
+// the service. It fails if the webhooks are backed by more than one service,
+// as their certificates cannot be stored at the same secret.
+func (m *Manager) relocateServiceSecrets(objects objectMap, certificateChain *chain.CertificateChainData) error {
+	if m.serviceSecretName == nil {
+		return nil
+	}
+	for key, object := range objects {
+		if key.Kind != secretType || object.kobject != nil || object.certificateIssue != "" || key.NamespacedName == m.secretCAName() {
+			continue
+		}
+		certificateIssueName := serviceHostname(key.Name, key.Namespace)
+		if _, found := certificateChain.CertificatesIssued[certificateIssueName]; !found {
+			continue
+		}
+		delete(objects, key)
+
+		relocated := m.relocatedServiceSecret(objects)
+		if relocated != nil && relocated.certificateIssue != certificateIssueName {
+			return errors.Errorf("secret %s cannot store the certificates of both %s and %s", m.serviceSecretName, relocated.certificateIssue, certificateIssueName)
+		}
+		if relocated != nil {
+			continue
+		}
+		relocatedKey := newObjectKey(secretType, m.serviceSecretName.Namespace, m.serviceSecretName.Name)
+		objects[relocatedKey] = &keyedObject{key: relocatedKey, certificateIssue: certificateIssueName}
+	}
+	return nil
+}
+
+// relocatedServiceSecret returns the reference to the configured service
+// secret, nil if there is none yet
+func (m *Manager) relocatedServiceSecret(objects objectMap) *keyedObject {
+	for key, object := range objects {
+		if key.Kind == secretType && key.NamespacedName == *m.serviceSecretName && object.certificateIssue != "" {
+			return object
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Service secret relocation", func() {
+	webhooks := []WebhookReference{{Type: MutatingWebhook, Name: "foo"}}
+
+	It("should default the secret namespace to the manager one", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithSecretName("", "foo-tls"))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		Expect(*mgr.serviceSecretName).To(Equal(types.NamespacedName{Namespace: "bar", Name: "foo-tls"}), "should store the secret at the manager namespace")
+	})
+
+	It("should fail with an empty secret name", func() {
+		_, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithSecretName("bar", ""))
+		Expect(err).To(MatchError(ContainSubstring("secret name cannot be empty")), "should fail validating the options")
+	})
+
+	It("should fail with the CA secret name", func() {
+		_, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithSecretName("bar", "foo-ca"))
+		Expect(err).To(MatchError(ContainSubstring("secret name cannot be the CA secret name bar/foo-ca")), "should fail validating the options")
+	})
+
+	It("should fail relocating the secrets of more than one service", func() {
+		mgr, err := NewManagerWithOptions("foo", "bar", nil, webhooks, WithSecretName("bar", "foo-tls"))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+		objects := objectMap{}
+		certificateChain := chain.CertificateChainData{CertificatesIssued: map[string]*chain.CertificateIssue{}}
+		for _, service := range []string{"first", "second"} {
+			key := newObjectKey(secretType, "bar", service)
+			objects[key] = &keyedObject{key: key}
+			certificateIssue := newCertificateIssue(service, "bar")
+			certificateChain.CertificatesIssued[certificateIssue.Name] = certificateIssue
+		}
+		err = mgr.relocateServiceSecrets(objects, &certificateChain)
+		Expect(err).To(MatchError(ContainSubstring("secret bar/foo-tls cannot store the certificates of both")), "should fail relocating the secrets")
+	})
+})
+
+var _ = Describe("Service secret name", func() {
+	var (
+		mgr        *Manager
+		secretName = types.NamespacedName{Namespace: expectedNamespace.Name, Name: "webhook-tls"}
+	)
+
+	getRelocatedSecret := func() corev1.Secret {
+		secret := corev1.Secret{}
+		err := cli.Get(context.TODO(), secretName, &secret)
+		Expect(err).To(Succeed(), "should succeed getting the configured TLS secret")
+		return secret
+	}
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithSecretName(secretName.Namespace, secretName.Name),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+		_ = cli.Delete(context.TODO(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: secretName.Namespace, Name: secretName.Name}})
+	})
+
+	It("should store the certificate issued for the service at the configured secret", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+
+		_, err = getSecret()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not create the secret named after the service")
+		secret := getRelocatedSecret()
+		certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+		Expect(err).To(Succeed(), "should succeed parsing the service certificate")
+		Expect(certs[len(certs)-1].DNSNames).To(ContainElement(serviceHostname(expectedService.Name, expectedService.Namespace)), "should issue the certificate for the service")
+
+		caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+		err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caBundle)
+		Expect(err).To(Succeed(), "should verify the certificate with the injected CA bundle")
+		Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+
+		By("Reconciling without rotation")
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(getRelocatedSecret().Data).To(Equal(secret.Data), "should read back the certificate from the configured secret")
+
+		By("Forcing a rotation")
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(Succeed(), "should succeed forcing rotation")
+		Expect(getRelocatedSecret().Data[corev1.TLSCertKey]).ToNot(Equal(secret.Data[corev1.TLSCertKey]), "should rotate the certificate at the configured secret")
+		_, err = getSecret()
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "should not create the secret named after the service")
+	})
+
+	It("should rotate the certificate at the configured secret once the service is renamed", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret := getRelocatedSecret()
+
+		By("Renaming the service of the webhook")
+		webhookConfiguration := getWebhookConfiguration()
+		webhookConfiguration.Webhooks[0].ClientConfig.Service.Name = "renamed-service"
+		err = cli.Update(context.TODO(), &webhookConfiguration)
+		Expect(err).To(Succeed(), "should succeed updating the webhook configuration")
+
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		Expect(mgr.Status().LastRotationReason).To(Equal(chain.RotationReasonSANsChanged), "should rotate the certificate for the SANs change")
+		renamedSecret := getRelocatedSecret()
+		Expect(renamedSecret.Data[corev1.TLSCertKey]).ToNot(Equal(secret.Data[corev1.TLSCertKey]), "should rotate the certificate while still valid")
+		certs, err := triple.ParseCertsPEM(renamedSecret.Data[corev1.TLSCertKey])
+		Expect(err).To(Succeed(), "should succeed parsing the service certificate")
+		Expect(certs[len(certs)-1].DNSNames).To(ContainElement(serviceHostname("renamed-service", expectedService.Namespace)), "should issue the certificate for the renamed service")
+		Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+	})
+})
@@ -0,0 +1,93 @@
+package certificate
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// serving.go keeps in memory the service key pair of the last successful
+// reconcile so that a webhook server can serve it straight from the manager.
+// It keeps being served while the API server is unreachable and the manager
+// cannot rotate it, for as long as it is valid.
+
+// firstServingCertificate returns the key pair of the first service by name,
+// nil if there is none. During the rotation overlap the service certificates
+// are both the previous and the current ones, the current one being last and
+// the one matching the service key.
+func firstServingCertificate(certificateChain *chain.CertificateChainData) (*tls.Certificate, error) {
+	certificateIssue := firstCertificateIssue(certificateChain)
+	if certificateIssue == nil {
+		return nil, nil
+	}
+	certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed parsing certificates of %s", certificateIssue.Name)
+	}
+	key, err := triple.ParseSignerPEM(certificateIssue.KeyPEM)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed parsing key of %s", certificateIssue.Name)
+	}
+	leaf := certs[len(certs)-1]
+	err = triple.VerifyKeyPair(leaf, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed verifying key pair of %s", certificateIssue.Name)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// TLSCertificate returns the service key pair of the last successful
+// reconcile, the one of the first service by name if the webhooks are backed
+// by more than one. It keeps returning it when later reconciles fail, for
+// instance while the API server is unreachable, and fails while it is not
+// valid yet, once it expires or if there was no successful reconcile yet.
+func (m *Manager) TLSCertificate() (*tls.Certificate, error) {
+	servingCertificate := m.lastServingCertificate()
+	if servingCertificate == nil {
+		return nil, errors.New("no serving certificate issued yet")
+	}
+	err := checkServingCertificateValidity(servingCertificate)
+	if err != nil {
+		return nil, err
+	}
+	return servingCertificate, nil
+}
+
+// GetTLSConfig returns a TLS configuration serving TLSCertificate, picking up
+// every rotation without restarting the server.
+func (m *Manager) GetTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.TLSCertificate()
+		},
+	}
+}
+
+// lastServingCertificate returns the service key pair of the last successful
+// reconcile, nil if there was none
+func (m *Manager) lastServingCertificate() *tls.Certificate {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.servingCertificate
+}
+
+// checkServingCertificateValidity fails if the serving certificate is not
+// valid yet or expired
+func checkServingCertificateValidity(servingCertificate *tls.Certificate) error {
+	now := triple.Now()
+	if notBefore := servingCertificate.Leaf.NotBefore; now.Before(notBefore) {
+		return errors.Errorf("serving certificate not valid until %s", notBefore.UTC())
+	}
+	if notAfter := servingCertificate.Leaf.NotAfter; now.After(notAfter) {
+		return errors.Errorf("serving certificate expired at %s", notAfter.UTC())
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package certificate
+
+import (
+	"context"
+	"crypto"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Serving certificate", func() {
+	var (
+		mgr        *Manager
+		outage     *outageClient
+		now        time.Time
+		certRotate = 30 * time.Minute
+	)
+
+	BeforeEach(func() {
+		now = time.Now().Truncate(time.Second).UTC()
+		triple.Now = func() time.Time { return now }
+		createResources()
+
+		outage = &outageClient{Client: cli}
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			outage,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: certRotate,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should fail before the first reconcile", func() {
+		_, err := mgr.TLSCertificate()
+		Expect(err).To(MatchError("no serving certificate issued yet"), "should fail getting the serving certificate")
+		Expect(mgr.Healthz(nil)).To(Succeed(), "should be healthy")
+	})
+
+	It("should keep serving the last certificate during an API server outage while it is valid", func() {
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+		Expect(err).To(Succeed(), "should succeed parsing the service certificate")
+
+		servingCertificate, err := mgr.GetTLSConfig().GetCertificate(nil)
+		Expect(err).To(Succeed(), "should succeed getting the serving certificate")
+		Expect(servingCertificate.Certificate[len(servingCertificate.Certificate)-1]).To(Equal(certs[len(certs)-1].Raw), "should serve the certificate of the secret")
+
+		By("Failing to reach the API server past the rotation deadline")
+		outage.down = true
+		now = now.Add(certRotate - time.Minute)
+		err = mgr.ForceRotate(context.TODO())
+		Expect(err).To(HaveOccurred(), "should fail forcing rotation")
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(HaveOccurred(), "should fail applying certificates")
+
+		staleCertificate, err := mgr.TLSCertificate()
+		Expect(err).To(Succeed(), "should keep serving the certificate")
+		Expect(staleCertificate).To(Equal(servingCertificate), "should serve the last certificate")
+		Expect(mgr.Healthz(nil)).To(Succeed(), "should be healthy while the certificate is valid")
+
+		By("Letting the certificate expire")
+		now = now.Add(2 * time.Minute)
+		_, err = mgr.TLSCertificate()
+		Expect(err).To(MatchError(ContainSubstring("serving certificate expired")), "should fail serving the expired certificate")
+		Expect(mgr.Healthz(nil)).To(MatchError(ContainSubstring("serving certificate expired")), "should be unhealthy")
+
+		By("Recovering the API server")
+		outage.down = false
+		err = mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		renewedCertificate, err := mgr.TLSCertificate()
+		Expect(err).To(Succeed(), "should serve the renewed certificate")
+		Expect(renewedCertificate.Leaf.NotAfter).To(BeTemporally(">", now), "should serve a valid certificate")
+		Expect(mgr.Healthz(nil)).To(Succeed(), "should be healthy again")
+	})
+})
+
+var _ = Describe("Serving certificate during the rotation overlap", func() {
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+
+	It("should serve the current certificate with the current key", func() {
+		now := time.Now()
+		triple.Now = func() time.Time { return now }
+		options := chain.Options{
+			CARotateInterval:   time.Hour,
+			CertRotateInterval: 30 * time.Minute,
+		}
+		Expect(options.SetDefaultsAndValidate()).To(Succeed(), "should validate options")
+		certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+		certificateChain := chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				certificateIssue.Name: certificateIssue,
+			},
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		_, err := chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+
+		By("Rotating the service certificate with overlap")
+		_, certsDeadline, err := chain.RotationDeadlines(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed computing the rotation deadlines")
+		now = certsDeadline.Add(time.Second)
+		_, err = chain.Update(&options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed rotating certificates")
+		certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+		Expect(err).To(Succeed(), "should succeed parsing the service certificates")
+		Expect(certs).To(HaveLen(2), "should keep the previous certificate during the overlap")
+
+		servingCertificate, err := firstServingCertificate(&certificateChain)
+		Expect(err).To(Succeed(), "should succeed loading the serving certificate")
+		Expect(servingCertificate.Leaf).To(Equal(certs[1]), "should serve the current certificate")
+		Expect(servingCertificate.Certificate).To(Equal([][]byte{certs[1].Raw}), "should serve the current certificate only")
+		Expect(triple.VerifyKeyPair(servingCertificate.Leaf, servingCertificate.PrivateKey.(crypto.Signer))).To(Succeed(), "should serve the current key")
+	})
+})
+
+var _ = Describe("Serving certificate not valid yet", func() {
+	AfterEach(func() {
+		triple.Now = time.Now
+	})
+
+	It("should neither serve it nor report ready nor healthy until it is valid", func() {
+		issued := time.Now().Truncate(time.Second)
+		now := issued
+		triple.Now = func() time.Time { return now }
+		mgr, err := NewManager(expectedMutatingWebhookConfiguration.Name, expectedNamespace.Name, nil, chain.Options{}, nil)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		certificateIssue := newCertificateIssue(expectedService.Name, expectedService.Namespace)
+		certificateChain := chain.CertificateChainData{
+			CertificatesIssued: map[string]*chain.CertificateIssue{
+				certificateIssue.Name: certificateIssue,
+			},
+			CA: chain.CA{
+				Name: expectedCASecret.Namespace + "/" + expectedCASecret.Name,
+			},
+		}
+		reconcileAt, err := chain.Update(&mgr.options, &certificateChain)
+		Expect(err).To(Succeed(), "should succeed issuing certificates")
+		mgr.updateStatus(&certificateChain, reconcileAt)
+
+		By("Going back in time as if issued with a clock ahead")
+		now = issued.Add(-10 * time.Minute)
+		_, err = mgr.TLSCertificate()
+		Expect(err).To(MatchError(ContainSubstring("serving certificate not valid until")), "should not serve the certificate")
+		Expect(mgr.CheckReadiness(nil)).To(MatchError(ContainSubstring("serving certificate not valid until")), "should not be ready")
+		Expect(mgr.Healthz(nil)).To(MatchError(ContainSubstring("serving certificate not valid until")), "should not be healthy")
+
+		By("Reaching the time it is valid at")
+		now = issued
+		_, err = mgr.TLSCertificate()
+		Expect(err).To(Succeed(), "should serve the certificate")
+		Expect(mgr.CheckReadiness(nil)).To(Succeed(), "should be ready")
+		Expect(mgr.Healthz(nil)).To(Succeed(), "should be healthy")
+	})
+})
+
+// outageClient fails every call, as if the API server was unreachable, once
+// set to
+type outageClient struct {
+	client.Client
+	down bool
+}
+
+func (c *outageClient) unavailable() error {
+	return apierrors.NewServiceUnavailable("API server unreachable")
+}
+
+func (c *outageClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if c.down {
+		return c.unavailable()
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *outageClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if c.down {
+		return c.unavailable()
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *outageClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if c.down {
+		return c.unavailable()
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *outageClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if c.down {
+		return c.unavailable()
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *outageClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if c.down {
+		return c.unavailable()
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
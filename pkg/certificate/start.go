@@ -0,0 +1,83 @@
+package certificate
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// start.go runs the rotation loop standalone, without the controller
+// registered by Add, reconciling at the rotation deadlines until its context
+// is cancelled. Added to a controller-runtime manager, it only runs at the
+// leader so that replicas do not race rotating the same secrets.
+
+var (
+	_ manager.Runnable               = &Manager{}
+	_ manager.LeaderElectionRunnable = &Manager{}
+)
+
+const (
+	// startRetryInterval is the interval a failed reconcile of the rotation
+	// loop is retried after, doubled on every consecutive failure
+	startRetryInterval = time.Second
+
+	// startMaxRetryInterval caps the interval failed reconciles of the
+	// rotation loop are retried after
+	startMaxRetryInterval = time.Minute
+)
+
+// Start runs the rotation loop, reconciling the certificates right away and
+// then again at every rotation deadline, as the controller registered by Add
+// does but without watching any object. The certificates stored by a previous
+// run are reused while valid and not due for rotation, so that a restart does
+// not churn the CA bundle. Failed reconciles are passed to the error handler,
+// if configured, and retried with backoff. Waits are cut short when ctx is
+// cancelled, Start returning nil then, so it can run as a controller-runtime
+// manager.Runnable that stops cleanly on shutdown.
+func (m *Manager) Start(ctx context.Context) error {
+	logger := m.log.WithName("Start")
+	logger.Info("Starting rotation loop")
+	retryInterval := startRetryInterval
+	for {
+		requeueAfter, err := m.reconcileCertificates(ctx)
+		if err != nil {
+			logger.Error(err, "Reconcile failed, retrying", "RetryAfter", retryInterval)
+			m.handleError(err)
+			requeueAfter = retryInterval
+			retryInterval *= 2
+			if retryInterval > startMaxRetryInterval {
+				retryInterval = startMaxRetryInterval
+			}
+		} else {
+			requeueAfter = m.capRequeue(requeueAfter)
+			retryInterval = startRetryInterval
+			logger.Info("Reconcile done, waiting", "RequeueAfter", requeueAfter)
+		}
+
+		if !waitOrDone(ctx, requeueAfter) {
+			logger.Info("Stopping rotation loop")
+			return nil
+		}
+	}
+}
+
+// NeedLeaderElection returns true so that, added to a controller-runtime
+// manager with leader election enabled, the rotation loop only runs at the
+// leader.
+func (m *Manager) NeedLeaderElection() bool {
+	return true
+}
+
+// waitOrDone waits for d to elapse, returning true, or for ctx to be done,
+// returning false.
+func waitOrDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,137 @@
+package certificate
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// startManager runs the rotation loop of mgr in the background, returning
+// the context cancel function and a channel closed with the Start result
+func startManager(mgr *Manager) (context.CancelFunc, <-chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- mgr.Start(ctx)
+		close(done)
+	}()
+	return cancel, done
+}
+
+var _ = Describe("Rotation loop shutdown", func() {
+	It("should be a controller-runtime runnable needing leader election", func() {
+		var mgr interface{} = &Manager{}
+		_, isRunnable := mgr.(manager.Runnable)
+		Expect(isRunnable).To(BeTrue(), "should be a runnable")
+		leaderElectionRunnable, isLeaderElectionRunnable := mgr.(manager.LeaderElectionRunnable)
+		Expect(isLeaderElectionRunnable).To(BeTrue(), "should be a leader election runnable")
+		Expect(leaderElectionRunnable.NeedLeaderElection()).To(BeTrue(), "should need leader election")
+	})
+
+	It("should return promptly when the context is cancelled while retrying without leaking goroutines", func() {
+		goroutines := runtime.NumGoroutine()
+
+		errs := make(chan error, 10)
+		mgr, err := NewManager("foo", "bar", &outageClient{down: true}, chain.Options{}, []WebhookReference{{Type: MutatingWebhook, Name: "foo"}},
+			WithErrorHandler(func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			}))
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+
+		cancel, done := startManager(mgr)
+		Eventually(errs).Should(Receive(), "should pass the failed reconcile to the error handler")
+
+		cancel()
+		Eventually(done, time.Second).Should(Receive(Succeed()), "should return once the context is cancelled")
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", goroutines), "should not leak goroutines")
+	})
+})
+
+var _ = Describe("Rotation loop", func() {
+	var mgr *Manager
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   time.Hour,
+				CertRotateInterval: 30 * time.Minute,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	It("should reconcile the certificates and return promptly when the context is cancelled while waiting for the deadline", func() {
+		goroutines := runtime.NumGoroutine()
+
+		cancel, done := startManager(mgr)
+		Eventually(mgr.VerifyTLS, 10*time.Second).Should(Succeed(), "should issue the certificates")
+		Consistently(done).ShouldNot(Receive(), "should wait for the rotation deadline")
+
+		cancel()
+		Eventually(done, time.Second).Should(Receive(Succeed()), "should return once the context is cancelled")
+		Eventually(runtime.NumGoroutine).Should(BeNumerically("<=", goroutines), "should not leak goroutines")
+	})
+
+	It("should reuse the valid certificates stored by a previous run without rotating them", func() {
+		By("Storing the certificates as a previous run")
+		err := mgr.Apply(context.TODO())
+		Expect(err).To(Succeed(), "should succeed applying certificates")
+		secret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		caSecret := corev1.Secret{}
+		err = cli.Get(context.TODO(), types.NamespacedName{Namespace: expectedCASecret.Namespace, Name: expectedCASecret.Name}, &caSecret)
+		Expect(err).To(Succeed(), "should succeed getting CA secret")
+		webhookConfiguration := getWebhookConfiguration()
+
+		By("Restarting with a new manager")
+		restarted, err := NewManager(mgr.name, mgr.namespace, cli, mgr.options, mgr.webhooks)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+		cancel, done := startManager(restarted)
+		Eventually(func() time.Time {
+			return restarted.Status().LastReconcileTime
+		}, 10*time.Second).ShouldNot(BeZero(), "should reconcile the certificates")
+		cancel()
+		Eventually(done, time.Second).Should(Receive(Succeed()), "should return once the context is cancelled")
+
+		Expect(restarted.Status().LastRotationReason).To(BeEmpty(), "should not rotate the certificates")
+		restartedSecret, err := getSecret()
+		Expect(err).To(Succeed(), "should succeed getting TLS secret")
+		Expect(restartedSecret.ResourceVersion).To(Equal(secret.ResourceVersion), "should not write the TLS secret")
+		restartedCASecret := corev1.Secret{}
+		err = cli.Get(context.TODO(), types.NamespacedName{Namespace: expectedCASecret.Namespace, Name: expectedCASecret.Name}, &restartedCASecret)
+		Expect(err).To(Succeed(), "should succeed getting CA secret")
+		Expect(restartedCASecret.ResourceVersion).To(Equal(caSecret.ResourceVersion), "should not write the CA secret")
+		Expect(getWebhookConfiguration().ResourceVersion).To(Equal(webhookConfiguration.ResourceVersion), "should not inject the CA bundle again")
+	})
+})
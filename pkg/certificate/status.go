@@ -0,0 +1,215 @@
+package certificate
+
+import (
+	"crypto/x509"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// Status reports the state of the certificates handled by a Manager as of
+// its last successful reconcile. All times are in UTC.
+type Status struct {
+	// LastReconcileTime is the time of the last successful reconcile
+	LastReconcileTime time.Time
+
+	// NextReconcileTime is the time the next reconcile is due at
+	NextReconcileTime time.Time
+
+	// CANotAfter is the expiration time of the current CA certificate
+	CANotAfter time.Time
+
+	// CARotationTime is the time the CA certificate is due for rotation at
+	CARotationTime time.Time
+
+	// CertsRotationTime is the time the service certificates are due for
+	// rotation at
+	CertsRotationTime time.Time
+
+	// LastRotationTime is the time of the last certificates rotation
+	LastRotationTime time.Time
+
+	// LastRotationReason is the trigger of the last certificates rotation
+	LastRotationReason chain.RotationReason
+
+	// AdmissionCheckTime is the time the admission check last ran at, after
+	// a CA bundle injection
+	AdmissionCheckTime time.Time
+
+	// AdmissionCheckError is the error the admission check last failed with,
+	// nil if it succeeded
+	AdmissionCheckError error
+
+	// TrustDistributionTime is the time the trust distribution check last
+	// ran at, before activating service certificates issued by a new CA
+	TrustDistributionTime time.Time
+
+	// TrustDistributionError is the error the trust distribution check last
+	// failed with, nil if it succeeded
+	TrustDistributionError error
+
+	// Webhooks is the state of the webhook configurations as of the last CA
+	// bundle injection into them, by WebhookReference string
+	Webhooks map[string]WebhookStatus
+}
+
+// WebhookStatus is the state of a webhook configuration as of the last CA
+// bundle injection into it
+type WebhookStatus struct {
+	// Generation and ResourceVersion of the webhook configuration as last
+	// injected into, or found already injected, by the manager
+	Generation      int64
+	ResourceVersion string
+
+	// ExternallyModified is set if the webhook configuration generation
+	// advanced since the manager last injected into it, for instance because
+	// a GitOps tool reverted it. It is cleared once it is found unchanged.
+	ExternallyModified bool
+
+	// Error is the error the last CA bundle injection into the webhook
+	// configuration failed with, nil if it succeeded. It does not fail the
+	// injection into the other webhook configurations.
+	Error error
+}
+
+// LeafCertificate returns the current service certificate as of the last
+// successful reconcile, the one of the first service by name if the webhooks
+// are backed by more than one. It returns nil if there was no such
+// reconcile yet. The returned certificate is a copy owned by the caller.
+func (m *Manager) LeafCertificate() *x509.Certificate {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.leafCertificateCopy()
+}
+
+// leafCertificateCopy returns a copy of the current service certificate, the
+// status lock has to be held
+func (m *Manager) leafCertificateCopy() *x509.Certificate {
+	if m.leafCertificate == nil {
+		return nil
+	}
+	leafCertificate, err := x509.ParseCertificate(m.leafCertificate.Raw)
+	if err != nil {
+		return nil
+	}
+	return leafCertificate
+}
+
+// Status returns the state of the certificates handled by this manager
+func (m *Manager) Status() Status {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.statusCopy()
+}
+
+// statusAndLeafCertificate returns Status and LeafCertificate as of the same
+// reconcile
+func (m *Manager) statusAndLeafCertificate() (Status, *x509.Certificate) {
+	m.statusLock.RLock()
+	defer m.statusLock.RUnlock()
+	return m.statusCopy(), m.leafCertificateCopy()
+}
+
+// statusCopy returns a copy of the status, the status lock has to be held
+func (m *Manager) statusCopy() Status {
+	status := m.status
+	if m.status.Webhooks != nil {
+		status.Webhooks = make(map[string]WebhookStatus, len(m.status.Webhooks))
+		for reference, webhookStatus := range m.status.Webhooks {
+			status.Webhooks[reference] = webhookStatus
+		}
+	}
+	return status
+}
+
+// recordWebhookInjection records the generation and resource version of a
+// webhook configuration as injected, flagging it as externally modified if
+// its live generation advanced since the last injection.
+func (m *Manager) recordWebhookInjection(key *objectKey, live runtime.Object, injected client.Object) {
+	webhook, isWebhook := webhookReference(key)
+	if !isWebhook {
+		return
+	}
+	liveObject, ok := live.(client.Object)
+	if !ok || liveObject.GetResourceVersion() == "" {
+		return
+	}
+	reference := webhook.String()
+
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	if m.status.Webhooks == nil {
+		m.status.Webhooks = map[string]WebhookStatus{}
+	}
+	previous, recorded := m.status.Webhooks[reference]
+	m.status.Webhooks[reference] = WebhookStatus{
+		Generation:         injected.GetGeneration(),
+		ResourceVersion:    injected.GetResourceVersion(),
+		ExternallyModified: recorded && liveObject.GetGeneration() != previous.Generation,
+	}
+}
+
+// recordWebhookError records the error the CA bundle injection into a webhook
+// configuration failed with, keeping the state of its last injection.
+func (m *Manager) recordWebhookError(key *objectKey, err error) {
+	webhook, isWebhook := webhookReference(key)
+	if !isWebhook {
+		return
+	}
+	reference := webhook.String()
+
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	if m.status.Webhooks == nil {
+		m.status.Webhooks = map[string]WebhookStatus{}
+	}
+	webhookStatus := m.status.Webhooks[reference]
+	webhookStatus.Error = err
+	m.status.Webhooks[reference] = webhookStatus
+}
+
+// updateStatus records the state of a certificate chain after a successful
+// reconcile.
+func (m *Manager) updateStatus(certificateChain *chain.CertificateChainData, reconcileAt time.Time) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.status.LastReconcileTime = triple.Now().UTC()
+	m.status.NextReconcileTime = reconcileAt.UTC()
+	if certificateChain.RotationReason != "" {
+		m.status.LastRotationTime = m.status.LastReconcileTime
+		m.status.LastRotationReason = certificateChain.RotationReason
+	}
+	caCerts, err := triple.ParseCertsPEM(certificateChain.CA.CertPEM)
+	if err == nil {
+		m.status.CANotAfter = caCerts[len(caCerts)-1].NotAfter.UTC()
+	}
+	if len(certificateChain.CertificatesIssued) == 0 {
+		return
+	}
+	m.leafCertificate = firstLeafCertificate(certificateChain)
+	servingCertificate, err := firstServingCertificate(certificateChain)
+	if err != nil {
+		m.log.WithName("updateStatus").Error(err, "Failed loading serving certificate, keeping the previous one")
+	} else if servingCertificate != nil {
+		m.servingCertificate = servingCertificate
+	}
+	caDeadline, certsDeadline, err := chain.RotationDeadlines(&m.options, certificateChain)
+	if err == nil {
+		m.status.CARotationTime = caDeadline.UTC()
+		m.status.CertsRotationTime = certsDeadline.UTC()
+	}
+}
+
+// firstLeafCertificate returns the last certificate issued for the first
+// service by name, nil if it cannot be parsed.
+func firstLeafCertificate(certificateChain *chain.CertificateChainData) *x509.Certificate {
+	certs, err := triple.ParseCertsPEM(firstCertificateIssue(certificateChain).CertPEM)
+	if err != nil {
+		return nil
+	}
+	return certs[len(certs)-1]
+}
@@ -19,14 +19,17 @@ package triple
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	cryptorand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
-	"math"
+	"fmt"
 	"math/big"
 	"net"
 	"time"
@@ -37,11 +40,30 @@ import (
 )
 
 const (
-	rsaKeySize = 2048
+	// DefaultRSAKeySize is the size in bits of the RSA keys created by
+	// NewPrivateKey, and the minimum one
+	DefaultRSAKeySize = 2048
+
+	// DefaultSerialNumberBits is the bit length of the serial numbers of
+	// certificates if not configured, and the largest one: positive
+	// integers of that length fit the 20 octets maximum of RFC 5280 once
+	// DER encoded with their sign bit
+	DefaultSerialNumberBits = 159
+
+	// LegacySerialNumberBits is the smallest bit length of the serial
+	// numbers of certificates, for systems storing them as signed 64-bit
+	// integers
+	LegacySerialNumberBits = 63
+
+	// caExpirationSkew is the clock skew tolerated on CA expiration, CAs
+	// expiring within it are considered expired
+	caExpirationSkew = time.Minute
 )
 
 var (
-	Now = func() time.Time { return time.Now() }
+	// Now returns the current time in UTC, the same location certificate
+	// times are in
+	Now = func() time.Time { return time.Now().UTC() }
 )
 
 // Config contains the basic fields required for creating a certificate
@@ -50,6 +72,20 @@ type Config struct {
 	Organization []string
 	AltNames     AltNames
 	Usages       []x509.ExtKeyUsage
+
+	// PolicyIdentifiers, if any, are the certificate policy OIDs the
+	// certificate is tagged with
+	PolicyIdentifiers []asn1.ObjectIdentifier
+
+	// SerialNumberBits is the maximum bit length of the serial number of
+	// the certificate, a random positive integer, DefaultSerialNumberBits
+	// if not set.
+	SerialNumberBits int
+
+	// SerialNumber, if set, is the serial number of the certificate instead
+	// of a random one, for reproducible certificates. It has to be positive
+	// and at most DefaultSerialNumberBits long.
+	SerialNumber *big.Int
 }
 
 // AltNames contains the domain names and IP addresses that will be added
@@ -60,25 +96,156 @@ type AltNames struct {
 	IPs      []net.IP
 }
 
-// NewPrivateKey creates an RSA private key
+// KeyAlgorithm is the algorithm of a private key
+type KeyAlgorithm string
+
+const (
+	// KeyAlgorithmRSA is an RSA key, the default
+	KeyAlgorithmRSA KeyAlgorithm = "RSA"
+
+	// KeyAlgorithmECDSAP256 is an ECDSA key on the P-256 curve
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ECDSA-P256"
+
+	// KeyAlgorithmECDSAP384 is an ECDSA key on the P-384 curve
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ECDSA-P384"
+
+	// KeyAlgorithmEd25519 is an Ed25519 key
+	KeyAlgorithmEd25519 KeyAlgorithm = "Ed25519"
+)
+
+// KeyConfig contains the fields required for creating a private key
+type KeyConfig struct {
+	// Algorithm of the key, KeyAlgorithmRSA if not set
+	Algorithm KeyAlgorithm
+}
+
+// NewPrivateKey creates an RSA private key of DefaultRSAKeySize bits
 func NewPrivateKey() (*rsa.PrivateKey, error) {
-	return rsa.GenerateKey(cryptorand.Reader, rsaKeySize)
+	return NewPrivateKeyWithSize(DefaultRSAKeySize)
+}
+
+// NewPrivateKeyWithSize creates an RSA private key of the given size in bits
+func NewPrivateKeyWithSize(bits int) (*rsa.PrivateKey, error) {
+	err := ValidateRSAKeySize(bits)
+	if err != nil {
+		return nil, err
+	}
+	return rsa.GenerateKey(cryptorand.Reader, bits)
+}
+
+// ValidateRSAKeySize checks that an RSA key size is at least
+// DefaultRSAKeySize bits and a whole number of bytes
+func ValidateRSAKeySize(bits int) error {
+	if bits < DefaultRSAKeySize {
+		return errors.Errorf("RSA key size %d is below the minimum of %d bits", bits, DefaultRSAKeySize)
+	}
+	if bits%8 != 0 {
+		return errors.Errorf("RSA key size %d is not a multiple of 8 bits", bits)
+	}
+	return nil
+}
+
+// ValidateSerialNumberBits checks that a serial number bit length is between
+// LegacySerialNumberBits and DefaultSerialNumberBits
+func ValidateSerialNumberBits(bits int) error {
+	if bits < LegacySerialNumberBits || bits > DefaultSerialNumberBits {
+		return errors.Errorf("serial number bit length %d is not between %d and %d", bits, LegacySerialNumberBits, DefaultSerialNumberBits)
+	}
+	return nil
+}
+
+// newSerialNumber returns a random positive serial number at most bits long,
+// DefaultSerialNumberBits if not set.
+func newSerialNumber(bits int) (*big.Int, error) {
+	if bits == 0 {
+		bits = DefaultSerialNumberBits
+	}
+	err := ValidateSerialNumberBits(bits)
+	if err != nil {
+		return nil, err
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	serial, err := rand.Int(rand.Reader, limit.Sub(limit, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// serialNumberFor returns the serial number of cfg if set, a random one
+// otherwise
+func serialNumberFor(cfg Config) (*big.Int, error) {
+	if cfg.SerialNumber == nil {
+		return newSerialNumber(cfg.SerialNumberBits)
+	}
+	if cfg.SerialNumber.Sign() <= 0 || cfg.SerialNumber.BitLen() > DefaultSerialNumberBits {
+		return nil, errors.Errorf("serial number %s is not positive or longer than %d bits", cfg.SerialNumber, DefaultSerialNumberBits)
+	}
+	return new(big.Int).Set(cfg.SerialNumber), nil
+}
+
+// NewPrivateKeyWithConfig creates a private key with the algorithm of cfg
+func NewPrivateKeyWithConfig(cfg KeyConfig) (crypto.Signer, error) {
+	switch cfg.Algorithm {
+	case "", KeyAlgorithmRSA:
+		return NewPrivateKey()
+	case KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	case KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+	case KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(cryptorand.Reader)
+		return key, err
+	default:
+		return nil, errors.Errorf("unknown key algorithm %s", cfg.Algorithm)
+	}
+}
+
+// signatureAlgorithmFor returns the signature algorithm certificates signed
+// by key are issued with
+func signatureAlgorithmFor(key crypto.Signer) x509.SignatureAlgorithm {
+	switch publicKey := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if publicKey.Curve == elliptic.P384() {
+			return x509.ECDSAWithSHA384
+		}
+		return x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	default:
+		return x509.SHA256WithRSA
+	}
+}
+
+// keyUsageFor returns the key usage of certificates for key, key
+// encipherment only being possible with RSA keys
+func keyUsageFor(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.Public().(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
 }
 
 // NewSelfSignedCACert creates a CA certificate
 func NewSelfSignedCACert(cfg Config, key crypto.Signer, duration time.Duration) (*x509.Certificate, error) {
+	serial, err := serialNumberFor(cfg)
+	if err != nil {
+		return nil, err
+	}
 	now := Now()
 	tmpl := x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(0),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			CommonName:   cfg.CommonName,
 			Organization: cfg.Organization,
 		},
 		NotBefore:             now.UTC(),
 		NotAfter:              now.Add(duration).UTC(),
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              keyUsageFor(key) | x509.KeyUsageCertSign,
 		BasicConstraintsValid: true,
 		IsCA:                  true,
+		SignatureAlgorithm:    signatureAlgorithmFor(key),
+		PolicyIdentifiers:     cfg.PolicyIdentifiers,
 	}
 	certDERBytes, err := x509.CreateCertificate(cryptorand.Reader, &tmpl, &tmpl, key.Public(), key)
 	if err != nil {
@@ -89,7 +256,7 @@ func NewSelfSignedCACert(cfg Config, key crypto.Signer, duration time.Duration)
 
 // NewSignedCert creates a signed certificate using the given CA certificate and key
 func NewSignedCert(cfg Config, key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer, duration time.Duration) (*x509.Certificate, error) {
-	serial, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
+	serial, err := serialNumberFor(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +266,13 @@ func NewSignedCert(cfg Config, key crypto.Signer, caCert *x509.Certificate, caKe
 	if len(cfg.Usages) == 0 {
 		return nil, errors.New("must specify at least one ExtKeyUsage")
 	}
+	if !Now().Add(caExpirationSkew).Before(caCert.NotAfter) {
+		return nil, errors.Errorf("CA certificate %s expired at %s, it has to be rotated first", caCert.Subject.CommonName, caCert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	subjectKeyID, err := newSubjectKeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
 
 	certTmpl := x509.Certificate{
 		Subject: pkix.Name{
@@ -110,8 +284,14 @@ func NewSignedCert(cfg Config, key crypto.Signer, caCert *x509.Certificate, caKe
 		SerialNumber: serial,
 		NotBefore:    caCert.NotBefore,
 		NotAfter:     Now().Add(duration).UTC(),
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:     keyUsageFor(key),
 		ExtKeyUsage:  cfg.Usages,
+		// CAs get a subject key id generated, but not the rest of
+		// certificates
+		SubjectKeyId:       subjectKeyID,
+		AuthorityKeyId:     caCert.SubjectKeyId,
+		SignatureAlgorithm: signatureAlgorithmFor(caKey),
+		PolicyIdentifiers:  cfg.PolicyIdentifiers,
 	}
 
 	certDERBytes, err := x509.CreateCertificate(cryptorand.Reader, &certTmpl, caCert, key.Public(), caKey)
@@ -121,7 +301,28 @@ func NewSignedCert(cfg Config, key crypto.Signer, caCert *x509.Certificate, caKe
 	return x509.ParseCertificate(certDERBytes)
 }
 
-// MakeEllipticPrivateKeyPEM creates an ECDSA private key
+// newSubjectKeyID generates a subject key identifier as described by method
+// (1) of RFC 5280 section 4.2.1.2: the SHA-1 hash of the subject public key
+// bit string.
+func newSubjectKeyID(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	var subjectPublicKeyInfo struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(der, &subjectPublicKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	subjectKeyID := sha1.Sum(subjectPublicKeyInfo.SubjectPublicKey.Bytes)
+	return subjectKeyID[:], nil
+}
+
+// MakeEllipticPrivateKeyPEM creates an ECDSA private key, PEM encoded. It can
+// be parsed with ParseSignerPEM to sign certificates.
 func MakeEllipticPrivateKeyPEM() ([]byte, error) {
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
 	if err != nil {
@@ -140,6 +341,19 @@ func MakeEllipticPrivateKeyPEM() ([]byte, error) {
 	return pem.EncodeToMemory(privateKeyPemBlock), nil
 }
 
+// VerifyKeyPair checks that the public key of the certificate corresponds
+// to the private key
+func VerifyKeyPair(cert *x509.Certificate, key crypto.Signer) error {
+	publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	if !publicKey.Equal(cert.PublicKey) {
+		return errors.New("certificate public key does not match private key")
+	}
+	return nil
+}
+
 func ipsToStrings(ips []net.IP) []string {
 	ss := make([]string, 0, len(ips))
 	for _, ip := range ips {
@@ -148,35 +362,271 @@ func ipsToStrings(ips []net.IP) []string {
 	return ss
 }
 
+// HostnameVerification selects the hostnames a certificate is verified for
+type HostnameVerification string
+
+const (
+	// VerifyFirstDNSName verifies the certificate for its first DNS name,
+	// or for its first IP address if it has no DNS names, or only its trust
+	// chain if it has neither
+	VerifyFirstDNSName HostnameVerification = "FirstDNSName"
+
+	// VerifyDNSName verifies the certificate for VerifyOptions DNSName
+	VerifyDNSName HostnameVerification = "DNSName"
+
+	// VerifyAllSANs verifies the certificate for each one of its DNS names
+	// and IP addresses
+	VerifyAllSANs HostnameVerification = "AllSANs"
+
+	// VerifyChainOnly verifies only the certificate trust chain, ignoring
+	// hostnames
+	VerifyChainOnly HostnameVerification = "ChainOnly"
+)
+
+// VerifyOptions customizes VerifyTLSWithOptions
+type VerifyOptions struct {
+	// Hostnames selects the hostnames to verify the certificate for, if not
+	// set it will default to VerifyFirstDNSName
+	Hostnames HostnameVerification
+
+	// DNSName is the name to verify the certificate for with VerifyDNSName
+	DNSName string
+}
+
+// VerifyFailureReason classifies why a certificate failed verification
+type VerifyFailureReason string
+
+const (
+	// VerifyFailureMissingIntermediate the issuer of the certificate is
+	// neither at the CA bundle nor at the certificate chain
+	VerifyFailureMissingIntermediate VerifyFailureReason = "MissingIntermediate"
+
+	// VerifyFailureUnknownAuthority the issuer of the certificate is present
+	// but it does not chain up to the CA bundle
+	VerifyFailureUnknownAuthority VerifyFailureReason = "UnknownAuthority"
+
+	// VerifyFailureExpired the certificate, or one of its issuers, is
+	// expired or not yet valid
+	VerifyFailureExpired VerifyFailureReason = "Expired"
+
+	// VerifyFailureNameMismatch the certificate is not valid for the
+	// verified hostname
+	VerifyFailureNameMismatch VerifyFailureReason = "NameMismatch"
+
+	// VerifyFailureInvalid the certificate is invalid for any other reason
+	VerifyFailureInvalid VerifyFailureReason = "Invalid"
+)
+
+// VerifyError is returned, wrapped, by VerifyTLSWithOptions when the
+// certificate fails verification against the CA bundle.
+type VerifyError struct {
+	Reason VerifyFailureReason
+	Err    error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// newVerifyError classifies the x509 verification error of the first of
+// certs with the given CA bundle certificates.
+func newVerifyError(err error, certs, caCerts []*x509.Certificate) *VerifyError {
+	switch verifyErr := err.(type) {
+	case x509.UnknownAuthorityError:
+		issuers := append(append([]*x509.Certificate{}, caCerts...), certs[1:]...)
+		for _, issuer := range issuers {
+			if certs[0].CheckSignatureFrom(issuer) == nil {
+				return &VerifyError{Reason: VerifyFailureUnknownAuthority, Err: err}
+			}
+		}
+		return &VerifyError{Reason: VerifyFailureMissingIntermediate, Err: err}
+	case x509.CertificateInvalidError:
+		if verifyErr.Reason == x509.Expired {
+			return &VerifyError{Reason: VerifyFailureExpired, Err: err}
+		}
+	case x509.HostnameError:
+		return &VerifyError{Reason: VerifyFailureNameMismatch, Err: err}
+	}
+	return &VerifyError{Reason: VerifyFailureInvalid, Err: err}
+}
+
+// VerifyTLS verifies the certificate for its first DNS name, or its first IP
+// address if it has no DNS names, with the CA bundle.
 func VerifyTLS(certsPEM, keyPEM, caBundle []byte) error {
-	logger := logf.Log.WithName("VerifyTLS")
+	return VerifyTLSWithOptions(certsPEM, keyPEM, caBundle, VerifyOptions{})
+}
+
+// VerifyTLSWithOptions verifies the certificate with the CA bundle for the
+// hostnames selected by opts, through the intermediate CA certificates
+// following it at certsPEM if any. It fails with the first property failed
+// by VerifyTLSDetailed, verification failures wrap a *VerifyError telling why
+// the certificate failed.
+func VerifyTLSWithOptions(certsPEM, keyPEM, caBundle []byte, opts VerifyOptions) error {
+	err := VerifyTLSDetailed(certsPEM, keyPEM, caBundle, opts).Err()
+	if err != nil {
+		return err
+	}
+	logf.Log.WithName("VerifyTLS").Info("TLS certificates chain verified")
+	return nil
+}
+
+// intermediatesPool returns the certificates following the leaf one, the
+// intermediate CAs the chain is built through up to the CA bundle.
+// Certificates that are not CAs are kept too since chain building skips
+// them.
+func intermediatesPool(certs []*x509.Certificate) *x509.CertPool {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return intermediates
+}
+
+// verifyDNSNames returns the names to verify a certificate for as selected
+// by opts, an empty name standing for no hostname verification. It returns at
+// least one name so that the chain is always verified.
+func verifyDNSNames(cert *x509.Certificate, opts VerifyOptions) ([]string, error) {
+	var dnsNames []string
+	switch opts.Hostnames {
+	case "", VerifyFirstDNSName:
+		switch {
+		case len(cert.DNSNames) > 0:
+			dnsNames = []string{cert.DNSNames[0]}
+		case len(cert.IPAddresses) > 0:
+			dnsNames = []string{cert.IPAddresses[0].String()}
+		default:
+			dnsNames = []string{""}
+		}
+	case VerifyDNSName:
+		if opts.DNSName == "" {
+			return nil, errors.Errorf("hostname verification %s requires a DNS name", VerifyDNSName)
+		}
+		dnsNames = []string{opts.DNSName}
+	case VerifyAllSANs:
+		dnsNames = append(dnsNames, cert.DNSNames...)
+		dnsNames = append(dnsNames, ipsToStrings(cert.IPAddresses)...)
+		if len(dnsNames) == 0 {
+			// the chain is verified even if there are no SANs to verify
+			dnsNames = []string{""}
+		}
+	case VerifyChainOnly:
+		dnsNames = []string{""}
+	default:
+		return nil, errors.Errorf("unknown hostname verification %s", opts.Hostnames)
+	}
+	return dnsNames, nil
+}
+
+// VerifyCheck is the result of a property checked by VerifyTLSDetailed, it
+// passed if Err is nil.
+type VerifyCheck struct {
+	Err error
+}
+
+// Passed returns whether the property check passed
+func (c VerifyCheck) Passed() bool {
+	return c.Err == nil
+}
+
+// VerifyResult describes every property checked by VerifyTLSDetailed.
+// Properties depending on failed ones are failed as not checked.
+type VerifyResult struct {
+	// KeyParsed the private key is parsed
+	KeyParsed VerifyCheck
+	// CertsParsed the certificates are parsed
+	CertsParsed VerifyCheck
+	// CAParsed the CA bundle is parsed
+	CAParsed VerifyCheck
+	// ValidityWindow the current time is within the certificate validity
+	ValidityWindow VerifyCheck
+	// ChainBuilt the certificate chains up to the CA bundle
+	ChainBuilt VerifyCheck
+	// HostnameMatched the certificate is valid for the verified hostnames
+	HostnameMatched VerifyCheck
+}
+
+// Err returns the error of the first failed property, if any
+func (r VerifyResult) Err() error {
+	for _, check := range []VerifyCheck{r.KeyParsed, r.CertsParsed, r.CAParsed, r.ValidityWindow, r.ChainBuilt, r.HostnameMatched} {
+		if !check.Passed() {
+			return check.Err
+		}
+	}
+	return nil
+}
+
+// VerifyTLSDetailed checks the properties VerifyTLSWithOptions verifies but
+// instead of stopping at the first failure it reports each of them, for
+// diagnostics.
+func VerifyTLSDetailed(certsPEM, keyPEM, caBundle []byte, opts VerifyOptions) VerifyResult {
+	result := VerifyResult{}
 
 	_, err := ParsePrivateKeyPEM(keyPEM)
 	if err != nil {
-		return errors.Wrap(err, "failed parsing PEM TLS key")
+		result.KeyParsed.Err = errors.Wrap(err, "failed parsing PEM TLS key")
 	}
 
 	certs, err := ParseCertsPEM(certsPEM)
 	if err != nil {
-		return errors.Wrap(err, "failed parsing PEM TLS certs")
+		result.CertsParsed.Err = errors.Wrap(err, "failed parsing PEM TLS certs")
 	}
 
 	cas := x509.NewCertPool()
-	ok := cas.AppendCertsFromPEM([]byte(caBundle))
-	if !ok {
-		return errors.New("failed to parse CA bundle")
+	if !cas.AppendCertsFromPEM(caBundle) {
+		result.CAParsed.Err = errors.New("failed to parse CA bundle")
 	}
 
-	opts := x509.VerifyOptions{
-		Roots:       cas,
-		DNSName:     certs[0].DNSNames[0],
-		CurrentTime: Now(),
+	if !result.CertsParsed.Passed() {
+		notChecked := errors.New("not checked, failed parsing PEM TLS certs")
+		result.ValidityWindow.Err = notChecked
+		result.ChainBuilt.Err = notChecked
+		result.HostnameMatched.Err = notChecked
+		return result
 	}
+	cert := certs[0]
 
-	if _, err := certs[0].Verify(opts); err != nil {
-		return errors.Wrap(err, "failed to verify certificate")
+	// Check the chain at a time the certificate is valid at so that an
+	// expired certificate is only reported as out of its validity window
+	now := Now()
+	chainTime := now
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		result.ValidityWindow.Err = errors.Wrap(&VerifyError{
+			Reason: VerifyFailureExpired,
+			Err: errors.Errorf("current time %s is out of the certificate validity from %s to %s",
+				now.UTC().Format(time.RFC3339), cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339)),
+		}, "failed to verify certificate")
+		chainTime = cert.NotBefore
 	}
 
-	logger.Info("TLS certificates chain verified")
-	return nil
+	if result.CAParsed.Passed() {
+		_, err = cert.Verify(x509.VerifyOptions{Roots: cas, Intermediates: intermediatesPool(certs), CurrentTime: chainTime})
+		if err != nil {
+			caCerts, _ := ParseCertsPEM(caBundle)
+			result.ChainBuilt.Err = errors.Wrap(newVerifyError(err, certs, caCerts), "failed to verify certificate")
+		}
+	} else {
+		result.ChainBuilt.Err = errors.New("not checked, failed to parse CA bundle")
+	}
+
+	dnsNames, err := verifyDNSNames(cert, opts)
+	if err != nil {
+		result.HostnameMatched.Err = err
+		return result
+	}
+	for _, dnsName := range dnsNames {
+		if dnsName == "" {
+			continue
+		}
+		err = cert.VerifyHostname(dnsName)
+		if err != nil {
+			result.HostnameMatched.Err = errors.Wrap(&VerifyError{Reason: VerifyFailureNameMismatch, Err: err}, "failed to verify certificate hostname")
+			break
+		}
+	}
+
+	return result
 }
@@ -0,0 +1,141 @@
+package triple
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// FixtureCACertFile is the file WriteFixtures writes the CA certificate to
+	FixtureCACertFile = "ca.crt"
+
+	// FixtureCertFile is the file WriteFixtures writes the server certificate to
+	FixtureCertFile = "tls.crt"
+
+	// FixtureKeyFile is the file WriteFixtures writes the server key to
+	FixtureKeyFile = "tls.key"
+
+	// FixtureKubeconfigFile is the file WriteFixtures writes the kubeconfig
+	// CA snippet to
+	FixtureKubeconfigFile = "kubeconfig"
+)
+
+type fixtureFile struct {
+	name string
+	data []byte
+	perm os.FileMode
+}
+
+// FixturesConfig configures the certificates written by WriteFixtures
+type FixturesConfig struct {
+	// CAName is the CommonName of the CA certificate
+	CAName string
+
+	// CommonName, IPs and Hostnames of the server certificate
+	CommonName string
+	IPs        []string
+	Hostnames  []string
+
+	// Duration is the validity of the CA and server certificates, starting
+	// at Now
+	Duration time.Duration
+
+	// KubeconfigServer, if set, also writes a kubeconfig with a cluster
+	// pointing to this server URL and trusting the CA certificate
+	KubeconfigServer string
+
+	// CAKey and Key, if set, are the keys of the CA and server certificates
+	// instead of new RSA ones of DefaultRSAKeySize bits
+	CAKey crypto.Signer
+	Key   crypto.Signer
+
+	// CASerialNumber and SerialNumber, if set, are the serial numbers of the
+	// CA and server certificates instead of random ones
+	CASerialNumber *big.Int
+	SerialNumber   *big.Int
+}
+
+// WriteFixtures writes to dir, creating it if needed, a CA certificate and a
+// server key pair issued by it as FixtureCACertFile, FixtureCertFile and
+// FixtureKeyFile, for integration tests. Certificates are issued at Now;
+// overriding it and setting the keys and serial numbers of cfg makes the
+// fixtures reproducible byte for byte, as golden files, with RSA or Ed25519
+// keys since ECDSA signatures are randomized.
+func WriteFixtures(dir string, cfg FixturesConfig) error {
+	caKey := cfg.CAKey
+	if caKey == nil {
+		var err error
+		caKey, err = NewPrivateKey()
+		if err != nil {
+			return fmt.Errorf("unable to create fixtures CA key: %v", err)
+		}
+	}
+	ca, err := NewCAWithConfig(Config{CommonName: cfg.CAName, SerialNumber: cfg.CASerialNumber}, caKey, cfg.Duration)
+	if err != nil {
+		return fmt.Errorf("unable to create fixtures CA: %v", err)
+	}
+
+	key := cfg.Key
+	if key == nil {
+		key, err = NewPrivateKey()
+		if err != nil {
+			return fmt.Errorf("unable to create fixtures server key: %v", err)
+		}
+	}
+	server, err := NewServerKeyPairWithConfig(ca, key, Config{
+		CommonName:   cfg.CommonName,
+		Usages:       []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		SerialNumber: cfg.SerialNumber,
+	}, cfg.IPs, cfg.Hostnames, cfg.Duration)
+	if err != nil {
+		return fmt.Errorf("unable to create fixtures server key pair: %v", err)
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create fixtures directory: %v", err)
+	}
+
+	keyPEM, err := EncodeSignerPEM(server.Key)
+	if err != nil {
+		return fmt.Errorf("unable to encode fixtures server key: %v", err)
+	}
+
+	caPEM := EncodeCertPEM(ca.Cert)
+	files := []fixtureFile{
+		{FixtureCACertFile, caPEM, 0644},
+		{FixtureCertFile, EncodeCertPEM(server.Cert), 0644},
+		{FixtureKeyFile, keyPEM, 0600},
+	}
+	if cfg.KubeconfigServer != "" {
+		files = append(files, fixtureFile{FixtureKubeconfigFile, kubeconfigCASnippet(cfg.CAName, cfg.KubeconfigServer, caPEM), 0644})
+	}
+
+	for _, file := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, file.name), file.data, file.perm)
+		if err != nil {
+			return fmt.Errorf("unable to write fixture %s: %v", file.name, err)
+		}
+	}
+	return nil
+}
+
+// kubeconfigCASnippet returns a kubeconfig with a single cluster named name
+// at server trusting caPEM
+func kubeconfigCASnippet(name, server string, caPEM []byte) []byte {
+	return []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: %s
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+`, name, server, base64.StdEncoding.EncodeToString(caPEM)))
+}
@@ -17,12 +17,15 @@ limitations under the License.
 package triple
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -62,6 +65,29 @@ func EncodePrivateKeyPEM(key *rsa.PrivateKey) []byte {
 	return pem.EncodeToMemory(&block)
 }
 
+// EncodeSignerPEM returns PEM-encoded private key data of an RSA, ECDSA or
+// Ed25519 private key
+func EncodeSignerPEM(key crypto.Signer) ([]byte, error) {
+	switch privateKey := key.(type) {
+	case *rsa.PrivateKey:
+		return EncodePrivateKeyPEM(privateKey), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: ECPrivateKeyBlockType, Bytes: der}), nil
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: PrivateKeyBlockType, Bytes: der}), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+}
+
 // EncodeCertPEM returns PEM-endcoded certificate data
 func EncodeCertPEM(cert *x509.Certificate) []byte {
 	block := pem.Block{
@@ -71,7 +97,8 @@ func EncodeCertPEM(cert *x509.Certificate) []byte {
 	return pem.EncodeToMemory(&block)
 }
 
-// EncodeCertsPEM returns PEM-endcoded certificates data
+// EncodeCertsPEM returns PEM-endcoded certificates data as a bundle of
+// canonical headerless blocks with LF line endings
 func EncodeCertsPEM(certs []*x509.Certificate) []byte {
 	certsPEM := []byte{}
 	for _, cert := range certs {
@@ -103,7 +130,7 @@ func ParsePrivateKeyPEM(keyData []byte) (interface{}, error) {
 				return key, nil
 			}
 		case PrivateKeyBlockType:
-			// RSA or ECDSA Private Key in unencrypted PKCS#8 format
+			// RSA, ECDSA or Ed25519 Private Key in unencrypted PKCS#8 format
 			if key, err := x509.ParsePKCS8PrivateKey(privateKeyPemBlock.Bytes); err == nil {
 				return key, nil
 			}
@@ -114,7 +141,23 @@ func ParsePrivateKeyPEM(keyData []byte) (interface{}, error) {
 	}
 
 	// we read all the PEM blocks and didn't recognize one
-	return nil, fmt.Errorf("data does not contain a valid RSA or ECDSA private key")
+	return nil, fmt.Errorf("data does not contain a valid RSA, ECDSA or Ed25519 private key")
+}
+
+// ParseSignerPEM returns the private key parsed from a PEM block in the
+// supplied data as a crypto.Signer, so that keys encoded by EncodeSignerPEM
+// or MakeEllipticPrivateKeyPEM can sign certificates with NewSelfSignedCACert
+// and NewSignedCert.
+func ParseSignerPEM(keyData []byte) (crypto.Signer, error) {
+	key, err := ParsePrivateKeyPEM(keyData)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T cannot sign", key)
+	}
+	return signer, nil
 }
 
 // ParsePublicKeysPEM is a helper function for reading an array of rsa.PublicKey or ecdsa.PublicKey from a PEM-encoded byte array.
@@ -188,6 +231,67 @@ func ParseCertsPEM(pemCerts []byte) ([]*x509.Certificate, error) {
 	return certs, nil
 }
 
+// PEMBlockTypeError is returned when a PEM block is not of any of the
+// expected types.
+type PEMBlockTypeError struct {
+	Expected []string
+	Got      string
+}
+
+func (e *PEMBlockTypeError) Error() string {
+	if len(e.Expected) == 1 {
+		return fmt.Sprintf("expected %s PEM block, got %s", e.Expected[0], e.Got)
+	}
+	return fmt.Sprintf("expected one of %s PEM blocks, got %s", strings.Join(e.Expected, ", "), e.Got)
+}
+
+// ValidatePEMBlockType checks that the given PEM-encoded byte array is made
+// of blocks of any of the expected types, like CertificateBlockType, and
+// returns a *PEMBlockTypeError for the first block that is not.
+func ValidatePEMBlockType(data []byte, expected ...string) error {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		found = true
+		if !containsBlockType(expected, block.Type) {
+			return &PEMBlockTypeError{Expected: expected, Got: block.Type}
+		}
+	}
+	if !found {
+		return errors.New("data does not contain any PEM block")
+	}
+	return nil
+}
+
+// ContainsPrivateKeyPEM returns true if the given PEM-encoded byte array has
+// any private key block, of any of the private key types or encrypted,
+// anywhere in it.
+func ContainsPrivateKeyPEM(data []byte) bool {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return false
+		}
+		if strings.HasSuffix(block.Type, PrivateKeyBlockType) {
+			return true
+		}
+	}
+}
+
+func containsBlockType(blockTypes []string, blockType string) bool {
+	for _, t := range blockTypes {
+		if t == blockType {
+			return true
+		}
+	}
+	return false
+}
+
 func AddCertToPEM(cert *x509.Certificate, pemCerts []byte) ([]byte, error) {
 	certs := []*x509.Certificate{}
 	if len(pemCerts) > 0 {
@@ -16,28 +16,34 @@ limitations under the License.
 package triple
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"fmt"
 	"net"
 	"time"
 )
 
+// KeyPair is a certificate and its private key, an RSA, ECDSA or Ed25519
+// one
 type KeyPair struct {
-	Key  *rsa.PrivateKey
+	Key  crypto.Signer
 	Cert *x509.Certificate
 }
 
+// NewCA creates a CA with an RSA key of DefaultRSAKeySize bits
 func NewCA(name string, duration time.Duration) (*KeyPair, error) {
 	key, err := NewPrivateKey()
 	if err != nil {
 		return nil, fmt.Errorf("unable to create a private key for a new CA: %v", err)
 	}
 
-	config := Config{
-		CommonName: name,
-	}
+	return NewCAWithConfig(Config{CommonName: name}, key, duration)
+}
 
+// NewCAWithConfig creates a CA with an existing key, for instance to extend
+// the validity of a CA keeping its public key, named after the CommonName of
+// config and with its serial number size
+func NewCAWithConfig(config Config, key crypto.Signer, duration time.Duration) (*KeyPair, error) {
 	cert, err := NewSelfSignedCACert(config, key, duration)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create a self-signed certificate for a new CA: %v", err)
@@ -48,12 +54,24 @@ func NewCA(name string, duration time.Duration) (*KeyPair, error) {
 	}, nil
 }
 
+// NewServerKeyPair issues a server key pair for ips and hostnames with an RSA
+// key of DefaultRSAKeySize bits
 func NewServerKeyPair(ca *KeyPair, commonName string, ips, hostnames []string, duration time.Duration) (*KeyPair, error) {
 	key, err := NewPrivateKey()
 	if err != nil {
 		return nil, fmt.Errorf("unable to create a server private key: %v", err)
 	}
 
+	return NewServerKeyPairWithConfig(ca, key, Config{
+		CommonName: commonName,
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ips, hostnames, duration)
+}
+
+// NewServerKeyPairWithConfig issues a server key pair for ips and hostnames
+// with an existing key and the CommonName, extended key usages, policy
+// identifiers and serial number size of config
+func NewServerKeyPairWithConfig(ca *KeyPair, key crypto.Signer, config Config, ips, hostnames []string, duration time.Duration) (*KeyPair, error) {
 	altNames := AltNames{}
 	for _, ipStr := range ips {
 		ip := net.ParseIP(ipStr)
@@ -63,11 +81,7 @@ func NewServerKeyPair(ca *KeyPair, commonName string, ips, hostnames []string, d
 	}
 	altNames.DNSNames = append(altNames.DNSNames, hostnames...)
 
-	config := Config{
-		CommonName: commonName,
-		AltNames:   altNames,
-		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-	}
+	config.AltNames = altNames
 	cert, err := NewSignedCert(config, key, ca.Cert, ca.Key, duration)
 	if err != nil {
 		return nil, fmt.Errorf("unable to sign the server certificate: %v", err)
@@ -1,10 +1,23 @@
 package triple
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
@@ -31,7 +44,8 @@ var _ = Describe("Cert library", func() {
 
 			Expect(privateKey).ToNot(BeNil(), "should generate a private key")
 			Expect(caCert).ToNot(BeNil(), "should generate a CA certificate")
-			Expect(caCert.SerialNumber.Int64()).To(Equal(int64(0)), "should have zero as serial number")
+			Expect(caCert.SerialNumber.Sign()).To(Equal(1), "should have a positive serial number")
+			Expect(caCert.SerialNumber.BitLen()).To(BeNumerically("<=", DefaultSerialNumberBits), "should have a serial number of the default bit length")
 			Expect(caCert.Subject.CommonName).To(Equal(name), "should take CommonName from name field")
 			Expect(caCert.NotBefore).To(BeTemporally("~", now.UTC(), time.Second), "should set NotBefore to now")
 			Expect(caCert.NotAfter).To(BeTemporally("~", now.Add(duration).UTC(), time.Second), "should  set NotAfter to now + duration")
@@ -42,4 +56,792 @@ var _ = Describe("Cert library", func() {
 		})
 
 	})
+	DescribeTable("when generating certificates with a serial number size",
+		func(bits int, expectedBits int) {
+			key, err := NewPrivateKey()
+			Expect(err).To(Succeed(), "should succeed generating key")
+			ca, err := NewCAWithConfig(Config{CommonName: "foo-ca", SerialNumberBits: bits}, key, time.Hour)
+			Expect(err).To(Succeed(), "should succeed generating CA")
+			server, err := NewServerKeyPairWithConfig(ca, key, Config{
+				CommonName:       "foo",
+				Usages:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				SerialNumberBits: bits,
+			}, nil, []string{"foo"}, time.Hour)
+			Expect(err).To(Succeed(), "should succeed generating server key pair")
+			for _, cert := range []*x509.Certificate{ca.Cert, server.Cert} {
+				Expect(cert.SerialNumber.Sign()).To(Equal(1), "should have a positive serial number")
+				Expect(cert.SerialNumber.BitLen()).To(BeNumerically("<=", expectedBits), "should have a serial number within the bit length")
+				der, err := asn1.Marshal(cert.SerialNumber)
+				Expect(err).To(Succeed(), "should succeed encoding the serial number")
+				Expect(len(der)-2).To(BeNumerically("<=", 20), "should encode the serial number within the 20 octets of RFC 5280")
+			}
+		},
+		Entry("not set should default to 159 bits", 0, DefaultSerialNumberBits),
+		Entry("159 bits", 159, 159),
+		Entry("100 bits", 100, 100),
+		Entry("legacy 63 bits", LegacySerialNumberBits, 63),
+	)
+	DescribeTable("when validating a serial number size",
+		func(bits int, isValid bool) {
+			err := ValidateSerialNumberBits(bits)
+			if isValid {
+				Expect(err).To(Succeed(), "should be valid")
+			} else {
+				Expect(err).To(HaveOccurred(), "should be invalid")
+			}
+		},
+		Entry("63 bits should be valid", 63, true),
+		Entry("100 bits should be valid", 100, true),
+		Entry("159 bits should be valid", 159, true),
+		Entry("62 bits should be invalid", 62, false),
+		Entry("160 bits should be invalid", 160, false),
+	)
+	Context("when PEM data is encoded", func() {
+		var (
+			ca     *KeyPair
+			server *KeyPair
+		)
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+			server, err = NewServerKeyPair(ca, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+		})
+		It("should use canonical headerless blocks with LF line endings", func() {
+			pems := map[string][]byte{
+				"CA bundle":   EncodeCertsPEM([]*x509.Certificate{ca.Cert, ca.Cert}),
+				"certificate": EncodeCertPEM(server.Cert),
+				"private key": EncodePrivateKeyPEM(server.Key.(*rsa.PrivateKey)),
+			}
+			for name, data := range pems {
+				Expect(data).ToNot(ContainSubstring("\r"), "%s should not contain CR line endings", name)
+				Expect(data).To(HaveSuffix("\n"), "%s should end with a LF", name)
+				canonical := []byte{}
+				rest := data
+				for len(rest) > 0 {
+					var block *pem.Block
+					block, rest = pem.Decode(rest)
+					Expect(block).ToNot(BeNil(), "%s should only contain PEM blocks", name)
+					Expect(block.Headers).To(BeEmpty(), "%s should not contain PEM headers", name)
+					canonical = append(canonical, pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: block.Bytes})...)
+				}
+				Expect(bytes.Equal(data, canonical)).To(BeTrue(), "%s should be canonically encoded", name)
+			}
+		})
+	})
+	Context("when PEM block types are validated", func() {
+		var (
+			ca *KeyPair
+		)
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+		})
+		type validatePEMBlockTypeCase struct {
+			data          func() []byte
+			expected      []string
+			expectedError string
+		}
+		DescribeTable("ValidatePEMBlockType",
+			func(c validatePEMBlockTypeCase) {
+				err := ValidatePEMBlockType(c.data(), c.expected...)
+				if c.expectedError == "" {
+					Expect(err).ToNot(HaveOccurred(), "should match the expected block type")
+					return
+				}
+				Expect(err).To(MatchError(c.expectedError), "should fail with the block type mismatch")
+			},
+			Entry("certificate as certificate", validatePEMBlockTypeCase{
+				data:     func() []byte { return EncodeCertsPEM([]*x509.Certificate{ca.Cert, ca.Cert}) },
+				expected: []string{CertificateBlockType},
+			}),
+			Entry("private key as any private key", validatePEMBlockTypeCase{
+				data:     func() []byte { return EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey)) },
+				expected: []string{ECPrivateKeyBlockType, RSAPrivateKeyBlockType, PrivateKeyBlockType},
+			}),
+			Entry("private key as certificate", validatePEMBlockTypeCase{
+				data:          func() []byte { return EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey)) },
+				expected:      []string{CertificateBlockType},
+				expectedError: "expected CERTIFICATE PEM block, got RSA PRIVATE KEY",
+			}),
+			Entry("certificate followed by a private key as certificate", validatePEMBlockTypeCase{
+				data: func() []byte {
+					return append(EncodeCertPEM(ca.Cert), EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey))...)
+				},
+				expected:      []string{CertificateBlockType},
+				expectedError: "expected CERTIFICATE PEM block, got RSA PRIVATE KEY",
+			}),
+			Entry("certificate as any private key", validatePEMBlockTypeCase{
+				data:          func() []byte { return EncodeCertPEM(ca.Cert) },
+				expected:      []string{RSAPrivateKeyBlockType, PrivateKeyBlockType},
+				expectedError: "expected one of RSA PRIVATE KEY, PRIVATE KEY PEM blocks, got CERTIFICATE",
+			}),
+			Entry("non PEM data", validatePEMBlockTypeCase{
+				data:          func() []byte { return []byte("This is not PEM") },
+				expected:      []string{CertificateBlockType},
+				expectedError: "data does not contain any PEM block",
+			}),
+		)
+		DescribeTable("ContainsPrivateKeyPEM",
+			func(data func() []byte, expected bool) {
+				Expect(ContainsPrivateKeyPEM(data())).To(Equal(expected), "should detect private key blocks")
+			},
+			Entry("certificates", func() []byte { return EncodeCertsPEM([]*x509.Certificate{ca.Cert, ca.Cert}) }, false),
+			Entry("RSA private key", func() []byte { return EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey)) }, true),
+			Entry("certificate followed by a private key", func() []byte {
+				return append(EncodeCertPEM(ca.Cert), EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey))...)
+			}, true),
+			Entry("private key after non PEM data", func() []byte {
+				return append([]byte("This is not PEM\n"), EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey))...)
+			}, true),
+			Entry("encrypted private key", func() []byte {
+				return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("foo")})
+			}, true),
+			Entry("non PEM data", func() []byte { return []byte("This is not PEM") }, false),
+		)
+		It("should return a typed error on mismatch", func() {
+			err := ValidatePEMBlockType(EncodePrivateKeyPEM(ca.Key.(*rsa.PrivateKey)), CertificateBlockType)
+			blockTypeErr, ok := err.(*PEMBlockTypeError)
+			Expect(ok).To(BeTrue(), "should return a PEMBlockTypeError")
+			Expect(blockTypeErr.Got).To(Equal(RSAPrivateKeyBlockType), "should report the found block type")
+		})
+	})
+
+	Context("when VerifyKeyPair is called", func() {
+		var (
+			ca *KeyPair
+		)
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+		})
+		It("should succeed with the certificate's own key", func() {
+			Expect(VerifyKeyPair(ca.Cert, ca.Key)).To(Succeed(), "should match certificate and key")
+		})
+		It("should fail with an unrelated key", func() {
+			key, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating a private key")
+			Expect(VerifyKeyPair(ca.Cert, key)).ToNot(Succeed(), "should not match certificate and key")
+		})
+	})
+	Context("when NewServerKeyPair is called", func() {
+		var (
+			ca     *KeyPair
+			server *KeyPair
+		)
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+			server, err = NewServerKeyPair(ca, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+		})
+		It("should link the certificate to the CA with key identifiers", func() {
+			Expect(server.Cert.SubjectKeyId).ToNot(BeEmpty(), "should include a SKI")
+			Expect(server.Cert.SubjectKeyId).ToNot(Equal(ca.Cert.SubjectKeyId), "should have its own SKI")
+			Expect(server.Cert.AuthorityKeyId).To(Equal(ca.Cert.SubjectKeyId), "should have the CA SKI as AKI")
+		})
+	})
+
+	Context("when NewPrivateKeyWithSize is called", func() {
+		DescribeTable("should generate a key of the requested size",
+			func(bits int) {
+				key, err := NewPrivateKeyWithSize(bits)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating the key")
+				Expect(key.N.BitLen()).To(Equal(bits), "should generate a key of the requested size")
+			},
+			Entry("2048 bits", 2048),
+			Entry("3072 bits", 3072),
+			Entry("4096 bits", 4096),
+		)
+		DescribeTable("should refuse an invalid size",
+			func(bits int) {
+				_, err := NewPrivateKeyWithSize(bits)
+				Expect(err).To(HaveOccurred(), "should fail generating the key")
+			},
+			Entry("below the minimum", 1024),
+			Entry("not a multiple of 8", 2049),
+		)
+	})
+
+	Context("when issuing certificates with different key algorithms", func() {
+		DescribeTable("should round trip the key and verify the certificate",
+			func(algorithm KeyAlgorithm, expectedSignatureAlgorithm x509.SignatureAlgorithm) {
+				caKey, err := NewPrivateKeyWithConfig(KeyConfig{Algorithm: algorithm})
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating CA key")
+				caCert, err := NewSelfSignedCACert(Config{CommonName: "foo-ca"}, caKey, time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating CA certificate")
+				Expect(caCert.SignatureAlgorithm).To(Equal(expectedSignatureAlgorithm), "should self sign the CA certificate with the key algorithm")
+
+				key, err := NewPrivateKeyWithConfig(KeyConfig{Algorithm: algorithm})
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating server key")
+				cert, err := NewSignedCert(Config{
+					CommonName: "foo.bar.svc",
+					AltNames:   AltNames{DNSNames: []string{"foo.bar.svc"}},
+					Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				}, key, caCert, caKey, time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating server certificate")
+				Expect(cert.SignatureAlgorithm).To(Equal(expectedSignatureAlgorithm), "should sign the server certificate with the CA key algorithm")
+
+				keyPEM, err := EncodeSignerPEM(key)
+				Expect(err).ToNot(HaveOccurred(), "should succeed encoding server key")
+				parsedKey, err := ParsePrivateKeyPEM(keyPEM)
+				Expect(err).ToNot(HaveOccurred(), "should succeed parsing server key")
+				Expect(parsedKey).To(Equal(key), "should round trip the server key")
+
+				Expect(VerifyTLS(EncodeCertPEM(cert), keyPEM, EncodeCertPEM(caCert))).To(Succeed(), "should verify the server certificate")
+
+				By("Issuing key pairs with the key")
+				ca, err := NewCAWithConfig(Config{CommonName: "foo-ca"}, caKey, time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating CA key pair")
+				server, err := NewServerKeyPairWithConfig(ca, key, Config{
+					CommonName: "foo.bar.svc",
+					Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				}, nil, []string{"foo.bar.svc"}, time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+				Expect(server.Key).To(Equal(key), "should keep the server key")
+				Expect(server.Cert.SignatureAlgorithm).To(Equal(expectedSignatureAlgorithm), "should sign the server key pair with the CA key algorithm")
+				Expect(VerifyTLS(EncodeCertPEM(server.Cert), keyPEM, EncodeCertPEM(ca.Cert))).To(Succeed(), "should verify the server key pair")
+			},
+			Entry("RSA", KeyAlgorithmRSA, x509.SHA256WithRSA),
+			Entry("ECDSA P-256", KeyAlgorithmECDSAP256, x509.ECDSAWithSHA256),
+			Entry("ECDSA P-384", KeyAlgorithmECDSAP384, x509.ECDSAWithSHA384),
+			Entry("Ed25519", KeyAlgorithmEd25519, x509.PureEd25519),
+		)
+		It("should sign certificates with a key from MakeEllipticPrivateKeyPEM", func() {
+			caKeyPEM, err := MakeEllipticPrivateKeyPEM()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA key PEM")
+			caKey, err := ParseSignerPEM(caKeyPEM)
+			Expect(err).ToNot(HaveOccurred(), "should succeed parsing CA key PEM")
+			caCert, err := NewSelfSignedCACert(Config{CommonName: "foo-ca"}, caKey, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA certificate")
+			Expect(caCert.SignatureAlgorithm).To(Equal(x509.ECDSAWithSHA256), "should self sign the CA certificate with ECDSA")
+
+			keyPEM, err := MakeEllipticPrivateKeyPEM()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key PEM")
+			key, err := ParseSignerPEM(keyPEM)
+			Expect(err).ToNot(HaveOccurred(), "should succeed parsing server key PEM")
+			cert, err := NewSignedCert(Config{
+				CommonName: "foo.bar.svc",
+				AltNames:   AltNames{DNSNames: []string{"foo.bar.svc"}},
+				Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}, key, caCert, caKey, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server certificate")
+			Expect(cert.SignatureAlgorithm).To(Equal(x509.ECDSAWithSHA256), "should sign the server certificate with ECDSA")
+
+			Expect(VerifyTLS(EncodeCertPEM(cert), keyPEM, EncodeCertPEM(caCert))).To(Succeed(), "should verify the server certificate")
+		})
+		It("should fail parsing a signer from data without a private key", func() {
+			_, err := ParseSignerPEM([]byte("foo"))
+			Expect(err).To(HaveOccurred(), "should fail parsing the key")
+		})
+		It("should fail with an unknown key algorithm", func() {
+			_, err := NewPrivateKeyWithConfig(KeyConfig{Algorithm: "DSA"})
+			Expect(err).To(HaveOccurred(), "should fail generating the key")
+		})
+	})
+
+	Context("when issuing certificates with policy identifiers", func() {
+		It("should tag the CA and server certificates with them", func() {
+			policies := []asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}, {1, 3, 6, 1, 4, 1, 99999, 1}}
+			caKey, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA key")
+			caCert, err := NewSelfSignedCACert(Config{CommonName: "foo-ca", PolicyIdentifiers: policies}, caKey, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA certificate")
+			Expect(caCert.PolicyIdentifiers).To(Equal(policies), "should tag the CA certificate")
+
+			key, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key")
+			cert, err := NewSignedCert(Config{
+				CommonName:        "foo.bar.svc",
+				Usages:            []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				PolicyIdentifiers: policies,
+			}, key, caCert, caKey, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server certificate")
+			Expect(cert.PolicyIdentifiers).To(Equal(policies), "should tag the server certificate")
+
+			cert, err = NewSignedCert(Config{
+				CommonName: "foo.bar.svc",
+				Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}, key, caCert, caKey, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server certificate")
+			Expect(cert.PolicyIdentifiers).To(BeEmpty(), "should not tag the certificate by default")
+		})
+	})
+
+	Context("when VerifyTLSWithOptions is called", func() {
+		var (
+			ca, server, otherCA *KeyPair
+		)
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+			otherCA, err = NewCA("bar-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating other CA")
+			server, err = NewServerKeyPair(ca, "foo.bar.svc", []string{"10.0.0.1"}, []string{"foo.bar.svc", "foo.bar.svc.cluster.local"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+		})
+		type verifyTLSWithOptionsCase struct {
+			opts       VerifyOptions
+			useOtherCA bool
+			shouldFail bool
+		}
+		DescribeTable("with verification mode",
+			func(c verifyTLSWithOptionsCase) {
+				caBundle := EncodeCertPEM(ca.Cert)
+				if c.useOtherCA {
+					caBundle = EncodeCertPEM(otherCA.Cert)
+				}
+				err := VerifyTLSWithOptions(EncodeCertPEM(server.Cert), EncodePrivateKeyPEM(server.Key.(*rsa.PrivateKey)), caBundle, c.opts)
+				if c.shouldFail {
+					Expect(err).To(HaveOccurred(), "should fail verification")
+				} else {
+					Expect(err).ToNot(HaveOccurred(), "should succeed verification")
+				}
+			},
+			Entry("not set should verify the first DNS name", verifyTLSWithOptionsCase{}),
+			Entry("first DNS name should verify", verifyTLSWithOptionsCase{
+				opts: VerifyOptions{Hostnames: VerifyFirstDNSName},
+			}),
+			Entry("a specific SAN DNS name should verify", verifyTLSWithOptionsCase{
+				opts: VerifyOptions{Hostnames: VerifyDNSName, DNSName: "foo.bar.svc.cluster.local"},
+			}),
+			Entry("a specific name not in SANs should fail", verifyTLSWithOptionsCase{
+				opts:       VerifyOptions{Hostnames: VerifyDNSName, DNSName: "other.bar.svc"},
+				shouldFail: true,
+			}),
+			Entry("a specific name left empty should fail", verifyTLSWithOptionsCase{
+				opts:       VerifyOptions{Hostnames: VerifyDNSName},
+				shouldFail: true,
+			}),
+			Entry("all SANs should verify", verifyTLSWithOptionsCase{
+				opts: VerifyOptions{Hostnames: VerifyAllSANs},
+			}),
+			Entry("all SANs with an untrusted CA should fail", verifyTLSWithOptionsCase{
+				opts:       VerifyOptions{Hostnames: VerifyAllSANs},
+				useOtherCA: true,
+				shouldFail: true,
+			}),
+			Entry("chain only should ignore hostnames", verifyTLSWithOptionsCase{
+				opts: VerifyOptions{Hostnames: VerifyChainOnly, DNSName: "other.bar.svc"},
+			}),
+			Entry("chain only with an untrusted CA should fail", verifyTLSWithOptionsCase{
+				opts:       VerifyOptions{Hostnames: VerifyChainOnly},
+				useOtherCA: true,
+				shouldFail: true,
+			}),
+			Entry("unknown mode should fail", verifyTLSWithOptionsCase{
+				opts:       VerifyOptions{Hostnames: "Random"},
+				shouldFail: true,
+			}),
+		)
+	})
+
+	Context("when VerifyTLS is called with a certificate without DNS names", func() {
+		var ca *KeyPair
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+		})
+		DescribeTable("should verify it without panicking",
+			func(ips []string) {
+				server, err := NewServerKeyPair(ca, "foo.bar.svc", ips, nil, time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+				Expect(server.Cert.DNSNames).To(BeEmpty(), "should issue the certificate without DNS names")
+				Expect(VerifyTLS(EncodeCertPEM(server.Cert), EncodePrivateKeyPEM(server.Key.(*rsa.PrivateKey)), EncodeCertPEM(ca.Cert))).To(Succeed(), "should verify the certificate")
+			},
+			Entry("with IP SANs only", []string{"10.0.0.1", "10.0.0.2"}),
+			Entry("with no SANs", nil),
+		)
+		DescribeTable("with no SANs signed by a foreign CA should fail verifying the chain",
+			func(opts VerifyOptions) {
+				foreignCA, err := NewCA("bar-ca", time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating foreign CA")
+				server, err := NewServerKeyPair(foreignCA, "foo.bar.svc", nil, nil, time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+				err = VerifyTLSWithOptions(EncodeCertPEM(server.Cert), EncodePrivateKeyPEM(server.Key.(*rsa.PrivateKey)), EncodeCertPEM(ca.Cert), opts)
+				Expect(err).To(HaveOccurred(), "should fail verifying the certificate chain")
+			},
+			Entry("for its first DNS name", VerifyOptions{}),
+			Entry("for all its SANs", VerifyOptions{Hostnames: VerifyAllSANs}),
+			Entry("for its chain only", VerifyOptions{Hostnames: VerifyChainOnly}),
+		)
+	})
+
+	Context("when VerifyTLS is called with a certificate issued by an intermediate CA", func() {
+		var (
+			root                 *KeyPair
+			intermediate, server *x509.Certificate
+			serverKeyPEM         []byte
+		)
+		BeforeEach(func() {
+			Now = time.Now
+			var err error
+			root, err = NewCA("foo-root-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating root CA")
+
+			intermediateKey, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating intermediate CA key")
+			intermediateDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+				SerialNumber:          big.NewInt(2),
+				Subject:               pkix.Name{CommonName: "foo-intermediate-ca"},
+				NotBefore:             root.Cert.NotBefore,
+				NotAfter:              root.Cert.NotAfter,
+				KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}, root.Cert, intermediateKey.Public(), root.Key)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating intermediate CA certificate")
+			intermediate, err = x509.ParseCertificate(intermediateDER)
+			Expect(err).ToNot(HaveOccurred(), "should succeed parsing intermediate CA certificate")
+
+			serverKey, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key")
+			server, err = NewSignedCert(Config{
+				CommonName: "foo.bar.svc",
+				AltNames:   AltNames{DNSNames: []string{"foo.bar.svc"}},
+				Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}, serverKey, intermediate, intermediateKey, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server certificate")
+			serverKeyPEM = EncodePrivateKeyPEM(serverKey)
+		})
+		It("should verify the chain through the intermediate CA following the certificate", func() {
+			certsPEM := EncodeCertsPEM([]*x509.Certificate{server, intermediate})
+			Expect(VerifyTLS(certsPEM, serverKeyPEM, EncodeCertPEM(root.Cert))).To(Succeed(), "should verify the certificate chain")
+			Expect(VerifyTLSDetailed(certsPEM, serverKeyPEM, EncodeCertPEM(root.Cert), VerifyOptions{}).Err()).To(Succeed(), "should report the certificate chain as built")
+		})
+		It("should fail verifying the certificate without the intermediate CA", func() {
+			Expect(VerifyTLS(EncodeCertPEM(server), serverKeyPEM, EncodeCertPEM(root.Cert))).ToNot(Succeed(), "should fail building the certificate chain")
+		})
+	})
+
+	Context("when VerifyTLS fails", func() {
+		var (
+			now                         time.Time
+			ca, otherCA, intermediateCA *KeyPair
+			server, intermediateServer  *KeyPair
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			Now = func() time.Time { return now }
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+			otherCA, err = NewCA("other-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating other CA")
+			server, err = NewServerKeyPair(ca, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+
+			By("Issuing a server certificate with an intermediate CA")
+			intermediateKey, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating intermediate CA key")
+			template := x509.Certificate{
+				SerialNumber:          big.NewInt(2),
+				Subject:               pkix.Name{CommonName: "intermediate-ca"},
+				NotBefore:             now,
+				NotAfter:              now.Add(time.Hour),
+				KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			}
+			intermediateDER, err := x509.CreateCertificate(rand.Reader, &template, ca.Cert, intermediateKey.Public(), ca.Key)
+			Expect(err).ToNot(HaveOccurred(), "should succeed signing intermediate CA")
+			intermediateCert, err := x509.ParseCertificate(intermediateDER)
+			Expect(err).ToNot(HaveOccurred(), "should succeed parsing intermediate CA")
+			intermediateCA = &KeyPair{Key: intermediateKey, Cert: intermediateCert}
+			intermediateServer, err = NewServerKeyPair(intermediateCA, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair with intermediate CA")
+		})
+		AfterEach(func() {
+			Now = time.Now
+		})
+		type verifyFailureCase struct {
+			certs          func() []*x509.Certificate
+			key            func() *KeyPair
+			caBundle       func() []byte
+			opts           VerifyOptions
+			elapsed        time.Duration
+			expectedReason VerifyFailureReason
+		}
+		DescribeTable("should report why",
+			func(c verifyFailureCase) {
+				now = now.Add(c.elapsed)
+				err := VerifyTLSWithOptions(EncodeCertsPEM(c.certs()), EncodePrivateKeyPEM(c.key().Key.(*rsa.PrivateKey)), c.caBundle(), c.opts)
+				Expect(err).To(HaveOccurred(), "should fail verification")
+				var verifyErr *VerifyError
+				Expect(errors.As(err, &verifyErr)).To(BeTrue(), "should wrap a VerifyError")
+				Expect(verifyErr.Reason).To(Equal(c.expectedReason), "should report the failure reason")
+			},
+			Entry("missing intermediate", verifyFailureCase{
+				certs:          func() []*x509.Certificate { return []*x509.Certificate{intermediateServer.Cert} },
+				key:            func() *KeyPair { return intermediateServer },
+				caBundle:       func() []byte { return EncodeCertPEM(ca.Cert) },
+				expectedReason: VerifyFailureMissingIntermediate,
+			}),
+			Entry("untrusted issuer", verifyFailureCase{
+				certs:          func() []*x509.Certificate { return []*x509.Certificate{server.Cert, ca.Cert} },
+				key:            func() *KeyPair { return server },
+				caBundle:       func() []byte { return EncodeCertPEM(otherCA.Cert) },
+				expectedReason: VerifyFailureUnknownAuthority,
+			}),
+			Entry("expired certificate", verifyFailureCase{
+				certs:          func() []*x509.Certificate { return []*x509.Certificate{server.Cert} },
+				key:            func() *KeyPair { return server },
+				caBundle:       func() []byte { return EncodeCertPEM(ca.Cert) },
+				elapsed:        2 * time.Hour,
+				expectedReason: VerifyFailureExpired,
+			}),
+			Entry("name mismatch", verifyFailureCase{
+				certs:          func() []*x509.Certificate { return []*x509.Certificate{server.Cert} },
+				key:            func() *KeyPair { return server },
+				caBundle:       func() []byte { return EncodeCertPEM(ca.Cert) },
+				opts:           VerifyOptions{Hostnames: VerifyDNSName, DNSName: "bar.foo.svc"},
+				expectedReason: VerifyFailureNameMismatch,
+			}),
+		)
+	})
+
+	Context("when VerifyTLSDetailed is called", func() {
+		var (
+			now              time.Time
+			ca, otherCA      *KeyPair
+			server           *KeyPair
+			certsPEM, keyPEM []byte
+			caBundle         []byte
+			otherCABundle    []byte
+			notPEM           = []byte("not PEM")
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			Now = func() time.Time { return now }
+			var err error
+			ca, err = NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+			otherCA, err = NewCA("other-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating other CA")
+			server, err = NewServerKeyPair(ca, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating server key pair")
+			certsPEM = EncodeCertPEM(server.Cert)
+			keyPEM = EncodePrivateKeyPEM(server.Key.(*rsa.PrivateKey))
+			caBundle = EncodeCertPEM(ca.Cert)
+			otherCABundle = EncodeCertPEM(otherCA.Cert)
+		})
+		AfterEach(func() {
+			Now = time.Now
+		})
+		type verifyDetailedCase struct {
+			certsPEM func() []byte
+			keyPEM   func() []byte
+			caBundle func() []byte
+			opts     VerifyOptions
+			elapsed  time.Duration
+			// expected pass/fail of key parsed, certs parsed, CA parsed,
+			// validity window, chain built and hostname matched
+			expected   []bool
+			shouldFail bool
+		}
+		DescribeTable("should flag the failed properties",
+			func(c verifyDetailedCase) {
+				now = now.Add(c.elapsed)
+				result := VerifyTLSDetailed(c.certsPEM(), c.keyPEM(), c.caBundle(), c.opts)
+				obtained := []bool{
+					result.KeyParsed.Passed(),
+					result.CertsParsed.Passed(),
+					result.CAParsed.Passed(),
+					result.ValidityWindow.Passed(),
+					result.ChainBuilt.Passed(),
+					result.HostnameMatched.Passed(),
+				}
+				Expect(obtained).To(Equal(c.expected), "should flag exactly the failed properties")
+				if c.shouldFail {
+					Expect(result.Err()).To(HaveOccurred(), "should report the first failure")
+					Expect(VerifyTLSWithOptions(c.certsPEM(), c.keyPEM(), c.caBundle(), c.opts)).To(MatchError(result.Err().Error()), "should fail VerifyTLSWithOptions with the first failure")
+				} else {
+					Expect(result.Err()).ToNot(HaveOccurred(), "should not report an error")
+					Expect(VerifyTLSWithOptions(c.certsPEM(), c.keyPEM(), c.caBundle(), c.opts)).To(Succeed(), "should pass VerifyTLSWithOptions")
+				}
+			},
+			Entry("valid TLS", verifyDetailedCase{
+				certsPEM: func() []byte { return certsPEM },
+				keyPEM:   func() []byte { return keyPEM },
+				caBundle: func() []byte { return caBundle },
+				expected: []bool{true, true, true, true, true, true},
+			}),
+			Entry("broken key", verifyDetailedCase{
+				certsPEM:   func() []byte { return certsPEM },
+				keyPEM:     func() []byte { return notPEM },
+				caBundle:   func() []byte { return caBundle },
+				expected:   []bool{false, true, true, true, true, true},
+				shouldFail: true,
+			}),
+			Entry("broken certs", verifyDetailedCase{
+				certsPEM:   func() []byte { return notPEM },
+				keyPEM:     func() []byte { return keyPEM },
+				caBundle:   func() []byte { return caBundle },
+				expected:   []bool{true, false, true, false, false, false},
+				shouldFail: true,
+			}),
+			Entry("broken CA bundle", verifyDetailedCase{
+				certsPEM:   func() []byte { return certsPEM },
+				keyPEM:     func() []byte { return keyPEM },
+				caBundle:   func() []byte { return notPEM },
+				expected:   []bool{true, true, false, true, false, true},
+				shouldFail: true,
+			}),
+			Entry("untrusted CA", verifyDetailedCase{
+				certsPEM:   func() []byte { return certsPEM },
+				keyPEM:     func() []byte { return keyPEM },
+				caBundle:   func() []byte { return otherCABundle },
+				expected:   []bool{true, true, true, true, false, true},
+				shouldFail: true,
+			}),
+			Entry("hostname mismatch", verifyDetailedCase{
+				certsPEM:   func() []byte { return certsPEM },
+				keyPEM:     func() []byte { return keyPEM },
+				caBundle:   func() []byte { return caBundle },
+				opts:       VerifyOptions{Hostnames: VerifyDNSName, DNSName: "bar.foo.svc"},
+				expected:   []bool{true, true, true, true, true, false},
+				shouldFail: true,
+			}),
+			Entry("expired certificate", verifyDetailedCase{
+				certsPEM:   func() []byte { return certsPEM },
+				keyPEM:     func() []byte { return keyPEM },
+				caBundle:   func() []byte { return caBundle },
+				elapsed:    2 * time.Hour,
+				expected:   []bool{true, true, true, false, true, true},
+				shouldFail: true,
+			}),
+		)
+	})
+
+	Context("when WriteFixtures is called", func() {
+		var (
+			dir string
+		)
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "fixtures")
+			Expect(err).ToNot(HaveOccurred(), "should succeed creating a temporary directory")
+		})
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+		It("should write a CA and server key pair that parse and verify", func() {
+			fixturesDir := filepath.Join(dir, "certs")
+			err := WriteFixtures(fixturesDir, FixturesConfig{
+				CAName:           "foo-ca",
+				CommonName:       "foo.bar.svc",
+				Hostnames:        []string{"foo.bar.svc"},
+				Duration:         time.Hour,
+				KubeconfigServer: "https://foo.bar.svc:443",
+			})
+			Expect(err).ToNot(HaveOccurred(), "should succeed writing the fixtures")
+
+			caPEM, err := ioutil.ReadFile(filepath.Join(fixturesDir, FixtureCACertFile))
+			Expect(err).ToNot(HaveOccurred(), "should succeed reading the CA certificate")
+			certPEM, err := ioutil.ReadFile(filepath.Join(fixturesDir, FixtureCertFile))
+			Expect(err).ToNot(HaveOccurred(), "should succeed reading the server certificate")
+			keyPEM, err := ioutil.ReadFile(filepath.Join(fixturesDir, FixtureKeyFile))
+			Expect(err).ToNot(HaveOccurred(), "should succeed reading the server key")
+			kubeconfig, err := ioutil.ReadFile(filepath.Join(fixturesDir, FixtureKubeconfigFile))
+			Expect(err).ToNot(HaveOccurred(), "should succeed reading the kubeconfig")
+
+			caCerts, err := ParseCertsPEM(caPEM)
+			Expect(err).ToNot(HaveOccurred(), "should parse the CA certificate")
+			Expect(caCerts[0].Subject.CommonName).To(Equal("foo-ca"), "should issue the CA certificate with the CA name")
+			certs, err := ParseCertsPEM(certPEM)
+			Expect(err).ToNot(HaveOccurred(), "should parse the server certificate")
+			Expect(certs[0].Subject.CommonName).To(Equal("foo.bar.svc"), "should issue the server certificate with the common name")
+			_, err = ParsePrivateKeyPEM(keyPEM)
+			Expect(err).ToNot(HaveOccurred(), "should parse the server key")
+			Expect(VerifyTLS(certPEM, keyPEM, caPEM)).To(Succeed(), "should verify the server key pair with the CA")
+			Expect(string(kubeconfig)).To(ContainSubstring("certificate-authority-data: "+base64.StdEncoding.EncodeToString(caPEM)), "should trust the CA at the kubeconfig")
+		})
+		It("should write the same fixtures byte for byte with the same keys, serial numbers and time", func() {
+			now := time.Now()
+			Now = func() time.Time { return now }
+			defer func() { Now = time.Now }()
+			caKey, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating the CA key")
+			key, err := NewPrivateKey()
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating the server key")
+			cfg := FixturesConfig{
+				CAName:           "foo-ca",
+				CommonName:       "foo.bar.svc",
+				Hostnames:        []string{"foo.bar.svc"},
+				Duration:         time.Hour,
+				KubeconfigServer: "https://foo.bar.svc:443",
+				CAKey:            caKey,
+				Key:              key,
+				CASerialNumber:   big.NewInt(1),
+				SerialNumber:     big.NewInt(2),
+			}
+			Expect(WriteFixtures(filepath.Join(dir, "first"), cfg)).To(Succeed(), "should succeed writing the fixtures")
+			Expect(WriteFixtures(filepath.Join(dir, "second"), cfg)).To(Succeed(), "should succeed writing the fixtures again")
+
+			for _, file := range []string{FixtureCACertFile, FixtureCertFile, FixtureKeyFile, FixtureKubeconfigFile} {
+				first, err := ioutil.ReadFile(filepath.Join(dir, "first", file))
+				Expect(err).ToNot(HaveOccurred(), "should succeed reading %s", file)
+				second, err := ioutil.ReadFile(filepath.Join(dir, "second", file))
+				Expect(err).ToNot(HaveOccurred(), "should succeed reading %s again", file)
+				Expect(second).To(Equal(first), "should write the same %s", file)
+			}
+			certPEM, err := ioutil.ReadFile(filepath.Join(dir, "first", FixtureCertFile))
+			Expect(err).ToNot(HaveOccurred(), "should succeed reading the server certificate")
+			certs, err := ParseCertsPEM(certPEM)
+			Expect(err).ToNot(HaveOccurred(), "should parse the server certificate")
+			Expect(certs[0].SerialNumber).To(Equal(big.NewInt(2)), "should issue the server certificate with the serial number")
+		})
+		It("should refuse a serial number that is not positive", func() {
+			err := WriteFixtures(dir, FixturesConfig{
+				CAName:         "foo-ca",
+				CommonName:     "foo.bar.svc",
+				Duration:       time.Hour,
+				CASerialNumber: big.NewInt(0),
+			})
+			Expect(err).To(MatchError(ContainSubstring("serial number 0 is not positive")), "should fail writing the fixtures")
+		})
+	})
+
+	Context("when NewServerKeyPair is called with an expired CA", func() {
+		var (
+			now time.Time
+		)
+		BeforeEach(func() {
+			now = time.Now()
+			Now = func() time.Time { return now }
+		})
+		AfterEach(func() {
+			Now = time.Now
+		})
+		DescribeTable("should refuse signing",
+			func(expiresIn time.Duration) {
+				ca, err := NewCA("foo-ca", time.Hour)
+				Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+				now = now.Add(time.Hour - expiresIn)
+				_, err = NewServerKeyPair(ca, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+				Expect(err).To(MatchError(ContainSubstring("CA certificate foo-ca expired")), "should fail with a clear error")
+			},
+			Entry("already expired", -time.Minute),
+			Entry("expiring within the clock skew", caExpirationSkew/2),
+		)
+		It("should sign with a CA that is not expired", func() {
+			ca, err := NewCA("foo-ca", time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed generating CA")
+			now = now.Add(time.Hour - 2*caExpirationSkew)
+			_, err = NewServerKeyPair(ca, "foo.bar.svc", nil, []string{"foo.bar.svc"}, time.Hour)
+			Expect(err).ToNot(HaveOccurred(), "should succeed signing")
+		})
+	})
 })
@@ -0,0 +1,114 @@
+package certificate
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+// trust.go stages the activation of service certificates issued by a new CA:
+// the CA bundle trusting both the previous and the new CA is distributed
+// first, keeping the previous service certificates, and the new ones are only
+// activated once the configured check confirms that the webhook clients trust
+// the new CA.
+
+// TrustDistributionCheck confirms that caBundle, just injected into the
+// webhook configurations and mirrored to the CA ConfigMaps, is trusted by the
+// clients of the webhooks
+type TrustDistributionCheck func(ctx context.Context, caBundle []byte) error
+
+// certificateIssuesCopy returns a copy of the certificate issues of a
+// certificate chain, by name
+func certificateIssuesCopy(certificateChain *chain.CertificateChainData) map[string]chain.CertificateIssue {
+	certificateIssues := map[string]chain.CertificateIssue{}
+	for name, certificateIssue := range certificateChain.CertificatesIssued {
+		certificateIssues[name] = *certificateIssue
+	}
+	return certificateIssues
+}
+
+// pendingActivation returns the names of the certificate issues whose service
+// certificate is now issued by a CA other than the one of their previous
+// service certificate
+func pendingActivation(previousIssues map[string]chain.CertificateIssue, certificateChain *chain.CertificateChainData) []string {
+	pending := []string{}
+	for name, certificateIssue := range certificateChain.CertificatesIssued {
+		previousIssue, found := previousIssues[name]
+		if !found || bytes.Equal(previousIssue.CertPEM, certificateIssue.CertPEM) {
+			continue
+		}
+		previousCerts, err := triple.ParseCertsPEM(previousIssue.CertPEM)
+		if err != nil {
+			continue
+		}
+		certs, err := triple.ParseCertsPEM(certificateIssue.CertPEM)
+		if err != nil {
+			continue
+		}
+		previousCert, cert := previousCerts[len(previousCerts)-1], certs[len(certs)-1]
+		if !bytes.Equal(previousCert.AuthorityKeyId, cert.AuthorityKeyId) {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
+
+// distributeCATrust writes the certificate chain with the previous service
+// certificates of the certificate issues pending activation, mirrors its CA
+// bundle and runs the trust distribution check, bounded by its timeout. It
+// returns the certificate chain written, nil if none, and a DeferredError,
+// leaving the previous service certificates in place, if the check does not
+// succeed in time. Nothing is done if there is no check configured or no
+// service certificate pending activation.
+func (m *Manager) distributeCATrust(ctx context.Context, objects objectMap, previousIssues map[string]chain.CertificateIssue, certificateChain *chain.CertificateChainData) (*chain.CertificateChainData, error) {
+	if m.trustDistributionCheck == nil {
+		return nil, nil
+	}
+	pending := pendingActivation(previousIssues, certificateChain)
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	logger := m.log.WithName("distributeCATrust")
+	logger.Info("Distributing CA trust before activating certificates", "certificates", pending)
+
+	staged := *certificateChain
+	staged.CertificatesIssued = map[string]*chain.CertificateIssue{}
+	for name, certificateIssue := range certificateChain.CertificatesIssued {
+		stagedIssue := *certificateIssue
+		staged.CertificatesIssued[name] = &stagedIssue
+	}
+	for _, name := range pending {
+		staged.CertificatesIssued[name].CertPEM = previousIssues[name].CertPEM
+		staged.CertificatesIssued[name].KeyPEM = previousIssues[name].KeyPEM
+	}
+
+	err := m.writeCertificateChain(ctx, objects, &staged)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed writing CA trust")
+	}
+	err = m.mirrorCABundle(ctx, &staged)
+	if err != nil {
+		return &staged, errors.Wrap(err, "failed mirroring CA trust")
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, m.trustDistributionTimeout)
+	defer cancel()
+	err = m.trustDistributionCheck(checkCtx, chainCABundle(&staged))
+
+	m.statusLock.Lock()
+	m.status.TrustDistributionTime = triple.Now().UTC()
+	m.status.TrustDistributionError = err
+	m.statusLock.Unlock()
+
+	if err != nil {
+		logger.Error(err, "CA trust distribution not confirmed, keeping the previous certificates")
+		return &staged, &DeferredError{Err: errors.Wrap(err, "CA trust distribution not confirmed")}
+	}
+	logger.Info("CA trust distribution confirmed, activating certificates")
+	return &staged, nil
+}
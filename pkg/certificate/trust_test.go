@@ -0,0 +1,131 @@
+package certificate
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/chain"
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Trust distribution check", func() {
+	var (
+		mgr               *Manager
+		confirmed         bool
+		checkedCABundles  [][]byte
+		issued            []*x509.Certificate
+		caRotateInterval  = time.Hour
+		caOverlapInterval = 20 * time.Minute
+	)
+
+	BeforeEach(func() {
+		confirmed = false
+		checkedCABundles = nil
+		issued = nil
+		createResources()
+
+		var err error
+		mgr, err = NewManager(
+			expectedMutatingWebhookConfiguration.Name,
+			expectedNamespace.Name,
+			cli,
+			chain.Options{
+				CARotateInterval:   caRotateInterval,
+				CAOverlapInterval:  caOverlapInterval,
+				CertRotateInterval: caRotateInterval,
+			},
+			[]WebhookReference{
+				{
+					Type: MutatingWebhook,
+					Name: expectedMutatingWebhookConfiguration.Name,
+				},
+			},
+			WithTrustDistributionCheck(func(ctx context.Context, caBundle []byte) error {
+				checkedCABundles = append(checkedCABundles, caBundle)
+				if confirmed {
+					return nil
+				}
+				<-ctx.Done()
+				return ctx.Err()
+			}, 100*time.Millisecond),
+			WithOnIssue(func(cert *x509.Certificate) error {
+				issued = append(issued, cert)
+				return nil
+			}),
+		)
+		Expect(err).To(Succeed(), "should succeed constructing certificate manager")
+	})
+
+	AfterEach(func() {
+		triple.Now = time.Now
+		deleteResources()
+		_ = cli.Delete(context.TODO(), &expectedCASecret)
+	})
+
+	Context("when the CA is rotated and the trust distribution is not confirmed in time", func() {
+		var (
+			previousSecret corev1.Secret
+			rotateErr      error
+		)
+		BeforeEach(func() {
+			t0 := time.Now().Truncate(time.Second).UTC()
+			now := t0
+			triple.Now = func() time.Time { return now }
+			err := mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(checkedCABundles).To(BeEmpty(), "should not check trust distribution on initial generation")
+			previousSecret, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+
+			now = t0.Add(caRotateInterval - caOverlapInterval + time.Minute)
+			issued = nil
+			rotateErr = mgr.Apply(context.TODO())
+		})
+		It("should keep serving the previous certificate with the CA bundle of both CAs and report the error", func() {
+			Expect(rotateErr).To(MatchError(ContainSubstring("CA trust distribution not confirmed")), "should fail the reconcile")
+			Expect(IsDeferred(rotateErr)).To(BeTrue(), "should defer the rotation")
+			Expect(mgr.Status().TrustDistributionError).To(MatchError(context.DeadlineExceeded), "should report the check error")
+			rotationFailures := &dto.Metric{}
+			Expect(mgr.metrics.rotationFailures.Write(rotationFailures)).To(Succeed(), "should succeed reading the rotation failures")
+			Expect(rotationFailures.Counter.GetValue()).To(BeZero(), "should not count the deferral as a rotation failure")
+
+			secret, err := getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Data[corev1.TLSCertKey]).To(Equal(previousSecret.Data[corev1.TLSCertKey]), "should keep the previous certificate")
+			Expect(secret.Data[corev1.TLSPrivateKeyKey]).To(Equal(previousSecret.Data[corev1.TLSPrivateKeyKey]), "should keep the previous key")
+
+			caBundle := getWebhookConfiguration().Webhooks[0].ClientConfig.CABundle
+			Expect(checkedCABundles).To(ConsistOf(caBundle), "should check the injected CA bundle")
+			caCerts, err := triple.ParseCertsPEM(caBundle)
+			Expect(err).To(Succeed(), "should succeed parsing CA bundle")
+			Expect(caCerts).To(HaveLen(2), "should inject the CA bundle of both CAs")
+			err = triple.VerifyTLS(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], caBundle)
+			Expect(err).To(Succeed(), "should verify the previous certificate with the injected CA bundle")
+			Expect(issued).To(HaveLen(1), "should report the new CA as issued")
+			Expect(issued[0].IsCA).To(BeTrue(), "should report the new CA as issued")
+			Expect(issued[0].Equal(caCerts[len(caCerts)-1])).To(BeTrue(), "should report the new CA as issued")
+
+			By("Confirming the trust distribution")
+			confirmed = true
+			issued = nil
+			err = mgr.Apply(context.TODO())
+			Expect(err).To(Succeed(), "should succeed applying certificates")
+			Expect(mgr.Status().TrustDistributionError).To(Succeed(), "should report the check success")
+			secret, err = getSecret()
+			Expect(err).To(Succeed(), "should succeed getting TLS secret")
+			Expect(secret.Data[corev1.TLSCertKey]).ToNot(Equal(previousSecret.Data[corev1.TLSCertKey]), "should activate the new certificate")
+			certs, err := triple.ParseCertsPEM(secret.Data[corev1.TLSCertKey])
+			Expect(err).To(Succeed(), "should succeed parsing the new certificate")
+			Expect(certs[len(certs)-1].AuthorityKeyId).To(Equal(caCerts[len(caCerts)-1].SubjectKeyId), "should activate a certificate issued by the new CA")
+			Expect(issued).To(ConsistOf(certs[len(certs)-1]), "should report the activated certificate as issued, the CA was already")
+			Expect(mgr.VerifyTLS()).To(Succeed(), "should verify the certificate chain")
+		})
+	})
+})
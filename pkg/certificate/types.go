@@ -9,13 +9,42 @@ type WebhookType string
 const (
 	MutatingWebhook   WebhookType = "Mutating"
 	ValidatingWebhook WebhookType = "Validating"
+
+	// CRDConversionWebhook references a CustomResourceDefinition by name,
+	// its conversion webhook getting the CA bundle injected. The manager
+	// client scheme has to include apiextensions v1.
+	CRDConversionWebhook WebhookType = "CRDConversion"
+
+	// APIService references an apiregistration v1 APIService by name, its
+	// CA bundle being injected and its backing service getting the serving
+	// certificate.
+	APIService WebhookType = "APIService"
+)
+
+// WebhookAPIVersion is the admissionregistration API version a webhook
+// configuration is managed with
+type WebhookAPIVersion string
+
+const (
+	WebhookAPIVersionV1 WebhookAPIVersion = "v1"
+
+	// WebhookAPIVersionV1beta1 is meant for clusters older than Kubernetes
+	// 1.16, it is removed as of Kubernetes 1.22
+	WebhookAPIVersionV1beta1 WebhookAPIVersion = "v1beta1"
 )
 
 type WebhookReference struct {
 	Type WebhookType
 	Name string
+
+	// APIVersion of the webhook configuration, WebhookAPIVersionV1 if not
+	// set
+	APIVersion WebhookAPIVersion
 }
 
 func (w WebhookReference) String() string {
+	if w.APIVersion == WebhookAPIVersionV1beta1 {
+		return fmt.Sprintf("%sWebhook.%s/%s", w.Type, w.APIVersion, w.Name)
+	}
 	return fmt.Sprintf("%sWebhook/%s", w.Type, w.Name)
 }
@@ -0,0 +1,157 @@
+package certificate
+
+import (
+	"reflect"
+	"sort"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// v1beta1.go handles webhook configurations managed with the
+// admissionregistration v1beta1 API, for clusters older than Kubernetes 1.16.
+// They are mapped to and from certificate chain data as v1 ones are, through
+// their client configs.
+
+func initMutatingWebhookV1beta1(name, namespace string) client.Object {
+	return &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+func initValidatingWebhookV1beta1(name, namespace string) client.Object {
+	return &admissionregistrationv1beta1.ValidatingWebhookConfiguration{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+// v1beta1ClientConfig converts a v1beta1 client config to a v1 one. It does
+// not share memory with the v1beta1 webhook configuration, CA bundles set on
+// it are stored back with storeClientConfigs.
+func v1beta1ClientConfig(clientConfig *admissionregistrationv1beta1.WebhookClientConfig) *admissionregistrationv1.WebhookClientConfig {
+	converted := &admissionregistrationv1.WebhookClientConfig{
+		URL:      clientConfig.URL,
+		CABundle: clientConfig.CABundle,
+	}
+	if clientConfig.Service != nil {
+		converted.Service = &admissionregistrationv1.ServiceReference{
+			Namespace: clientConfig.Service.Namespace,
+			Name:      clientConfig.Service.Name,
+			Path:      clientConfig.Service.Path,
+			Port:      clientConfig.Service.Port,
+		}
+	}
+	return converted
+}
+
+// storeV1beta1ClientConfig stores back at a v1beta1 client config the CA
+// bundle of its converted one, if any.
+func storeV1beta1ClientConfig(clientConfig *admissionregistrationv1beta1.WebhookClientConfig, converted *admissionregistrationv1.WebhookClientConfig) {
+	if converted == nil {
+		return
+	}
+	clientConfig.CABundle = converted.CABundle
+}
+
+// webhookAlias returns the reference of the webhook configuration with the
+// same type and name at the other admissionregistration API version, false
+// if the webhook is not an admission one.
+func webhookAlias(webhook WebhookReference) (WebhookReference, bool) {
+	if webhook.Type != MutatingWebhook && webhook.Type != ValidatingWebhook {
+		return WebhookReference{}, false
+	}
+	alias := webhook
+	alias.APIVersion = WebhookAPIVersionV1beta1
+	if webhook.APIVersion == WebhookAPIVersionV1beta1 {
+		alias.APIVersion = WebhookAPIVersionV1
+	}
+	return alias, true
+}
+
+// managedWebhooks returns the managed webhooks followed, if configured, by
+// their aliases at the other admissionregistration API version not managed
+// already.
+func (m *Manager) managedWebhooks() []WebhookReference {
+	if !m.webhookAPIVersionAliases {
+		return m.webhooks
+	}
+	webhooks := append([]WebhookReference{}, m.webhooks...)
+	for _, webhook := range m.webhooks {
+		alias, ok := webhookAlias(webhook)
+		if ok && !m.isManagedWebhook(alias) {
+			webhooks = append(webhooks, alias)
+		}
+	}
+	return webhooks
+}
+
+// isManagedWebhook returns whether webhook is one of the configured managed
+// webhooks, regardless of aliases
+func (m *Manager) isManagedWebhook(webhook WebhookReference) bool {
+	for _, webhookRef := range m.webhooks {
+		if webhookObjectKind(webhookRef) == webhookObjectKind(webhook) && webhookRef.Name == webhook.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebhookAlias returns whether key is of a webhook configuration only
+// managed as the alias of a configured one. Aliases are optional: they are
+// ignored if they do not exist or their API version is not served. When
+// served, they are usually the very same object than the one they are an
+// alias of.
+func (m *Manager) isWebhookAlias(key *objectKey) bool {
+	webhook, isWebhook := webhookReference(key)
+	return isWebhook && m.webhookAPIVersionAliases && !m.isManagedWebhook(webhook)
+}
+
+// webhookNames returns the sorted names of the webhooks of a webhook
+// configuration
+func webhookNames(webhook client.Object) []string {
+	names := []string{}
+	for name := range filterClientConfigMap(webhook, func(*admissionregistrationv1.WebhookClientConfig) bool { return true }) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// preferGAWebhooks drops from objects the v1beta1 webhook configurations
+// whose webhooks diverged from the ones of the v1 webhook configuration of
+// the same name, when both exist, so that only the v1 one is injected. They
+// are usually the very same object, a divergence meaning the v1beta1 one is
+// stale, which is warned about.
+func (m *Manager) preferGAWebhooks(objects objectMap) {
+	existing := map[WebhookReference]*keyedObject{}
+	for _, object := range objects {
+		webhook, isWebhook := webhookReference(object.key)
+		if isWebhook && object.kobject != nil && object.kobject.GetUID() != "" {
+			existing[webhook] = object
+		}
+	}
+	for webhook, object := range existing {
+		if webhook.APIVersion != WebhookAPIVersionV1beta1 {
+			continue
+		}
+		gaObject, found := existing[WebhookReference{Type: webhook.Type, Name: webhook.Name}]
+		if !found {
+			continue
+		}
+		gaNames, names := webhookNames(gaObject.kobject), webhookNames(object.kobject)
+		if reflect.DeepEqual(gaNames, names) {
+			continue
+		}
+		m.log.WithName("preferGAWebhooks").Info("WARNING: webhook configuration diverged between API versions, injecting only the v1 one, the stale v1beta1 one should be cleaned up",
+			"webhook", webhook.String(), "v1Webhooks", gaNames, "v1beta1Webhooks", names)
+		delete(objects, object.key)
+	}
+}
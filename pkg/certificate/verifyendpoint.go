@@ -0,0 +1,71 @@
+package certificate
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// verifyendpoint.go checks a live webhook endpoint with a TLS handshake, so
+// that operators can confirm the server picked up a certificate trusted by the
+// injected CA bundle with an acceptable TLS version.
+
+// EndpointVerification reports the TLS handshake done with a webhook endpoint
+type EndpointVerification struct {
+	// Version is the negotiated TLS version, one of the tls.VersionTLS*
+	// constants
+	Version uint16
+
+	// Fingerprint is the hex encoded SHA-256 fingerprint of the certificate
+	// served by the endpoint
+	Fingerprint string
+}
+
+// VerifyEndpoint does a TLS handshake with the webhook endpoint at address,
+// verifying the certificate it serves for serverName with caBundle, the CA
+// bundle injected on the webhooks, and failing if the negotiated TLS version
+// is older than minVersion, tls.VersionTLS12 if not set.
+func VerifyEndpoint(ctx context.Context, address, serverName string, caBundle []byte, minVersion uint16) (EndpointVerification, error) {
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caBundle) {
+		return EndpointVerification{}, errors.New("no PEM certificate found at the CA bundle")
+	}
+
+	dialer := &net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return EndpointVerification{}, errors.Wrapf(err, "failed connecting to endpoint %s", address)
+	}
+	defer rawConn.Close()
+
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+		MinVersion: minVersion,
+	})
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return EndpointVerification{}, errors.Wrapf(err, "failed setting deadline for endpoint %s", address)
+		}
+	}
+	err = conn.Handshake()
+	if err != nil {
+		return EndpointVerification{}, errors.Wrapf(err, "failed TLS handshake with endpoint %s", address)
+	}
+
+	state := conn.ConnectionState()
+	fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return EndpointVerification{
+		Version:     state.Version,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}, nil
+}
@@ -0,0 +1,97 @@
+package certificate
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/qinqon/kube-admission-webhook/pkg/certificate/triple"
+)
+
+var _ = Describe("Endpoint verification", func() {
+	var (
+		ca           *triple.KeyPair
+		server       *triple.KeyPair
+		listener     net.Listener
+		hostname     = serviceHostname(expectedService.Name, expectedService.Namespace)
+		serverMaxTLS uint16
+	)
+
+	BeforeEach(func() {
+		triple.Now = time.Now
+		var err error
+		ca, err = triple.NewCA("foo-ca", time.Hour)
+		Expect(err).To(Succeed(), "should succeed creating a CA")
+		server, err = triple.NewServerKeyPair(ca, hostname, nil, []string{hostname}, time.Hour)
+		Expect(err).To(Succeed(), "should succeed creating a server key pair")
+		serverMaxTLS = 0
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{server.Cert.Raw},
+				PrivateKey:  server.Key,
+			}},
+			MinVersion: tls.VersionTLS12,
+			MaxVersion: serverMaxTLS,
+		})
+		Expect(err).To(Succeed(), "should succeed listening")
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	verifyEndpoint := func(caBundle []byte, minVersion uint16) (EndpointVerification, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return VerifyEndpoint(ctx, listener.Addr().String(), hostname, caBundle, minVersion)
+	}
+
+	It("should report the negotiated version and the fingerprint of the served certificate", func() {
+		verification, err := verifyEndpoint(triple.EncodeCertPEM(ca.Cert), tls.VersionTLS12)
+		Expect(err).To(Succeed(), "should verify the endpoint")
+		Expect(verification.Version).To(Equal(uint16(tls.VersionTLS13)), "should negotiate the newest TLS version")
+		fingerprint := sha256.Sum256(server.Cert.Raw)
+		Expect(verification.Fingerprint).To(Equal(hex.EncodeToString(fingerprint[:])), "should report the fingerprint of the served certificate")
+	})
+
+	It("should fail with a CA bundle not trusting the served certificate", func() {
+		otherCA, err := triple.NewCA("bar-ca", time.Hour)
+		Expect(err).To(Succeed(), "should succeed creating a CA")
+		_, err = verifyEndpoint(triple.EncodeCertPEM(otherCA.Cert), tls.VersionTLS12)
+		Expect(err).To(MatchError(ContainSubstring("failed TLS handshake")), "should fail verifying the endpoint")
+	})
+
+	Context("when the endpoint serves an older TLS version than the minimum", func() {
+		BeforeEach(func() {
+			serverMaxTLS = tls.VersionTLS12
+		})
+		It("should reject the handshake", func() {
+			_, err := verifyEndpoint(triple.EncodeCertPEM(ca.Cert), tls.VersionTLS13)
+			Expect(err).To(MatchError(ContainSubstring("failed TLS handshake")), "should fail verifying the endpoint")
+
+			verification, err := verifyEndpoint(triple.EncodeCertPEM(ca.Cert), 0)
+			Expect(err).To(Succeed(), "should verify the endpoint with the default minimum")
+			Expect(verification.Version).To(Equal(uint16(tls.VersionTLS12)), "should negotiate the newest TLS version of the endpoint")
+		})
+	})
+})